@@ -0,0 +1,190 @@
+package thirtdparty
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/astaxie/beego"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+)
+
+// ServerAddress is one address of a server as reported by nova
+type ServerAddress struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	Public  bool   `json:"public"`
+	MAC     string `json:"mac,omitempty"`
+}
+
+// StackAddresses are the addresses reported for a provisioned stack
+type StackAddresses struct {
+	Primary   string          `json:"primary"`
+	PrivateIP string          `json:"privateIp"`
+	PublicIP  string          `json:"publicIp"`
+	All       []ServerAddress `json:"addresses"`
+	// Error tells why the requested floating IP could not be allocated
+	Error string `json:"error,omitempty"`
+}
+
+// defaultAddressPolicy prefers addresses reachable from outside, then IPv4 over IPv6
+const defaultAddressPolicy = "floating-ipv4,public-ipv4,floating-ipv6,public-ipv6,fixed-ipv4,fixed-ipv6"
+
+// DiscoverAddresses walks every network of the server and classifies its addresses.
+// Entries nova reports in an unexpected shape are skipped.
+func DiscoverAddresses(server *servers.Server) []ServerAddress {
+	result := []ServerAddress{}
+	if server == nil {
+		return result
+	}
+
+	networkNames := make([]string, 0, len(server.Addresses))
+	for name := range server.Addresses {
+		networkNames = append(networkNames, name)
+	}
+	sort.Strings(networkNames)
+
+	for _, name := range networkNames {
+		entries, ok := server.Addresses[name].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, entry := range entries {
+			fields, ok := entry.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			addr, _ := fields["addr"].(string)
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				continue
+			}
+			address := ServerAddress{Network: name, Addr: addr, Type: "fixed"}
+			if version, ok := fields["version"].(float64); ok {
+				address.Version = int(version)
+			} else if ip.To4() != nil {
+				address.Version = 4
+			} else {
+				address.Version = 6
+			}
+			if ipType, ok := fields["OS-EXT-IPS:type"].(string); ok && len(ipType) > 0 {
+				address.Type = ipType
+			}
+			address.MAC, _ = fields["OS-EXT-IPS-MAC:mac_addr"].(string)
+			address.Public = address.Type == "floating" || isPublicIP(ip)
+			result = append(result, address)
+		}
+	}
+	return result
+}
+
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && publicAddress(ip)
+}
+
+// addressPolicy returns the ordered address classes used to pick the primary address
+func addressPolicy() []string {
+	policy := beego.AppConfig.DefaultString("address.primary.policy", defaultAddressPolicy)
+	return strings.Split(policy, ",")
+}
+
+// matchesClass reports whether the address belongs to a class such as floating-ipv4 or fixed-any
+func (a ServerAddress) matchesClass(class string) bool {
+	parts := strings.SplitN(strings.TrimSpace(class), "-", 2)
+	kind, family := parts[0], "any"
+	if len(parts) == 2 {
+		family = parts[1]
+	}
+
+	switch family {
+	case "ipv4":
+		if a.Version != 4 {
+			return false
+		}
+	case "ipv6":
+		if a.Version != 6 {
+			return false
+		}
+	}
+
+	switch kind {
+	case "floating":
+		return a.Type == "floating"
+	case "fixed":
+		return a.Type == "fixed"
+	case "public":
+		return a.Public
+	case "private":
+		return !a.Public
+	case "any":
+		return true
+	}
+	return false
+}
+
+// PrimaryAddress picks the address of the first matching class of the policy, or the first address
+func PrimaryAddress(addresses []ServerAddress, policy []string) string {
+	if addr := matchAddress(addresses, policy); len(addr) > 0 {
+		return addr
+	}
+	if len(addresses) > 0 {
+		return addresses[0].Addr
+	}
+	return ""
+}
+
+// matchAddress returns the address of the first matching class, or "" when no address matches
+func matchAddress(addresses []ServerAddress, classes []string) string {
+	for _, class := range classes {
+		for _, address := range addresses {
+			if address.matchesClass(class) {
+				return address.Addr
+			}
+		}
+	}
+	return ""
+}
+
+// resolveStackAddresses discovers the server's addresses, allocating the floating IP first when requested.
+// The addresses found are returned with the error of an allocation that failed.
+func resolveStackAddresses(provider *gophercloud.ProviderClient, region shared.CloudRegion, server *servers.Server, networkID string, params StackNetworkParams) (StackAddresses, error) {
+	addresses := DiscoverAddresses(server)
+
+	var allocateErr error
+	if params.UsesTenantNetwork() {
+		var publicIP string
+		_, publicIP, allocateErr = allocateStackAddresses(provider, region, server.ID, networkID, params)
+		// nova lists a new floating IP only after its next cache refresh
+		if len(publicIP) > 0 && !hasAddress(addresses, publicIP) {
+			version := 6
+			if ip := net.ParseIP(publicIP); ip != nil && ip.To4() != nil {
+				version = 4
+			}
+			addresses = append(addresses, ServerAddress{Addr: publicIP, Version: version, Type: "floating", Public: true})
+		}
+	}
+
+	return summarizeAddresses(addresses), allocateErr
+}
+
+// summarizeAddresses picks the primary, private and public address out of the list
+func summarizeAddresses(addresses []ServerAddress) StackAddresses {
+	result := StackAddresses{All: addresses}
+	result.Primary = PrimaryAddress(addresses, addressPolicy())
+	result.PrivateIP = matchAddress(addresses, []string{"private-ipv4", "private-ipv6"})
+	result.PublicIP = matchAddress(addresses, []string{"floating-ipv4", "public-ipv4", "floating-ipv6", "public-ipv6"})
+	return result
+}
+
+func hasAddress(addresses []ServerAddress, addr string) bool {
+	for _, address := range addresses {
+		if address.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,614 @@
+package thirtdparty
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/backups"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+	"gitlab.com/ics-project/back-thirdparty/service"
+)
+
+// Backup kinds
+const (
+	BackupImage    = "image"
+	BackupVolume   = "backup"
+	BackupSnapshot = "snapshot"
+)
+
+// Backup job statuses
+const (
+	BackupQueued    = "QUEUED"
+	BackupRunning   = "RUNNING"
+	BackupAvailable = "AVAILABLE"
+	BackupError     = "ERROR"
+	BackupDeleting  = "DELETING"
+)
+
+// backupTimeout bounds how long a backup job is tracked
+const backupTimeout = 2 * time.Hour
+
+// StackBackup is a snapshot or backup job of a stack
+type StackBackup struct {
+	ID              uint32    `orm:"column(id);auto;pk" json:"id"`
+	StackID         uint32    `orm:"column(stack_id);index" json:"stackId"`
+	ServerID        string    `orm:"column(server_id);size(64);index" json:"serverId"`
+	ProjectID       string    `orm:"column(project_id);size(64);null" json:"projectId"`
+	Region          string    `orm:"column(region);size(64)" json:"region"`
+	SysUserID       uint32    `orm:"column(sys_user_id)" json:"-"`
+	OsUserID        string    `orm:"column(os_user_id);size(64);index" json:"osUserId"`
+	Kind            string    `orm:"column(kind);size(16)" json:"kind"`
+	Name            string    `orm:"column(name);size(255)" json:"name"`
+	ResourceID      string    `orm:"column(resource_id);size(64);null" json:"resourceId"`
+	VolumeID        string    `orm:"column(volume_id);size(64);null" json:"volumeId"`
+	PolicyID        uint32    `orm:"column(policy_id);null;index" json:"policyId"`
+	TemplateVersion string    `orm:"column(template_version);size(64);null" json:"templateVersion"`
+	Size            int       `orm:"column(size);null" json:"size"`
+	Status          string    `orm:"column(status);size(32)" json:"status"`
+	Message         string    `orm:"column(message);size(1024);null" json:"message"`
+	CreatedAt       time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+	UpdatedAt       time.Time `orm:"column(updated_at);auto_now;type(datetime)" json:"updatedAt"`
+}
+
+// TableName ...
+func (t *StackBackup) TableName() string {
+	return "stack_backups"
+}
+
+func init() {
+	orm.RegisterModel(new(StackBackup))
+}
+
+// backupMetadata links a backup to its stack, owner and template version
+func backupMetadata(stack *Stack) map[string]string {
+	return map[string]string{
+		"stack_id":         strconv.Itoa(int(stack.ID)),
+		"stack_type":       stack.Type,
+		"server_id":        stack.ServerID,
+		"owner":            stack.OsUserID,
+		"template_version": stack.TemplateVersion,
+	}
+}
+
+// setBackupStatus stores the progress of the backup job
+func setBackupStatus(backup *StackBackup, status, message string) {
+	backup.Status = status
+	backup.Message = message
+	o := orm.NewOrm()
+	if _, err := o.Update(backup); err != nil {
+		fmt.Println("Failed updating backup", backup.ID, err)
+	}
+}
+
+// GetOwnedBackup returns the backup when it belongs to the user
+func GetOwnedBackup(id uint32, osUserID string) (*StackBackup, error) {
+	o := orm.NewOrm()
+	backup := StackBackup{}
+	err := o.QueryTable(new(StackBackup)).Filter("id", id).Filter("os_user_id", osUserID).One(&backup)
+	if err != nil {
+		return nil, fmt.Errorf("backup %d not found", id)
+	}
+	return &backup, nil
+}
+
+// backupSession opens the session of the project the backup was taken in
+func backupSession(claims shared.Claims, clientIP string, backup *StackBackup, minimum string) (*StackSession, error) {
+	stack := &Stack{ServerID: backup.ServerID, Region: backup.Region, ProjectID: backup.ProjectID, OsUserID: backup.OsUserID}
+	return serverSession(claims, clientIP, stack, minimum)
+}
+
+// projectBackupClients returns the clients of the service account scoped to the project,
+// for scheduled jobs that run without a user session
+func projectBackupClients(region shared.CloudRegion, projectID string) (*backupClients, error) {
+	if len(projectID) == 0 {
+		return nil, fmt.Errorf("project of the stack is unknown")
+	}
+	provider, err := serviceProvider(region, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return newBackupClients(provider, region)
+}
+
+// backupClients are the clients of the stack's region a backup job works with
+type backupClients struct {
+	compute *gophercloud.ServiceClient
+	volume  *gophercloud.ServiceClient
+	image   *gophercloud.ServiceClient
+}
+
+func newBackupClients(provider *gophercloud.ProviderClient, region shared.CloudRegion) (*backupClients, error) {
+	computeClient, err := region.ComputeClient(provider)
+	if err != nil {
+		return nil, err
+	}
+	volumeClient, err := region.BlockStorageClient(provider)
+	if err != nil {
+		return nil, err
+	}
+	imageClient, err := region.ImageClient(provider)
+	if err != nil {
+		return nil, err
+	}
+	return &backupClients{compute: computeClient, volume: volumeClient, image: imageClient}, nil
+}
+
+// serverRoot is what nova reports about the disk a server boots from
+type serverRoot struct {
+	Image          interface{} `json:"image"`
+	RootDeviceName string      `json:"OS-EXT-SRV-ATTR:root_device_name"`
+}
+
+// bootsFromVolume reports whether nova booted the server from a volume rather than an image
+func (r serverRoot) bootsFromVolume() bool {
+	image, ok := r.Image.(map[string]interface{})
+	return !ok || len(image) == 0
+}
+
+// stackVolumes splits the volumes attached to the server into the boot volume and the data volumes.
+// The boot volume is the one attached at the server's root device name; where the policy hides the
+// name, it is the bootable volume of a server booted from a volume.
+func stackVolumes(clients *backupClients, serverID string) (string, []string, error) {
+	// the root device name is reported from microversion 2.3
+	rootClient := *clients.compute
+	rootClient.Microversion = "2.3"
+	var root struct {
+		Server serverRoot `json:"server"`
+	}
+	if err := servers.Get(&rootClient, serverID).ExtractInto(&root); err != nil {
+		return "", nil, err
+	}
+
+	allPages, err := volumeattach.List(clients.compute, serverID).AllPages()
+	if err != nil {
+		return "", nil, err
+	}
+	attachments, err := volumeattach.ExtractVolumeAttachments(allPages)
+	if err != nil {
+		return "", nil, err
+	}
+	bootVolume := ""
+	dataVolumes := []string{}
+	for _, attachment := range attachments {
+		isBoot := false
+		switch {
+		case !root.Server.bootsFromVolume() || len(bootVolume) > 0:
+		case len(root.Server.RootDeviceName) > 0:
+			isBoot = attachment.Device == root.Server.RootDeviceName
+		default:
+			volume, err := volumes.Get(clients.volume, attachment.VolumeID).Extract()
+			if err != nil {
+				return "", nil, err
+			}
+			isBoot = volume.Bootable == "true"
+		}
+		if isBoot {
+			bootVolume = attachment.VolumeID
+		} else {
+			dataVolumes = append(dataVolumes, attachment.VolumeID)
+		}
+	}
+	return bootVolume, dataVolumes, nil
+}
+
+// imageSnapshots returns the cinder snapshots nova took for the image of a server booted from a volume
+func imageSnapshots(image *images.Image) []string {
+	mapping, _ := image.Properties["block_device_mapping"].(string)
+	if len(mapping) == 0 {
+		return nil
+	}
+	var devices []struct {
+		SnapshotID string `json:"snapshot_id"`
+	}
+	if err := json.Unmarshal([]byte(mapping), &devices); err != nil {
+		return nil
+	}
+	snapshotIDs := []string{}
+	for _, device := range devices {
+		if len(device.SnapshotID) > 0 {
+			snapshotIDs = append(snapshotIDs, device.SnapshotID)
+		}
+	}
+	return snapshotIDs
+}
+
+// queueBackups records the jobs of the kind for the stack.
+// An image is taken of the server, a backup of its boot volume and a snapshot of every data volume.
+func queueBackups(clients *backupClients, stack *Stack, kind, name string, policyID uint32) ([]*StackBackup, error) {
+	if len(name) == 0 {
+		name = fmt.Sprintf("%s-%s-%s", stack.Name, kind, time.Now().Format("20060102150405"))
+	}
+
+	var volumeIDs []string
+	switch kind {
+	case BackupImage:
+		volumeIDs = []string{""}
+	case BackupVolume, BackupSnapshot:
+		bootVolume, dataVolumes, err := stackVolumes(clients, stack.ServerID)
+		if err != nil {
+			return nil, err
+		}
+		if kind == BackupVolume {
+			if len(bootVolume) == 0 {
+				return nil, fmt.Errorf("server %s has no boot volume", stack.ServerID)
+			}
+			volumeIDs = []string{bootVolume}
+		} else {
+			if len(dataVolumes) == 0 {
+				return nil, fmt.Errorf("server %s has no data volumes", stack.ServerID)
+			}
+			volumeIDs = dataVolumes
+		}
+	default:
+		return nil, fmt.Errorf("unknown backup kind %q", kind)
+	}
+
+	o := orm.NewOrm()
+	result := []*StackBackup{}
+	for i, volumeID := range volumeIDs {
+		backup := &StackBackup{
+			StackID:         stack.ID,
+			ServerID:        stack.ServerID,
+			ProjectID:       stack.ProjectID,
+			Region:          stack.Region,
+			SysUserID:       stack.SysUserID,
+			OsUserID:        stack.OsUserID,
+			Kind:            kind,
+			Name:            name,
+			VolumeID:        volumeID,
+			TemplateVersion: stack.TemplateVersion,
+			PolicyID:        policyID,
+			Status:          BackupQueued,
+		}
+		if len(volumeIDs) > 1 {
+			backup.Name = fmt.Sprintf("%s-%d", name, i+1)
+		}
+		if _, err := o.Insert(backup); err != nil {
+			return result, err
+		}
+		result = append(result, backup)
+	}
+	return result, nil
+}
+
+// runBackup creates the backup resource and tracks it until it is available or failed
+func runBackup(clients *backupClients, stack *Stack, backup *StackBackup) {
+	if beginBackup(clients, stack, backup) {
+		trackBackup(clients, backup)
+	}
+}
+
+// beginBackup creates the backup resource, the point in time the backup is taken at
+func beginBackup(clients *backupClients, stack *Stack, backup *StackBackup) bool {
+	resourceID, err := createBackupResource(clients, stack, backup)
+	service.CreateLogAction(stack.ServerID, "Backup", backup.Name, "Create", stack.OsUserID, err)
+	if err != nil {
+		setBackupStatus(backup, BackupError, err.Error())
+		return false
+	}
+	backup.ResourceID = resourceID
+	setBackupStatus(backup, BackupRunning, "")
+	return true
+}
+
+// trackBackup waits until the backup resource is available or failed
+func trackBackup(clients *backupClients, backup *StackBackup) {
+	deadline := time.Now().Add(backupTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(10 * time.Second)
+		status, size, err := backupResourceStatus(clients, backup)
+		if err != nil {
+			continue
+		}
+		switch status {
+		case "active", "available":
+			backup.Size = size
+			setBackupStatus(backup, BackupAvailable, "")
+			return
+		case "error", "killed", "deleted":
+			setBackupStatus(backup, BackupError, fmt.Sprintf("%s ended in status %s", backup.Kind, status))
+			return
+		}
+	}
+	setBackupStatus(backup, BackupError, "backup timed out")
+}
+
+func createBackupResource(clients *backupClients, stack *Stack, backup *StackBackup) (string, error) {
+	metadata := backupMetadata(stack)
+	switch backup.Kind {
+	case BackupImage:
+		return servers.CreateImage(clients.compute, stack.ServerID, servers.CreateImageOpts{
+			Name:     backup.Name,
+			Metadata: metadata,
+		}).ExtractImageID()
+	case BackupVolume:
+		// the boot volume is in use, so cinder has to be forced to back it up
+		result, err := backups.Create(clients.volume, backups.CreateOpts{
+			VolumeID:    backup.VolumeID,
+			Name:        backup.Name,
+			Description: fmt.Sprintf("stack %s (%s) of %s, template %s", metadata["stack_id"], stack.Type, stack.OsUserID, stack.TemplateVersion),
+			Force:       true,
+		}).Extract()
+		if err != nil {
+			return "", err
+		}
+		return result.ID, nil
+	case BackupSnapshot:
+		result, err := snapshots.Create(clients.volume, snapshots.CreateOpts{
+			VolumeID: backup.VolumeID,
+			Name:     backup.Name,
+			Force:    true,
+			Metadata: metadata,
+		}).Extract()
+		if err != nil {
+			return "", err
+		}
+		return result.ID, nil
+	}
+	return "", fmt.Errorf("unknown backup kind %q", backup.Kind)
+}
+
+// backupResourceStatus returns the status and the size in GB of the backup resource
+func backupResourceStatus(clients *backupClients, backup *StackBackup) (string, int, error) {
+	switch backup.Kind {
+	case BackupImage:
+		image, err := images.Get(clients.image, backup.ResourceID).Extract()
+		if err != nil {
+			return "", 0, err
+		}
+		return string(image.Status), int((image.SizeBytes + 1<<30 - 1) >> 30), nil
+	case BackupVolume:
+		result, err := backups.Get(clients.volume, backup.ResourceID).Extract()
+		if err != nil {
+			return "", 0, err
+		}
+		return result.Status, result.Size, nil
+	case BackupSnapshot:
+		result, err := snapshots.Get(clients.volume, backup.ResourceID).Extract()
+		if err != nil {
+			return "", 0, err
+		}
+		return result.Status, result.Size, nil
+	}
+	return "", 0, fmt.Errorf("unknown backup kind %q", backup.Kind)
+}
+
+// deleteBackupResource removes the backup from the cloud, treating an already missing one as deleted
+func deleteBackupResource(clients *backupClients, backup *StackBackup) error {
+	if len(backup.ResourceID) == 0 {
+		return nil
+	}
+	var err error
+	switch backup.Kind {
+	case BackupImage:
+		// the image of a server booted from a volume keeps its data in cinder snapshots
+		image, errGet := images.Get(clients.image, backup.ResourceID).Extract()
+		if errGet != nil {
+			err = errGet
+			break
+		}
+		if err = images.Delete(clients.image, backup.ResourceID).ExtractErr(); err != nil {
+			break
+		}
+		for _, snapshotID := range imageSnapshots(image) {
+			errSnapshot := snapshots.Delete(clients.volume, snapshotID).ExtractErr()
+			if _, ok := errSnapshot.(gophercloud.ErrDefault404); errSnapshot != nil && !ok {
+				return errSnapshot
+			}
+		}
+	case BackupVolume:
+		err = backups.Delete(clients.volume, backup.ResourceID).ExtractErr()
+	case BackupSnapshot:
+		err = snapshots.Delete(clients.volume, backup.ResourceID).ExtractErr()
+	}
+	if _, ok := err.(gophercloud.ErrDefault404); ok {
+		return nil
+	}
+	return err
+}
+
+// BackupController struct
+type BackupController struct {
+	shared.BaseController
+}
+
+// URLMapping URL mapping
+func (m *BackupController) URLMapping() {
+	m.Mapping("Create", m.Create)
+	m.Mapping("List", m.List)
+	m.Mapping("Detail", m.Detail)
+	m.Mapping("Delete", m.Delete)
+	m.Mapping("Restore", m.Restore)
+}
+
+// BackupCreateParams ...
+type BackupCreateParams struct {
+	ID   string `json:"id" bind:"required"`
+	Kind string `json:"kind" bind:"required"`
+	Name string `json:"name"`
+}
+
+// Create ...
+// @Title Create
+// @Description take an image, a boot volume backup or data volume snapshots of the stack
+// @Param	body	body	thirtdparty.BackupCreateParams	true	"body for backup"
+// @Failure 403
+// @router /create [post]
+func (m *BackupController) Create() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params BackupCreateParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+
+	stack, err := GetProjectStack(claims, params.ID, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	session, err := stackSession(claims, m.GetClientIP(), stack, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	clients, err := session.backupClients()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	result, err := queueBackups(clients, stack, params.Kind, params.Name, 0)
+	if err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	for _, backup := range result {
+		job := *backup
+		go runBackup(clients, stack, &job)
+	}
+	m.SetBody(result)
+}
+
+// List ...
+// @Title List
+// @Description backups of the user, optionally of one stack
+// @Param	id	query	string	false	"server id"
+// @Param	kind	query	string	false	"image, backup or snapshot"
+// @Failure 403
+// @router /list [get]
+func (m *BackupController) List() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	o := orm.NewOrm()
+	query := o.QueryTable(new(StackBackup)).Filter("os_user_id", claims.OsUserID)
+	if serverID := m.GetString("id"); len(serverID) > 0 {
+		query = query.Filter("server_id", serverID)
+	}
+	if kind := m.GetString("kind"); len(kind) > 0 {
+		query = query.Filter("kind", kind)
+	}
+	var result []StackBackup
+	if _, err := query.OrderBy("-id").All(&result); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(result)
+}
+
+// Detail ...
+// @Title Detail
+// @Description status of a backup job
+// @Param	id	query	int	true	"backup id"
+// @Failure 403
+// @router /detail [get]
+func (m *BackupController) Detail() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	id, err := m.GetUint32("id")
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	backup, err := GetOwnedBackup(id, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(backup)
+}
+
+// BackupDeleteParams ...
+type BackupDeleteParams struct {
+	ID uint32 `json:"id" bind:"required"`
+}
+
+// Delete ...
+// @Title Delete
+// @Description delete a backup and its cloud resource
+// @Param	body	body	thirtdparty.BackupDeleteParams	true	"body for delete"
+// @Failure 403
+// @router /delete [post]
+func (m *BackupController) Delete() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params BackupDeleteParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	backup, err := GetOwnedBackup(params.ID, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if backup.Status == BackupQueued || backup.Status == BackupRunning {
+		err := fmt.Errorf("backup %d is still %s", backup.ID, backup.Status)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	session, err := backupSession(claims, m.GetClientIP(), backup, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	clients, err := session.backupClients()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	setBackupStatus(backup, BackupDeleting, "")
+	err = deleteBackupResource(clients, backup)
+	service.CreateLogAction(backup.ServerID, "Backup", backup.Name, "Delete", claims.UserID, err)
+	if err != nil {
+		setBackupStatus(backup, BackupError, err.Error())
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	o := orm.NewOrm()
+	if _, err := o.Delete(backup); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(backup)
+}
@@ -0,0 +1,565 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/orm"
+	"github.com/astaxie/beego/toolbox"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// BackupPolicy runs backups of a stack, or of every stack of a project, on a schedule
+type BackupPolicy struct {
+	ID             uint32    `orm:"column(id);auto;pk" json:"id"`
+	Name           string    `orm:"column(name);size(255)" json:"name"`
+	SysUserID      uint32    `orm:"column(sys_user_id)" json:"-"`
+	OsUserID       string    `orm:"column(os_user_id);size(64);index" json:"osUserId"`
+	Username       string    `orm:"column(username);size(255)" json:"-"`
+	ProjectID      string    `orm:"column(project_id);size(64);null" json:"projectId"`
+	ServerID       string    `orm:"column(server_id);size(64);null" json:"serverId"`
+	Kind           string    `orm:"column(kind);size(16)" json:"kind"`
+	Schedule       string    `orm:"column(schedule);size(128)" json:"schedule"`
+	RetentionCount int       `orm:"column(retention_count)" json:"retentionCount"`
+	RetentionDays  int       `orm:"column(retention_days)" json:"retentionDays"`
+	Quiesce        bool      `orm:"column(quiesce)" json:"quiesce"`
+	Enabled        bool      `orm:"column(enabled)" json:"enabled"`
+	LastRunAt      time.Time `orm:"column(last_run_at);type(datetime);null" json:"lastRunAt"`
+	LastStatus     string    `orm:"column(last_status);size(32);null" json:"lastStatus"`
+	LastMessage    string    `orm:"column(last_message);size(1024);null" json:"lastMessage"`
+	CreatedAt      time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+	UpdatedAt      time.Time `orm:"column(updated_at);auto_now;type(datetime)" json:"updatedAt"`
+}
+
+// TableName ...
+func (t *BackupPolicy) TableName() string {
+	return "backup_policies"
+}
+
+func init() {
+	orm.RegisterModel(new(BackupPolicy))
+	beego.AddAPPStartHook(startBackupScheduler)
+}
+
+// policyRuns keeps a policy from running twice at the same time
+var policyRuns sync.Map
+
+func policyTaskName(id uint32) string {
+	return fmt.Sprintf("backup-policy-%d", id)
+}
+
+// normalizeSchedule accepts the 5 field cron format and turns it into the 6 field one of toolbox
+func normalizeSchedule(spec string) (string, error) {
+	spec = strings.TrimSpace(spec)
+	if !strings.HasPrefix(spec, "@") && len(strings.Fields(spec)) == 5 {
+		spec = "0 " + spec
+	}
+	task, err := newScheduledTask("validate", spec, func() error { return nil })
+	if err != nil {
+		return "", err
+	}
+	if task.Spec == nil {
+		return "", fmt.Errorf("invalid schedule %q", spec)
+	}
+	return spec, nil
+}
+
+// newScheduledTask wraps toolbox.NewTask, which panics on a malformed spec
+func newScheduledTask(name, spec string, f toolbox.TaskFunc) (task *toolbox.Task, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid schedule %q: %v", spec, r)
+		}
+	}()
+	return toolbox.NewTask(name, spec, f), nil
+}
+
+// schedulePolicy registers the policy with the task scheduler, replacing an earlier registration
+func schedulePolicy(policy BackupPolicy) error {
+	name := policyTaskName(policy.ID)
+	toolbox.DeleteTask(name)
+	if !policy.Enabled {
+		return nil
+	}
+	id := policy.ID
+	task, err := newScheduledTask(name, policy.Schedule, func() error {
+		return runBackupPolicy(id)
+	})
+	if err != nil {
+		return err
+	}
+	toolbox.AddTask(name, task)
+	return nil
+}
+
+// startBackupScheduler schedules every enabled policy once the application has started
+func startBackupScheduler() error {
+	o := orm.NewOrm()
+	var policies []BackupPolicy
+	if _, err := o.QueryTable(new(BackupPolicy)).Filter("enabled", true).All(&policies); err != nil {
+		return err
+	}
+	for _, policy := range policies {
+		if err := schedulePolicy(policy); err != nil {
+			fmt.Println("Failed scheduling backup policy", policy.ID, err)
+		}
+	}
+	toolbox.StartTask()
+	return nil
+}
+
+// policyStacks returns the stacks the policy protects
+func policyStacks(policy *BackupPolicy) ([]Stack, error) {
+	o := orm.NewOrm()
+	query := o.QueryTable(new(Stack)).Filter("os_user_id", policy.OsUserID).Exclude("status", "ERROR")
+	if len(policy.ServerID) > 0 {
+		query = query.Filter("server_id", policy.ServerID)
+	} else {
+		query = query.Filter("project_id", policy.ProjectID)
+	}
+	var stacks []Stack
+	_, err := query.All(&stacks)
+	return stacks, err
+}
+
+// runBackupPolicy backs up every stack of the policy, prunes expired backups and notifies the owner
+func runBackupPolicy(id uint32) error {
+	if _, running := policyRuns.LoadOrStore(id, true); running {
+		return nil
+	}
+	defer policyRuns.Delete(id)
+
+	o := orm.NewOrm()
+	policy := BackupPolicy{ID: id}
+	if err := o.Read(&policy); err != nil {
+		return err
+	}
+
+	stacks, err := policyStacks(&policy)
+	if err != nil {
+		return finishPolicyRun(&policy, 0, 1, err)
+	}
+
+	var wg sync.WaitGroup
+	var jobs []*StackBackup
+	failed := 0
+	for i := range stacks {
+		stack := &stacks[i]
+		region, err := shared.GetRegion(stack.Region)
+		if err != nil {
+			failed++
+			continue
+		}
+		clients, err := projectBackupClients(region, stack.ProjectID)
+		if err != nil {
+			failed++
+			continue
+		}
+		name := fmt.Sprintf("%s-%s-%s", stack.Name, policy.Name, time.Now().Format("20060102150405"))
+		backups, err := queueBackups(clients, stack, policy.Kind, name, policy.ID)
+		if err != nil {
+			failed++
+			continue
+		}
+
+		if policy.Quiesce {
+			if err := quiesceSupported(clients.image, stack.ImageID); err != nil {
+				for _, backup := range backups {
+					setBackupStatus(backup, BackupError, err.Error())
+				}
+				jobs = append(jobs, backups...)
+				continue
+			}
+		}
+		started := []*StackBackup{}
+		for _, backup := range backups {
+			if beginBackup(clients, stack, backup) {
+				started = append(started, backup)
+			}
+		}
+
+		for _, backup := range started {
+			wg.Add(1)
+			go func(backup *StackBackup) {
+				defer wg.Done()
+				trackBackup(clients, backup)
+			}(backup)
+		}
+		jobs = append(jobs, backups...)
+	}
+	wg.Wait()
+
+	pruneBackups(&policy)
+	// stacks that could not be backed up at all count as one failed backup each
+	total := len(jobs) + failed
+	for _, backup := range jobs {
+		if backup.Status != BackupAvailable {
+			failed++
+		}
+	}
+	return finishPolicyRun(&policy, total, failed, nil)
+}
+
+// quiesceSupported checks the stack was booted from an image nova can quiesce through the qemu guest
+// agent. Nova freezes the file systems of such a server while it takes an image backup and, with
+// os_require_quiesce, fails the backup instead of taking an unquiesced one.
+func quiesceSupported(client *gophercloud.ServiceClient, imageID string) error {
+	image, err := images.Get(client, imageID).Extract()
+	if err != nil {
+		return fmt.Errorf("failed reading image %s: %v", imageID, err)
+	}
+	for _, property := range []string{"hw_qemu_guest_agent", "os_require_quiesce"} {
+		if value := fmt.Sprint(image.Properties[property]); value != "yes" && value != "true" {
+			return fmt.Errorf("image %s does not set %s, the guest agent can not quiesce the stack", image.Name, property)
+		}
+	}
+	return nil
+}
+
+// finishPolicyRun stores the outcome of the run and reports it to the owner
+func finishPolicyRun(policy *BackupPolicy, total, failed int, err error) error {
+	policy.LastRunAt = time.Now()
+	policy.LastStatus = "SUCCESS"
+	policy.LastMessage = fmt.Sprintf("%d backups taken", total-failed)
+	topic := "Backup completed"
+	if err != nil || failed > 0 {
+		policy.LastStatus = "FAILED"
+		policy.LastMessage = fmt.Sprintf("%d of %d backups failed", failed, total)
+		if err != nil {
+			policy.LastMessage = err.Error()
+		}
+		topic = "Backup failed"
+	}
+	o := orm.NewOrm()
+	if _, errUpdate := o.Update(policy, "last_run_at", "last_status", "last_message", "updated_at"); errUpdate != nil {
+		fmt.Println("Failed updating backup policy", policy.ID, errUpdate)
+	}
+
+	notif := fmt.Sprintf("%s: %s", policy.Name, policy.LastMessage)
+	if errNotify := shared.SendPushNotificationToUser(policy.OsUserID, topic, notif, policy.ProjectID, "", nil); errNotify != nil {
+		fmt.Println("Failed notifying backup policy", policy.ID, errNotify)
+	}
+	return err
+}
+
+// pruneBackups deletes the backups of the policy that exceed its retention count or age
+func pruneBackups(policy *BackupPolicy) {
+	o := orm.NewOrm()
+	var backups []*StackBackup
+	_, err := o.QueryTable(new(StackBackup)).Filter("policy_id", policy.ID).Filter("status", BackupAvailable).OrderBy("-created_at").All(&backups)
+	if err != nil {
+		fmt.Println("Failed listing backups of policy", policy.ID, err)
+		return
+	}
+
+	kept := map[string]int{}
+	cutoff := time.Now().AddDate(0, 0, -policy.RetentionDays)
+	for _, backup := range backups {
+		// every volume of a stack counts separately against the retention count
+		key := backup.ServerID + "/" + backup.VolumeID
+		kept[key]++
+		expired := (policy.RetentionCount > 0 && kept[key] > policy.RetentionCount) ||
+			(policy.RetentionDays > 0 && backup.CreatedAt.Before(cutoff))
+		if !expired {
+			continue
+		}
+
+		region, err := shared.GetRegion(backup.Region)
+		if err != nil {
+			continue
+		}
+		projectID := backup.ProjectID
+		if len(projectID) == 0 {
+			if stack, err := GetStackByServer(backup.ServerID); err == nil {
+				projectID = stack.ProjectID
+			}
+		}
+		clients, err := projectBackupClients(region, projectID)
+		if err != nil {
+			continue
+		}
+		if err := deleteBackupResource(clients, backup); err != nil {
+			setBackupStatus(backup, BackupError, err.Error())
+			continue
+		}
+		o.Delete(backup)
+	}
+}
+
+// BackupPolicyController struct
+type BackupPolicyController struct {
+	shared.BaseController
+}
+
+// URLMapping URL mapping
+func (m *BackupPolicyController) URLMapping() {
+	m.Mapping("Create", m.Create)
+	m.Mapping("List", m.List)
+	m.Mapping("Update", m.Update)
+	m.Mapping("Delete", m.Delete)
+	m.Mapping("Run", m.Run)
+}
+
+// BackupPolicyParams ...
+type BackupPolicyParams struct {
+	Name           string `json:"name" bind:"required"`
+	ProjectID      string `json:"projectId"`
+	ServerID       string `json:"serverId"`
+	Kind           string `json:"kind" bind:"required"`
+	Schedule       string `json:"schedule" bind:"required"`
+	RetentionCount int    `json:"retentionCount"`
+	RetentionDays  int    `json:"retentionDays"`
+	Quiesce        bool   `json:"quiesce"`
+	Enabled        *bool  `json:"enabled"`
+}
+
+// apply validates the params and copies them onto the policy
+func (p BackupPolicyParams) apply(policy *BackupPolicy, claims shared.Claims) error {
+	if p.Kind != BackupImage && p.Kind != BackupVolume && p.Kind != BackupSnapshot {
+		return fmt.Errorf("unknown backup kind %q", p.Kind)
+	}
+	if p.RetentionCount < 0 || p.RetentionDays < 0 {
+		return fmt.Errorf("retention can not be negative")
+	}
+	if p.RetentionCount == 0 && p.RetentionDays == 0 {
+		return fmt.Errorf("retentionCount or retentionDays is required")
+	}
+	if p.Quiesce && p.Kind != BackupImage {
+		return fmt.Errorf("quiesce is only supported by %s backups, nova quiesces the stack while it takes them", BackupImage)
+	}
+	schedule, err := normalizeSchedule(p.Schedule)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(p.ServerID) > 0:
+		stack, err := GetProjectStack(claims, p.ServerID, RoleAdmin)
+		if err != nil {
+			return err
+		}
+		policy.ServerID = stack.ServerID
+		policy.ProjectID = stack.ProjectID
+	case len(p.ProjectID) > 0:
+		if _, _, err := projectAccess(claims, p.ProjectID, RoleAdmin); err != nil {
+			return err
+		}
+		policy.ServerID = ""
+		policy.ProjectID = p.ProjectID
+	default:
+		return fmt.Errorf("serverId or projectId is required")
+	}
+
+	policy.Name = p.Name
+	policy.Kind = p.Kind
+	policy.Schedule = schedule
+	policy.RetentionCount = p.RetentionCount
+	policy.RetentionDays = p.RetentionDays
+	policy.Quiesce = p.Quiesce
+	if p.Enabled != nil {
+		policy.Enabled = *p.Enabled
+	}
+	policy.SysUserID = claims.SysUserID
+	policy.OsUserID = claims.OsUserID
+	policy.Username = claims.Username
+	return nil
+}
+
+// GetOwnedPolicy returns the backup policy when it belongs to the user
+func GetOwnedPolicy(id uint32, osUserID string) (*BackupPolicy, error) {
+	o := orm.NewOrm()
+	policy := BackupPolicy{}
+	err := o.QueryTable(new(BackupPolicy)).Filter("id", id).Filter("os_user_id", osUserID).One(&policy)
+	if err != nil {
+		return nil, fmt.Errorf("backup policy %d not found", id)
+	}
+	return &policy, nil
+}
+
+// Create ...
+// @Title Create
+// @Description create a scheduled backup policy for a stack or a project
+// @Param	body	body	thirtdparty.BackupPolicyParams	true	"body for policy"
+// @Failure 403
+// @router /create [post]
+func (m *BackupPolicyController) Create() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params BackupPolicyParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+
+	policy := BackupPolicy{Enabled: true}
+	if err := params.apply(&policy, claims); err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	o := orm.NewOrm()
+	if _, err := o.Insert(&policy); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if err := schedulePolicy(policy); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(policy)
+}
+
+// List ...
+// @Title List
+// @Description backup policies of the user
+// @Failure 403
+// @router /list [get]
+func (m *BackupPolicyController) List() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	o := orm.NewOrm()
+	var policies []BackupPolicy
+	if _, err := o.QueryTable(new(BackupPolicy)).Filter("os_user_id", claims.OsUserID).OrderBy("-id").All(&policies); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(policies)
+}
+
+// BackupPolicyUpdateParams ...
+type BackupPolicyUpdateParams struct {
+	ID uint32 `json:"id" bind:"required"`
+	BackupPolicyParams
+}
+
+// Update ...
+// @Title Update
+// @Description change the schedule, retention or target of a backup policy
+// @Param	body	body	thirtdparty.BackupPolicyUpdateParams	true	"body for policy"
+// @Failure 403
+// @router /update [post]
+func (m *BackupPolicyController) Update() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params BackupPolicyUpdateParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	policy, err := GetOwnedPolicy(params.ID, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if err := params.apply(policy, claims); err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	o := orm.NewOrm()
+	if _, err := o.Update(policy); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if err := schedulePolicy(*policy); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(policy)
+}
+
+// BackupPolicyIDParams ...
+type BackupPolicyIDParams struct {
+	ID uint32 `json:"id" bind:"required"`
+}
+
+// Delete ...
+// @Title Delete
+// @Description delete a backup policy, its backups are kept
+// @Param	body	body	thirtdparty.BackupPolicyIDParams	true	"body for policy"
+// @Failure 403
+// @router /delete [post]
+func (m *BackupPolicyController) Delete() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params BackupPolicyIDParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	policy, err := GetOwnedPolicy(params.ID, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	toolbox.DeleteTask(policyTaskName(policy.ID))
+	o := orm.NewOrm()
+	if _, err := o.Delete(policy); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(policy)
+}
+
+// Run ...
+// @Title Run
+// @Description run a backup policy now
+// @Param	body	body	thirtdparty.BackupPolicyIDParams	true	"body for policy"
+// @Failure 403
+// @router /run [post]
+func (m *BackupPolicyController) Run() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params BackupPolicyIDParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	policy, err := GetOwnedPolicy(params.ID, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if _, running := policyRuns.Load(policy.ID); running {
+		err := fmt.Errorf("backup policy %d is already running", policy.ID)
+		m.SetError(helper.StatusAlready, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	go runBackupPolicy(policy.ID)
+	m.SetBody(policy)
+}
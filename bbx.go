@@ -10,7 +10,6 @@ import (
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
 	"gitlab.com/ics-project/back-thirdparty/helper"
-	"gitlab.com/ics-project/back-thirdparty/integration/compute"
 	"gitlab.com/ics-project/back-thirdparty/integration/networking"
 	"gitlab.com/ics-project/back-thirdparty/models"
 	"gitlab.com/ics-project/back-thirdparty/service"
@@ -55,54 +54,54 @@ func (m *BBXController) Create() {
 		AllowedIP   string `json:"allowed_ip" bind:"required"`
 		CallbackUrl string `json:"callback_url" bind:"required"`
 		FlavorID    string `json:"flavor_id"  bind:"required"`
+		Region      string `json:"region"`
+		ProjectID   string `json:"projectId"`
+		StackNetworkParams
 	}
 
 	params := RequestedParams{}
 	if m.BindJSON(&params) != nil {
 		return
 	}
+	session, err := openSession(claims, m.GetClientIP(), params.ProjectID, params.Region, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	region := session.Region
 	id := params.ID
 	flavorID := params.FlavorID // ics4  - 8gb -ram 4 vcpu
-	allowedIp := fmt.Sprintf("%s/32", params.AllowedIP)
 	callbackUrl := params.CallbackUrl
 
 	diskSize := 10
 
+	imageID := region.Image("3thparty", models.GetConfig("3thparty_image"))
+	if session.quotaRejected(&m.BaseController, QuotaRequest{FlavorID: flavorID, Disk: diskSize, Volumes: 1, FloatingIPs: floatingIPCount(params.StackNetworkParams)}) {
+		return
+	}
+	if session.imageRejected(&m.BaseController, "bbx", imageID, flavorID, 0, diskSize) {
+		return
+	}
+
 	/* find default security group */
-	securityGroupList, err := compute.GetCompute(claims.Username).ListSecGroups()
+	secGroupName, err := session.openStackFirewall("bbx", params.AllowedIP)
 	if err != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), fmt.Sprintf("bbx-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
 	}
 
-	var sgIDs []interface{}
-	for _, secGroup := range securityGroupList {
-		if secGroup.Name == "default" {
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "psql", 5432, 5432, "tcp", allowedIp)
-
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "bbx-admin", 8081, 8081, "tcp", allowedIp)
-
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "bbx-core", 8082, 8082, "tcp", allowedIp)
-
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "bbx-scheduler", 8083, 8083, "tcp", allowedIp)
-
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "bbx-uaa", 8084, 8084, "tcp", allowedIp)
-
-			sgIDs = append(sgIDs, secGroup.Name)
-		}
+	networkID, err := resolveStackNetwork(session.Provider(), region, params.StackNetworkParams, id)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
 	}
 
-	networkID := ""
-	imageID := models.GetConfig("3thparty_image")
-
 	if networkID == "" {
-		adminProvider, _ := shared.AuthOSAdmin()
+		adminProvider, _ := region.AdminProvider()
 		networkID, _ = networking.GetNetworking("admin").GetAvailableNetworks(adminProvider)
 	}
 
-	secGroup := make([]string, len(sgIDs))
-	for i, v := range sgIDs {
-		secGroup[i] = fmt.Sprint(v)
-	}
+	secGroup := []string{secGroupName}
 
 	userData, err := ioutil.ReadFile("files/bbx/base.yml")
 	if err != nil {
@@ -127,61 +126,92 @@ func (m *BBXController) Create() {
 	output := strings.Join(lines, "\n")
 	fmt.Println(output)
 
-	scripted := []byte(output)
+	phoneHomeToken := newPhoneHomeToken()
+	scripted := withPhoneHome([]byte(output), phoneHomeToken)
 
-	server, errServer := compute.GetCompute(claims.Username).CreateServerForVolume(imageID, id, flavorID, "", int(diskSize), secGroup, scripted, "nova", true, networkID)
+	server, errServer := session.bootServer(stackServerOpts{Name: id, ImageID: imageID, FlavorID: flavorID, NetworkID: networkID, DiskSize: diskSize, SecurityGroups: secGroup, UserData: scripted})
 	if errServer != nil {
 		fmt.Print(errServer)
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), fmt.Sprintf("bbx-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("bbx-%v", claims.UserID))
 		return
 	}
 
 	service.CreateLogAction(server.ID, "bbx", id, "Create", claims.UserID, err)
-	_, errGetFlavor := compute.GetCompute(claims.Username).GetFlavor(flavorID, "CLOUD.MN")
-	if errGetFlavor != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("bbx-%v", claims.UserID))
+	recordStack(&Stack{
+		Type:            "bbx",
+		RequestID:       id,
+		Name:            id,
+		ServerID:        server.ID,
+		ProjectID:       session.ProjectID,
+		Region:          region.Tag,
+		SysUserID:       claims.SysUserID,
+		OsUserID:        claims.OsUserID,
+		FlavorID:        flavorID,
+		ImageID:         imageID,
+		NetworkID:       networkID,
+		AllowedIP:       params.AllowedIP,
+		DiskSize:        diskSize,
+		TemplateVersion: templateVersion(userData),
+		PhoneHomeToken:  phoneHomeHash(phoneHomeToken),
+		HealthProbes: []HealthProbe{
+			{Name: "bbx-admin", Kind: "http", Port: 8081, Path: "/"},
+			{Name: "postgres", Kind: "tcp", Port: 5432},
+		},
+	})
+	if len(phoneHomeToken) > 0 {
+		watchPhoneHome(server.ID, phoneHomeDeadline())
+	}
+	computeClient, err := session.Compute()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), fmt.Sprintf("bbx-%v", claims.UserID))
+		return
+	}
+	if _, errGetFlavor := flavors.Get(computeClient, flavorID).Extract(); errGetFlavor != nil {
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errGetFlavor.Error(), fmt.Sprintf("bbx-%v", claims.UserID))
 	}
 
-	go func(serverid string, username string) {
-		provider := service.GetProvider(username)
-		for {
-			server, _ := servers.Get(service.GetClientCompute(provider), serverid).Extract()
+	go func(serverid string) {
+		deadline := time.Now().Add(provisionDeadline())
+		for time.Now().Before(deadline) {
+			server, err := servers.Get(computeClient, serverid).Extract()
+			if err != nil {
+				time.Sleep(3 * time.Second)
+				continue
+			}
 			if server.Status == "ACTIVE" {
-				var ip string
-				if server.Addresses["public1"] != nil {
-					for _, l := range server.Addresses["public1"].([]interface{}) {
-						tmp := l.(map[string]interface{})
-						ip = tmp["addr"].(string)
-					}
-				}
-				if server.Addresses["public2"] != nil {
-					for _, l := range server.Addresses["public2"].([]interface{}) {
-						tmp := l.(map[string]interface{})
-						ip = tmp["addr"].(string)
-
-					}
+				addresses, err := resolveStackAddresses(session.Provider(), region, server, networkID, params.StackNetworkParams)
+				if err != nil {
+					addresses.Error = err.Error()
 				}
+				ip := addresses.Primary
+				updateStackAddresses(serverid, "ACTIVE", addresses)
 
 				type ReturnParams struct {
-					ID         string `json:"requestId"`
-					DBName     string `json:"databaseName"`
-					DBUsername string `json:"databaseUser"`
-					DBPassword string `json:"databasePwd"`
-					Ip         string `json:"databaseUrl"`
+					ID           string          `json:"requestId"`
+					DBName       string          `json:"databaseName"`
+					DBUsername   string          `json:"databaseUser"`
+					DBPassword   string          `json:"databasePwd"`
+					Ip           string          `json:"databaseUrl"`
+					PrivateIP    string          `json:"privateIp"`
+					PublicIP     string          `json:"publicIp"`
+					Addresses    []ServerAddress `json:"addresses"`
+					AddressError string          `json:"addressError,omitempty"`
 				}
 
-				returnParams := ReturnParams{ID: id, DBName: "primebbx", DBUsername: generatedUsername, DBPassword: generatedPassword, Ip: ip}
+				returnParams := ReturnParams{ID: id, DBName: "primebbx", DBUsername: generatedUsername, DBPassword: generatedPassword, Ip: ip, PrivateIP: addresses.PrivateIP, PublicIP: addresses.PublicIP, Addresses: addresses.All, AddressError: addresses.Error}
 				/* sending callback request */
 				fmt.Println("sending callback request")
-				shared.CallbackFunction(callbackUrl, returnParams)
+				deliverWhenReady(serverid, callbackUrl, returnParams)
 				return
 			}
 			if server.Status == "ERROR" {
+				updateStackStatus(serverid, "ERROR")
 				return
 			}
 			time.Sleep(3 * time.Second)
 		}
-	}(server.ID, claims.Username)
+		failProvisioning(serverid)
+	}(server.ID)
 
 	m.SetBody(server)
 }
@@ -189,13 +219,19 @@ func (m *BBXController) Create() {
 // FlavorBBX ...
 // @Title FlavorBBX
 // @Description hint FlavorBBX
+// @Param	region	query	string	false	"region tag"
+// @Param	min_cpu	query	int	false	"minimum vcpus"
+// @Param	max_cpu	query	int	false	"maximum vcpus"
+// @Param	min_ram	query	int	false	"minimum ram in MB"
+// @Param	max_ram	query	int	false	"maximum ram in MB"
+// @Param	sort	query	string	false	"name, cpu, ram, price or available"
+// @Param	order	query	string	false	"asc or desc"
 // @Failure 403
 // @router /list [get]
 func (m *BBXController) FlavorBBX() {
 
 	claims := m.Claim()
 
-	var mainRes []flavors.Flavor
 	defer func() {
 		if r := recover(); r != nil {
 			m.RespondPanic(r)
@@ -204,18 +240,5 @@ func (m *BBXController) FlavorBBX() {
 		}
 	}()
 
-	pAccess := flavors.AllAccess
-	listFlavors, err := compute.GetCompute(claims.Username).ListFlavors(pAccess)
-	if err != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), claims.UserID)
-		return
-	}
-	for _, c := range listFlavors {
-		if strings.Contains(c.Name, "BBX") {
-			mainRes = append(mainRes, c)
-		}
-
-	}
-
-	m.SetBody(mainRes)
+	respondCatalogFlavors(&m.BaseController, claims, "bbx")
 }
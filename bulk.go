@@ -0,0 +1,160 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/orm"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// JobBulkAction is the kind of jobs running a lifecycle action over many stacks
+const JobBulkAction = "bulk-action"
+
+// BulkActionParams selects the stacks either by server id or by project, stack type and region tag
+type BulkActionParams struct {
+	Action    string   `json:"action" bind:"required"`
+	IDs       []string `json:"ids"`
+	ProjectID string   `json:"project_id"`
+	Type      string   `json:"type"`
+	Tag       string   `json:"tag"`
+}
+
+// selectStacks returns the user's stacks matched by the params and the ids that matched none
+func (p BulkActionParams) selectStacks(osUserID string) ([]Stack, []string, error) {
+	if len(p.IDs) == 0 && len(p.ProjectID) == 0 && len(p.Type) == 0 && len(p.Tag) == 0 {
+		return nil, nil, fmt.Errorf("ids or a selector of project_id, type or tag is required")
+	}
+
+	o := orm.NewOrm()
+	query := o.QueryTable(new(Stack)).Filter("os_user_id", osUserID)
+	if len(p.IDs) > 0 {
+		query = query.Filter("server_id__in", p.IDs)
+	}
+	if len(p.ProjectID) > 0 {
+		query = query.Filter("project_id", p.ProjectID)
+	}
+	if len(p.Type) > 0 {
+		query = query.Filter("type", p.Type)
+	}
+	if len(p.Tag) > 0 {
+		query = query.Filter("region", p.Tag)
+	}
+	var stacks []Stack
+	if _, err := query.OrderBy("id").All(&stacks); err != nil {
+		return nil, nil, err
+	}
+
+	missing := []string{}
+	for _, id := range p.IDs {
+		found := false
+		for _, stack := range stacks {
+			if stack.ServerID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, id)
+		}
+	}
+	return stacks, missing, nil
+}
+
+// runBulkAction runs the action on every pending item with bounded concurrency
+func runBulkAction(job *Job, claims shared.Claims, clientIP string, stacks map[string]Stack, items []JobItem) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("Bulk action panicked", job.ID, r)
+		}
+		finishJob(job.ID)
+	}()
+	setJobStatus(job.ID, JobRunning)
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, beego.AppConfig.DefaultInt("bulk.action.concurrency", 5))
+	for i := range items {
+		item := &items[i]
+		if item.Status != JobItemPending {
+			continue
+		}
+		stack := stacks[item.ResourceID]
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			// every stack runs with a session of its own project and region
+			session, err := stackSession(claims, clientIP, &stack, RoleAdmin)
+			if err == nil {
+				_, err = RunStackAction(session.Actor, session.Region, stack.ServerID, job.Action)
+			}
+			if err != nil {
+				setJobItem(item, JobItemFailed, err)
+				return
+			}
+			setJobItem(item, JobItemSucceeded, nil)
+		}()
+	}
+	wg.Wait()
+}
+
+// BulkAction ...
+// @Title BulkAction
+// @Description run a lifecycle action on many stacks, the result is fetched from the returned job
+// @Param	body	body	thirtdparty.BulkActionParams	true	"body for bulk action"
+// @Failure 403
+// @router /bulk/action [post]
+func (m *StackController) BulkAction() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params BulkActionParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	params.Action = strings.ToLower(params.Action)
+	if _, ok := lifecycleActions[params.Action]; !ok {
+		err := fmt.Errorf("unknown action %q, supported actions are %s", params.Action, strings.Join(LifecycleActionNames(), ", "))
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	stacks, missing, err := params.selectStacks(claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if len(stacks) == 0 {
+		m.SetError(helper.StatusMissingParams, "no stacks matched", "no stacks matched", claims.UserID)
+		return
+	}
+
+	byServer := map[string]Stack{}
+	items := []JobItem{}
+	for _, stack := range stacks {
+		byServer[stack.ServerID] = stack
+		items = append(items, JobItem{ResourceID: stack.ServerID, Name: stack.Name})
+	}
+	for _, id := range missing {
+		items = append(items, JobItem{ResourceID: id, Status: JobItemSkipped, Message: "stack not found"})
+	}
+
+	actor := ActorFromClaims(claims, m.GetClientIP())
+	job, err := newJob(JobBulkAction, params.Action, actor, params, items)
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	go runBulkAction(job, claims, m.GetClientIP(), byServer, items)
+	m.SetBody(job)
+}
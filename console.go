@@ -0,0 +1,159 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/remoteconsoles"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+	"gitlab.com/ics-project/back-thirdparty/service"
+)
+
+// defaultConsoleTail is the number of trailing log lines returned when none are requested
+const defaultConsoleTail = 200
+
+// consoleTypes maps the requested console type to its nova protocol and type
+var consoleTypes = map[string]remoteconsoles.CreateOpts{
+	"novnc": {Protocol: remoteconsoles.ConsoleProtocolVNC, Type: remoteconsoles.ConsoleTypeNoVNC},
+	"spice": {Protocol: remoteconsoles.ConsoleProtocolSPICE, Type: remoteconsoles.ConsoleTypeSPICEHTML5},
+}
+
+// ConsoleLog is the tail of the serial console log of a server
+type ConsoleLog struct {
+	ServerID string   `json:"serverId"`
+	Tail     int      `json:"tail"`
+	Lines    []string `json:"lines"`
+}
+
+// RemoteConsole is a console URL that stops working once it expires.
+// Nova does not report when the token expires, ExpiresAt is estimated from console.token.ttl
+// and is only right while the setting matches the consoleauth token_ttl of nova.
+type RemoteConsole struct {
+	ServerID  string    `json:"serverId"`
+	Type      string    `json:"type"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ConsoleLog ...
+// @Title ConsoleLog
+// @Description tail of the serial console log of the stack's server
+// @Param	id	query	string	true	"server id"
+// @Param	tail	query	int	false	"number of trailing lines"
+// @Failure 403
+// @router /console/log [get]
+func (m *StackController) ConsoleLog() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	stack, err := GetProjectStack(claims, m.GetString("id"), RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	maxTail := beego.AppConfig.DefaultInt("console.log.max.lines", 2000)
+	tail, err := m.GetInt("tail", defaultConsoleTail)
+	if err != nil || tail <= 0 {
+		err := fmt.Errorf("tail must be a positive number")
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if tail > maxTail {
+		tail = maxTail
+	}
+
+	session, err := stackSession(claims, m.GetClientIP(), stack, RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	computeClient, err := session.Compute()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	output, err := servers.ShowConsoleOutput(computeClient, stack.ServerID, servers.ShowConsoleOutputOpts{Length: tail}).Extract()
+	service.CreateLogAction(stack.ServerID, "Instance", stack.Name, "ConsoleLog", claims.UserID, err)
+	if err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	// nova counts lines itself, trim again in case the log did not end with a newline
+	if len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+	m.SetBody(ConsoleLog{ServerID: stack.ServerID, Tail: tail, Lines: lines})
+}
+
+// Console ...
+// @Title Console
+// @Description time limited noVNC or SPICE console URL of the stack's server
+// @Param	id	query	string	true	"server id"
+// @Param	type	query	string	false	"novnc or spice"
+// @Failure 403
+// @router /console [get]
+func (m *StackController) Console() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	stack, err := GetProjectStack(claims, m.GetString("id"), RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	consoleType := m.GetString("type", "novnc")
+	opts, ok := consoleTypes[consoleType]
+	if !ok {
+		err := fmt.Errorf("unknown console type %q", consoleType)
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	session, err := stackSession(claims, m.GetClientIP(), stack, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	computeClient, err := session.Compute()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	// remote consoles were added in microversion 2.6
+	computeClient.Microversion = "2.6"
+
+	console, err := remoteconsoles.Create(computeClient, stack.ServerID, opts).Extract()
+	service.CreateLogAction(stack.ServerID, "Instance", stack.Name, "Console", claims.UserID, err)
+	if err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	// nova expires the console token after its token_ttl, console.token.ttl mirrors it
+	ttl := beego.AppConfig.DefaultInt("console.token.ttl", 600)
+	m.SetBody(RemoteConsole{
+		ServerID:  stack.ServerID,
+		Type:      consoleType,
+		URL:       console.URL,
+		ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second),
+	})
+}
@@ -0,0 +1,298 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/orm"
+	"github.com/astaxie/beego/toolbox"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+)
+
+// legacyFlavorSuffix names the per request flavors iFinance created before they were reused
+const legacyFlavorSuffix = "_ifinance"
+
+// CustomFlavor is a private flavor made for an iFinance size no catalog flavor offers
+type CustomFlavor struct {
+	ID         uint32    `orm:"column(id);auto;pk" json:"id"`
+	Region     string    `orm:"column(region);size(64)" json:"region"`
+	FlavorID   string    `orm:"column(flavor_id);size(64);index" json:"flavorId"`
+	Name       string    `orm:"column(name);size(255)" json:"name"`
+	VCPUs      int       `orm:"column(vcpus)" json:"vcpus"`
+	RAM        int       `orm:"column(ram)" json:"ram"`
+	Disk       int       `orm:"column(disk)" json:"disk"`
+	LastUsedAt time.Time `orm:"column(last_used_at);type(datetime)" json:"lastUsedAt"`
+	CreatedAt  time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+}
+
+// TableName ...
+func (t *CustomFlavor) TableName() string {
+	return "custom_flavors"
+}
+
+// CustomFlavorAccess records that a project was granted a custom flavor, so the flavors of a
+// project are listed without asking nova for the access list of every flavor
+type CustomFlavorAccess struct {
+	ID        uint32    `orm:"column(id);auto;pk" json:"id"`
+	FlavorID  string    `orm:"column(flavor_id);size(64);index" json:"flavorId"`
+	ProjectID string    `orm:"column(project_id);size(64);index" json:"projectId"`
+	CreatedAt time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+}
+
+// TableName ...
+func (t *CustomFlavorAccess) TableName() string {
+	return "custom_flavor_accesses"
+}
+
+// recordFlavorAccess stores the grant of the flavor to the project once
+func recordFlavorAccess(flavorID, projectID string) {
+	o := orm.NewOrm()
+	access := CustomFlavorAccess{FlavorID: flavorID, ProjectID: projectID}
+	if _, _, err := o.ReadOrCreate(&access, "FlavorID", "ProjectID"); err != nil {
+		fmt.Println("Failed recording access to custom flavor", flavorID, projectID, err)
+	}
+}
+
+// syncFlavorAccesses replaces the recorded grants of the flavor with the ones nova has,
+// which also adopts the grants made before they were recorded
+func syncFlavorAccesses(client *gophercloud.ServiceClient, flavorID string) error {
+	allPages, err := flavors.ListAccesses(client, flavorID).AllPages()
+	if err != nil {
+		return err
+	}
+	accesses, err := flavors.ExtractAccesses(allPages)
+	if err != nil {
+		return err
+	}
+	o := orm.NewOrm()
+	granted := []string{}
+	for _, access := range accesses {
+		granted = append(granted, access.TenantID)
+		recordFlavorAccess(flavorID, access.TenantID)
+	}
+	query := o.QueryTable(new(CustomFlavorAccess)).Filter("flavor_id", flavorID)
+	if len(granted) > 0 {
+		query = query.Exclude("project_id__in", granted)
+	}
+	_, err = query.Delete()
+	return err
+}
+
+func init() {
+	orm.RegisterModel(new(CustomFlavor), new(CustomFlavorAccess))
+	beego.AddAPPStartHook(startFlavorReaper)
+}
+
+// flavorSizeLocks keep concurrent requests for the same size from creating two flavors, and the
+// reaper from deleting a flavor while it is handed out. Requests for other sizes do not wait.
+var (
+	flavorSizeLocksMu sync.Mutex
+	flavorSizeLocks   = map[string]*sync.Mutex{}
+)
+
+// lockFlavorSize locks the size in the region and returns the unlock
+func lockFlavorSize(region string, vcpus, ram, disk int) func() {
+	key := fmt.Sprintf("%s/%d/%d/%d", region, vcpus, ram, disk)
+	flavorSizeLocksMu.Lock()
+	mu, ok := flavorSizeLocks[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		flavorSizeLocks[key] = mu
+	}
+	flavorSizeLocksMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// customFlavor returns the private flavor of the size, creating it once per region,
+// and grants the project access to it
+func customFlavor(region shared.CloudRegion, projectID string, vcpus, ram, disk int) (*flavors.Flavor, error) {
+	provider, err := region.AdminProvider()
+	if err != nil {
+		return nil, err
+	}
+	client, err := region.ComputeClient(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	defer lockFlavorSize(region.Tag, vcpus, ram, disk)()
+
+	o := orm.NewOrm()
+	record := CustomFlavor{}
+	var flavor *flavors.Flavor
+	err = o.QueryTable(new(CustomFlavor)).Filter("region", region.Tag).Filter("vcpus", vcpus).Filter("ram", ram).Filter("disk", disk).OrderBy("id").One(&record)
+	if err == nil {
+		flavor, err = flavors.Get(client, record.FlavorID).Extract()
+		if _, gone := err.(gophercloud.ErrDefault404); gone {
+			o.Delete(&record)
+			record = CustomFlavor{}
+			err = nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if flavor == nil {
+		isPublic := false
+		name := fmt.Sprintf("ifinance-%dc-%dm-%dg", vcpus, ram, disk)
+		flavor, err = flavors.Create(client, flavors.CreateOpts{
+			Name:       name,
+			VCPUs:      vcpus,
+			RAM:        ram,
+			Disk:       &disk,
+			RxTxFactor: 1.0,
+			IsPublic:   &isPublic,
+		}).Extract()
+		if err != nil {
+			return nil, err
+		}
+		record = CustomFlavor{Region: region.Tag, FlavorID: flavor.ID, Name: name, VCPUs: vcpus, RAM: ram, Disk: disk}
+	}
+
+	if len(projectID) > 0 {
+		_, err = flavors.AddAccess(client, flavor.ID, flavors.AddAccessOpts{Tenant: projectID}).Extract()
+		// nova answers 409 when the project already has access
+		if _, granted := err.(gophercloud.ErrDefault409); err != nil && !granted {
+			return nil, err
+		}
+		recordFlavorAccess(flavor.ID, projectID)
+	}
+
+	record.LastUsedAt = time.Now()
+	if record.ID == 0 {
+		_, err = o.Insert(&record)
+	} else {
+		_, err = o.Update(&record, "last_used_at")
+	}
+	if err != nil {
+		fmt.Println("Failed recording custom flavor", flavor.ID, err)
+	}
+	return flavor, nil
+}
+
+// startFlavorReaper schedules the removal of idle custom flavors once the application has started
+func startFlavorReaper() error {
+	spec := beego.AppConfig.DefaultString("flavor.reaper.schedule", "0 30 3 * * *")
+	task, err := newScheduledTask("custom-flavor-reaper", spec, func() error {
+		for _, region := range shared.Regions() {
+			if err := reapCustomFlavors(region); err != nil {
+				fmt.Println("Failed reaping custom flavors of", region.Tag, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	toolbox.AddTask("custom-flavor-reaper", task)
+	toolbox.StartTask()
+	return nil
+}
+
+// flavorsInUse returns the flavors of every server of the region, shelved ones included
+func flavorsInUse(client *gophercloud.ServiceClient) (map[string]bool, error) {
+	allPages, err := servers.List(client, servers.ListOpts{AllTenants: true}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	list, err := servers.ExtractServers(allPages)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, server := range list {
+		if id, ok := server.Flavor["id"].(string); ok {
+			used[id] = true
+		}
+	}
+	return used, nil
+}
+
+// reapCustomFlavors deletes the custom flavors of the region no server has used for flavor.reaper.idle.days.
+// The per request flavors made before custom flavors were reused are adopted and reaped the same way.
+func reapCustomFlavors(region shared.CloudRegion) error {
+	provider, err := region.AdminProvider()
+	if err != nil {
+		return err
+	}
+	client, err := region.ComputeClient(provider)
+	if err != nil {
+		return err
+	}
+
+	used, err := flavorsInUse(client)
+	if err != nil {
+		return err
+	}
+
+	o := orm.NewOrm()
+	var records []CustomFlavor
+	if _, err := o.QueryTable(new(CustomFlavor)).Filter("region", region.Tag).All(&records); err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, record := range records {
+		known[record.FlavorID] = true
+	}
+
+	allPages, err := flavors.ListDetail(client, flavors.ListOpts{AccessType: flavors.PrivateAccess}).AllPages()
+	if err != nil {
+		return err
+	}
+	private, err := flavors.ExtractFlavors(allPages)
+	if err != nil {
+		return err
+	}
+	for _, flavor := range private {
+		if known[flavor.ID] || !strings.HasSuffix(flavor.Name, legacyFlavorSuffix) {
+			continue
+		}
+		record := CustomFlavor{Region: region.Tag, FlavorID: flavor.ID, Name: flavor.Name, VCPUs: flavor.VCPUs, RAM: flavor.RAM, Disk: flavor.Disk, LastUsedAt: time.Now()}
+		if _, err := o.Insert(&record); err == nil {
+			records = append(records, record)
+		}
+	}
+
+	idle := time.Duration(beego.AppConfig.DefaultInt("flavor.reaper.idle.days", 7)) * 24 * time.Hour
+	for i := range records {
+		reapCustomFlavor(client, &records[i], used[records[i].FlavorID], idle)
+	}
+	return nil
+}
+
+// reapCustomFlavor syncs the grants of the flavor and deletes it when it has been idle too long.
+// Only the flavor's size is locked, and the record is read again under it since a request
+// may have handed the flavor out after the servers were listed.
+func reapCustomFlavor(client *gophercloud.ServiceClient, record *CustomFlavor, used bool, idle time.Duration) {
+	defer lockFlavorSize(record.Region, record.VCPUs, record.RAM, record.Disk)()
+
+	o := orm.NewOrm()
+	if err := o.Read(record); err != nil {
+		return
+	}
+	if err := syncFlavorAccesses(client, record.FlavorID); err != nil {
+		fmt.Println("Failed reading access to custom flavor", record.FlavorID, err)
+	}
+	if used {
+		record.LastUsedAt = time.Now()
+		o.Update(record, "last_used_at")
+		return
+	}
+	if time.Since(record.LastUsedAt) < idle {
+		return
+	}
+	err := flavors.Delete(client, record.FlavorID).ExtractErr()
+	if _, gone := err.(gophercloud.ErrDefault404); err != nil && !gone {
+		fmt.Println("Failed deleting custom flavor", record.FlavorID, err)
+		return
+	}
+	o.Delete(record)
+	o.QueryTable(new(CustomFlavorAccess)).Filter("flavor_id", record.FlavorID).Delete()
+}
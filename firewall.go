@@ -0,0 +1,321 @@
+package thirtdparty
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+// FirewallRule is a single security group rule requested for a stack
+type FirewallRule struct {
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name"`
+	Protocol  string `json:"protocol"`
+	Port      int    `json:"port"`
+	PortMin   int    `json:"portMin"`
+	PortMax   int    `json:"portMax"`
+	Direction string `json:"direction"`
+	Source    string `json:"source"`
+	EtherType string `json:"etherType,omitempty"`
+	// ICMPType and ICMPCode select the icmp messages of an icmp rule, nil matches any.
+	// Pointers because type 0 is echo reply.
+	ICMPType *int `json:"icmpType,omitempty"`
+	ICMPCode *int `json:"icmpCode,omitempty"`
+}
+
+// FirewallRuleError describes why a requested rule was rejected
+type FirewallRuleError struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// Normalize fills the defaults of a rule: tcp, ingress and single port. The source is never defaulted,
+// a rule open to everyone must say 0.0.0.0/0.
+func (r *FirewallRule) Normalize() {
+	r.Protocol = strings.ToLower(strings.TrimSpace(r.Protocol))
+	if r.Protocol == "" {
+		r.Protocol = "tcp"
+	}
+	r.Direction = strings.ToLower(strings.TrimSpace(r.Direction))
+	if r.Direction == "" {
+		r.Direction = "ingress"
+	}
+	if r.Protocol == "icmp" {
+		// earlier clients sent the icmp type and code as the port range
+		if r.ICMPType == nil && r.PortMin > 0 {
+			icmpType := r.PortMin
+			r.ICMPType = &icmpType
+		}
+		if r.ICMPCode == nil && r.PortMax > 0 {
+			icmpCode := r.PortMax
+			r.ICMPCode = &icmpCode
+		}
+		r.Port, r.PortMin, r.PortMax = 0, 0, 0
+	}
+	if r.PortMin == 0 && r.PortMax == 0 && r.Port > 0 {
+		r.PortMin = r.Port
+		r.PortMax = r.Port
+	}
+	if r.PortMax == 0 {
+		r.PortMax = r.PortMin
+	}
+	r.Source = strings.TrimSpace(r.Source)
+	// a bare address means the host itself
+	if !strings.Contains(r.Source, "/") {
+		if ip := net.ParseIP(r.Source); ip != nil {
+			if ip.To4() != nil {
+				r.Source += "/32"
+			} else {
+				r.Source += "/128"
+			}
+		}
+	}
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		r.Name = r.defaultName()
+	}
+}
+
+func (r *FirewallRule) defaultName() string {
+	if r.Protocol == "icmp" {
+		if r.ICMPType != nil {
+			return fmt.Sprintf("icmp-%d-%s", *r.ICMPType, r.Direction)
+		}
+		return fmt.Sprintf("icmp-%s", r.Direction)
+	}
+	if r.PortMin == r.PortMax {
+		return fmt.Sprintf("%s-%d", r.Protocol, r.PortMin)
+	}
+	return fmt.Sprintf("%s-%d-%d", r.Protocol, r.PortMin, r.PortMax)
+}
+
+// Validate checks protocol, port range, direction and source CIDR of a normalized rule
+func (r *FirewallRule) Validate() error {
+	switch r.Protocol {
+	case "tcp", "udp":
+		if r.PortMin < 1 || r.PortMin > 65535 || r.PortMax < 1 || r.PortMax > 65535 {
+			return fmt.Errorf("port range %d-%d is out of 1-65535", r.PortMin, r.PortMax)
+		}
+		if r.PortMin > r.PortMax {
+			return fmt.Errorf("port range %d-%d is reversed", r.PortMin, r.PortMax)
+		}
+	case "icmp":
+		if r.ICMPType != nil && (*r.ICMPType < 0 || *r.ICMPType > 255) {
+			return fmt.Errorf("icmp type %d is out of 0-255", *r.ICMPType)
+		}
+		if r.ICMPCode != nil {
+			if r.ICMPType == nil {
+				return errors.New("icmp code requires an icmp type")
+			}
+			if *r.ICMPCode < 0 || *r.ICMPCode > 255 {
+				return fmt.Errorf("icmp code %d is out of 0-255", *r.ICMPCode)
+			}
+		}
+	default:
+		return fmt.Errorf("protocol %q is not supported, use tcp, udp or icmp", r.Protocol)
+	}
+
+	if r.Direction != "ingress" && r.Direction != "egress" {
+		return fmt.Errorf("direction %q is not supported, use ingress or egress", r.Direction)
+	}
+
+	if r.Source == "" {
+		return errors.New("source is required, use 0.0.0.0/0 to allow any address")
+	}
+	ip, _, err := net.ParseCIDR(r.Source)
+	if err != nil {
+		return fmt.Errorf("source %q is not a valid IPv4 or IPv6 CIDR", r.Source)
+	}
+	if ip.To4() != nil {
+		r.EtherType = string(rules.EtherType4)
+	} else {
+		r.EtherType = string(rules.EtherType6)
+	}
+
+	if len(r.Name) > 255 {
+		return errors.New("name is longer than 255 characters")
+	}
+	return nil
+}
+
+// ValidateFirewallRules normalizes every rule and returns the rejected ones
+func ValidateFirewallRules(firewallRules []FirewallRule) []FirewallRuleError {
+	var ruleErrors []FirewallRuleError
+	for i := range firewallRules {
+		firewallRules[i].Normalize()
+		if err := firewallRules[i].Validate(); err != nil {
+			ruleErrors = append(ruleErrors, FirewallRuleError{Index: i, Name: firewallRules[i].Name, Error: err.Error()})
+		}
+	}
+	return ruleErrors
+}
+
+// ruleCreateOpts sends the icmp type and code even when they are 0, which rules.CreateOpts omits
+type ruleCreateOpts struct {
+	rules.CreateOpts
+	icmpType *int
+	icmpCode *int
+}
+
+// ToSecGroupRuleCreateMap ...
+func (opts ruleCreateOpts) ToSecGroupRuleCreateMap() (map[string]interface{}, error) {
+	b, err := opts.CreateOpts.ToSecGroupRuleCreateMap()
+	if err != nil {
+		return nil, err
+	}
+	rule := b["security_group_rule"].(map[string]interface{})
+	if opts.icmpType != nil {
+		rule["port_range_min"] = *opts.icmpType
+	}
+	if opts.icmpCode != nil {
+		rule["port_range_max"] = *opts.icmpCode
+	}
+	return b, nil
+}
+
+// ApplyFirewallRules creates validated rules in the security group. Rules that already exist are kept.
+func ApplyFirewallRules(client *gophercloud.ServiceClient, secGroupID string, firewallRules []FirewallRule) []FirewallRuleError {
+	var ruleErrors []FirewallRuleError
+	for i, r := range firewallRules {
+		opts := ruleCreateOpts{CreateOpts: rules.CreateOpts{
+			Direction:      rules.RuleDirection(r.Direction),
+			Description:    r.Name,
+			EtherType:      rules.RuleEtherType(r.EtherType),
+			SecGroupID:     secGroupID,
+			Protocol:       rules.RuleProtocol(r.Protocol),
+			RemoteIPPrefix: r.Source,
+		}}
+		if r.Protocol == "icmp" {
+			opts.icmpType = r.ICMPType
+			opts.icmpCode = r.ICMPCode
+		} else {
+			opts.PortRangeMin = r.PortMin
+			opts.PortRangeMax = r.PortMax
+		}
+		created, err := rules.Create(client, opts).Extract()
+		if err != nil {
+			if _, ok := err.(gophercloud.ErrDefault409); ok {
+				continue
+			}
+			ruleErrors = append(ruleErrors, FirewallRuleError{Index: i, Name: r.Name, Error: err.Error()})
+			continue
+		}
+		firewallRules[i].ID = created.ID
+	}
+	return ruleErrors
+}
+
+// ListFirewallRules returns the rules of the security group in request form
+func ListFirewallRules(client *gophercloud.ServiceClient, secGroupID string) ([]FirewallRule, error) {
+	allPages, err := rules.List(client, rules.ListOpts{SecGroupID: secGroupID}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	secGroupRules, err := rules.ExtractRules(allPages)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]FirewallRule, 0, len(secGroupRules))
+	for _, r := range secGroupRules {
+		rule := FirewallRule{
+			ID:        r.ID,
+			Name:      r.Description,
+			Protocol:  r.Protocol,
+			PortMin:   r.PortRangeMin,
+			PortMax:   r.PortRangeMax,
+			Direction: r.Direction,
+			Source:    r.RemoteIPPrefix,
+			EtherType: r.EtherType,
+		}
+		if r.Protocol == "icmp" {
+			// neutron reports an unset type as 0 too, so a listed type 0 may mean any
+			icmpType, icmpCode := r.PortRangeMin, r.PortRangeMax
+			rule.ICMPType, rule.ICMPCode = &icmpType, &icmpCode
+			rule.PortMin, rule.PortMax = 0, 0
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+// DeleteFirewallRules removes rules by id and returns the ones that failed
+func DeleteFirewallRules(client *gophercloud.ServiceClient, ruleIDs []string) []FirewallRuleError {
+	var ruleErrors []FirewallRuleError
+	for i, id := range ruleIDs {
+		if err := rules.Delete(client, id).ExtractErr(); err != nil {
+			if _, ok := err.(gophercloud.ErrDefault404); ok {
+				continue
+			}
+			ruleErrors = append(ruleErrors, FirewallRuleError{Index: i, Name: id, Error: err.Error()})
+		}
+	}
+	return ruleErrors
+}
+
+// stackPorts are the ports each stack type opens. Rules without a source are opened to the partner's allowed IP only.
+var stackPorts = map[string][]FirewallRule{
+	"bbx": {
+		{Name: "psql", Port: 5432},
+		{Name: "bbx-admin", Port: 8081},
+		{Name: "bbx-core", Port: 8082},
+		{Name: "bbx-scheduler", Port: 8083},
+		{Name: "bbx-uaa", Port: 8084},
+	},
+	"lambda": {
+		{Name: "mysql", Port: 3306},
+		{Name: "app", Port: 8080},
+		{Name: "http", Port: 80, Source: "0.0.0.0/0"},
+		{Name: "https", Port: 443, Source: "0.0.0.0/0"},
+	},
+	"lambda-php": {
+		{Name: "web server", Port: 80, Source: "0.0.0.0/0"},
+		{Name: "mysql", Port: 3306},
+		{Name: "app", Port: 8080},
+		{Name: "https", Port: 443, Source: "0.0.0.0/0"},
+	},
+	"scs": {
+		{Name: "psql", Port: 8080},
+		{Name: "psql", Port: 9990},
+		{Name: "psql", Port: 8282},
+		{Name: "psql", Port: 7077},
+		{Name: "psql", Port: 5432},
+		{Name: "psql", Port: 6060},
+		{Name: "public", Port: 80, Source: "0.0.0.0/0"},
+		{Name: "public", Port: 443, Source: "0.0.0.0/0"},
+	},
+}
+
+// stackFirewallRules returns the validated rules a stack type opens in the default security group.
+// A stack with ports for the partner needs a valid allowed IP, it is never widened to any address.
+func stackFirewallRules(stackType, allowedIP string) ([]FirewallRule, error) {
+	result := []FirewallRule{}
+	for _, rule := range stackPorts[stackType] {
+		if rule.Source == "" {
+			rule.Source = allowedIP
+		}
+		rule.Normalize()
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("%s rule %s: %v", stackType, rule.Name, err)
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+// applyStackFirewall opens the ports of the stack type in the security group
+func applyStackFirewall(client *gophercloud.ServiceClient, secGroupID, stackType, allowedIP string) error {
+	firewallRules, err := stackFirewallRules(stackType, allowedIP)
+	if err != nil {
+		return err
+	}
+	if ruleErrors := ApplyFirewallRules(client, secGroupID, firewallRules); len(ruleErrors) > 0 {
+		return fmt.Errorf("failed creating %s firewall rule %s: %s", stackType, ruleErrors[0].Name, ruleErrors[0].Error)
+	}
+	return nil
+}
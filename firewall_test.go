@@ -0,0 +1,191 @@
+package thirtdparty
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+)
+
+func intPointer(value int) *int {
+	return &value
+}
+
+func TestFirewallRuleNormalize(t *testing.T) {
+	cases := []struct {
+		name string
+		rule FirewallRule
+		want FirewallRule
+	}{
+		{
+			"defaults",
+			FirewallRule{Port: 8080, Source: "10.0.0.0/8"},
+			FirewallRule{Name: "tcp-8080", Protocol: "tcp", PortMin: 8080, PortMax: 8080, Direction: "ingress", Port: 8080, Source: "10.0.0.0/8"},
+		},
+		{
+			"range and case",
+			FirewallRule{Name: " app ", Protocol: " UDP ", Direction: "Egress", PortMin: 5000, Source: " 0.0.0.0/0 "},
+			FirewallRule{Name: "app", Protocol: "udp", PortMin: 5000, PortMax: 5000, Direction: "egress", Source: "0.0.0.0/0"},
+		},
+		{
+			"bare addresses are hosts",
+			FirewallRule{Port: 22, Source: "203.0.113.7"},
+			FirewallRule{Name: "tcp-22", Protocol: "tcp", Port: 22, PortMin: 22, PortMax: 22, Direction: "ingress", Source: "203.0.113.7/32"},
+		},
+		{
+			"bare IPv6 address",
+			FirewallRule{Port: 22, Source: "2001:db8::1"},
+			FirewallRule{Name: "tcp-22", Protocol: "tcp", Port: 22, PortMin: 22, PortMax: 22, Direction: "ingress", Source: "2001:db8::1/128"},
+		},
+		{
+			"source is never defaulted",
+			FirewallRule{Port: 22},
+			FirewallRule{Name: "tcp-22", Protocol: "tcp", Port: 22, PortMin: 22, PortMax: 22, Direction: "ingress"},
+		},
+	}
+	for _, c := range cases {
+		rule := c.rule
+		rule.Normalize()
+		if rule != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, rule, c.want)
+		}
+	}
+}
+
+func TestFirewallRuleNormalizeICMP(t *testing.T) {
+	cases := []struct {
+		name     string
+		rule     FirewallRule
+		icmpType *int
+		icmpCode *int
+		ruleName string
+	}{
+		{"any message", FirewallRule{Protocol: "icmp", Source: "0.0.0.0/0"}, nil, nil, "icmp-ingress"},
+		{"echo reply is type 0", FirewallRule{Protocol: "icmp", ICMPType: intPointer(0), Source: "0.0.0.0/0"}, intPointer(0), nil, "icmp-0-ingress"},
+		{"type and code", FirewallRule{Protocol: "icmp", ICMPType: intPointer(3), ICMPCode: intPointer(0), Source: "0.0.0.0/0"}, intPointer(3), intPointer(0), "icmp-3-ingress"},
+		{"legacy port range", FirewallRule{Protocol: "icmp", PortMin: 8, PortMax: 1, Source: "0.0.0.0/0"}, intPointer(8), intPointer(1), "icmp-8-ingress"},
+	}
+	for _, c := range cases {
+		rule := c.rule
+		rule.Normalize()
+		if !sameIntPointer(rule.ICMPType, c.icmpType) || !sameIntPointer(rule.ICMPCode, c.icmpCode) {
+			t.Errorf("%s: got type %v code %v", c.name, rule.ICMPType, rule.ICMPCode)
+		}
+		if rule.Port != 0 || rule.PortMin != 0 || rule.PortMax != 0 {
+			t.Errorf("%s: icmp rule keeps ports %d %d-%d", c.name, rule.Port, rule.PortMin, rule.PortMax)
+		}
+		if rule.Name != c.ruleName {
+			t.Errorf("%s: got name %s, want %s", c.name, rule.Name, c.ruleName)
+		}
+	}
+}
+
+func sameIntPointer(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func TestFirewallRuleValidate(t *testing.T) {
+	cases := []struct {
+		name      string
+		rule      FirewallRule
+		want      string
+		etherType string
+	}{
+		{"tcp", FirewallRule{Port: 443, Source: "0.0.0.0/0"}, "", string(rules.EtherType4)},
+		{"IPv6 source", FirewallRule{Port: 443, Source: "2001:db8::/32"}, "", string(rules.EtherType6)},
+		{"missing source", FirewallRule{Port: 443}, "source is required, use 0.0.0.0/0 to allow any address", ""},
+		{"invalid source", FirewallRule{Port: 443, Source: "10.0.0.0/33"}, `source "10.0.0.0/33" is not a valid IPv4 or IPv6 CIDR`, ""},
+		{"no port", FirewallRule{Source: "0.0.0.0/0"}, "port range 0-0 is out of 1-65535", ""},
+		{"port too high", FirewallRule{Port: 70000, Source: "0.0.0.0/0"}, "port range 70000-70000 is out of 1-65535", ""},
+		{"reversed range", FirewallRule{PortMin: 9000, PortMax: 8000, Source: "0.0.0.0/0"}, "port range 9000-8000 is reversed", ""},
+		{"unknown protocol", FirewallRule{Protocol: "gre", Source: "0.0.0.0/0"}, `protocol "gre" is not supported, use tcp, udp or icmp`, ""},
+		{"unknown direction", FirewallRule{Port: 80, Direction: "inbound", Source: "0.0.0.0/0"}, `direction "inbound" is not supported, use ingress or egress`, ""},
+		{"icmp type 0", FirewallRule{Protocol: "icmp", ICMPType: intPointer(0), ICMPCode: intPointer(0), Source: "0.0.0.0/0"}, "", string(rules.EtherType4)},
+		{"icmp type out of range", FirewallRule{Protocol: "icmp", ICMPType: intPointer(256), Source: "0.0.0.0/0"}, "icmp type 256 is out of 0-255", ""},
+		{"icmp code without type", FirewallRule{Protocol: "icmp", ICMPCode: intPointer(0), Source: "0.0.0.0/0"}, "icmp code requires an icmp type", ""},
+	}
+	for _, c := range cases {
+		rule := c.rule
+		rule.Normalize()
+		got := ""
+		if err := rule.Validate(); err != nil {
+			got = err.Error()
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+		if c.want == "" && rule.EtherType != c.etherType {
+			t.Errorf("%s: got ether type %s, want %s", c.name, rule.EtherType, c.etherType)
+		}
+	}
+}
+
+func TestValidateFirewallRules(t *testing.T) {
+	firewallRules := []FirewallRule{
+		{Port: 80, Source: "0.0.0.0/0"},
+		{Name: "db", Port: 5432},
+		{Protocol: "icmp", ICMPType: intPointer(0), Source: "0.0.0.0/0"},
+	}
+	ruleErrors := ValidateFirewallRules(firewallRules)
+	if len(ruleErrors) != 1 || ruleErrors[0].Index != 1 || ruleErrors[0].Name != "db" {
+		t.Fatalf("got %+v, want only the rule without a source rejected", ruleErrors)
+	}
+	if firewallRules[0].PortMin != 80 || firewallRules[0].Protocol != "tcp" {
+		t.Errorf("rules are not normalized in place: %+v", firewallRules[0])
+	}
+}
+
+func TestRuleCreateOptsSendsICMPTypeZero(t *testing.T) {
+	opts := ruleCreateOpts{
+		CreateOpts: rules.CreateOpts{
+			Direction:      rules.DirIngress,
+			EtherType:      rules.EtherType4,
+			SecGroupID:     "group",
+			Protocol:       rules.ProtocolICMP,
+			RemoteIPPrefix: "0.0.0.0/0",
+		},
+		icmpType: intPointer(0),
+		icmpCode: intPointer(0),
+	}
+	body, err := opts.ToSecGroupRuleCreateMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := body["security_group_rule"].(map[string]interface{})
+	if rule["port_range_min"] != 0 || rule["port_range_max"] != 0 {
+		t.Errorf("icmp type and code 0 must be sent, got %v", rule)
+	}
+
+	opts.icmpType, opts.icmpCode = nil, nil
+	body, err = opts.ToSecGroupRuleCreateMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule = body["security_group_rule"].(map[string]interface{})
+	if _, ok := rule["port_range_min"]; ok {
+		t.Errorf("an icmp rule for any message must not send a type, got %v", rule)
+	}
+}
+
+func TestStackFirewallRules(t *testing.T) {
+	firewallRules, err := stackFirewallRules("lambda", "198.51.100.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := map[string]string{}
+	for _, rule := range firewallRules {
+		sources[rule.Name] = rule.Source
+	}
+	if sources["mysql"] != "198.51.100.4/32" || sources["http"] != "0.0.0.0/0" {
+		t.Errorf("got sources %v", sources)
+	}
+
+	if _, err := stackFirewallRules("lambda", ""); err == nil {
+		t.Errorf("partner ports without an allowed IP must be rejected")
+	}
+	if _, err := stackFirewallRules("bbx", "not an address"); err == nil {
+		t.Errorf("an invalid allowed IP must be rejected")
+	}
+}
@@ -0,0 +1,349 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/hypervisors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// Extra specs that map a flavor to stack types without a catalog row
+const (
+	specStackTypes     = "ics:stack_types"
+	specDisplayName    = "ics:display_name"
+	specPricePerHour   = "ics:price_per_hour"
+	specRecommendedUse = "ics:recommended_use"
+)
+
+// legacyFlavorMarkers are the name markers stacks were matched by before the catalog,
+// used only for a stack type that neither the catalog nor any extra spec maps in the region
+var legacyFlavorMarkers = map[string]string{
+	"bbx":        "BBX",
+	"lambda":     "Lambda",
+	"lambda-php": "Lambda",
+	"ifinance":   "cloud",
+	"scs":        "IFinance",
+}
+
+// FlavorCatalog offers a flavor to a stack type. An empty region applies to every region,
+// a hidden row withdraws the flavor without deleting its price.
+type FlavorCatalog struct {
+	ID             uint32  `orm:"column(id);auto;pk" json:"id"`
+	Region         string  `orm:"column(region);size(64);null" json:"region"`
+	FlavorID       string  `orm:"column(flavor_id);size(64);index" json:"flavorId"`
+	StackType      string  `orm:"column(stack_type);size(32);index" json:"stackType"`
+	DisplayName    string  `orm:"column(display_name);size(255);null" json:"displayName"`
+	PricePerHour   float64 `orm:"column(price_per_hour);digits(12);decimals(4)" json:"pricePerHour"`
+	RecommendedUse string  `orm:"column(recommended_use);size(512);null" json:"recommendedUse"`
+	SortOrder      int     `orm:"column(sort_order)" json:"sortOrder"`
+	Hidden         bool    `orm:"column(hidden)" json:"hidden"`
+}
+
+// TableName ...
+func (t *FlavorCatalog) TableName() string {
+	return "flavor_catalog"
+}
+
+func init() {
+	orm.RegisterModel(new(FlavorCatalog))
+}
+
+// CatalogFlavor is a flavor offered to a stack type with its price and the capacity left for it
+type CatalogFlavor struct {
+	RegionFlavor
+	StackType      string  `json:"stackType"`
+	DisplayName    string  `json:"displayName"`
+	PricePerHour   float64 `json:"pricePerHour"`
+	RecommendedUse string  `json:"recommendedUse"`
+	SortOrder      int     `json:"sortOrder"`
+	Available      int     `json:"available"`
+}
+
+type flavorWithSpecs struct {
+	flavors.Flavor
+	ExtraSpecs map[string]string `json:"extra_specs"`
+}
+
+// listFlavorsWithSpecs lists the flavors of the region together with their extra specs
+func listFlavorsWithSpecs(client *gophercloud.ServiceClient) ([]flavorWithSpecs, error) {
+	// extra specs are part of the flavor list from microversion 2.61
+	specClient := *client
+	specClient.Microversion = "2.61"
+	allPages, err := flavors.ListDetail(&specClient, flavors.ListOpts{AccessType: flavors.AllAccess}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	var list []flavorWithSpecs
+	err = flavors.ExtractFlavorsInto(allPages, &list)
+	return list, err
+}
+
+func specHasStackType(specs map[string]string, stackType string) bool {
+	for _, value := range strings.Split(specs[specStackTypes], ",") {
+		if strings.TrimSpace(value) == stackType {
+			return true
+		}
+	}
+	return false
+}
+
+// regionCatalogFlavors returns the flavors of the region offered to the stack type.
+// Catalog rows take precedence over extra specs, hidden rows hide a flavor.
+func regionCatalogFlavors(client *gophercloud.ServiceClient, region, stackType string) ([]CatalogFlavor, error) {
+	list, err := listFlavorsWithSpecs(client)
+	if err != nil {
+		return nil, err
+	}
+
+	o := orm.NewOrm()
+	var rows []FlavorCatalog
+	cond := orm.NewCondition().Or("region", region).Or("region", "").Or("region__isnull", true)
+	if _, err := o.QueryTable(new(FlavorCatalog)).Filter("stack_type", stackType).SetCond(cond).All(&rows); err != nil {
+		return nil, err
+	}
+	catalog := map[string]FlavorCatalog{}
+	for _, row := range rows {
+		// a row of the region overrides the one of every region
+		if existing, ok := catalog[row.FlavorID]; ok && len(existing.Region) > 0 {
+			continue
+		}
+		catalog[row.FlavorID] = row
+	}
+
+	result := []CatalogFlavor{}
+	for _, f := range list {
+		item := CatalogFlavor{RegionFlavor: RegionFlavor{Flavor: f.Flavor, Region: region}, StackType: stackType, DisplayName: f.Name, Available: -1}
+		if row, ok := catalog[f.ID]; ok {
+			if row.Hidden {
+				continue
+			}
+			if len(row.DisplayName) > 0 {
+				item.DisplayName = row.DisplayName
+			}
+			item.PricePerHour = row.PricePerHour
+			item.RecommendedUse = row.RecommendedUse
+			item.SortOrder = row.SortOrder
+		} else if specHasStackType(f.ExtraSpecs, stackType) {
+			if name := f.ExtraSpecs[specDisplayName]; len(name) > 0 {
+				item.DisplayName = name
+			}
+			item.PricePerHour, _ = strconv.ParseFloat(f.ExtraSpecs[specPricePerHour], 64)
+			item.RecommendedUse = f.ExtraSpecs[specRecommendedUse]
+		} else {
+			continue
+		}
+		result = append(result, item)
+	}
+
+	if marker, ok := legacyFlavorMarkers[stackType]; ok && len(result) == 0 {
+		for _, f := range list {
+			if strings.Contains(f.Name, marker) {
+				result = append(result, CatalogFlavor{RegionFlavor: RegionFlavor{Flavor: f.Flavor, Region: region}, StackType: stackType, DisplayName: f.Name, Available: -1})
+			}
+		}
+	}
+	return result, nil
+}
+
+// stackFlavorMatch returns the filter of the flavors the stack type may use in the region
+func stackFlavorMatch(client *gophercloud.ServiceClient, region, stackType string) (func(flavors.Flavor) bool, error) {
+	offered, err := regionCatalogFlavors(client, region, stackType)
+	if err != nil {
+		return nil, err
+	}
+	if len(offered) == 0 {
+		return nil, fmt.Errorf("no flavors are offered for %s stacks", stackType)
+	}
+	allowed := map[string]bool{}
+	for _, f := range offered {
+		allowed[f.ID] = true
+	}
+	return func(f flavors.Flavor) bool {
+		return allowed[f.ID]
+	}, nil
+}
+
+// regionCapacity is the free compute of a region, allocation ratios applied
+type regionCapacity struct {
+	vcpus     int
+	ram       int
+	checkedAt time.Time
+}
+
+var (
+	capacityMu    sync.Mutex
+	capacityCache = map[string]regionCapacity{}
+)
+
+// freeCapacity returns the free vcpus and RAM of the region, cached for a minute
+func freeCapacity(region shared.CloudRegion) (regionCapacity, error) {
+	capacityMu.Lock()
+	defer capacityMu.Unlock()
+	if cached, ok := capacityCache[region.Tag]; ok && time.Since(cached.checkedAt) < time.Minute {
+		return cached, nil
+	}
+
+	provider, err := region.AdminProvider()
+	if err != nil {
+		return regionCapacity{}, err
+	}
+	client, err := region.ComputeClient(provider)
+	if err != nil {
+		return regionCapacity{}, err
+	}
+	stats, err := hypervisors.GetStatistics(client).Extract()
+	if err != nil {
+		return regionCapacity{}, err
+	}
+	cpuRatio := beego.AppConfig.DefaultFloat("capacity.cpu.allocation.ratio", 4)
+	ramRatio := beego.AppConfig.DefaultFloat("capacity.ram.allocation.ratio", 1)
+	capacity := regionCapacity{
+		vcpus:     int(float64(stats.VCPUs)*cpuRatio) - stats.VCPUsUsed,
+		ram:       int(float64(stats.MemoryMB)*ramRatio) - stats.MemoryMBUsed,
+		checkedAt: time.Now(),
+	}
+	capacityCache[region.Tag] = capacity
+	return capacity, nil
+}
+
+// available estimates how many more servers of the flavor fit in the capacity
+func (c regionCapacity) available(f flavors.Flavor) int {
+	if f.VCPUs <= 0 || f.RAM <= 0 {
+		return -1
+	}
+	count := c.vcpus / f.VCPUs
+	if byRAM := c.ram / f.RAM; byRAM < count {
+		count = byRAM
+	}
+	if count < 0 {
+		return 0
+	}
+	return count
+}
+
+// FlavorQuery filters and sorts catalog flavors, RAM is in MB and zero bounds are ignored
+type FlavorQuery struct {
+	Region string
+	MinCPU int
+	MaxCPU int
+	MinRAM int
+	MaxRAM int
+	Sort   string
+	Desc   bool
+}
+
+// flavorQuery reads the filter and sort query parameters of a flavor list request
+func flavorQuery(c *shared.BaseController) FlavorQuery {
+	query := FlavorQuery{
+		Region: c.GetString("region"),
+		Sort:   c.GetString("sort"),
+		Desc:   strings.EqualFold(c.GetString("order"), "desc"),
+	}
+	query.MinCPU, _ = c.GetInt("min_cpu", 0)
+	query.MaxCPU, _ = c.GetInt("max_cpu", 0)
+	query.MinRAM, _ = c.GetInt("min_ram", 0)
+	query.MaxRAM, _ = c.GetInt("max_ram", 0)
+	return query
+}
+
+func (q FlavorQuery) accepts(f CatalogFlavor) bool {
+	return (q.MinCPU == 0 || f.VCPUs >= q.MinCPU) &&
+		(q.MaxCPU == 0 || f.VCPUs <= q.MaxCPU) &&
+		(q.MinRAM == 0 || f.RAM >= q.MinRAM) &&
+		(q.MaxRAM == 0 || f.RAM <= q.MaxRAM)
+}
+
+func (q FlavorQuery) less(a, b CatalogFlavor) bool {
+	switch q.Sort {
+	case "cpu":
+		return a.VCPUs < b.VCPUs
+	case "ram":
+		return a.RAM < b.RAM
+	case "price":
+		return a.PricePerHour < b.PricePerHour
+	case "available":
+		return a.Available < b.Available
+	case "name":
+		return a.DisplayName < b.DisplayName
+	}
+	if a.SortOrder != b.SortOrder {
+		return a.SortOrder < b.SortOrder
+	}
+	return a.PricePerHour < b.PricePerHour
+}
+
+// listCatalogFlavors aggregates the catalog flavors of the stack type over the regions, each read
+// with the service account of its own cloud. A region that cannot be reached is skipped unless every region fails.
+func listCatalogFlavors(stackType string, query FlavorQuery) ([]CatalogFlavor, error) {
+	regions := shared.DistinctRegions()
+	if len(query.Region) > 0 {
+		region, err := shared.GetRegion(query.Region)
+		if err != nil {
+			return nil, err
+		}
+		regions = []shared.CloudRegion{region}
+	}
+
+	result := []CatalogFlavor{}
+	var lastErr error
+	reached := 0
+	for _, region := range regions {
+		provider, err := region.AdminProvider()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		client, err := region.ComputeClient(provider)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		offered, err := regionCatalogFlavors(client, region.Tag, stackType)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		capacity, capacityErr := freeCapacity(region)
+		for _, f := range offered {
+			if !query.accepts(f) {
+				continue
+			}
+			if capacityErr == nil {
+				f.Available = capacity.available(f.Flavor)
+			}
+			result = append(result, f)
+		}
+		reached++
+	}
+	if reached == 0 && lastErr != nil {
+		return nil, fmt.Errorf("failed listing flavors: %v", lastErr)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if query.Desc {
+			return query.less(result[j], result[i])
+		}
+		return query.less(result[i], result[j])
+	})
+	return result, nil
+}
+
+// respondCatalogFlavors answers a flavor list request of the stack type
+func respondCatalogFlavors(c *shared.BaseController, claims shared.Claims, stackType string) {
+	list, err := listCatalogFlavors(stackType, flavorQuery(c))
+	if err != nil {
+		c.SetError(helper.StatusError, helper.StatusText(helper.StatusError), err.Error(), claims.UserID)
+		return
+	}
+	c.SetBody(list)
+}
@@ -0,0 +1,329 @@
+package thirtdparty
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/orm"
+	"github.com/astaxie/beego/toolbox"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// Health statuses of a stack
+const (
+	HealthUnknown   = "UNKNOWN"
+	HealthHealthy   = "HEALTHY"
+	HealthUnhealthy = "UNHEALTHY"
+)
+
+// probeTimeout bounds a single probe
+const probeTimeout = 5 * time.Second
+
+// probeConcurrency is the number of stacks probed at the same time
+const probeConcurrency = 10
+
+// HealthProbe is one check of a stack's application.
+// Kind is http, https, tcp or tls. An http probe without ExpectStatus accepts anything below 500.
+type HealthProbe struct {
+	Name         string `json:"name"`
+	Kind         string `json:"kind"`
+	Port         int    `json:"port"`
+	Path         string `json:"path,omitempty"`
+	ExpectStatus int    `json:"expectStatus,omitempty"`
+}
+
+// probeSource is the address the API host probes stacks from, health.probe.source in app.conf
+func probeSource() net.IP {
+	return net.ParseIP(beego.AppConfig.String("health.probe.source"))
+}
+
+// reachableProbes keeps the probes whose port is open to the API host. A port the stack type's
+// firewall rules do not cover is served from security groups the stack brings itself.
+func reachableProbes(probes []HealthProbe, rules []FirewallRule, source net.IP) []HealthProbe {
+	result := []HealthProbe{}
+	for _, probe := range probes {
+		covered, open := false, false
+		for _, rule := range rules {
+			if rule.Protocol != "tcp" || rule.Direction != "ingress" || probe.Port < rule.PortMin || probe.Port > rule.PortMax {
+				continue
+			}
+			covered = true
+			_, network, err := net.ParseCIDR(rule.Source)
+			if err != nil {
+				continue
+			}
+			if ones, _ := network.Mask.Size(); ones == 0 || (source != nil && network.Contains(source)) {
+				open = true
+			}
+		}
+		if !covered || open {
+			result = append(result, probe)
+		}
+	}
+	return result
+}
+
+// declareProbes returns the stored form of the probes of the stack the API host can reach
+func declareProbes(stack *Stack) string {
+	rules, err := stackFirewallRules(stack.Type, stack.AllowedIP)
+	if err != nil {
+		rules = nil
+	}
+	probes := reachableProbes(stack.HealthProbes, rules, probeSource())
+	if len(probes) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(probes)
+	return string(data)
+}
+
+// DeclaredProbes returns the probes stored with the stack
+func (t *Stack) DeclaredProbes() []HealthProbe {
+	probes := []HealthProbe{}
+	if len(t.Probes) > 0 {
+		if err := json.Unmarshal([]byte(t.Probes), &probes); err != nil {
+			fmt.Println("Failed reading probes of", t.ServerID, err)
+		}
+	}
+	return probes
+}
+
+// StackHealth is the result of one probe run against a stack
+type StackHealth struct {
+	ID        uint32    `orm:"column(id);auto;pk" json:"id"`
+	StackID   uint32    `orm:"column(stack_id);index" json:"stackId"`
+	ServerID  string    `orm:"column(server_id);size(64);index" json:"serverId"`
+	Probe     string    `orm:"column(probe);size(64)" json:"probe"`
+	Target    string    `orm:"column(target);size(255)" json:"target"`
+	Healthy   bool      `orm:"column(healthy)" json:"healthy"`
+	Latency   int64     `orm:"column(latency)" json:"latency"`
+	Message   string    `orm:"column(message);size(1024);null" json:"message"`
+	CheckedAt time.Time `orm:"column(checked_at);type(datetime);index" json:"checkedAt"`
+}
+
+// TableName ...
+func (t *StackHealth) TableName() string {
+	return "stack_health"
+}
+
+func init() {
+	orm.RegisterModel(new(StackHealth))
+	beego.AddAPPStartHook(startHealthProbes)
+}
+
+// startHealthProbes schedules the probe run once the application has started
+func startHealthProbes() error {
+	spec := beego.AppConfig.DefaultString("health.probe.schedule", "0 */5 * * * *")
+	task, err := newScheduledTask("stack-health", spec, func() error {
+		probeStacks()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	toolbox.AddTask("stack-health", task)
+	toolbox.StartTask()
+	return nil
+}
+
+// probeTarget returns the public address the stack's probes connect to and the name its certificate is for.
+// A stack on a private network has no public address and is not probed.
+func probeTarget(stack *Stack) (string, string) {
+	host := stack.StoredAddresses().PublicIP
+	serverName := ""
+	if domainStacks[stack.Type] {
+		serverName = stack.Name
+	}
+	return host, serverName
+}
+
+// runProbe checks a single probe and returns an error describing why it failed
+func runProbe(probe HealthProbe, host, serverName string) error {
+	address := net.JoinHostPort(host, strconv.Itoa(probe.Port))
+	switch probe.Kind {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", address, probeTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "tls":
+		config := &tls.Config{ServerName: serverName, InsecureSkipVerify: len(serverName) == 0}
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: probeTimeout}, "tcp", address, config)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http", "https":
+		hostHeader := host
+		if len(serverName) > 0 {
+			hostHeader = serverName
+		}
+		client := &http.Client{
+			Timeout: probeTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: len(serverName) == 0},
+			},
+		}
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s%s", probe.Kind, address, probe.Path), nil)
+		if err != nil {
+			return err
+		}
+		req.Host = hostHeader
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if probe.ExpectStatus > 0 && resp.StatusCode != probe.ExpectStatus {
+			return fmt.Errorf("expected status %d, got %d", probe.ExpectStatus, resp.StatusCode)
+		}
+		if probe.ExpectStatus == 0 && resp.StatusCode >= 500 {
+			return fmt.Errorf("got status %d", resp.StatusCode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown probe kind %q", probe.Kind)
+}
+
+// probeStack runs every probe of the stack, stores the results and updates its health status
+func probeStack(stack *Stack) {
+	probes := stack.DeclaredProbes()
+	host, serverName := probeTarget(stack)
+	if len(probes) == 0 || len(host) == 0 {
+		return
+	}
+	o := orm.NewOrm()
+
+	healthy := true
+	failures := []string{}
+	for _, probe := range probes {
+		started := time.Now()
+		err := runProbe(probe, host, serverName)
+		result := StackHealth{
+			StackID:   stack.ID,
+			ServerID:  stack.ServerID,
+			Probe:     probe.Name,
+			Target:    fmt.Sprintf("%s %s:%d%s", probe.Kind, host, probe.Port, probe.Path),
+			Healthy:   err == nil,
+			Latency:   int64(time.Since(started) / time.Millisecond),
+			CheckedAt: started,
+		}
+		if err != nil {
+			healthy = false
+			result.Message = err.Error()
+			failures = append(failures, fmt.Sprintf("%s: %s", probe.Name, err.Error()))
+		}
+		if _, err := o.Insert(&result); err != nil {
+			fmt.Println("Failed storing health of", stack.ServerID, err)
+		}
+	}
+
+	status := HealthHealthy
+	if !healthy {
+		status = HealthUnhealthy
+	}
+	o.QueryTable(new(Stack)).Filter("server_id", stack.ServerID).Update(orm.Params{
+		"health_status":     status,
+		"health_checked_at": time.Now(),
+	})
+
+	if status == HealthUnhealthy && stack.HealthStatus != HealthUnhealthy {
+		notif := fmt.Sprintf("%s %s is unhealthy: %v", stack.Type, stack.Name, failures)
+		shared.SendPushNotificationToUser(stack.OsUserID, "Stack unhealthy", notif, stack.ProjectID, "", nil)
+	}
+}
+
+// probeStacks probes every running stack that declares probes and prunes old history
+func probeStacks() {
+	o := orm.NewOrm()
+	var stacks []Stack
+	_, err := o.QueryTable(new(Stack)).Filter("probes__isnull", false).Exclude("probes", "").Filter("status__in", "ACTIVE", StackReady).All(&stacks)
+	if err != nil {
+		fmt.Println("Failed listing stacks to probe", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, probeConcurrency)
+	for i := range stacks {
+		stack := &stacks[i]
+		// stacks that phone home are still provisioning until they report READY
+		if len(stack.PhoneHomeToken) > 0 && stack.Status != StackReady {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			probeStack(stack)
+		}()
+	}
+	wg.Wait()
+
+	days := beego.AppConfig.DefaultInt("health.history.days", 7)
+	o.QueryTable(new(StackHealth)).Filter("checked_at__lt", time.Now().AddDate(0, 0, -days)).Delete()
+}
+
+// StackHealthDetail is the health status of a stack with its latest probe results
+type StackHealthDetail struct {
+	ServerID  string        `json:"serverId"`
+	Status    string        `json:"status"`
+	CheckedAt time.Time     `json:"checkedAt"`
+	Probes    []HealthProbe `json:"probes"`
+	History   []StackHealth `json:"history"`
+}
+
+// Health ...
+// @Title Health
+// @Description health status and probe history of the stack
+// @Param	id	query	string	true	"server id"
+// @Param	limit	query	int	false	"number of history entries"
+// @Failure 403
+// @router /health [get]
+func (m *StackController) Health() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	stack, err := GetProjectStack(claims, m.GetString("id"), RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	limit, err := m.GetInt("limit", 50)
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+
+	detail := StackHealthDetail{
+		ServerID:  stack.ServerID,
+		Status:    stack.HealthStatus,
+		CheckedAt: stack.HealthCheckedAt,
+		Probes:    stack.DeclaredProbes(),
+		History:   []StackHealth{},
+	}
+	if len(detail.Status) == 0 {
+		detail.Status = HealthUnknown
+	}
+	o := orm.NewOrm()
+	if _, err := o.QueryTable(new(StackHealth)).Filter("server_id", stack.ServerID).OrderBy("-id").Limit(limit).All(&detail.History); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(detail)
+}
@@ -0,0 +1,47 @@
+package thirtdparty
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReachableProbes(t *testing.T) {
+	probes := []HealthProbe{
+		{Name: "web", Kind: "http", Port: 80},
+		{Name: "admin", Kind: "https", Port: 8443},
+		{Name: "db", Kind: "tcp", Port: 5432},
+		{Name: "app", Kind: "tcp", Port: 9000},
+	}
+	rules := []FirewallRule{
+		{Protocol: "tcp", Direction: "ingress", PortMin: 80, PortMax: 80, Source: "0.0.0.0/0"},
+		{Protocol: "tcp", Direction: "ingress", PortMin: 8443, PortMax: 8443, Source: "10.1.0.0/16"},
+		{Protocol: "tcp", Direction: "ingress", PortMin: 5432, PortMax: 5432, Source: "192.168.0.0/24"},
+		{Protocol: "udp", Direction: "ingress", PortMin: 9000, PortMax: 9000, Source: "192.168.0.0/24"},
+	}
+	cases := []struct {
+		name   string
+		source net.IP
+		want   []string
+	}{
+		// app is only covered by a udp rule, so the stack opens it with groups of its own
+		{"inside the admin range", net.ParseIP("10.1.2.3"), []string{"web", "admin", "app"}},
+		{"outside every range", net.ParseIP("172.16.0.1"), []string{"web", "app"}},
+		{"no source configured", nil, []string{"web", "app"}},
+	}
+	for _, c := range cases {
+		got := []string{}
+		for _, probe := range reachableProbes(probes, rules, c.source) {
+			got = append(got, probe.Name)
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+				break
+			}
+		}
+	}
+}
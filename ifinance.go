@@ -5,19 +5,12 @@ import (
 	"strings"
 	"time"
 
-	"github.com/astaxie/beego/orm"
 	"github.com/gophercloud/gophercloud"
-	"github.com/gophercloud/gophercloud/openstack"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
-	"github.com/gophercloud/gophercloud/openstack/compute/v2/images"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 
 	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
 	"gitlab.com/ics-project/back-thirdparty/helper"
-	"gitlab.com/ics-project/back-thirdparty/integration/blockstorage"
-	"gitlab.com/ics-project/back-thirdparty/integration/compute"
-	"gitlab.com/ics-project/back-thirdparty/integration/networking"
-	"gitlab.com/ics-project/back-thirdparty/integration/project"
 	"gitlab.com/ics-project/back-thirdparty/models"
 	"gitlab.com/ics-project/back-thirdparty/service"
 	"gitlab.com/ics-project/back-thirdparty/utils"
@@ -34,6 +27,8 @@ func (m *IFinanceController) URLMapping() {
 	m.Mapping("Action", m.Action)
 	m.Mapping("List", m.Flavors)
 	m.Mapping("Images", m.Images)
+	m.Mapping("Rules", m.Rules)
+	m.Mapping("UpdateRules", m.UpdateRules)
 	//    m.Mapping("Update", m.Update)
 }
 
@@ -59,34 +54,27 @@ func (m *IFinanceController) Create() {
 			m.Respond()
 		}
 	}()
-	type PortParams struct {
-		Port   int    `json:"port"`
-		Source string `json:"source"`
-		Name   string `json:"name"`
-	}
 	type Env struct {
 		Key   string `json:"key"`
 		Value string `json:"value"`
 	}
-	type IP_config struct {
-		IP_address int 	`json:"IP_address"`
-		controller 
-	}
 	// RequestedParams ...
 	type RequestedParams struct {
-		ID          string       `json:"requestId" bind:"required"`
-		Name        string       `json:"name" bind:"required"`
-		ProjectId   string       `json:"projectId" bind:"required"`
-		CallbackUrl string       `json:"callbackUrl" bind:"required"`
-		Image       string       `json:"imageImage"`
-		FlavorID    string       `json:"flavorId"`
-		CPU         int          `json:"cpu"`
-		RAM         float64      `json:"ram"`
-		Disk        int          `json:"disk"`
-		IsNew       bool         `json:"isNew"`
-		IsHDD       bool         `json:"isHDD"`
-		Ports       []PortParams `json:"ports"`
-		Env         []Env        `json:"env"`
+		ID          string         `json:"requestId" bind:"required"`
+		Name        string         `json:"name" bind:"required"`
+		ProjectId   string         `json:"projectId" bind:"required"`
+		CallbackUrl string         `json:"callbackUrl" bind:"required"`
+		Image       string         `json:"imageImage"`
+		FlavorID    string         `json:"flavorId"`
+		CPU         int            `json:"cpu"`
+		RAM         float64        `json:"ram"`
+		Disk        int            `json:"disk"`
+		IsNew       bool           `json:"isNew"`
+		IsHDD       bool           `json:"isHDD"`
+		Region      string         `json:"region"`
+		Ports       []FirewallRule `json:"ports"`
+		Env         []Env          `json:"env"`
+		StackNetworkParams
 	}
 
 	// [{ port: 8081, allowed_ip: "192.168.0.1" },{ port: 8081, allowed_ip: "192.168.0.1" },{ port: 8081, allowed_ip: "192.168.0.1" }]
@@ -97,16 +85,35 @@ func (m *IFinanceController) Create() {
 	}
 	params.IsHDD = true
 
-	// login to project
-	project.SetCurrentStack(claims.Email, params.ProjectId, "CLOUD.MN", claims.OsUserID, "", "")
-	stack := project.GetCurrentStack(claims.Email)
+	if ruleErrors := ValidateFirewallRules(params.Ports); len(ruleErrors) > 0 {
+		m.SetErrorWithBody(helper.StatusMissingParams, ruleErrors, "Invalid firewall rules", "Invalid firewall rules", claims.UserID)
+		return
+	}
+
+	region, err := resolveRegion(params.ProjectId, params.Region)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
 
-	if stack.IsICS {
-		m.SetError(helper.StatusError, "Failed login to project", "Failed login to project", claims.UserID)
-		fmt.Println("Failed login to project. ")
+	// login to project
+	session, err := newStackSession(claims, m.GetClientIP(), params.ProjectId, region, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusError, "Failed login to project: "+err.Error(), err.Error(), claims.UserID)
 		return
 	}
-	fmt.Println("\n✅✅✅ Successfully logged into the project: ", stack.ProjectID, stack.Tag)
+	// the project's defaults fill what the request leaves out
+	defaults := projectDefaults(params.ProjectId, region)
+	if len(params.FlavorID) == 0 && params.CPU == 0 && params.RAM == 0 {
+		params.FlavorID = defaults.DefaultFlavorID
+	}
+	if len(params.Image) == 0 {
+		params.Image = defaults.DefaultImageID
+	}
+	if len(params.NetworkID) == 0 {
+		params.NetworkID = defaults.DefaultNetworkID
+	}
+
 	// create instance
 
 	diskSize := 30
@@ -118,31 +125,43 @@ func (m *IFinanceController) Create() {
 		diskSize = params.Disk
 	}
 
+	imageID := region.Image("3thparty", models.GetConfig("3thparty_image"))
+	if params.IsNew {
+		imageID = region.Image("ifinance_new", models.GetConfig("image_ifinance_new"))
+	}
+	if len(params.Image) > 0 {
+		imageID = params.Image
+	}
+
+	if session.quotaRejected(&m.BaseController, QuotaRequest{FlavorID: flavorID, VCPUs: params.CPU, RAM: int(params.RAM * 1024), Disk: diskSize, Volumes: 1, FloatingIPs: floatingIPCount(params.StackNetworkParams)}) {
+		return
+	}
+	if session.imageRejected(&m.BaseController, "ifinance", imageID, flavorID, int(params.RAM*1024), diskSize) {
+		return
+	}
+
 	/* find default security group */
-	securityGroupList, err := compute.GetCompute(claims.Username).ListSecGroups()
+	defaultGroup, err := session.defaultSecurityGroup()
 	if err != nil {
-		m.SetError(helper.StatusMissingParams, "Failed fetching security group list", "Failed fetching security group list", fmt.Sprintf("ifinance-%v", claims.UserID))
-		fmt.Println("Failed fetching security group list")
-	}
-	var sgIDs []interface{}
-	for _, secGroup := range securityGroupList {
-		if secGroup.Name == "default" {
-			for _, port := range params.Ports {
-				networking.GetNetworking(claims.Username).CreateSecGroupRule("ingres", "", secGroup.ID, port.Name, port.Port, port.Port, "tcp", port.Source)
-			}
-			sgIDs = append(sgIDs, secGroup.Name)
-		}
+		m.SetError(helper.StatusMissingParams, "Failed fetching security group list", err.Error(), fmt.Sprintf("ifinance-%v", claims.UserID))
+		return
 	}
-
-	networkID := ""
-	imageID := models.GetConfig("3thparty_image")
-	if params.IsNew {
-		imageID = models.GetConfig("image_ifinance_new")
+	networkClient, err := session.Network()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
 	}
-	secGroup := make([]string, len(sgIDs))
-	for i, v := range sgIDs {
-		secGroup[i] = fmt.Sprint(v)
+	if ruleErrors := ApplyFirewallRules(networkClient, defaultGroup.ID, params.Ports); len(ruleErrors) > 0 {
+		m.SetErrorWithBody(helper.StatusError, ruleErrors, "Failed creating firewall rules", "Failed creating firewall rules", claims.UserID)
+		return
+	}
+
+	networkID, err := resolveStackNetwork(session.Provider(), region, params.StackNetworkParams, params.Name)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
 	}
+	secGroup := []string{defaultGroup.Name}
 	userData, err := models.GetCloudInitByName(client)
 	if err != nil {
 		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), client)
@@ -175,97 +194,116 @@ func (m *IFinanceController) Create() {
 	output := strings.Join(lines, "\n")
 	fmt.Println(output)
 
-	scripted := []byte(output)
+	phoneHomeToken := newPhoneHomeToken()
+	scripted := withPhoneHome([]byte(output), phoneHomeToken)
 
 	if len(params.FlavorID) == 0 {
-		provider1, _ := shared.AuthOSAdmin()
-		clientAdmin, err := openstack.NewComputeV2(provider1, gophercloud.EndpointOpts{
-			Region: "RegionOne",
-		})
+		// custom sizes share one private flavor per region instead of one per request
+		flavor, err := customFlavor(region, params.ProjectId, params.CPU, int(params.RAM*1024), diskSize)
 		if err != nil {
 			m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
 			return
 		}
-		flavor, err := compute.GetCompute(claims.Username).CreateFlavor(clientAdmin, id+"_ifinance", diskSize, int(params.RAM)*1024, params.CPU, 1.0, true)
 		flavorID = flavor.ID
 		diskSize = flavor.Disk
+	}
+	serverOpts := stackServerOpts{
+		Name:           params.Name,
+		ImageID:        imageID,
+		FlavorID:       flavorID,
+		NetworkID:      networkID,
+		DiskSize:       diskSize,
+		SecurityGroups: secGroup,
+		UserData:       scripted,
+	}
+	if !params.IsHDD {
+		volume, err := session.createVolumeFromImage(params.Name, "ssd", imageID, diskSize)
 		if err != nil {
 			m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
 			return
 		}
+		serverOpts.VolumeID = volume.ID
 	}
-	var server *servers.Server
-	var errServer error
-	if !params.IsHDD {
-		volume, err1 := blockstorage.GetBlockstorage(claims.Username).CreateVolumeFromImage(diskSize, fmt.Sprintf("%s-volume", params.Name), fmt.Sprintf("%s is volume", params.Name), "ssd", imageID)
-		if err1 != nil {
-			m.SetError(helper.StatusError, errServer.Error(), errServer.Error(), claims.UserID)
-			return
-		}
-		blockstorage.GetBlockstorage(claims.Username).WaitVolumeStat(volume.ID, "Available")
-		server, errServer = compute.GetCompute(claims.Username).CreateServerForSSDVolume(volume.ID, params.Name, flavorID, "", diskSize, secGroup, scripted, "nova", true, networkID)
-		if errServer != nil {
-			m.SetError(helper.StatusError, errServer.Error(), errServer.Error(), claims.UserID)
-			return
-		}
-
-	} else {
-		server, errServer = compute.GetCompute(claims.Username).CreateServerForVolume(imageID, params.Name, flavorID, "", diskSize, secGroup, scripted, "nova", true, networkID)
-
-		if errServer != nil {
-			m.SetError(helper.StatusError, errServer.Error(), errServer.Error(), claims.UserID)
-			return
-		}
+	server, errServer := session.bootServer(serverOpts)
+	if errServer != nil {
+		m.SetError(helper.StatusError, errServer.Error(), errServer.Error(), claims.UserID)
+		return
 	}
 	service.CreateLogAction(server.ID, "ifinance", id, "Create", claims.UserID, err)
-	_, errGetFlavor := compute.GetCompute(claims.Username).GetFlavor(flavorID, "CLOUD.MN")
-	if errGetFlavor != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("ifinance-%v", claims.UserID))
+	recordStack(&Stack{
+		Type:            "ifinance",
+		RequestID:       id,
+		Name:            params.Name,
+		ServerID:        server.ID,
+		ProjectID:       params.ProjectId,
+		Region:          region.Tag,
+		SysUserID:       claims.SysUserID,
+		OsUserID:        claims.OsUserID,
+		FlavorID:        flavorID,
+		ImageID:         imageID,
+		NetworkID:       networkID,
+		DiskSize:        diskSize,
+		TemplateVersion: templateVersion([]byte(userData.YML)),
+		PhoneHomeToken:  phoneHomeHash(phoneHomeToken),
+	})
+	if len(phoneHomeToken) > 0 {
+		watchPhoneHome(server.ID, phoneHomeDeadline())
+	}
+	computeClient, err := session.Compute()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if _, errGetFlavor := flavors.Get(computeClient, flavorID).Extract(); errGetFlavor != nil {
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errGetFlavor.Error(), fmt.Sprintf("ifinance-%v", claims.UserID))
 		return
 	}
 
-	go func(serverid string, username string) {
-		provider := service.GetProvider(username)
-		for {
-			server, _ := servers.Get(service.GetClientCompute(provider), serverid).Extract()
+	go func(serverid string) {
+		deadline := time.Now().Add(provisionDeadline())
+		for time.Now().Before(deadline) {
+			server, err := servers.Get(computeClient, serverid).Extract()
+			if err != nil {
+				time.Sleep(3 * time.Second)
+				continue
+			}
 			if server.Status == "ACTIVE" {
-				var ip string
-				if server.Addresses["public-1"] != nil {
-					for _, l := range server.Addresses["public-1"].([]interface{}) {
-						tmp := l.(map[string]interface{})
-						ip = tmp["addr"].(string)
-					}
+				addresses, err := resolveStackAddresses(session.Provider(), region, server, networkID, params.StackNetworkParams)
+				if err != nil {
+					addresses.Error = err.Error()
 				}
-				if server.Addresses["public-2"] != nil {
-					for _, l := range server.Addresses["public-2"].([]interface{}) {
-						tmp := l.(map[string]interface{})
-						ip = tmp["addr"].(string)
+				ip := addresses.Primary
+				updateStackAddresses(serverid, "ACTIVE", addresses)
 
-					}
-				}
 				type ReturnParams struct {
-					ID           string `json:"requestId"`
-					DBName       string `json:"databaseName"`
-					DBUsername   string `json:"databaseUser"`
-					DBPassword   string `json:"databasePwd"`
-					SSHName1     string `json:"sshName1"`
-					SSHPassword1 string `json:"sshPassword1"`
-					SSHName2     string `json:"sshName2"`
-					SSHPassword2 string `json:"sshPassword2"`
-					Ip           string `json:"databaseUrl"`
+					ID           string          `json:"requestId"`
+					DBName       string          `json:"databaseName"`
+					DBUsername   string          `json:"databaseUser"`
+					DBPassword   string          `json:"databasePwd"`
+					SSHName1     string          `json:"sshName1"`
+					SSHPassword1 string          `json:"sshPassword1"`
+					SSHName2     string          `json:"sshName2"`
+					SSHPassword2 string          `json:"sshPassword2"`
+					Ip           string          `json:"databaseUrl"`
+					PrivateIP    string          `json:"privateIp"`
+					PublicIP     string          `json:"publicIp"`
+					Addresses    []ServerAddress `json:"addresses"`
+					AddressError string          `json:"addressError,omitempty"`
 				}
 
-				returnParams := ReturnParams{ID: id, DBName: "prime finance", SSHName1: "fibo", SSHPassword1: generatedSshPassword1, SSHName2: "ifinance", SSHPassword2: generatedSshPassword2, Ip: ip}
+				returnParams := ReturnParams{ID: id, DBName: "prime finance", SSHName1: "fibo", SSHPassword1: generatedSshPassword1, SSHName2: "ifinance", SSHPassword2: generatedSshPassword2, Ip: ip, PrivateIP: addresses.PrivateIP, PublicIP: addresses.PublicIP, Addresses: addresses.All, AddressError: addresses.Error}
 				fmt.Println("sending callback request")
-				shared.CallbackFunction(callbackUrl, returnParams)
+				deliverWhenReady(serverid, callbackUrl, returnParams)
 				return
 			}
 			if server.Status == "ERROR" {
+				updateStackStatus(serverid, "ERROR")
 				return
 			}
 			time.Sleep(3 * time.Second)
 		}
-	}(server.ID, claims.Username)
+		failProvisioning(serverid)
+	}(server.ID)
 
 	m.SetBody(server)
 }
@@ -273,11 +311,17 @@ func (m *IFinanceController) Create() {
 // Flavors ...
 // @Title Flavors
 // @Description hint Flavors
+// @Param	region	query	string	false	"region tag"
+// @Param	min_cpu	query	int	false	"minimum vcpus"
+// @Param	max_cpu	query	int	false	"maximum vcpus"
+// @Param	min_ram	query	int	false	"minimum ram in MB"
+// @Param	max_ram	query	int	false	"maximum ram in MB"
+// @Param	sort	query	string	false	"name, cpu, ram, price or available"
+// @Param	order	query	string	false	"asc or desc"
 // @Failure 403
 // @router /list [get]
 func (m *IFinanceController) Flavors() {
 	claims := m.Claim()
-	var mainRes []flavors.Flavor
 	defer func() {
 		if r := recover(); r != nil {
 			m.RespondPanic(r)
@@ -286,20 +330,7 @@ func (m *IFinanceController) Flavors() {
 		}
 	}()
 
-	pAccess := flavors.AllAccess
-	listFlavors, err := compute.GetCompute(claims.Username).ListFlavors(pAccess)
-	if err != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), claims.UserID)
-		return
-	}
-	for _, c := range listFlavors {
-		if strings.Contains(c.Name, "cloud") {
-			mainRes = append(mainRes, c)
-		}
-
-	}
-
-	m.SetBody(mainRes)
+	respondCatalogFlavors(&m.BaseController, claims, "ifinance")
 }
 
 // Flavors ...
@@ -324,51 +355,169 @@ func (m *IFinanceController) DeleteProject() {
 	if m.BindJSON(&params) != nil {
 		return
 	}
-	o := orm.NewOrm()
+	job, err := startProjectDelete(claims, m.GetClientIP(), ProjectDeleteParams{ProjectID: params.ProjectID})
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
 
-	var defaultProjectId string
+	// the project is only gone once the job succeeds
+	m.SetBody(map[string]interface{}{
+		"project_id": params.ProjectID,
+		"status":     JobQueued,
+		"job":        job,
+	})
+}
+
+// Rules ...
+// @Title Rules
+// @Description list firewall rules of the project's default security group
+// @Param	projectId	query	string	true	"projectId"
+// @Param	tag	query	string	false	"tag"
+// @Failure 403
+// @router /rules [get]
+func (m *IFinanceController) Rules() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
 
-	/* rules
-	   You can't delete default project of the user of openstack
-	   You can't delete project with bill invoice
-	*/
-	err := o.Raw("select su.os_tenant_id from sys_user su where su.os_user_id in (?)", claims.OsUserID).QueryRow(&defaultProjectId)
+	networkClient, secGroupID, err := m.defaultSecGroup(m.GetString("projectId"), m.GetString("tag"), RoleViewer)
 	if err != nil {
-		m.SetError(helper.StatusMissingParams, "Cannot find project user", "Cannot find project user", claims.UserID)
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	firewallRules, err := ListFirewallRules(networkClient, secGroupID)
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(firewallRules)
+}
+
+// UpdateRules ...
+// @Title UpdateRules
+// @Description add and remove firewall rules of the project's default security group
+// @Param	projectId	string	true	"projectId"
+// @Param	tag	string	false	"tag"
+// @Param	add	[]FirewallRule	false	"add"
+// @Param	remove	[]string	false	"remove"
+// @Failure 403
+// @router /rules [post]
+func (m *IFinanceController) UpdateRules() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	// RequestedParams ...
+	type RequestedParams struct {
+		ProjectID string         `json:"projectId" bind:"required"`
+		Tag       string         `json:"tag"`
+		Add       []FirewallRule `json:"add"`
+		Remove    []string       `json:"remove"`
+	}
+
+	params := RequestedParams{}
+	if m.BindJSON(&params) != nil {
 		return
 	}
 
-	if defaultProjectId == params.ProjectID {
-		m.SetError(helper.StatusMissingParams, "Cannot delete default project", "Cannot delete default project", claims.UserID)
+	if ruleErrors := ValidateFirewallRules(params.Add); len(ruleErrors) > 0 {
+		m.SetErrorWithBody(helper.StatusMissingParams, ruleErrors, "Invalid firewall rules", "Invalid firewall rules", claims.UserID)
 		return
 	}
 
-	var count int
-	err = o.Raw("select count(bi.id) as count from bill_invoice bi where bi.project_id in (?)", params.ProjectID).QueryRow(&count)
+	networkClient, secGroupID, err := m.defaultSecGroup(params.ProjectID, params.Tag, RoleAdmin)
 	if err != nil {
-		m.SetError(helper.StatusMissingParams, "Error querying bill invoice", "Error querying bill invoice", claims.UserID)
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
 		return
 	}
-	if count > 0 {
-		m.SetError(helper.StatusMissingParams, fmt.Sprintf("Project has bill invoices %v", count), fmt.Sprintf("Project has bill invoices %v", count), claims.UserID)
+
+	// only rules of this security group may be removed
+	existing, err := ListFirewallRules(networkClient, secGroupID)
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	owned := map[string]bool{}
+	for _, r := range existing {
+		owned[r.ID] = true
+	}
+	var ruleErrors []FirewallRuleError
+	var removeIDs []string
+	for i, id := range params.Remove {
+		if !owned[id] {
+			ruleErrors = append(ruleErrors, FirewallRuleError{Index: i, Name: id, Error: "rule does not belong to the default security group"})
+			continue
+		}
+		removeIDs = append(removeIDs, id)
+	}
+	if len(ruleErrors) > 0 {
+		m.SetErrorWithBody(helper.StatusMissingParams, ruleErrors, "Invalid firewall rules", "Invalid firewall rules", claims.UserID)
 		return
 	}
 
-	// passed everything now delete the project, delete everything within the project
-	success, err := project.DeleteProject(project.DeleteProjectStruct{
-		ProjectID: params.ProjectID,
-		Email:     claims.Email,
-	})
+	// the new rules go in first so that a failure leaves the old rules untouched
+	if ruleErrors := ApplyFirewallRules(networkClient, secGroupID, params.Add); len(ruleErrors) > 0 {
+		var addedIDs []string
+		for _, r := range params.Add {
+			if len(r.ID) > 0 {
+				addedIDs = append(addedIDs, r.ID)
+			}
+		}
+		DeleteFirewallRules(networkClient, addedIDs)
+		m.SetErrorWithBody(helper.StatusError, ruleErrors, "Failed updating firewall rules", "Failed updating firewall rules", claims.UserID)
+		return
+	}
+	ruleErrors = DeleteFirewallRules(networkClient, removeIDs)
+	service.CreateLogAction(secGroupID, "SecurityGroup", "default", "UpdateRules", claims.UserID, nil)
+	if len(ruleErrors) > 0 {
+		m.SetErrorWithBody(helper.StatusError, ruleErrors, "Failed removing firewall rules", "Failed removing firewall rules", claims.UserID)
+		return
+	}
 
+	firewallRules, err := ListFirewallRules(networkClient, secGroupID)
 	if err != nil {
-		m.SetError(helper.StatusMissingParams, "Error deleting project: "+err.Error(), "Error deleting project: "+err.Error(), claims.UserID)
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
 		return
 	}
+	m.SetBody(firewallRules)
+}
 
-	m.SetBody(map[string]interface{}{
-		"project_id": params.ProjectID,
-		"success":    success,
-	})
+// defaultSecGroup logs into the project and returns a network client with its default security group
+func (m *IFinanceController) defaultSecGroup(projectID, tag, minimum string) (*gophercloud.ServiceClient, string, error) {
+	claims := m.Claim()
+	if len(projectID) == 0 {
+		return nil, "", fmt.Errorf("projectId is required")
+	}
+	region, err := resolveRegion(projectID, tag)
+	if err != nil {
+		return nil, "", err
+	}
+
+	session, err := newStackSession(claims, m.GetClientIP(), projectID, region, minimum)
+	if err != nil {
+		return nil, "", err
+	}
+	secGroup, err := session.defaultSecurityGroup()
+	if err != nil {
+		return nil, "", err
+	}
+	networkClient, err := session.Network()
+	if err != nil {
+		return nil, "", err
+	}
+	return networkClient, secGroup.ID, nil
 }
 
 // Action's ifinance stack ...
@@ -396,129 +545,33 @@ func (m *IFinanceController) Action() {
 		InstanceID string `json:"id" bind:"required"`
 		Action     string `json:"action" bind:"required"`
 		ProjectID  string `json:"project_id" bind:"required"`
-		Tag        string `json:"tag" bind:"required"`
+		Tag        string `json:"tag"`
+		Region     string `json:"region"`
 	}
 
 	params := RequestedParams{}
 	if m.BindJSON(&params) != nil {
 		return
 	}
-
-	// login to new project
-	project.SetCurrentStack(claims.Email, params.ProjectID, params.Tag, claims.OsUserID, "", "")
-	stack := project.GetCurrentStack(claims.Email)
-
-	if stack.IsICS {
-		m.SetError(helper.StatusError, "Failed login to new project", "Failed login to new project", claims.UserID)
-		fmt.Println("Failed login to new project. ")
-		return
-	}
-	fmt.Println("✅✅✅ Successfully logged into the new project: ", stack.ProjectID, stack.Tag)
-
-	if params.Action == "start" {
-		m.Start(params.InstanceID, params.Tag)
-	} else if params.Action == "stop" {
-		m.Stop(params.InstanceID, params.Tag)
-	} else if params.Action == "restart" {
-		m.Reboot(params.InstanceID, params.Tag)
-	}
-	m.SetBody(params)
-}
-
-func (m *IFinanceController) Start(instanceID, tag string) {
-	claims := m.Claim()
-	clientIP := m.GetClientIP()
-
-	errStart := compute.GetCompute(claims.Username).StartServer(instanceID, tag)
-
-	server, errServer := compute.GetCompute(claims.Username).GetServer(instanceID, tag)
-	flavor, err := compute.GetCompute(claims.Username).GetFlavor(server.Flavor["id"].(string), tag)
-	logID := service.CreateLogAction(instanceID, "Instance", server.Name, "Start", claims.UserID, errStart)
-	myCache := utils.GetUCache()
-	if errStart != nil {
-		m.SetError(helper.StatusBadRequest, errStart.Error(), errStart.Error(), claims.UserID)
-		return
-	}
-	o := orm.NewOrm()
-	if errServer == nil {
-		usageObj := models.UsgHistory{
-			SysUserID:       uint32(claims.SysUserID),
-			OsUserID:        claims.OsUserID,
-			Type:            "Instance",
-			Hostname:        server.Name,
-			OsResourceID:    server.ID,
-			OsInstanceID:    server.ID,
-			Flavor:          flavor.Name,
-			DiskSize:        0,
-			CPU:             flavor.VCPUs,
-			RAM:             flavor.RAM,
-			Status:          "ACTIVE",
-			StartDate:       time.Now().Format(helper.TimeFormatYYYYMMDDHHMMSS),
-			EndDate:         "",
-			IP:              clientIP,
-			LastLogActionID: uint32(logID),
-		}
-		_, errTable := o.Insert(&usageObj)
-		if errTable != nil {
-			m.SetError(helper.StatusBadRequest, errTable.Error(), errTable.Error(), claims.UserID)
-			return
-		}
-		myCache.Set(server.ID, helper.Starting)
-	}
-
-	service.CreateLogAction(instanceID, "Instance", server.Name, "Start", claims.UserID, err)
-	if err != nil {
-		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
-	}
-}
-
-func (m *IFinanceController) Stop(instanceID, tag string) {
-	claims := m.Claim()
-	myCache := utils.GetUCache()
-	clientIP := m.GetClientIP()
-	err := compute.GetCompute(claims.Username).StopServer(instanceID, tag)
+	region, err := shared.ResolveRegion(params.Region, params.Tag)
 	if err != nil {
-		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
 		return
 	}
-	server, _ := compute.GetCompute(claims.Username).GetServer(instanceID, tag)
-	logID := service.CreateLogAction(instanceID, "Instance", server.Name, "Stop", claims.UserID, err)
-	o := orm.NewOrm()
-	_, errTable := o.QueryTable("usg_history").Filter("os_resource_id", instanceID).Filter("end_date", "").Update(orm.Params{
-		"sys_user_id":        claims.SysUserID,
-		"os_user_id":         claims.OsUserID,
-		"status":             "SHUTOFF",
-		"end_date":           time.Now().Format(helper.TimeFormatYYYYMMDDHHMMSS),
-		"ip":                 clientIP,
-		"last_log_action_id": logID,
-	})
 
-	if errTable != nil {
-		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+	// login to the project for this request only
+	session, err := newStackSession(claims, m.GetClientIP(), params.ProjectID, region, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusError, "Failed login to new project: "+err.Error(), err.Error(), claims.UserID)
 		return
 	}
 
-	myCache.Set(server.ID, helper.STOPPING)
-	service.CreateLogAction(instanceID, "Instance", server.Name, "Start", claims.UserID, err)
+	server, err := RunStackAction(session.Actor, region, params.InstanceID, params.Action)
 	if err != nil {
 		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
-	}
-}
-
-func (m *IFinanceController) Reboot(instanceID, tag string) {
-	claims := m.Claim()
-
-	server, errServer := compute.GetCompute(claims.Username).GetServer(instanceID, tag)
-	if errServer != nil {
-		m.SetError(helper.StatusBadRequest, errServer.Error(), errServer.Error(), claims.UserID)
-	}
-	errStart := compute.GetCompute(claims.Username).RebootServer(instanceID, "hard", tag)
-	service.CreateLogAction(instanceID, "Instance", server.Name, "Reboot", claims.UserID, errStart)
-	if errStart != nil {
-		m.SetError(helper.StatusBadRequest, errStart.Error(), errStart.Error(), claims.UserID)
 		return
 	}
-	m.SetBody(nil)
+	m.SetBody(server)
 }
 
 //Code below will update existing Project
@@ -556,9 +609,19 @@ func (m *IFinanceController) Reboot(instanceID, tag string) {
 // func (m* IFinanceController) Update {
 
 // // }
+
+// Images ...
+// @Title Images
+// @Description images that boot iFinance stacks
+// @Param	projectId	query	string	false	"project id, the default project when empty"
+// @Param	region	query	string	false	"region tag"
+// @Param	include_deprecated	query	bool	false	"list deprecated images too"
+// @Param	limit	query	int	false	"page size, at most 100"
+// @Param	marker	query	string	false	"next marker of the previous page"
+// @Failure 403
+// @router /images [get]
 func (m *IFinanceController) Images() {
 	claims := m.Claim()
-	var mainRes []images.Image
 	defer func() {
 		if r := recover(); r != nil {
 			m.RespondPanic(r)
@@ -567,16 +630,5 @@ func (m *IFinanceController) Images() {
 		}
 	}()
 
-	listImages, err := compute.GetCompute(claims.Username).ListImage()
-	if err != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), claims.UserID)
-		return
-	}
-	for _, z := range listImages {
-		if strings.Contains(z.Name, "admin") {
-			mainRes = append(mainRes, z)
-		}
-
-	}
-	m.SetBody(mainRes)
+	respondCatalogImages(&m.BaseController, claims, "ifinance")
 }
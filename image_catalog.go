@@ -0,0 +1,304 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+	"github.com/gophercloud/gophercloud/pagination"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// Image properties read by the catalog
+const (
+	imagePropertyStackTypes = "stack_types"
+	imagePropertyDeprecated = "deprecated"
+	imagePropertyOS         = "os_distro"
+	imagePropertyOSVersion  = "os_version"
+)
+
+// CatalogImage is an image with the properties stacks are matched by
+type CatalogImage struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Region     string    `json:"region"`
+	OS         string    `json:"os"`
+	OSVersion  string    `json:"osVersion"`
+	MinDisk    int       `json:"minDisk"`
+	MinRAM     int       `json:"minRam"`
+	Size       int64     `json:"size"`
+	StackTypes []string  `json:"stackTypes"`
+	Deprecated bool      `json:"deprecated"`
+	Visibility string    `json:"visibility"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// ImagePage is one page of the catalog, Next is the marker of the following page
+type ImagePage struct {
+	Images []CatalogImage `json:"images"`
+	Next   string         `json:"next,omitempty"`
+}
+
+func imageProperty(image images.Image, key string) string {
+	if value, ok := image.Properties[key]; ok && value != nil {
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+// toCatalogImage reads the catalog properties of the image
+func toCatalogImage(image images.Image, region string) CatalogImage {
+	item := CatalogImage{
+		ID:         image.ID,
+		Name:       image.Name,
+		Region:     region,
+		OS:         imageProperty(image, imagePropertyOS),
+		OSVersion:  imageProperty(image, imagePropertyOSVersion),
+		MinDisk:    image.MinDiskGigabytes,
+		MinRAM:     image.MinRAMMegabytes,
+		Size:       image.SizeBytes,
+		StackTypes: []string{},
+		Visibility: string(image.Visibility),
+		Status:     string(image.Status),
+		CreatedAt:  image.CreatedAt,
+	}
+	for _, value := range strings.Split(imageProperty(image, imagePropertyStackTypes), ",") {
+		if value = strings.TrimSpace(value); len(value) > 0 {
+			item.StackTypes = append(item.StackTypes, value)
+		}
+	}
+	item.Deprecated, _ = strconv.ParseBool(imageProperty(image, imagePropertyDeprecated))
+	if image.Status == images.ImageStatusDeactivated {
+		item.Deprecated = true
+	}
+	return item
+}
+
+// Supports tells whether the image may boot the stack type, an image without stack types boots any
+func (t CatalogImage) Supports(stackType string) bool {
+	if len(t.StackTypes) == 0 {
+		return true
+	}
+	for _, value := range t.StackTypes {
+		if value == stackType {
+			return true
+		}
+	}
+	return false
+}
+
+// ImageQuery filters a catalog page
+type ImageQuery struct {
+	StackType         string
+	IncludeDeprecated bool
+	Limit             int
+	Marker            string
+}
+
+// listCatalogImages reads glance page by page until the page of the query is filled
+func listCatalogImages(client *gophercloud.ServiceClient, region string, query ImageQuery) (*ImagePage, error) {
+	if query.Limit <= 0 || query.Limit > 100 {
+		query.Limit = 20
+	}
+	page := &ImagePage{Images: []CatalogImage{}}
+	lastSeen := ""
+	full := false
+	opts := images.ListOpts{Limit: query.Limit, Marker: query.Marker, SortKey: "name", SortDir: "asc"}
+	err := images.List(client, opts).EachPage(func(p pagination.Page) (bool, error) {
+		list, err := images.ExtractImages(p)
+		if err != nil {
+			return false, err
+		}
+		for _, image := range list {
+			lastSeen = image.ID
+			item := toCatalogImage(image, region)
+			if (item.Deprecated && !query.IncludeDeprecated) || item.Status != string(images.ImageStatusActive) && !item.Deprecated {
+				continue
+			}
+			if len(query.StackType) > 0 && !item.Supports(query.StackType) {
+				continue
+			}
+			page.Images = append(page.Images, item)
+			if len(page.Images) == query.Limit {
+				full = true
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if full {
+		page.Next = lastSeen
+	}
+	return page, nil
+}
+
+// validateStackImage checks that the image is active, boots the stack type and fits the flavor and disk.
+// ram is in MB and only used when flavorID is empty.
+func validateStackImage(provider *gophercloud.ProviderClient, region shared.CloudRegion, stackType, imageID, flavorID string, ram, disk int) error {
+	imageClient, err := region.ImageClient(provider)
+	if err != nil {
+		return err
+	}
+	image, err := images.Get(imageClient, imageID).Extract()
+	if err != nil {
+		return fmt.Errorf("image %s not found", imageID)
+	}
+	if len(flavorID) > 0 {
+		computeClient, err := region.ComputeClient(provider)
+		if err != nil {
+			return err
+		}
+		flavor, err := flavors.Get(computeClient, flavorID).Extract()
+		if err != nil {
+			return fmt.Errorf("flavor %s not found", flavorID)
+		}
+		ram = flavor.RAM
+	}
+	return checkStackImage(toCatalogImage(*image, region.Tag), stackType, ram, disk)
+}
+
+// checkStackImage checks a catalog image against the stack type and the RAM in MB and disk in GB it gets
+func checkStackImage(item CatalogImage, stackType string, ram, disk int) error {
+	if item.Status != string(images.ImageStatusActive) {
+		return fmt.Errorf("image %s is %s", item.Name, item.Status)
+	}
+	if item.Deprecated {
+		return fmt.Errorf("image %s is deprecated", item.Name)
+	}
+	if !item.Supports(stackType) {
+		return fmt.Errorf("image %s does not support %s stacks", item.Name, stackType)
+	}
+	problems := []string{}
+	if item.MinDisk > disk {
+		problems = append(problems, fmt.Sprintf("needs %d GB of disk, %d GB requested", item.MinDisk, disk))
+	}
+	if item.MinRAM > ram {
+		problems = append(problems, fmt.Sprintf("needs %d MB of RAM, the flavor has %d MB", item.MinRAM, ram))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("image %s %s", item.Name, strings.Join(problems, " and "))
+	}
+	return nil
+}
+
+// providerImageRejected validates the image with the clients of the provider and sets the error response when it does not fit
+func providerImageRejected(c *shared.BaseController, provider *gophercloud.ProviderClient, claims shared.Claims, region shared.CloudRegion, stackType, imageID, flavorID string, ram, disk int) bool {
+	if err := validateStackImage(provider, region, stackType, imageID, flavorID, ram, disk); err != nil {
+		c.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return true
+	}
+	return false
+}
+
+// ImageController lists the image catalog
+type ImageController struct {
+	shared.BaseController
+}
+
+// URLMapping URL mapping
+func (m *ImageController) URLMapping() {
+	m.Mapping("List", m.List)
+	m.Mapping("Detail", m.Detail)
+	m.Mapping("Upload", m.Upload)
+	m.Mapping("Import", m.Import)
+	m.Mapping("Custom", m.Custom)
+	m.Mapping("Delete", m.Delete)
+}
+
+// respondCatalogImages answers an image list request, limited to the stack type when one is given
+func respondCatalogImages(c *shared.BaseController, claims shared.Claims, stackType string) {
+	session, err := openSession(claims, c.GetClientIP(), c.GetString("projectId"), c.GetString("region"), RoleViewer)
+	if err != nil {
+		c.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	region := session.Region
+	client, err := session.Image()
+	if err != nil {
+		c.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	query := ImageQuery{StackType: stackType, Marker: c.GetString("marker")}
+	if len(query.StackType) == 0 {
+		query.StackType = c.GetString("stack_type")
+	}
+	query.IncludeDeprecated, _ = c.GetBool("include_deprecated", false)
+	query.Limit, _ = c.GetInt("limit", 20)
+
+	page, err := listCatalogImages(client, region.Tag, query)
+	if err != nil {
+		c.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), claims.UserID)
+		return
+	}
+	c.SetBody(page)
+}
+
+// List ...
+// @Title List
+// @Description images with their OS, minimum disk and RAM, stack types and deprecation
+// @Param	projectId	query	string	false	"project id, the default project when empty"
+// @Param	region	query	string	false	"region tag"
+// @Param	stack_type	query	string	false	"only images supporting the stack type"
+// @Param	include_deprecated	query	bool	false	"list deprecated images too"
+// @Param	limit	query	int	false	"page size, at most 100"
+// @Param	marker	query	string	false	"next marker of the previous page"
+// @Failure 403
+// @router /list [get]
+func (m *ImageController) List() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	respondCatalogImages(&m.BaseController, claims, "")
+}
+
+// Detail ...
+// @Title Detail
+// @Description catalog properties of an image
+// @Param	id	query	string	true	"image id"
+// @Param	projectId	query	string	false	"project id, the default project when empty"
+// @Param	region	query	string	false	"region tag"
+// @Failure 403
+// @router /detail [get]
+func (m *ImageController) Detail() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	session, err := openSession(claims, m.GetClientIP(), m.GetString("projectId"), m.GetString("region"), RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	region := session.Region
+	client, err := session.Image()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	image, err := images.Get(client, m.GetString("id")).Extract()
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(toCatalogImage(*image, region.Tag))
+}
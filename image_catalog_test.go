@@ -0,0 +1,40 @@
+package thirtdparty
+
+import "testing"
+
+func TestCheckStackImage(t *testing.T) {
+	image := func(change func(*CatalogImage)) CatalogImage {
+		item := CatalogImage{Name: "ubuntu-22.04", Status: "active", MinDisk: 20, MinRAM: 2048, StackTypes: []string{"moodle", "lambda"}}
+		if change != nil {
+			change(&item)
+		}
+		return item
+	}
+	cases := []struct {
+		name      string
+		image     CatalogImage
+		stackType string
+		ram, disk int
+		want      string
+	}{
+		{"fits", image(nil), "moodle", 4096, 40, ""},
+		{"fits exactly", image(nil), "lambda", 2048, 20, ""},
+		{"any stack type", image(func(i *CatalogImage) { i.StackTypes = []string{} }), "bbx", 4096, 40, ""},
+		{"not active", image(func(i *CatalogImage) { i.Status = "queued" }), "moodle", 4096, 40, "image ubuntu-22.04 is queued"},
+		{"deprecated", image(func(i *CatalogImage) { i.Deprecated = true }), "moodle", 4096, 40, "image ubuntu-22.04 is deprecated"},
+		{"other stack type", image(nil), "bbx", 4096, 40, "image ubuntu-22.04 does not support bbx stacks"},
+		{"small disk", image(nil), "moodle", 4096, 10, "image ubuntu-22.04 needs 20 GB of disk, 10 GB requested"},
+		{"small flavor", image(nil), "moodle", 1024, 40, "image ubuntu-22.04 needs 2048 MB of RAM, the flavor has 1024 MB"},
+		{"both too small", image(nil), "moodle", 1024, 10, "image ubuntu-22.04 needs 20 GB of disk, 10 GB requested and needs 2048 MB of RAM, the flavor has 1024 MB"},
+	}
+	for _, c := range cases {
+		err := checkStackImage(c.image, c.stackType, c.ram, c.disk)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package thirtdparty
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/context"
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/imagedata"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/imageimport"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// Custom image statuses
+const (
+	ImageUploading = "UPLOADING"
+	ImageImporting = "IMPORTING"
+	ImageActive    = "ACTIVE"
+	ImageError     = "ERROR"
+	ImageDeleted   = "DELETED"
+)
+
+// Custom image sources
+const (
+	ImageSourceUpload = "upload"
+	ImageSourceURL    = "url"
+)
+
+// imageImportWait bounds how long glance may take to download an imported image
+const imageImportWait = 2 * time.Hour
+
+// StackImage is an image a user brought into the project for their stacks
+type StackImage struct {
+	ID         uint32    `orm:"column(id);auto;pk" json:"id"`
+	Region     string    `orm:"column(region);size(64)" json:"region"`
+	ProjectID  string    `orm:"column(project_id);size(64);index" json:"projectId"`
+	SysUserID  uint32    `orm:"column(sys_user_id)" json:"-"`
+	OsUserID   string    `orm:"column(os_user_id);size(64);index" json:"osUserId"`
+	ImageID    string    `orm:"column(image_id);size(64);null;index" json:"imageId"`
+	Name       string    `orm:"column(name);size(255)" json:"name"`
+	DiskFormat string    `orm:"column(disk_format);size(16)" json:"diskFormat"`
+	StackTypes string    `orm:"column(stack_types);size(255)" json:"stackTypes"`
+	Source     string    `orm:"column(source);size(16)" json:"source"`
+	SourceURL  string    `orm:"column(source_url);size(1024);null" json:"sourceUrl"`
+	Checksum   string    `orm:"column(checksum);size(64);null" json:"checksum"` // sha256 of an upload
+	Size       int64     `orm:"column(size)" json:"size"`
+	Status     string    `orm:"column(status);size(16)" json:"status"`
+	Message    string    `orm:"column(message);size(1024);null" json:"message"`
+	CreatedAt  time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+	UpdatedAt  time.Time `orm:"column(updated_at);auto_now;type(datetime)" json:"updatedAt"`
+}
+
+// TableName ...
+func (t *StackImage) TableName() string {
+	return "stack_images"
+}
+
+// uploadBodyKey holds the multipart body of an image upload taken away from beego,
+// which would otherwise read the whole form before the controller runs
+const uploadBodyKey = "imageUploadBody"
+
+// maxUploadField bounds the size of one form field of an upload, the file excepted
+const maxUploadField = 4096
+
+func init() {
+	orm.RegisterModel(new(StackImage))
+	beego.InsertFilter("*", beego.BeforeStatic, holdUploadBody)
+}
+
+// holdUploadBody runs before beego parses the body and keeps the multipart body of an image upload
+// for the controller to stream into glance
+func holdUploadBody(ctx *context.Context) {
+	r := ctx.Request
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/image/upload") {
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || len(params["boundary"]) == 0 {
+		return
+	}
+	ctx.Input.SetData(uploadBodyKey, multipart.NewReader(r.Body, params["boundary"]))
+	r.Body = http.NoBody
+	r.Header.Set("Content-Type", "application/octet-stream")
+}
+
+// importHostAllowed rejects import URLs whose host resolves to a loopback, private, link-local or otherwise
+// internal address glance could reach from inside the cloud. Hosts listed in image.import.hosts are
+// trusted without the check.
+func importHostAllowed(host string) error {
+	for _, allowed := range strings.Split(beego.AppConfig.String("image.import.hosts"), ",") {
+		if allowed = strings.TrimSpace(allowed); len(allowed) > 0 && strings.EqualFold(allowed, host) {
+			return nil
+		}
+	}
+	addresses, err := net.LookupIP(host)
+	if err != nil {
+		return fmt.Errorf("failed resolving %s: %v", host, err)
+	}
+	for _, ip := range addresses {
+		if !publicAddress(ip) {
+			return fmt.Errorf("%s resolves to the internal address %s", host, ip)
+		}
+	}
+	return nil
+}
+
+// internalNetworks are the ranges an import may not point into
+var internalNetworks = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4", "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+// publicAddress tells whether the address is outside every internal range
+func publicAddress(ip net.IP) bool {
+	for _, cidr := range internalNetworks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// setImageStatus stores the status of the image and the reason of a failure
+func setImageStatus(image *StackImage, status, message string, fields ...string) {
+	image.Status = status
+	image.Message = message
+	o := orm.NewOrm()
+	if _, err := o.Update(image, append([]string{"status", "message", "updated_at"}, fields...)...); err != nil {
+		fmt.Println("Failed updating image", image.ID, err)
+	}
+}
+
+// GetOwnedImage returns the custom image when it belongs to the user
+func GetOwnedImage(id uint32, osUserID string) (*StackImage, error) {
+	o := orm.NewOrm()
+	image := StackImage{}
+	err := o.QueryTable(new(StackImage)).Filter("id", id).Filter("os_user_id", osUserID).Exclude("status", ImageDeleted).One(&image)
+	if err != nil {
+		return nil, fmt.Errorf("image %d not found", id)
+	}
+	return &image, nil
+}
+
+// ImageRegisterParams describes the image to create, the file or URL is given apart
+type ImageRegisterParams struct {
+	Name       string   `json:"name" bind:"required"`
+	ProjectID  string   `json:"projectId"`
+	Region     string   `json:"region"`
+	DiskFormat string   `json:"diskFormat" bind:"required"`
+	StackTypes []string `json:"stackTypes" bind:"required"`
+	OS         string   `json:"os"`
+	OSVersion  string   `json:"osVersion"`
+	MinDisk    int      `json:"minDisk"`
+	MinRAM     int      `json:"minRam"`
+}
+
+// ImageImportParams ...
+type ImageImportParams struct {
+	ImageRegisterParams
+	URL string `json:"url" bind:"required"`
+}
+
+// validate checks the format and stack types of the image
+func (p *ImageRegisterParams) validate() error {
+	p.DiskFormat = strings.ToLower(p.DiskFormat)
+	if p.DiskFormat != "qcow2" && p.DiskFormat != "raw" {
+		return fmt.Errorf("disk format must be qcow2 or raw")
+	}
+	types := []string{}
+	for _, stackType := range p.StackTypes {
+		if stackType = strings.TrimSpace(stackType); len(stackType) > 0 {
+			types = append(types, stackType)
+		}
+	}
+	if len(types) == 0 {
+		return fmt.Errorf("at least one stack type is required")
+	}
+	p.StackTypes = types
+	if p.MinDisk < 0 || p.MinRAM < 0 {
+		return fmt.Errorf("minimum disk and RAM can not be negative")
+	}
+	return nil
+}
+
+// registerImage creates the private glance image and its record, the data follows by upload or import
+func registerImage(client *gophercloud.ServiceClient, session *StackSession, params ImageRegisterParams, source, sourceURL string) (*StackImage, error) {
+	visibility := images.ImageVisibilityPrivate
+	properties := map[string]string{imagePropertyStackTypes: strings.Join(params.StackTypes, ",")}
+	if len(params.OS) > 0 {
+		properties[imagePropertyOS] = params.OS
+	}
+	if len(params.OSVersion) > 0 {
+		properties[imagePropertyOSVersion] = params.OSVersion
+	}
+	created, err := images.Create(client, images.CreateOpts{
+		Name:            params.Name,
+		Visibility:      &visibility,
+		DiskFormat:      params.DiskFormat,
+		ContainerFormat: "bare",
+		MinDisk:         params.MinDisk,
+		MinRAM:          params.MinRAM,
+		Properties:      properties,
+	}).Extract()
+	if err != nil {
+		return nil, err
+	}
+
+	status := ImageUploading
+	if source == ImageSourceURL {
+		status = ImageImporting
+	}
+	image := &StackImage{
+		Region:     session.Region.Tag,
+		ProjectID:  session.ProjectID,
+		SysUserID:  session.Claims.SysUserID,
+		OsUserID:   session.Claims.OsUserID,
+		ImageID:    created.ID,
+		Name:       params.Name,
+		DiskFormat: params.DiskFormat,
+		StackTypes: strings.Join(params.StackTypes, ","),
+		Source:     source,
+		SourceURL:  sourceURL,
+		Status:     status,
+	}
+	o := orm.NewOrm()
+	if _, err := o.Insert(image); err != nil {
+		images.Delete(client, created.ID)
+		return nil, err
+	}
+	return image, nil
+}
+
+// failImage removes the glance image of a failed upload or import and records why
+func failImage(client *gophercloud.ServiceClient, image *StackImage, err error) {
+	if errDelete := images.Delete(client, image.ImageID).ExtractErr(); errDelete != nil {
+		fmt.Println("Failed deleting image", image.ImageID, errDelete)
+	}
+	setImageStatus(image, ImageError, err.Error())
+}
+
+// uploadImage streams the data into glance and verifies it against the expected sha256 and the md5 glance computed
+func uploadImage(client *gophercloud.ServiceClient, image *StackImage, data io.Reader, expected string) error {
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	counter := &countingReader{reader: io.TeeReader(data, io.MultiWriter(md5Hash, sha256Hash))}
+	if err := imagedata.Upload(client, image.ImageID, counter).ExtractErr(); err != nil {
+		return err
+	}
+
+	image.Checksum = hex.EncodeToString(sha256Hash.Sum(nil))
+	image.Size = counter.read
+	if len(expected) > 0 && !strings.EqualFold(expected, image.Checksum) {
+		return fmt.Errorf("checksum mismatch, expected %s got %s", expected, image.Checksum)
+	}
+	uploaded, err := images.Get(client, image.ImageID).Extract()
+	if err != nil {
+		return err
+	}
+	if computed := hex.EncodeToString(md5Hash.Sum(nil)); len(uploaded.Checksum) > 0 && uploaded.Checksum != computed {
+		return fmt.Errorf("image was corrupted in transfer, glance has md5 %s sent %s", uploaded.Checksum, computed)
+	}
+	return nil
+}
+
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+// watchImageImport waits for glance to finish the web download and notifies the user of the outcome
+func watchImageImport(client *gophercloud.ServiceClient, image *StackImage) {
+	deadline := time.Now().Add(imageImportWait)
+	for time.Now().Before(deadline) {
+		time.Sleep(15 * time.Second)
+		current, err := images.Get(client, image.ImageID).Extract()
+		if err != nil {
+			continue
+		}
+		switch current.Status {
+		case images.ImageStatusActive:
+			image.Size = current.SizeBytes
+			setImageStatus(image, ImageActive, "", "size")
+			shared.SendPushNotificationToUser(image.OsUserID, "Image imported", fmt.Sprintf("Image %s is ready", image.Name), image.ProjectID, "", nil)
+			return
+		case images.ImageStatusKilled, images.ImageStatusDeleted:
+			err = fmt.Errorf("glance could not import %s", image.SourceURL)
+			failImage(client, image, err)
+			shared.SendPushNotificationToUser(image.OsUserID, "Image import failed", fmt.Sprintf("Image %s: %v", image.Name, err), image.ProjectID, "", nil)
+			return
+		}
+	}
+	err := fmt.Errorf("import did not finish in %v", imageImportWait)
+	failImage(client, image, err)
+	shared.SendPushNotificationToUser(image.OsUserID, "Image import failed", fmt.Sprintf("Image %s: %v", image.Name, err), image.ProjectID, "", nil)
+}
+
+// Upload ...
+// @Title Upload
+// @Description upload a qcow2 or raw image as a multipart form, the image is private to the project.
+// The file is streamed into glance, so every other field has to come before it.
+// @Param	name	formData	string	true	"image name"
+// @Param	diskFormat	formData	string	true	"qcow2 or raw"
+// @Param	stackTypes	formData	string	true	"comma separated stack types the image boots"
+// @Param	checksum	formData	string	false	"sha256 of the file"
+// @Param	projectId	formData	string	false	"project id, the default project when empty"
+// @Param	region	formData	string	false	"region tag"
+// @Param	os	formData	string	false	"os distro"
+// @Param	osVersion	formData	string	false	"os version"
+// @Param	minDisk	formData	int	false	"minimum disk in GB"
+// @Param	minRam	formData	int	false	"minimum RAM in MB"
+// @Param	file	formData	file	true	"image file, the last field"
+// @Failure 403
+// @router /upload [post]
+func (m *ImageController) Upload() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	reader, ok := m.Ctx.Input.GetData(uploadBodyKey).(*multipart.Reader)
+	if !ok {
+		m.SetError(helper.StatusMissingParams, "a multipart form is required", "a multipart form is required", claims.UserID)
+		return
+	}
+	fields := map[string]string{}
+	var file *multipart.Part
+	for file == nil {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		if part.FormName() == "file" {
+			file = part
+			continue
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxUploadField))
+		if err != nil {
+			m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		fields[part.FormName()] = string(value)
+	}
+	if file == nil {
+		m.SetError(helper.StatusMissingParams, "file is required", "file is required", claims.UserID)
+		return
+	}
+	defer file.Close()
+
+	params := ImageRegisterParams{
+		Name:       fields["name"],
+		ProjectID:  fields["projectId"],
+		Region:     fields["region"],
+		DiskFormat: fields["diskFormat"],
+		StackTypes: strings.Split(fields["stackTypes"], ","),
+		OS:         fields["os"],
+		OSVersion:  fields["osVersion"],
+	}
+	params.MinDisk, _ = strconv.Atoi(fields["minDisk"])
+	params.MinRAM, _ = strconv.Atoi(fields["minRam"])
+	if len(params.Name) == 0 {
+		m.SetError(helper.StatusMissingParams, "name is required", "name is required", claims.UserID)
+		return
+	}
+	if err := params.validate(); err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	session, err := openSession(claims, m.GetClientIP(), params.ProjectID, params.Region, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	client, err := session.Image()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	image, err := registerImage(client, session, params, ImageSourceUpload, "")
+	if err != nil {
+		m.SetError(helper.StatusError, "Failed creating image", err.Error(), claims.UserID)
+		return
+	}
+	if err := uploadImage(client, image, file, fields["checksum"]); err != nil {
+		failImage(client, image, err)
+		m.SetErrorWithBody(helper.StatusError, image, "Failed uploading image", err.Error(), claims.UserID)
+		return
+	}
+	setImageStatus(image, ImageActive, "", "size", "checksum")
+	m.SetBody(image)
+}
+
+// Import ...
+// @Title Import
+// @Description let glance download a qcow2 or raw image from a URL, the image is private to the project
+// @Param	body	body	thirtdparty.ImageImportParams	true	"body for import"
+// @Failure 403
+// @router /import [post]
+func (m *ImageController) Import() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params ImageImportParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	if err := params.validate(); err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	source, err := url.Parse(params.URL)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || len(source.Host) == 0 {
+		m.SetError(helper.StatusMissingParams, "url must be an http or https address", "url must be an http or https address", claims.UserID)
+		return
+	}
+	if err := importHostAllowed(source.Hostname()); err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	session, err := openSession(claims, m.GetClientIP(), params.ProjectID, params.Region, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	client, err := session.Image()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	image, err := registerImage(client, session, params.ImageRegisterParams, ImageSourceURL, params.URL)
+	if err != nil {
+		m.SetError(helper.StatusError, "Failed creating image", err.Error(), claims.UserID)
+		return
+	}
+	err = imageimport.Create(client, image.ImageID, imageimport.CreateOpts{Name: imageimport.WebDownloadMethod, URI: params.URL}).ExtractErr()
+	if err != nil {
+		failImage(client, image, err)
+		m.SetErrorWithBody(helper.StatusError, image, "Failed importing image", err.Error(), claims.UserID)
+		return
+	}
+	go watchImageImport(client, image)
+	m.SetBody(image)
+}
+
+// Custom ...
+// @Title Custom
+// @Description images the user uploaded or imported
+// @Failure 403
+// @router /custom [get]
+func (m *ImageController) Custom() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	o := orm.NewOrm()
+	list := []StackImage{}
+	if _, err := o.QueryTable(new(StackImage)).Filter("os_user_id", claims.OsUserID).Exclude("status", ImageDeleted).OrderBy("-id").All(&list); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(list)
+}
+
+// Delete ...
+// @Title Delete
+// @Description delete an uploaded or imported image, stacks booted from it keep their volumes
+// @Param	id	query	int	true	"custom image id"
+// @Failure 403
+// @router /delete [delete]
+func (m *ImageController) Delete() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	id, err := m.GetUint32("id")
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	image, err := GetOwnedImage(id, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	session, err := serverSession(claims, m.GetClientIP(), &Stack{Region: image.Region, ProjectID: image.ProjectID, OsUserID: image.OsUserID}, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	client, err := session.Image()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if err := images.Delete(client, image.ImageID).ExtractErr(); err != nil {
+		if _, notFound := err.(gophercloud.ErrDefault404); !notFound {
+			m.SetError(helper.StatusError, "Failed deleting image", err.Error(), claims.UserID)
+			return
+		}
+	}
+	setImageStatus(image, ImageDeleted, "")
+	m.SetBody(image)
+}
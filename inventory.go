@@ -0,0 +1,626 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/gophercloud/gophercloud/pagination"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// Inventory groups, also the kinds a page can be limited to
+const (
+	InventoryServers        = "servers"
+	InventoryVolumes        = "volumes"
+	InventorySnapshots      = "snapshots"
+	InventoryFloatingIPs    = "floatingIps"
+	InventorySecurityGroups = "securityGroups"
+	InventoryFlavors        = "flavors"
+	InventoryDomains        = "domains"
+	InventoryStacks         = "stacks"
+)
+
+// inventoryPorts names the ports in what was skipped, they only link the other groups
+const inventoryPorts = "ports"
+
+// InventoryServer is a server with the ids of what hangs off it
+type InventoryServer struct {
+	ID             string   `json:"id"`
+	Name           string   `json:"name"`
+	Status         string   `json:"status"`
+	FlavorID       string   `json:"flavorId"`
+	VolumeIDs      []string `json:"volumeIds"`
+	FloatingIPIDs  []string `json:"floatingIpIds"`
+	SecurityGroups []string `json:"securityGroupIds"`
+	StackID        uint32   `json:"stackId,omitempty"`
+	StackType      string   `json:"stackType,omitempty"`
+	DomainID       uint32   `json:"domainId,omitempty"`
+}
+
+// InventoryVolume is a volume with the server it is attached to and its snapshots
+type InventoryVolume struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Size        int      `json:"size"`
+	Status      string   `json:"status"`
+	ServerID    string   `json:"serverId,omitempty"`
+	SnapshotIDs []string `json:"snapshotIds"`
+}
+
+// InventorySnapshot is a volume snapshot
+type InventorySnapshot struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Size     int    `json:"size"`
+	Status   string `json:"status"`
+	VolumeID string `json:"volumeId"`
+}
+
+// InventoryFloatingIP is a floating IP with the server its port belongs to
+type InventoryFloatingIP struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Status   string `json:"status"`
+	PortID   string `json:"portId,omitempty"`
+	ServerID string `json:"serverId,omitempty"`
+}
+
+// InventorySecurityGroup is a security group with the servers using it
+type InventorySecurityGroup struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Rules     int      `json:"rules"`
+	ServerIDs []string `json:"serverIds"`
+}
+
+// Inventory is everything that lives in a project of a region, what a project deletion plans from
+type Inventory struct {
+	ProjectID      string                   `json:"projectId"`
+	Region         string                   `json:"region"`
+	Counts         map[string]int           `json:"counts"`
+	Servers        []InventoryServer        `json:"servers,omitempty"`
+	Volumes        []InventoryVolume        `json:"volumes,omitempty"`
+	Snapshots      []InventorySnapshot      `json:"snapshots,omitempty"`
+	FloatingIPs    []InventoryFloatingIP    `json:"floatingIps,omitempty"`
+	SecurityGroups []InventorySecurityGroup `json:"securityGroups,omitempty"`
+	Flavors        []CustomFlavor           `json:"flavors,omitempty"`
+	Domains        []orm.Params             `json:"domains,omitempty"`
+	Stacks         []Stack                  `json:"stacks,omitempty"`
+	Skipped        []string                 `json:"skipped,omitempty"`
+}
+
+// inventoryClients are admin clients of the region, the project is selected by filters
+type inventoryClients struct {
+	compute *gophercloud.ServiceClient
+	volume  *gophercloud.ServiceClient
+	network *gophercloud.ServiceClient
+	image   *gophercloud.ServiceClient
+}
+
+func newInventoryClients(region shared.CloudRegion) (*inventoryClients, error) {
+	provider, err := region.AdminProvider()
+	if err != nil {
+		return nil, err
+	}
+	computeClient, err := region.ComputeClient(provider)
+	if err != nil {
+		return nil, err
+	}
+	volumeClient, err := region.BlockStorageClient(provider)
+	if err != nil {
+		return nil, err
+	}
+	networkClient, err := region.NetworkClient(provider)
+	if err != nil {
+		return nil, err
+	}
+	imageClient, err := region.ImageClient(provider)
+	if err != nil {
+		return nil, err
+	}
+	return &inventoryClients{compute: computeClient, volume: volumeClient, network: networkClient, image: imageClient}, nil
+}
+
+// projectInventory collects the project's resources in the region and links them to each other.
+// A service that can not be read is reported as skipped and leaves its group empty.
+func projectInventory(region shared.CloudRegion, projectID string) (*Inventory, error) {
+	clients, err := newInventoryClients(region)
+	if err != nil {
+		return nil, err
+	}
+	inventory := &Inventory{ProjectID: projectID, Region: region.Tag, Counts: map[string]int{}}
+	skip := func(kind string, err error) {
+		inventory.Skipped = append(inventory.Skipped, fmt.Sprintf("%s: %v", kind, err))
+	}
+
+	serverIndex := map[string]int{}
+	if allPages, err := servers.List(clients.compute, servers.ListOpts{AllTenants: true, TenantID: projectID}).AllPages(); err != nil {
+		skip(InventoryServers, err)
+	} else if list, err := servers.ExtractServers(allPages); err != nil {
+		skip(InventoryServers, err)
+	} else {
+		for _, server := range list {
+			serverIndex[server.ID] = len(inventory.Servers)
+			flavorID, _ := server.Flavor["id"].(string)
+			inventory.Servers = append(inventory.Servers, InventoryServer{
+				ID:             server.ID,
+				Name:           server.Name,
+				Status:         server.Status,
+				FlavorID:       flavorID,
+				VolumeIDs:      []string{},
+				FloatingIPIDs:  []string{},
+				SecurityGroups: []string{},
+			})
+		}
+	}
+
+	volumeIndex := map[string]int{}
+	if allPages, err := volumes.List(clients.volume, volumes.ListOpts{AllTenants: true, TenantID: projectID}).AllPages(); err != nil {
+		skip(InventoryVolumes, err)
+	} else if list, err := volumes.ExtractVolumes(allPages); err != nil {
+		skip(InventoryVolumes, err)
+	} else {
+		for _, volume := range list {
+			item := InventoryVolume{ID: volume.ID, Name: volume.Name, Size: volume.Size, Status: volume.Status, SnapshotIDs: []string{}}
+			for _, attachment := range volume.Attachments {
+				item.ServerID = attachment.ServerID
+				if i, ok := serverIndex[attachment.ServerID]; ok {
+					inventory.Servers[i].VolumeIDs = append(inventory.Servers[i].VolumeIDs, volume.ID)
+				}
+			}
+			volumeIndex[volume.ID] = len(inventory.Volumes)
+			inventory.Volumes = append(inventory.Volumes, item)
+		}
+	}
+
+	if allPages, err := snapshots.List(clients.volume, snapshots.ListOpts{AllTenants: true, TenantID: projectID}).AllPages(); err != nil {
+		skip(InventorySnapshots, err)
+	} else if list, err := snapshots.ExtractSnapshots(allPages); err != nil {
+		skip(InventorySnapshots, err)
+	} else {
+		for _, snapshot := range list {
+			if i, ok := volumeIndex[snapshot.VolumeID]; ok {
+				inventory.Volumes[i].SnapshotIDs = append(inventory.Volumes[i].SnapshotIDs, snapshot.ID)
+			}
+			inventory.Snapshots = append(inventory.Snapshots, InventorySnapshot{
+				ID: snapshot.ID, Name: snapshot.Name, Size: snapshot.Size, Status: snapshot.Status, VolumeID: snapshot.VolumeID,
+			})
+		}
+	}
+
+	// ports tie floating IPs and security groups to servers
+	portServer := map[string]string{}
+	groupServers := map[string][]string{}
+	if allPages, err := ports.List(clients.network, ports.ListOpts{ProjectID: projectID}).AllPages(); err != nil {
+		skip(inventoryPorts, err)
+	} else if list, err := ports.ExtractPorts(allPages); err != nil {
+		skip(inventoryPorts, err)
+	} else {
+		for _, port := range list {
+			i, ok := serverIndex[port.DeviceID]
+			if !ok {
+				continue
+			}
+			portServer[port.ID] = port.DeviceID
+			for _, groupID := range port.SecurityGroups {
+				if !containsString(inventory.Servers[i].SecurityGroups, groupID) {
+					inventory.Servers[i].SecurityGroups = append(inventory.Servers[i].SecurityGroups, groupID)
+					groupServers[groupID] = append(groupServers[groupID], port.DeviceID)
+				}
+			}
+		}
+	}
+
+	if allPages, err := floatingips.List(clients.network, floatingips.ListOpts{ProjectID: projectID}).AllPages(); err != nil {
+		skip(InventoryFloatingIPs, err)
+	} else if list, err := floatingips.ExtractFloatingIPs(allPages); err != nil {
+		skip(InventoryFloatingIPs, err)
+	} else {
+		for _, ip := range list {
+			item := InventoryFloatingIP{ID: ip.ID, Address: ip.FloatingIP, Status: ip.Status, PortID: ip.PortID, ServerID: portServer[ip.PortID]}
+			if i, ok := serverIndex[item.ServerID]; ok {
+				inventory.Servers[i].FloatingIPIDs = append(inventory.Servers[i].FloatingIPIDs, ip.ID)
+			}
+			inventory.FloatingIPs = append(inventory.FloatingIPs, item)
+		}
+	}
+
+	if allPages, err := groups.List(clients.network, groups.ListOpts{ProjectID: projectID}).AllPages(); err != nil {
+		skip(InventorySecurityGroups, err)
+	} else if list, err := groups.ExtractGroups(allPages); err != nil {
+		skip(InventorySecurityGroups, err)
+	} else {
+		for _, group := range list {
+			serverIDs := groupServers[group.ID]
+			if serverIDs == nil {
+				serverIDs = []string{}
+			}
+			inventory.SecurityGroups = append(inventory.SecurityGroups, InventorySecurityGroup{ID: group.ID, Name: group.Name, Rules: len(group.Rules), ServerIDs: serverIDs})
+		}
+	}
+
+	if flavorList, err := projectCustomFlavors(region.Tag, projectID, "", 0); err != nil {
+		skip(InventoryFlavors, err)
+	} else {
+		inventory.Flavors = flavorList
+	}
+
+	o := orm.NewOrm()
+	o.QueryTable(new(Stack)).Filter("project_id", projectID).Filter("region", region.Tag).Exclude("status", "DELETED").OrderBy("id").All(&inventory.Stacks)
+	domainIDs := []uint32{}
+	for _, stack := range inventory.Stacks {
+		if i, ok := serverIndex[stack.ServerID]; ok {
+			inventory.Servers[i].StackID = stack.ID
+			inventory.Servers[i].StackType = stack.Type
+			inventory.Servers[i].DomainID = stack.DomainID
+		}
+		if stack.DomainID > 0 {
+			domainIDs = append(domainIDs, stack.DomainID)
+		}
+	}
+	if len(domainIDs) > 0 {
+		if _, err := o.QueryTable("domains").Filter("id__in", domainIDs).OrderBy("id").Values(&inventory.Domains); err != nil {
+			skip(InventoryDomains, err)
+		}
+	}
+
+	inventory.Counts[InventoryServers] = len(inventory.Servers)
+	inventory.Counts[InventoryVolumes] = len(inventory.Volumes)
+	inventory.Counts[InventorySnapshots] = len(inventory.Snapshots)
+	inventory.Counts[InventoryFloatingIPs] = len(inventory.FloatingIPs)
+	inventory.Counts[InventorySecurityGroups] = len(inventory.SecurityGroups)
+	inventory.Counts[InventoryFlavors] = len(inventory.Flavors)
+	inventory.Counts[InventoryDomains] = len(inventory.Domains)
+	inventory.Counts[InventoryStacks] = len(inventory.Stacks)
+	return inventory, nil
+}
+
+// projectCustomFlavors returns the custom flavors of the region the project was granted, after the marker
+// and at most limit of them when limit is positive
+func projectCustomFlavors(region, projectID, marker string, limit int) ([]CustomFlavor, error) {
+	query := "select cf.* from custom_flavors cf join custom_flavor_accesses a on a.flavor_id = cf.flavor_id" +
+		" where cf.region = ? and a.project_id = ?"
+	args := []interface{}{region, projectID}
+	if len(marker) > 0 {
+		query += " and cf.id > ?"
+		args = append(args, marker)
+	}
+	query += " order by cf.id"
+	if limit > 0 {
+		query += fmt.Sprintf(" limit %d", limit)
+	}
+	o := orm.NewOrm()
+	result := []CustomFlavor{}
+	_, err := o.Raw(query, args...).QueryRows(&result)
+	return result, err
+}
+
+// InventoryPage is one page of a group of the project's resources. The services page the groups
+// themselves, nextMarker is the marker of the following page and is empty on the last one.
+type InventoryPage struct {
+	ProjectID  string      `json:"projectId"`
+	Region     string      `json:"region"`
+	Kind       string      `json:"kind"`
+	Items      interface{} `json:"items"`
+	NextMarker string      `json:"nextMarker,omitempty"`
+	Skipped    []string    `json:"skipped,omitempty"`
+}
+
+// firstPage reads only the page the marker and limit of the list options select
+func firstPage(pager pagination.Pager) (pagination.Page, error) {
+	var result pagination.Page
+	err := pager.EachPage(func(page pagination.Page) (bool, error) {
+		result = page
+		return false, nil
+	})
+	return result, err
+}
+
+// portLinks maps the ports of the project to their server and the security groups to the servers using them
+func portLinks(client *gophercloud.ServiceClient, projectID string) (map[string]string, map[string][]string, error) {
+	portServer := map[string]string{}
+	groupServers := map[string][]string{}
+	allPages, err := ports.List(client, ports.ListOpts{ProjectID: projectID}).AllPages()
+	if err != nil {
+		return portServer, groupServers, err
+	}
+	list, err := ports.ExtractPorts(allPages)
+	if err != nil {
+		return portServer, groupServers, err
+	}
+	for _, port := range list {
+		if !strings.HasPrefix(port.DeviceOwner, "compute:") {
+			continue
+		}
+		portServer[port.ID] = port.DeviceID
+		for _, groupID := range port.SecurityGroups {
+			if !containsString(groupServers[groupID], port.DeviceID) {
+				groupServers[groupID] = append(groupServers[groupID], port.DeviceID)
+			}
+		}
+	}
+	return portServer, groupServers, nil
+}
+
+// inventoryPage reads one page of a group of the project's resources in the region
+func inventoryPage(region shared.CloudRegion, projectID, kind, marker string, limit int) (*InventoryPage, error) {
+	clients, err := newInventoryClients(region)
+	if err != nil {
+		return nil, err
+	}
+	result := &InventoryPage{ProjectID: projectID, Region: region.Tag, Kind: kind}
+	skip := func(kind string, err error) {
+		result.Skipped = append(result.Skipped, fmt.Sprintf("%s: %v", kind, err))
+	}
+	// a full page means there may be another one after its last item
+	next := func(n int, last func() string) {
+		if n == limit {
+			result.NextMarker = last()
+		}
+	}
+	o := orm.NewOrm()
+
+	switch kind {
+	case InventoryServers:
+		page, err := firstPage(servers.List(clients.compute, servers.ListOpts{AllTenants: true, TenantID: projectID, Marker: marker, Limit: limit}))
+		if err != nil {
+			return nil, err
+		}
+		list, err := servers.ExtractServers(page)
+		if err != nil {
+			return nil, err
+		}
+		portServer, groupServers, err := portLinks(clients.network, projectID)
+		if err != nil {
+			skip(inventoryPorts, err)
+		}
+		serverIPs := map[string][]string{}
+		if allPages, err := floatingips.List(clients.network, floatingips.ListOpts{ProjectID: projectID}).AllPages(); err != nil {
+			skip(InventoryFloatingIPs, err)
+		} else if ips, err := floatingips.ExtractFloatingIPs(allPages); err != nil {
+			skip(InventoryFloatingIPs, err)
+		} else {
+			for _, ip := range ips {
+				if serverID, ok := portServer[ip.PortID]; ok {
+					serverIPs[serverID] = append(serverIPs[serverID], ip.ID)
+				}
+			}
+		}
+		stacks := map[string]Stack{}
+		var stackList []Stack
+		o.QueryTable(new(Stack)).Filter("project_id", projectID).Filter("region", region.Tag).Exclude("status", "DELETED").All(&stackList)
+		for _, stack := range stackList {
+			stacks[stack.ServerID] = stack
+		}
+
+		items := []InventoryServer{}
+		for _, server := range list {
+			flavorID, _ := server.Flavor["id"].(string)
+			item := InventoryServer{ID: server.ID, Name: server.Name, Status: server.Status, FlavorID: flavorID,
+				VolumeIDs: []string{}, FloatingIPIDs: []string{}, SecurityGroups: []string{}}
+			for _, volume := range server.AttachedVolumes {
+				item.VolumeIDs = append(item.VolumeIDs, volume.ID)
+			}
+			if ids, ok := serverIPs[server.ID]; ok {
+				item.FloatingIPIDs = ids
+			}
+			for groupID, serverIDs := range groupServers {
+				if containsString(serverIDs, server.ID) {
+					item.SecurityGroups = append(item.SecurityGroups, groupID)
+				}
+			}
+			sort.Strings(item.SecurityGroups)
+			if stack, ok := stacks[server.ID]; ok {
+				item.StackID, item.StackType, item.DomainID = stack.ID, stack.Type, stack.DomainID
+			}
+			items = append(items, item)
+		}
+		result.Items = items
+		next(len(items), func() string { return items[len(items)-1].ID })
+
+	case InventoryVolumes:
+		page, err := firstPage(volumes.List(clients.volume, volumes.ListOpts{AllTenants: true, TenantID: projectID, Marker: marker, Limit: limit}))
+		if err != nil {
+			return nil, err
+		}
+		list, err := volumes.ExtractVolumes(page)
+		if err != nil {
+			return nil, err
+		}
+		volumeSnapshots := map[string][]string{}
+		if allPages, err := snapshots.List(clients.volume, snapshots.ListOpts{AllTenants: true, TenantID: projectID}).AllPages(); err != nil {
+			skip(InventorySnapshots, err)
+		} else if snapshotList, err := snapshots.ExtractSnapshots(allPages); err != nil {
+			skip(InventorySnapshots, err)
+		} else {
+			for _, snapshot := range snapshotList {
+				volumeSnapshots[snapshot.VolumeID] = append(volumeSnapshots[snapshot.VolumeID], snapshot.ID)
+			}
+		}
+		items := []InventoryVolume{}
+		for _, volume := range list {
+			item := InventoryVolume{ID: volume.ID, Name: volume.Name, Size: volume.Size, Status: volume.Status, SnapshotIDs: []string{}}
+			for _, attachment := range volume.Attachments {
+				item.ServerID = attachment.ServerID
+			}
+			if ids, ok := volumeSnapshots[volume.ID]; ok {
+				item.SnapshotIDs = ids
+			}
+			items = append(items, item)
+		}
+		result.Items = items
+		next(len(items), func() string { return items[len(items)-1].ID })
+
+	case InventorySnapshots:
+		page, err := firstPage(snapshots.List(clients.volume, snapshots.ListOpts{AllTenants: true, TenantID: projectID, Marker: marker, Limit: limit}))
+		if err != nil {
+			return nil, err
+		}
+		list, err := snapshots.ExtractSnapshots(page)
+		if err != nil {
+			return nil, err
+		}
+		items := []InventorySnapshot{}
+		for _, snapshot := range list {
+			items = append(items, InventorySnapshot{ID: snapshot.ID, Name: snapshot.Name, Size: snapshot.Size, Status: snapshot.Status, VolumeID: snapshot.VolumeID})
+		}
+		result.Items = items
+		next(len(items), func() string { return items[len(items)-1].ID })
+
+	case InventoryFloatingIPs:
+		page, err := firstPage(floatingips.List(clients.network, floatingips.ListOpts{ProjectID: projectID, Marker: marker, Limit: limit}))
+		if err != nil {
+			return nil, err
+		}
+		list, err := floatingips.ExtractFloatingIPs(page)
+		if err != nil {
+			return nil, err
+		}
+		portServer, _, err := portLinks(clients.network, projectID)
+		if err != nil {
+			skip(inventoryPorts, err)
+		}
+		items := []InventoryFloatingIP{}
+		for _, ip := range list {
+			items = append(items, InventoryFloatingIP{ID: ip.ID, Address: ip.FloatingIP, Status: ip.Status, PortID: ip.PortID, ServerID: portServer[ip.PortID]})
+		}
+		result.Items = items
+		next(len(items), func() string { return items[len(items)-1].ID })
+
+	case InventorySecurityGroups:
+		page, err := firstPage(groups.List(clients.network, groups.ListOpts{ProjectID: projectID, Marker: marker, Limit: limit}))
+		if err != nil {
+			return nil, err
+		}
+		list, err := groups.ExtractGroups(page)
+		if err != nil {
+			return nil, err
+		}
+		_, groupServers, err := portLinks(clients.network, projectID)
+		if err != nil {
+			skip(inventoryPorts, err)
+		}
+		items := []InventorySecurityGroup{}
+		for _, group := range list {
+			serverIDs := groupServers[group.ID]
+			if serverIDs == nil {
+				serverIDs = []string{}
+			}
+			items = append(items, InventorySecurityGroup{ID: group.ID, Name: group.Name, Rules: len(group.Rules), ServerIDs: serverIDs})
+		}
+		result.Items = items
+		next(len(items), func() string { return items[len(items)-1].ID })
+
+	case InventoryFlavors:
+		items, err := projectCustomFlavors(region.Tag, projectID, marker, limit)
+		if err != nil {
+			return nil, err
+		}
+		result.Items = items
+		next(len(items), func() string { return fmt.Sprint(items[len(items)-1].ID) })
+
+	case InventoryStacks:
+		query := o.QueryTable(new(Stack)).Filter("project_id", projectID).Filter("region", region.Tag).Exclude("status", "DELETED")
+		if len(marker) > 0 {
+			query = query.Filter("id__gt", marker)
+		}
+		items := []Stack{}
+		if _, err := query.OrderBy("id").Limit(limit).All(&items); err != nil {
+			return nil, err
+		}
+		result.Items = items
+		next(len(items), func() string { return fmt.Sprint(items[len(items)-1].ID) })
+
+	case InventoryDomains:
+		stacks := o.QueryTable(new(Stack)).Filter("project_id", projectID).Filter("region", region.Tag).Exclude("status", "DELETED").Filter("domain_id__gt", 0)
+		var stackList []Stack
+		if _, err := stacks.All(&stackList, "DomainID"); err != nil {
+			return nil, err
+		}
+		ids := []uint32{}
+		for _, stack := range stackList {
+			ids = append(ids, stack.DomainID)
+		}
+		items := []orm.Params{}
+		if len(ids) > 0 {
+			query := "select * from domains where id in (?)"
+			args := []interface{}{ids}
+			if len(marker) > 0 {
+				query += " and id > ?"
+				args = append(args, marker)
+			}
+			query += fmt.Sprintf(" order by id limit %d", limit)
+			if _, err := o.Raw(query, args...).Values(&items); err != nil {
+				return nil, err
+			}
+		}
+		result.Items = items
+		next(len(items), func() string { return fmt.Sprint(items[len(items)-1]["id"]) })
+
+	default:
+		return nil, fmt.Errorf("unknown kind %s", kind)
+	}
+	return result, nil
+}
+
+// Inventory ...
+// @Title Inventory
+// @Description one page of the servers, volumes, snapshots, floating IPs, security groups, custom flavors, domains or stacks
+// of the project, linked by id. The services page the group, pass nextMarker as marker for the following page.
+// @Param	id	query	string	true	"project id"
+// @Param	region	query	string	false	"region tag"
+// @Param	kind	query	string	false	"servers (default), volumes, snapshots, floatingIps, securityGroups, flavors, domains or stacks"
+// @Param	marker	query	string	false	"nextMarker of the previous page"
+// @Param	limit	query	int	false	"page size, at most 500"
+// @Failure 403
+// @router /inventory [get]
+func (m *ProjectController) Inventory() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	setting, _, err := projectAccess(claims, m.GetString("id"), RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	region, err := resolveRegion(setting.ProjectID, m.GetString("region"))
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	kind := m.GetString("kind", InventoryServers)
+	switch kind {
+	case InventoryServers, InventoryVolumes, InventorySnapshots, InventoryFloatingIPs, InventorySecurityGroups,
+		InventoryFlavors, InventoryDomains, InventoryStacks:
+	default:
+		m.SetError(helper.StatusMissingParams, "unknown kind "+kind, "unknown kind "+kind, claims.UserID)
+		return
+	}
+	limit, _ := m.GetInt("limit", 100)
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	page, err := inventoryPage(region, setting.ProjectID, kind, m.GetString("marker"), limit)
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(page)
+}
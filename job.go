@@ -0,0 +1,260 @@
+package thirtdparty
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// Job statuses
+const (
+	JobQueued    = "QUEUED"
+	JobRunning   = "RUNNING"
+	JobSucceeded = "SUCCEEDED"
+	JobPartial   = "PARTIAL"
+	JobFailed    = "FAILED"
+)
+
+// Job item statuses
+const (
+	JobItemPending   = "PENDING"
+	JobItemSucceeded = "SUCCEEDED"
+	JobItemFailed    = "FAILED"
+	JobItemSkipped   = "SKIPPED"
+)
+
+// Job is a long running operation over many resources whose report can be fetched later
+type Job struct {
+	ID         uint32    `orm:"column(id);auto;pk" json:"id"`
+	Kind       string    `orm:"column(kind);size(32)" json:"kind"`
+	Action     string    `orm:"column(action);size(32)" json:"action"`
+	SysUserID  uint32    `orm:"column(sys_user_id)" json:"-"`
+	OsUserID   string    `orm:"column(os_user_id);size(64);index" json:"osUserId"`
+	Params     string    `orm:"column(params);type(text);null" json:"-"`
+	Status     string    `orm:"column(status);size(16)" json:"status"`
+	Total      int       `orm:"column(total)" json:"total"`
+	Succeeded  int       `orm:"column(succeeded)" json:"succeeded"`
+	Failed     int       `orm:"column(failed)" json:"failed"`
+	Skipped    int       `orm:"column(skipped)" json:"skipped"`
+	Message    string    `orm:"column(message);size(1024);null" json:"message"`
+	CreatedAt  time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+	FinishedAt time.Time `orm:"column(finished_at);type(datetime);null" json:"finishedAt"`
+}
+
+// TableName ...
+func (t *Job) TableName() string {
+	return "jobs"
+}
+
+// JobItem is the result of a job on one resource
+type JobItem struct {
+	ID         uint32    `orm:"column(id);auto;pk" json:"id"`
+	JobID      uint32    `orm:"column(job_id);index" json:"jobId"`
+	ResourceID string    `orm:"column(resource_id);size(64)" json:"resourceId"`
+	Kind       string    `orm:"column(kind);size(32);null" json:"kind,omitempty"`
+	Region     string    `orm:"column(region);size(64);null" json:"region,omitempty"`
+	Name       string    `orm:"column(name);size(255);null" json:"name"`
+	Step       int       `orm:"column(step)" json:"step"`
+	Status     string    `orm:"column(status);size(16)" json:"status"`
+	Message    string    `orm:"column(message);size(1024);null" json:"message"`
+	UpdatedAt  time.Time `orm:"column(updated_at);auto_now;type(datetime)" json:"updatedAt"`
+}
+
+// TableName ...
+func (t *JobItem) TableName() string {
+	return "job_items"
+}
+
+func init() {
+	orm.RegisterModel(new(Job), new(JobItem))
+}
+
+// newJob stores a queued job with a pending item for each resource
+func newJob(kind, action string, actor StackActor, params interface{}, items []JobItem) (*Job, error) {
+	data, _ := json.Marshal(params)
+	job := &Job{
+		Kind:      kind,
+		Action:    action,
+		SysUserID: actor.SysUserID,
+		OsUserID:  actor.OsUserID,
+		Params:    string(data),
+		Status:    JobQueued,
+		Total:     len(items),
+	}
+	o := orm.NewOrm()
+	id, err := o.Insert(job)
+	if err != nil {
+		return nil, err
+	}
+	job.ID = uint32(id)
+	for i := range items {
+		items[i].JobID = job.ID
+		if len(items[i].Status) == 0 {
+			items[i].Status = JobItemPending
+		}
+		itemID, err := o.Insert(&items[i])
+		if err != nil {
+			return nil, err
+		}
+		items[i].ID = uint32(itemID)
+	}
+	return job, nil
+}
+
+// setJobStatus changes the status of the job
+func setJobStatus(jobID uint32, status string) {
+	o := orm.NewOrm()
+	if _, err := o.QueryTable(new(Job)).Filter("id", jobID).Update(orm.Params{"status": status}); err != nil {
+		fmt.Println("Failed updating job", jobID, err)
+	}
+}
+
+// setJobItem stores the outcome of one item
+func setJobItem(item *JobItem, status string, err error) {
+	item.Status = status
+	item.Message = ""
+	if err != nil {
+		item.Message = err.Error()
+	}
+	o := orm.NewOrm()
+	if _, err := o.Update(item, "status", "message", "updated_at"); err != nil {
+		fmt.Println("Failed updating job item", item.ID, err)
+	}
+}
+
+// finishJob counts the item outcomes and closes the job
+func finishJob(jobID uint32) *Job {
+	o := orm.NewOrm()
+	job := Job{ID: jobID}
+	if err := o.Read(&job); err != nil {
+		fmt.Println("Failed loading job", jobID, err)
+		return nil
+	}
+	succeeded, _ := o.QueryTable(new(JobItem)).Filter("job_id", jobID).Filter("status", JobItemSucceeded).Count()
+	failed, _ := o.QueryTable(new(JobItem)).Filter("job_id", jobID).Filter("status", JobItemFailed).Count()
+	skipped, _ := o.QueryTable(new(JobItem)).Filter("job_id", jobID).Filter("status", JobItemSkipped).Count()
+
+	job.Succeeded = int(succeeded)
+	job.Failed = int(failed)
+	job.Skipped = int(skipped)
+	job.Status = jobOutcome(job.Succeeded, job.Failed, job.Skipped)
+	job.Message = fmt.Sprintf("%d of %d succeeded", job.Succeeded, job.Total)
+	if job.Skipped > 0 {
+		job.Message += fmt.Sprintf(", %d skipped", job.Skipped)
+	}
+	job.FinishedAt = time.Now()
+	if _, err := o.Update(&job, "status", "succeeded", "failed", "skipped", "message", "finished_at"); err != nil {
+		fmt.Println("Failed finishing job", jobID, err)
+	}
+	return &job
+}
+
+// jobOutcome is the status of a job from the counts of its items. Skipped items are not failures,
+// but a job that skipped some of its items did not do all it was asked to.
+func jobOutcome(succeeded, failed, skipped int) string {
+	switch {
+	case failed == 0 && skipped == 0:
+		return JobSucceeded
+	case succeeded == 0:
+		return JobFailed
+	default:
+		return JobPartial
+	}
+}
+
+// GetOwnedJob returns the job when it belongs to the user
+func GetOwnedJob(id uint32, osUserID string) (*Job, error) {
+	o := orm.NewOrm()
+	job := Job{}
+	err := o.QueryTable(new(Job)).Filter("id", id).Filter("os_user_id", osUserID).One(&job)
+	if err != nil {
+		return nil, fmt.Errorf("job %d not found", id)
+	}
+	return &job, nil
+}
+
+// JobController struct
+type JobController struct {
+	shared.BaseController
+}
+
+// URLMapping URL mapping
+func (m *JobController) URLMapping() {
+	m.Mapping("Detail", m.Detail)
+	m.Mapping("List", m.List)
+}
+
+// JobReport is a job with the result of every item
+type JobReport struct {
+	Job
+	Items []JobItem `json:"items"`
+}
+
+// Detail ...
+// @Title Detail
+// @Description job status with the result of every item
+// @Param	id	query	int	true	"job id"
+// @Failure 403
+// @router /detail [get]
+func (m *JobController) Detail() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	id, err := m.GetUint32("id")
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	job, err := GetOwnedJob(id, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	report := JobReport{Job: *job, Items: []JobItem{}}
+	o := orm.NewOrm()
+	if _, err := o.QueryTable(new(JobItem)).Filter("job_id", job.ID).OrderBy("step", "id").All(&report.Items); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(report)
+}
+
+// List ...
+// @Title List
+// @Description jobs of the user
+// @Param	kind	query	string	false	"job kind"
+// @Failure 403
+// @router /list [get]
+func (m *JobController) List() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	o := orm.NewOrm()
+	query := o.QueryTable(new(Job)).Filter("os_user_id", claims.OsUserID)
+	if kind := m.GetString("kind"); len(kind) > 0 {
+		query = query.Filter("kind", kind)
+	}
+	var jobs []Job
+	if _, err := query.OrderBy("-id").Limit(100).All(&jobs); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(jobs)
+}
@@ -0,0 +1,22 @@
+package thirtdparty
+
+import "testing"
+
+func TestJobOutcome(t *testing.T) {
+	cases := []struct {
+		succeeded, failed, skipped int
+		want                       string
+	}{
+		{3, 0, 0, JobSucceeded},
+		{0, 0, 0, JobSucceeded},
+		{0, 2, 0, JobFailed},
+		{0, 0, 2, JobFailed},
+		{2, 1, 0, JobPartial},
+		{2, 0, 1, JobPartial},
+	}
+	for _, c := range cases {
+		if got := jobOutcome(c.succeeded, c.failed, c.skipped); got != c.want {
+			t.Errorf("%d/%d/%d: got %s, want %s", c.succeeded, c.failed, c.skipped, got, c.want)
+		}
+	}
+}
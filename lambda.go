@@ -10,7 +10,6 @@ import (
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
 	"gitlab.com/ics-project/back-thirdparty/helper"
-	"gitlab.com/ics-project/back-thirdparty/integration/compute"
 	"gitlab.com/ics-project/back-thirdparty/integration/networking"
 	"gitlab.com/ics-project/back-thirdparty/models"
 	"gitlab.com/ics-project/back-thirdparty/service"
@@ -60,49 +59,54 @@ func (m *LambdaController) Create() {
 		SysAdminLogin    string `json:"sysAdminLogin"  bind:"required"`
 		SysAdminPassword string `json:"sysAdminPassword"  bind:"required"`
 		SysAdminEmail    string `json:"sysAdminEmail"  bind:"required"`
+		Region           string `json:"region"`
+		ProjectID        string `json:"projectId"`
+		StackNetworkParams
 	}
 
 	params := RequestedParams{}
 	if m.BindJSON(&params) != nil {
 		return
 	}
+	session, err := openSession(claims, m.GetClientIP(), params.ProjectID, params.Region, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	region := session.Region
 	lambdaFullName := params.LambdaFullName
 	key := params.Key
 	flavorID := params.Flavor
 	diskSize := 15
 	callbackUrl := params.CallbackUrl
-	allowedIp := fmt.Sprintf("%s/32", params.AllowedIP)
+
+	imageID := region.Image("3thparty", models.GetConfig("3thparty_image"))
+	if session.quotaRejected(&m.BaseController, QuotaRequest{FlavorID: flavorID, Disk: diskSize, Volumes: 1, FloatingIPs: floatingIPCount(params.StackNetworkParams)}) {
+		return
+	}
+	if session.imageRejected(&m.BaseController, "lambda", imageID, flavorID, 0, diskSize) {
+		return
+	}
 
 	/* find default security group */
-	securityGroupList, err := compute.GetCompute(claims.Username).ListSecGroups()
+	secGroupName, err := session.openStackFirewall("lambda", params.AllowedIP)
 	if err != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), fmt.Sprintf("lambda-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
 	}
 
-	var sgIDs []interface{}
-	for _, secGroup := range securityGroupList {
-		if secGroup.Name == "default" {
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "mysql", 3306, 3306, "tcp", allowedIp)
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "app", 8080, 8080, "tcp", allowedIp)
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "http", 80, 80, "tcp", "0.0.0.0/0")
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "https", 443, 443, "tcp", "0.0.0.0/0")
-			sgIDs = append(sgIDs, secGroup.Name)
-		}
+	networkID, err := resolveStackNetwork(session.Provider(), region, params.StackNetworkParams, params.ID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
 	}
 
-	networkID := ""
-	imageID := models.GetConfig("3thparty_image")
-
 	if networkID == "" {
-		adminProvider, _ := shared.AuthOSAdmin()
+		adminProvider, _ := region.AdminProvider()
 		networkID, _ = networking.GetNetworking("admin").GetAvailableNetworks(adminProvider)
 	}
 
-	secGroup := make([]string, len(sgIDs))
-	for i, v := range sgIDs {
-
-		secGroup[i] = fmt.Sprint(v)
-	}
+	secGroup := []string{secGroupName}
 
 	userData, err := ioutil.ReadFile("files/lambda/base.yml")
 	if err != nil {
@@ -140,63 +144,96 @@ func (m *LambdaController) Create() {
 	output := strings.Join(lines, "\n")
 	fmt.Println(output)
 
-	scripted := []byte(output)
+	phoneHomeToken := newPhoneHomeToken()
+	scripted := withPhoneHome([]byte(output), phoneHomeToken)
 
-	server, errServer := compute.GetCompute(claims.Username).CreateServerForVolume(imageID, lambdaFullName, flavorID, "", int(diskSize), secGroup, scripted, "nova", true, networkID)
+	server, errServer := session.bootServer(stackServerOpts{Name: lambdaFullName, ImageID: imageID, FlavorID: flavorID, NetworkID: networkID, DiskSize: diskSize, SecurityGroups: secGroup, UserData: scripted})
 	if errServer != nil {
 		fmt.Print(errServer)
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), fmt.Sprintf("lambda-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("lambda-%v", claims.UserID))
 		return
 	}
 
 	service.CreateLogAction(server.ID, "Lambda", lambdaFullName, "Create", claims.UserID, err)
-	_, errGetFlavor := compute.GetCompute(claims.Username).GetFlavor(flavorID, "CLOUD.MN")
+	recordStack(&Stack{
+		Type:            "lambda",
+		RequestID:       params.ID,
+		Name:            lambdaFullName,
+		ServerID:        server.ID,
+		ProjectID:       session.ProjectID,
+		Region:          region.Tag,
+		SysUserID:       claims.SysUserID,
+		OsUserID:        claims.OsUserID,
+		FlavorID:        flavorID,
+		ImageID:         imageID,
+		NetworkID:       networkID,
+		AllowedIP:       params.AllowedIP,
+		DiskSize:        diskSize,
+		TemplateVersion: templateVersion(userData),
+		PhoneHomeToken:  phoneHomeHash(phoneHomeToken),
+		HealthProbes: []HealthProbe{
+			{Name: "app", Kind: "http", Port: 8080, Path: "/"},
+			{Name: "mysql", Kind: "tcp", Port: 3306},
+		},
+	})
+	if len(phoneHomeToken) > 0 {
+		watchPhoneHome(server.ID, phoneHomeDeadline())
+	}
+	computeClient, err := session.Compute()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), fmt.Sprintf("lambda-%v", claims.UserID))
+		return
+	}
+	_, errGetFlavor := flavors.Get(computeClient, flavorID).Extract()
 	if errGetFlavor != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("lambda-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errGetFlavor.Error(), fmt.Sprintf("lambda-%v", claims.UserID))
+		return
 	}
 
-	go func(serverid, username, generatedDB, generatedUsername, generatedPassword string) {
-		provider := service.GetProvider(username)
-		for {
-			server, _ := servers.Get(service.GetClientCompute(provider), serverid).Extract()
+	go func(serverid, generatedDB, generatedUsername, generatedPassword string) {
+		deadline := time.Now().Add(provisionDeadline())
+		for time.Now().Before(deadline) {
+			server, err := servers.Get(computeClient, serverid).Extract()
+			if err != nil {
+				time.Sleep(3 * time.Second)
+				continue
+			}
 			if server.Status == "ACTIVE" {
-				var ip string
-				if server.Addresses["public1"] != nil {
-					for _, l := range server.Addresses["public1"].([]interface{}) {
-						tmp := l.(map[string]interface{})
-						ip = tmp["addr"].(string)
-					}
-				}
-				if server.Addresses["public2"] != nil {
-					for _, l := range server.Addresses["public2"].([]interface{}) {
-						tmp := l.(map[string]interface{})
-						ip = tmp["addr"].(string)
-
-					}
+				addresses, err := resolveStackAddresses(session.Provider(), region, server, networkID, params.StackNetworkParams)
+				if err != nil {
+					addresses.Error = err.Error()
 				}
+				ip := addresses.Primary
+				updateStackAddresses(serverid, "ACTIVE", addresses)
 
 				type ReturnParams struct {
-					ID             string `json:"requestId"`
-					DBName         string `json:"databaseName"`
-					DBUsername     string `json:"databaseUser"`
-					DBPassword     string `json:"databasePwd"`
-					Ip             string `json:"databaseUrl"`
-					ServerName     string `json:"serverName"`
-					ServerPassword string `json:"serverPwd"`
+					ID             string          `json:"requestId"`
+					DBName         string          `json:"databaseName"`
+					DBUsername     string          `json:"databaseUser"`
+					DBPassword     string          `json:"databasePwd"`
+					Ip             string          `json:"databaseUrl"`
+					PrivateIP      string          `json:"privateIp"`
+					PublicIP       string          `json:"publicIp"`
+					Addresses      []ServerAddress `json:"addresses"`
+					AddressError   string          `json:"addressError,omitempty"`
+					ServerName     string          `json:"serverName"`
+					ServerPassword string          `json:"serverPwd"`
 				}
 
-				returnParams := ReturnParams{ID: params.ID, DBName: generatedDB, DBUsername: generatedUsername, DBPassword: generatedPassword, Ip: ip, ServerName: "fibo", ServerPassword: "fibo123"}
+				returnParams := ReturnParams{ID: params.ID, DBName: generatedDB, DBUsername: generatedUsername, DBPassword: generatedPassword, Ip: ip, ServerName: "fibo", ServerPassword: "fibo123", PrivateIP: addresses.PrivateIP, PublicIP: addresses.PublicIP, Addresses: addresses.All, AddressError: addresses.Error}
 				/* sending callback request */
 				fmt.Println("sending callback request")
-				shared.CallbackFunction(callbackUrl, returnParams)
+				deliverWhenReady(serverid, callbackUrl, returnParams)
 				return
 			}
 			if server.Status == "ERROR" {
+				updateStackStatus(serverid, "ERROR")
 				return
 			}
 			time.Sleep(3 * time.Second)
 		}
-	}(server.ID, claims.Username, generatedDB, generatedUsername, generatedPassword)
+		failProvisioning(serverid)
+	}(server.ID, generatedDB, generatedUsername, generatedPassword)
 
 	m.SetBody(server)
 }
@@ -237,15 +274,23 @@ func (m *LambdaController) CreatePHP() {
 		SysAdminLogin    string `json:"sysAdminLogin"  bind:"required"`
 		SysAdminPassword string `json:"sysAdminPassword"  bind:"required"`
 		SysAdminEmail    string `json:"sysAdminEmail"  bind:"required"`
+		Region           string `json:"region"`
+		ProjectID        string `json:"projectId"`
+		StackNetworkParams
 	}
 
 	params := RequestedParams{}
 	if m.BindJSON(&params) != nil {
 		return
 	}
+	session, err := openSession(claims, m.GetClientIP(), params.ProjectID, params.Region, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	region := session.Region
 	id := params.ID
 	flavorID := params.FlavorID // ics4  - 8gb -ram 4 vcpu
-	allowedIp := fmt.Sprintf("%s/32", params.AllowedIP)
 	callbackUrl := params.CallbackUrl
 
 	sysAdminLogin := params.SysAdminLogin
@@ -254,35 +299,33 @@ func (m *LambdaController) CreatePHP() {
 
 	diskSize := 10
 
+	imageID := region.Image("3thparty", models.GetConfig("3thparty_image"))
+	if session.quotaRejected(&m.BaseController, QuotaRequest{FlavorID: flavorID, Disk: diskSize, Volumes: 1, FloatingIPs: floatingIPCount(params.StackNetworkParams)}) {
+		return
+	}
+	if session.imageRejected(&m.BaseController, "lambda-php", imageID, flavorID, 0, diskSize) {
+		return
+	}
+
 	/* find default security group */
-	securityGroupList, err := compute.GetCompute(claims.Username).ListSecGroups()
+	secGroupName, err := session.openStackFirewall("lambda-php", params.AllowedIP)
 	if err != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), fmt.Sprintf("bbx-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
 	}
 
-	var sgIDs []interface{}
-	for _, secGroup := range securityGroupList {
-		if secGroup.Name == "default" {
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "web server", 80, 80, "tcp", "0.0.0.0/0")
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "mysql", 3306, 3306, "tcp", allowedIp)
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "app", 8080, 8080, "tcp", allowedIp)
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "https", 443, 443, "tcp", "0.0.0.0/0")
-			sgIDs = append(sgIDs, secGroup.Name)
-		}
+	networkID, err := resolveStackNetwork(session.Provider(), region, params.StackNetworkParams, params.ID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
 	}
 
-	networkID := ""
-	imageID := models.GetConfig("3thparty_image")
-
 	if networkID == "" {
-		adminProvider, _ := shared.AuthOSAdmin()
+		adminProvider, _ := region.AdminProvider()
 		networkID, _ = networking.GetNetworking("admin").GetAvailableNetworks(adminProvider)
 	}
 
-	secGroup := make([]string, len(sgIDs))
-	for i, v := range sgIDs {
-		secGroup[i] = fmt.Sprint(v)
-	}
+	secGroup := []string{secGroupName}
 
 	userData, err := ioutil.ReadFile("files/lambda-php/base.yml")
 	if err != nil {
@@ -316,63 +359,96 @@ func (m *LambdaController) CreatePHP() {
 	output := strings.Join(lines, "\n")
 	fmt.Println(output)
 
-	scripted := []byte(output)
+	phoneHomeToken := newPhoneHomeToken()
+	scripted := withPhoneHome([]byte(output), phoneHomeToken)
 
-	server, errServer := compute.GetCompute(claims.Username).CreateServerForVolume(imageID, id, flavorID, "", int(diskSize), secGroup, scripted, "nova", true, networkID)
+	server, errServer := session.bootServer(stackServerOpts{Name: id, ImageID: imageID, FlavorID: flavorID, NetworkID: networkID, DiskSize: diskSize, SecurityGroups: secGroup, UserData: scripted})
 	if errServer != nil {
 		fmt.Print(errServer)
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), fmt.Sprintf("bbx-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("bbx-%v", claims.UserID))
 		return
 	}
 
 	service.CreateLogAction(server.ID, "lambda-php", id, "Create", claims.UserID, err)
-	_, errGetFlavor := compute.GetCompute(claims.Username).GetFlavor(flavorID, "CLOUD.MN")
+	recordStack(&Stack{
+		Type:            "lambda-php",
+		RequestID:       id,
+		Name:            id,
+		ServerID:        server.ID,
+		ProjectID:       session.ProjectID,
+		Region:          region.Tag,
+		SysUserID:       claims.SysUserID,
+		OsUserID:        claims.OsUserID,
+		FlavorID:        flavorID,
+		ImageID:         imageID,
+		NetworkID:       networkID,
+		AllowedIP:       params.AllowedIP,
+		DiskSize:        diskSize,
+		TemplateVersion: templateVersion(userData),
+		PhoneHomeToken:  phoneHomeHash(phoneHomeToken),
+		HealthProbes: []HealthProbe{
+			{Name: "web server", Kind: "http", Port: 80, Path: "/"},
+			{Name: "mysql", Kind: "tcp", Port: 3306},
+		},
+	})
+	if len(phoneHomeToken) > 0 {
+		watchPhoneHome(server.ID, phoneHomeDeadline())
+	}
+	computeClient, err := session.Compute()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), fmt.Sprintf("lambda-php-%v", claims.UserID))
+		return
+	}
+	_, errGetFlavor := flavors.Get(computeClient, flavorID).Extract()
 	if errGetFlavor != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("lambda-php-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errGetFlavor.Error(), fmt.Sprintf("lambda-php-%v", claims.UserID))
+		return
 	}
 
-	go func(serverid string, username string) {
-		provider := service.GetProvider(username)
-		for {
-			server, _ := servers.Get(service.GetClientCompute(provider), serverid).Extract()
+	go func(serverid string) {
+		deadline := time.Now().Add(provisionDeadline())
+		for time.Now().Before(deadline) {
+			server, err := servers.Get(computeClient, serverid).Extract()
+			if err != nil {
+				time.Sleep(3 * time.Second)
+				continue
+			}
 			if server.Status == "ACTIVE" {
-				var ip string
-				if server.Addresses["public1"] != nil {
-					for _, l := range server.Addresses["public1"].([]interface{}) {
-						tmp := l.(map[string]interface{})
-						ip = tmp["addr"].(string)
-					}
-				}
-				if server.Addresses["public2"] != nil {
-					for _, l := range server.Addresses["public2"].([]interface{}) {
-						tmp := l.(map[string]interface{})
-						ip = tmp["addr"].(string)
-
-					}
+				addresses, err := resolveStackAddresses(session.Provider(), region, server, networkID, params.StackNetworkParams)
+				if err != nil {
+					addresses.Error = err.Error()
 				}
+				ip := addresses.Primary
+				updateStackAddresses(serverid, "ACTIVE", addresses)
 
 				type ReturnParams struct {
-					ID             string `json:"requestId"`
-					DBName         string `json:"databaseName"`
-					DBUsername     string `json:"databaseUser"`
-					DBPassword     string `json:"databasePwd"`
-					Ip             string `json:"databaseUrl"`
-					ServerName     string `json:"serverName"`
-					ServerPassword string `json:"serverPwd"`
+					ID             string          `json:"requestId"`
+					DBName         string          `json:"databaseName"`
+					DBUsername     string          `json:"databaseUser"`
+					DBPassword     string          `json:"databasePwd"`
+					Ip             string          `json:"databaseUrl"`
+					PrivateIP      string          `json:"privateIp"`
+					PublicIP       string          `json:"publicIp"`
+					Addresses      []ServerAddress `json:"addresses"`
+					AddressError   string          `json:"addressError,omitempty"`
+					ServerName     string          `json:"serverName"`
+					ServerPassword string          `json:"serverPwd"`
 				}
 
-				returnParams := ReturnParams{ID: id, DBName: "primebbx", DBUsername: generatedUsername, DBPassword: generatedPassword, Ip: ip, ServerName: "fibo", ServerPassword: "fibo123"}
+				returnParams := ReturnParams{ID: id, DBName: "primebbx", DBUsername: generatedUsername, DBPassword: generatedPassword, Ip: ip, ServerName: "fibo", ServerPassword: "fibo123", PrivateIP: addresses.PrivateIP, PublicIP: addresses.PublicIP, Addresses: addresses.All, AddressError: addresses.Error}
 				/* sending callback request */
 				fmt.Println("sending callback request")
-				shared.CallbackFunction(callbackUrl, returnParams)
+				deliverWhenReady(serverid, callbackUrl, returnParams)
 				return
 			}
 			if server.Status == "ERROR" {
+				updateStackStatus(serverid, "ERROR")
 				return
 			}
 			time.Sleep(3 * time.Second)
 		}
-	}(server.ID, claims.Username)
+		failProvisioning(serverid)
+	}(server.ID)
 
 	m.SetBody(server)
 }
@@ -380,12 +456,18 @@ func (m *LambdaController) CreatePHP() {
 // FlavorLambda ...
 // @Title FlavorLambda
 // @Description hint FlavorLambda
+// @Param	region	query	string	false	"region tag"
+// @Param	min_cpu	query	int	false	"minimum vcpus"
+// @Param	max_cpu	query	int	false	"maximum vcpus"
+// @Param	min_ram	query	int	false	"minimum ram in MB"
+// @Param	max_ram	query	int	false	"maximum ram in MB"
+// @Param	sort	query	string	false	"name, cpu, ram, price or available"
+// @Param	order	query	string	false	"asc or desc"
 // @Failure 403
 // @router /list [get]
 func (m *LambdaController) FlavorLambda() {
 	claims := m.Claim()
 
-	var mainRes []flavors.Flavor
 	defer func() {
 		if r := recover(); r != nil {
 			m.RespondPanic(r)
@@ -394,18 +476,5 @@ func (m *LambdaController) FlavorLambda() {
 		}
 	}()
 
-	pAccess := flavors.AllAccess
-	listFlavors, err := compute.GetCompute(claims.Username).ListFlavors(pAccess)
-	if err != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), claims.UserID)
-		return
-	}
-	for _, c := range listFlavors {
-		if strings.Contains(c.Name, "Lambda") {
-			mainRes = append(mainRes, c)
-		}
-
-	}
-
-	m.SetBody(mainRes)
+	respondCatalogFlavors(&m.BaseController, claims, "lambda")
 }
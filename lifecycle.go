@@ -0,0 +1,292 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/pauseunpause"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/rescueunrescue"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/shelveunshelve"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/startstop"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/suspendresume"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+	"gitlab.com/ics-project/back-thirdparty/models"
+	"gitlab.com/ics-project/back-thirdparty/service"
+	"gitlab.com/ics-project/back-thirdparty/utils"
+)
+
+// How an action changes the instance usage billed to the user
+const (
+	billingUnchanged = iota
+	billingStart
+	billingStop
+)
+
+// StackActor is the user an action is carried out for, so actions can run outside a request
+type StackActor struct {
+	SysUserID uint32
+	OsUserID  string
+	Username  string
+	ClientIP  string
+	// Provider is scoped to the project of the stack. Stack actions need it; project deletion
+	// runs with admin clients and leaves it nil.
+	Provider *gophercloud.ProviderClient
+}
+
+// ActorFromClaims ...
+func ActorFromClaims(claims shared.Claims, clientIP string) StackActor {
+	return StackActor{
+		SysUserID: claims.SysUserID,
+		OsUserID:  claims.OsUserID,
+		Username:  claims.Username,
+		ClientIP:  clientIP,
+	}
+}
+
+// lifecycleAction is a nova action together with the server states it is allowed from
+type lifecycleAction struct {
+	name    string
+	from    []string
+	billing int
+	status  string
+	cache   string
+	run     func(client *gophercloud.ServiceClient, id string) error
+}
+
+// lifecycleActions are the supported actions keyed by the name clients send
+var lifecycleActions = map[string]lifecycleAction{
+	"start": {name: "Start", from: []string{"SHUTOFF"}, billing: billingStart, cache: helper.Starting, run: func(c *gophercloud.ServiceClient, id string) error {
+		return startstop.Start(c, id).ExtractErr()
+	}},
+	"stop": {name: "Stop", from: []string{"ACTIVE", "ERROR"}, billing: billingStop, status: "SHUTOFF", cache: helper.STOPPING, run: func(c *gophercloud.ServiceClient, id string) error {
+		return startstop.Stop(c, id).ExtractErr()
+	}},
+	// a hard reboot powers a stopped server on without billing it, such a server is started instead
+	"restart": {name: "Reboot", from: []string{"ACTIVE", "PAUSED", "SUSPENDED", "ERROR"}, run: func(c *gophercloud.ServiceClient, id string) error {
+		return servers.Reboot(c, id, servers.RebootOpts{Type: servers.HardReboot}).ExtractErr()
+	}},
+	"hard-reboot": {name: "Reboot", from: []string{"ACTIVE", "PAUSED", "SUSPENDED", "ERROR"}, run: func(c *gophercloud.ServiceClient, id string) error {
+		return servers.Reboot(c, id, servers.RebootOpts{Type: servers.HardReboot}).ExtractErr()
+	}},
+	"soft-reboot": {name: "SoftReboot", from: []string{"ACTIVE"}, run: func(c *gophercloud.ServiceClient, id string) error {
+		return servers.Reboot(c, id, servers.RebootOpts{Type: servers.SoftReboot}).ExtractErr()
+	}},
+	"pause": {name: "Pause", from: []string{"ACTIVE"}, run: func(c *gophercloud.ServiceClient, id string) error {
+		return pauseunpause.Pause(c, id).ExtractErr()
+	}},
+	"unpause": {name: "Unpause", from: []string{"PAUSED"}, run: func(c *gophercloud.ServiceClient, id string) error {
+		return pauseunpause.Unpause(c, id).ExtractErr()
+	}},
+	"suspend": {name: "Suspend", from: []string{"ACTIVE"}, run: func(c *gophercloud.ServiceClient, id string) error {
+		return suspendresume.Suspend(c, id).ExtractErr()
+	}},
+	"resume": {name: "Resume", from: []string{"SUSPENDED"}, run: func(c *gophercloud.ServiceClient, id string) error {
+		return suspendresume.Resume(c, id).ExtractErr()
+	}},
+	// a shelved server frees its hypervisor resources, so it is not billed as an instance
+	"shelve": {name: "Shelve", from: []string{"ACTIVE", "SHUTOFF", "PAUSED", "SUSPENDED"}, billing: billingStop, status: "SHELVED", run: func(c *gophercloud.ServiceClient, id string) error {
+		return shelveunshelve.Shelve(c, id).ExtractErr()
+	}},
+	"unshelve": {name: "Unshelve", from: []string{"SHELVED", "SHELVED_OFFLOADED"}, billing: billingStart, run: func(c *gophercloud.ServiceClient, id string) error {
+		return shelveunshelve.Unshelve(c, id, shelveunshelve.UnshelveOpts{}).ExtractErr()
+	}},
+	"rescue": {name: "Rescue", from: []string{"ACTIVE", "SHUTOFF"}, run: func(c *gophercloud.ServiceClient, id string) error {
+		// volume backed servers can only be rescued from microversion 2.87
+		rescueClient := *c
+		rescueClient.Microversion = "2.87"
+		_, err := rescueunrescue.Rescue(&rescueClient, id, rescueunrescue.RescueOpts{}).Extract()
+		return err
+	}},
+	"unrescue": {name: "Unrescue", from: []string{"RESCUE"}, run: func(c *gophercloud.ServiceClient, id string) error {
+		return rescueunrescue.Unrescue(c, id).ExtractErr()
+	}},
+}
+
+// StackStateError is returned when the server is not in a state the action is allowed from
+type StackStateError struct {
+	Action string
+	Status string
+	From   []string
+}
+
+func (e *StackStateError) Error() string {
+	return fmt.Sprintf("can not %s a server that is %s, it must be %s", e.Action, e.Status, strings.Join(e.From, " or "))
+}
+
+// allowedFrom fails with a StackStateError when the action can not run on a server in the status
+func (a lifecycleAction) allowedFrom(actionName, status string) error {
+	if !containsString(a.from, status) {
+		return &StackStateError{Action: actionName, Status: status, From: a.from}
+	}
+	return nil
+}
+
+// instanceActions holds the servers an action is running on, so two actions never overlap
+var instanceActions sync.Map
+
+// LifecycleActionNames returns the supported action names
+func LifecycleActionNames() []string {
+	names := make([]string, 0, len(lifecycleActions))
+	for name := range lifecycleActions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RunStackAction validates the action against the server's current state, runs it and updates the usage
+func RunStackAction(actor StackActor, region shared.CloudRegion, serverID, actionName string) (*servers.Server, error) {
+	action, ok := lifecycleActions[strings.ToLower(actionName)]
+	if !ok {
+		return nil, fmt.Errorf("unknown action %q, supported actions are %s", actionName, strings.Join(LifecycleActionNames(), ", "))
+	}
+	if running, busy := instanceActions.LoadOrStore(serverID, action.name); busy {
+		return nil, fmt.Errorf("server %s is busy with %s", serverID, running)
+	}
+	defer instanceActions.Delete(serverID)
+
+	if actor.Provider == nil {
+		return nil, fmt.Errorf("no project session to run %s on server %s", action.name, serverID)
+	}
+	client, err := region.ComputeClient(actor.Provider)
+	if err != nil {
+		return nil, err
+	}
+	server, err := servers.Get(client, serverID).Extract()
+	if err != nil {
+		return nil, err
+	}
+	if err := action.allowedFrom(actionName, server.Status); err != nil {
+		return server, err
+	}
+
+	err = action.run(client, server.ID)
+	logID := service.CreateLogAction(server.ID, "Instance", server.Name, action.name, actor.OsUserID, err)
+	if err != nil {
+		return server, err
+	}
+
+	switch action.billing {
+	case billingStart:
+		flavorID, _ := server.Flavor["id"].(string)
+		flavor, err := flavors.Get(client, flavorID).Extract()
+		if err != nil {
+			return server, err
+		}
+		if err := openInstanceUsage(actor, server, flavor, "ACTIVE", logID); err != nil {
+			return server, err
+		}
+	case billingStop:
+		if _, err := closeInstanceUsage(actor, server.ID, action.status, logID); err != nil {
+			return server, err
+		}
+	}
+	if len(action.cache) > 0 {
+		utils.GetUCache().Set(server.ID, action.cache)
+	}
+	return server, nil
+}
+
+// openInstanceUsage starts billing the server with the flavor
+func openInstanceUsage(actor StackActor, server *servers.Server, flavor *flavors.Flavor, status string, logID int64) error {
+	usageObj := models.UsgHistory{
+		SysUserID:       actor.SysUserID,
+		OsUserID:        actor.OsUserID,
+		Type:            "Instance",
+		Hostname:        server.Name,
+		OsResourceID:    server.ID,
+		OsInstanceID:    server.ID,
+		Flavor:          flavor.Name,
+		DiskSize:        0,
+		CPU:             flavor.VCPUs,
+		RAM:             flavor.RAM,
+		Status:          status,
+		StartDate:       time.Now().Format(helper.TimeFormatYYYYMMDDHHMMSS),
+		EndDate:         "",
+		IP:              actor.ClientIP,
+		LastLogActionID: uint32(logID),
+	}
+	o := orm.NewOrm()
+	_, err := o.Insert(&usageObj)
+	return err
+}
+
+// closeInstanceUsage ends the running usage of the server and returns how many rows were closed
+func closeInstanceUsage(actor StackActor, serverID, status string, logID int64) (int64, error) {
+	return closeUsage(actor, "Instance", serverID, status, logID)
+}
+
+// closeUsage ends the running usage of the resource and returns how many rows were closed
+func closeUsage(actor StackActor, usageType, resourceID, status string, logID int64) (int64, error) {
+	o := orm.NewOrm()
+	return o.QueryTable("usg_history").Filter("os_resource_id", resourceID).Filter("type", usageType).Filter("end_date", "").Update(orm.Params{
+		"sys_user_id":        actor.SysUserID,
+		"os_user_id":         actor.OsUserID,
+		"status":             status,
+		"end_date":           time.Now().Format(helper.TimeFormatYYYYMMDDHHMMSS),
+		"ip":                 actor.ClientIP,
+		"last_log_action_id": logID,
+	})
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// StackActionParams ...
+type StackActionParams struct {
+	ID     string `json:"id" bind:"required"`
+	Action string `json:"action" bind:"required"`
+}
+
+// Action ...
+// @Title Action
+// @Description start, stop, reboot, pause, suspend, shelve or rescue the stack's server and their reverse
+// @Param	body	body	thirtdparty.StackActionParams	true	"body for action"
+// @Failure 403
+// @router /action [post]
+func (m *StackController) Action() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params StackActionParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	stack, err := GetProjectStack(claims, params.ID, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	session, err := stackSession(claims, m.GetClientIP(), stack, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	server, err := RunStackAction(session.Actor, session.Region, stack.ServerID, params.Action)
+	if err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(server)
+}
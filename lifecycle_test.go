@@ -0,0 +1,60 @@
+package thirtdparty
+
+import "testing"
+
+func TestLifecycleActionAllowedFrom(t *testing.T) {
+	cases := []struct {
+		action string
+		status string
+		allow  bool
+	}{
+		{"start", "SHUTOFF", true},
+		{"start", "ACTIVE", false},
+		{"stop", "ACTIVE", true},
+		{"stop", "ERROR", true},
+		{"stop", "SHUTOFF", false},
+		{"soft-reboot", "SHUTOFF", false},
+		{"restart", "ACTIVE", true},
+		{"restart", "SHUTOFF", false},
+		{"hard-reboot", "SHUTOFF", false},
+		{"suspend", "ACTIVE", true},
+		{"suspend", "SHUTOFF", false},
+		{"unpause", "PAUSED", true},
+		{"resume", "ACTIVE", false},
+		{"unshelve", "SHELVED_OFFLOADED", true},
+		{"shelve", "SHELVED", false},
+		{"unrescue", "RESCUE", true},
+	}
+	for _, c := range cases {
+		action, ok := lifecycleActions[c.action]
+		if !ok {
+			t.Fatalf("%s: action not found", c.action)
+		}
+		err := action.allowedFrom(c.action, c.status)
+		if c.allow && err != nil {
+			t.Errorf("%s from %s: unexpected error %v", c.action, c.status, err)
+		}
+		if !c.allow {
+			stateErr, ok := err.(*StackStateError)
+			if !ok {
+				t.Errorf("%s from %s: expected a StackStateError, got %v", c.action, c.status, err)
+				continue
+			}
+			if stateErr.Action != c.action || stateErr.Status != c.status {
+				t.Errorf("%s from %s: error reports %s from %s", c.action, c.status, stateErr.Action, stateErr.Status)
+			}
+		}
+	}
+}
+
+func TestLifecycleActionsAreComplete(t *testing.T) {
+	for _, name := range LifecycleActionNames() {
+		action := lifecycleActions[name]
+		if len(action.from) == 0 {
+			t.Errorf("%s: no status it can run from", name)
+		}
+		if action.run == nil {
+			t.Errorf("%s: nothing to run", name)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package thirtdparty
 import (
 	"fmt"
 	"io/ioutil"
-	"os"
 	"strings"
 	"time"
 
@@ -16,9 +15,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
-	"gitlab.com/ics-project/back-thirdparty/integration/compute"
 	"gitlab.com/ics-project/back-thirdparty/service"
 	"gitlab.com/ics-project/back-thirdparty/utils"
 )
@@ -72,6 +71,9 @@ type MeetingCreateStruct struct {
 	SgIDs         []interface{} `json:"sg_ids" bind:"required"`
 	AdminEmail    string        `json:"admin_email" bind:"required"`
 	AdminPassword string        `json:"admin_password" bind:"required"`
+	Region        string        `json:"region"`
+	ProjectID     string        `json:"projectId"`
+	StackNetworkParams
 }
 
 // Create Moodle stack ...
@@ -98,6 +100,12 @@ func (m *MeetingController) Create() {
 	if m.BindJSON(&params) != nil {
 		return
 	}
+	session, err := openSession(claims, m.GetClientIP(), params.ProjectID, params.Region, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	region := session.Region
 
 	clientIP := m.Ctx.Request.Header.Get("ClientIP")
 	osUserID := claims.UserID
@@ -106,10 +114,25 @@ func (m *MeetingController) Create() {
 	adminPassword := params.AdminPassword
 	flavorID := "146aef2b-98ba-4c5e-8bb9-33f5aa8664ec"
 	diskSize := 50
-	networkID := os.Getenv("public.network.id")
-	imageID := "89b21a98-0ba6-46a3-8bac-bb210e289652"
+	imageID := region.Image("meeting", "89b21a98-0ba6-46a3-8bac-bb210e289652")
 	sysUserID := claims.SysUserID
 
+	if session.quotaRejected(&m.BaseController, QuotaRequest{FlavorID: flavorID, Disk: diskSize, Volumes: 1, FloatingIPs: floatingIPCount(params.StackNetworkParams)}) {
+		return
+	}
+	if session.imageRejected(&m.BaseController, "meeting", imageID, flavorID, 0, diskSize) {
+		return
+	}
+
+	networkID, err := resolveStackNetwork(session.Provider(), region, params.StackNetworkParams, params.Domain)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if networkID == "" {
+		networkID = region.PublicNetworkID
+	}
+
 	//region [DOMAIN CHECK, CREATE]
 	isExist, errDomain := Check(domainName)
 	if isExist {
@@ -177,33 +200,71 @@ func (m *MeetingController) Create() {
 	fmt.Println(output)
 	scripted := []byte(output)
 
-	server, errServer := compute.GetCompute(claims.Username).CreateServerForVolume(imageID, domainName, flavorID, "", int(diskSize), secGroup, scripted, "nova", true, networkID)
+	server, errServer := session.bootServer(stackServerOpts{Name: domainName, ImageID: imageID, FlavorID: flavorID, NetworkID: networkID, DiskSize: diskSize, SecurityGroups: secGroup, UserData: scripted})
 	if errServer != nil {
 		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("meeting-%v", claims.UserID))
 		return
 	}
 
 	logID := service.CreateLogAction(server.ID, "Moodle", domainName, "Create", claims.UserID, err)
-	flavorRes, errGetFlavor := compute.GetCompute(claims.Username).GetFlavor(flavorID, "CLOUD.MN")
+	recordStack(&Stack{
+		Type:            "meeting",
+		RequestID:       "",
+		Name:            domainName,
+		ServerID:        server.ID,
+		ProjectID:       session.ProjectID,
+		Region:          region.Tag,
+		SysUserID:       claims.SysUserID,
+		OsUserID:        claims.OsUserID,
+		FlavorID:        flavorID,
+		ImageID:         imageID,
+		NetworkID:       networkID,
+		DomainID:        uint32(domainID),
+		DiskSize:        diskSize,
+		TemplateVersion: templateVersion(userData),
+		HealthProbes: []HealthProbe{
+			{Name: "jitsi", Kind: "https", Port: 443, Path: "/", ExpectStatus: 200},
+			{Name: "certificate", Kind: "tls", Port: 443},
+		},
+	})
+	computeClient, err := session.Compute()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), fmt.Sprintf("meeting-%v", claims.UserID))
+		return
+	}
+	flavorRes, errGetFlavor := flavors.Get(computeClient, flavorID).Extract()
 	if errGetFlavor != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), fmt.Sprintf("meeting-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errGetFlavor.Error(), fmt.Sprintf("meeting-%v", claims.UserID))
+		return
 	}
 
-	go func(serverid string, username string, logID int64) {
-		provider := service.GetProvider(username)
-		for {
-			server, _ := servers.Get(service.GetClientCompute(provider), serverid).Extract()
+	go func(serverid string, logID int64) {
+		deadline := time.Now().Add(provisionDeadline())
+		for time.Now().Before(deadline) {
+			server, err := servers.Get(computeClient, serverid).Extract()
+			if err != nil {
+				time.Sleep(3 * time.Second)
+				continue
+			}
 			if server.Status == "ACTIVE" {
 				service.CreateUsageAction(uint32(sysUserID), osUserID, "Instance", domainName, server.ID, server.ID, flavorRes.Name, "ACTIVE", clientIP, logID, time.Now(), time.Time{}, 0, flavorRes.VCPUs, flavorRes.RAM, true)
 
-				for _, l := range server.Addresses["public1"].([]interface{}) {
-					tmp := l.(map[string]interface{})
+				addresses, err := resolveStackAddresses(session.Provider(), region, server, networkID, params.StackNetworkParams)
+				if err != nil {
+					addresses.Error = err.Error()
+				}
+				updateStackAddresses(serverid, "ACTIVE", addresses)
+				addr := addresses.PublicIP
+				if len(addr) == 0 {
+					addr = addresses.Primary
+				}
+				if len(addr) > 0 {
 					o := orm.NewOrm()
 					o.QueryTable("domains").Filter("id", domainID).Update(orm.Params{
-						"ip": tmp["addr"].(string),
+						"ip": addr,
 					})
 
-					service.CreateUsageAction(uint32(sysUserID), osUserID, "IP", tmp["addr"].(string), "", server.ID, "", "ACTIVE", tmp["addr"].(string), logID, time.Now(), time.Time{}, 0, 0, 0, true)
+					service.CreateUsageAction(uint32(sysUserID), osUserID, "IP", addr, "", server.ID, "", "ACTIVE", addr, logID, time.Now(), time.Time{}, 0, 0, 0, true)
 				}
 
 				for _, volume := range server.AttachedVolumes {
@@ -213,11 +274,13 @@ func (m *MeetingController) Create() {
 				return
 			}
 			if server.Status == "ERROR" {
+				updateStackStatus(serverid, "ERROR")
 				return
 			}
 			time.Sleep(3 * time.Second)
 		}
-	}(server.ID, claims.Username, logID)
+		failProvisioning(serverid)
+	}(server.ID, logID)
 	//endregion
 
 	m.SetBody(server)
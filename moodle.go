@@ -3,15 +3,14 @@ package thirtdparty
 import (
 	"fmt"
 	"io/ioutil"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
 	"gitlab.com/ics-project/back-thirdparty/helper"
-	"gitlab.com/ics-project/back-thirdparty/integration/compute"
 	"gitlab.com/ics-project/back-thirdparty/models"
 	"gitlab.com/ics-project/back-thirdparty/service"
 	"gitlab.com/ics-project/back-thirdparty/utils"
@@ -34,6 +33,9 @@ type MoodleCreateStruct struct {
 	MoodleFullname  string        `json:"moodle_full_name" bind:"required"`
 	MoodleShortname string        `json:"moodle_short_name" bind:"required"`
 	DomainName      string        `json:"domain_name" bind:"required"`
+	Region          string        `json:"region"`
+	ProjectID       string        `json:"projectId"`
+	StackNetworkParams
 }
 
 // Create Moodle stack ...
@@ -59,6 +61,12 @@ func (m *MoodleController) Create() {
 	if m.BindJSON(&params) != nil {
 		return
 	}
+	session, err := openSession(claims, m.GetClientIP(), params.ProjectID, params.Region, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	region := session.Region
 
 	clientIP := m.Ctx.Request.Header.Get("ClientIP")
 	dbUser := "fibo"
@@ -67,12 +75,27 @@ func (m *MoodleController) Create() {
 	osUserID := claims.UserID
 	flavorID := "7868fc2f-88b4-4aa9-96a0-d56519e2b910" // ics4  - 8gb -ram 4 vcpu
 	diskSize := 50
-	networkID := os.Getenv("public.network.id")
-	imageID := "89b21a98-0ba6-46a3-8bac-bb210e289652"
+	imageID := region.Image("moodle", "89b21a98-0ba6-46a3-8bac-bb210e289652")
 	sysUserID := claims.SysUserID
 
 	domainName := params.DomainName + ".ics.itools.mn"
 
+	if session.quotaRejected(&m.BaseController, QuotaRequest{FlavorID: flavorID, Disk: diskSize, Volumes: 1, FloatingIPs: floatingIPCount(params.StackNetworkParams)}) {
+		return
+	}
+	if session.imageRejected(&m.BaseController, "moodle", imageID, flavorID, 0, diskSize) {
+		return
+	}
+
+	networkID, err := resolveStackNetwork(session.Provider(), region, params.StackNetworkParams, params.DomainName)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if networkID == "" {
+		networkID = region.PublicNetworkID
+	}
+
 	//region [DOMAIN CHECK, CREATE]
 	isExist, errDomain := Check(domainName)
 	if isExist {
@@ -167,34 +190,72 @@ func (m *MoodleController) Create() {
 
 	scripted := []byte(output)
 
-	server, errServer := compute.GetCompute(claims.Username).CreateServerForVolume(imageID, domainName, flavorID, "", int(diskSize), secGroup, scripted, "nova", true, networkID)
+	server, errServer := session.bootServer(stackServerOpts{Name: domainName, ImageID: imageID, FlavorID: flavorID, NetworkID: networkID, DiskSize: diskSize, SecurityGroups: secGroup, UserData: scripted})
 	if errServer != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), fmt.Sprintf("moodle-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("moodle-%v", claims.UserID))
 		return
 	}
 
 	logID := service.CreateLogAction(server.ID, "Moodle", domainName, "Create", claims.UserID, err)
-	flavorRes, errGetFlavor := compute.GetCompute(claims.Username).GetFlavor(flavorID, "CLOUD.MN")
+	recordStack(&Stack{
+		Type:            "moodle",
+		RequestID:       "",
+		Name:            domainName,
+		ServerID:        server.ID,
+		ProjectID:       session.ProjectID,
+		Region:          region.Tag,
+		SysUserID:       claims.SysUserID,
+		OsUserID:        claims.OsUserID,
+		FlavorID:        flavorID,
+		ImageID:         imageID,
+		NetworkID:       networkID,
+		DomainID:        uint32(domainID),
+		DiskSize:        diskSize,
+		TemplateVersion: templateVersion(userData),
+		HealthProbes: []HealthProbe{
+			{Name: "moodle", Kind: "https", Port: 443, Path: "/login/index.php", ExpectStatus: 200},
+			{Name: "certificate", Kind: "tls", Port: 443},
+		},
+	})
+	computeClient, err := session.Compute()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), fmt.Sprintf("moodle-%v", claims.UserID))
+		return
+	}
+	flavorRes, errGetFlavor := flavors.Get(computeClient, flavorID).Extract()
 	if errGetFlavor != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("moodle-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errGetFlavor.Error(), fmt.Sprintf("moodle-%v", claims.UserID))
+		return
 	}
 
-	go func(serverid string, username string, logID int64) {
-		provider := service.GetProvider(username)
-		for {
-			server, _ := servers.Get(service.GetClientCompute(provider), serverid).Extract()
+	go func(serverid string, logID int64) {
+		deadline := time.Now().Add(provisionDeadline())
+		for time.Now().Before(deadline) {
+			server, err := servers.Get(computeClient, serverid).Extract()
+			if err != nil {
+				time.Sleep(3 * time.Second)
+				continue
+			}
 			if server.Status == "ACTIVE" {
 				service.CreateUsageAction(uint32(sysUserID), osUserID, "Instance", domainName, server.ID, server.ID, flavorRes.Name, "ACTIVE", clientIP, logID, time.Now(), time.Time{}, 0, flavorRes.VCPUs, flavorRes.RAM, true)
 
-				for _, l := range server.Addresses["public1"].([]interface{}) {
+				addresses, err := resolveStackAddresses(session.Provider(), region, server, networkID, params.StackNetworkParams)
+				if err != nil {
+					addresses.Error = err.Error()
+				}
+				updateStackAddresses(serverid, "ACTIVE", addresses)
+				addr := addresses.PublicIP
+				if len(addr) == 0 {
+					addr = addresses.Primary
+				}
+				if len(addr) > 0 {
 					o := orm.NewOrm()
-					tmp := l.(map[string]interface{})
 
 					o.QueryTable("domains").Filter("id", domainID).Update(orm.Params{
-						"ip": tmp["addr"].(string),
+						"ip": addr,
 					})
 
-					service.CreateUsageAction(uint32(sysUserID), osUserID, "IP", tmp["addr"].(string), "", server.ID, "", "ACTIVE", tmp["addr"].(string), logID, time.Now(), time.Time{}, 0, 0, 0, true)
+					service.CreateUsageAction(uint32(sysUserID), osUserID, "IP", addr, "", server.ID, "", "ACTIVE", addr, logID, time.Now(), time.Time{}, 0, 0, 0, true)
 				}
 
 				for _, volume := range server.AttachedVolumes {
@@ -205,11 +266,13 @@ func (m *MoodleController) Create() {
 				return
 			}
 			if server.Status == "ERROR" {
+				updateStackStatus(serverid, "ERROR")
 				return
 			}
 			time.Sleep(3 * time.Second)
 		}
-	}(server.ID, claims.Username, logID)
+		failProvisioning(serverid)
+	}(server.ID, logID)
 
 	m.SetBody(server)
 }
@@ -0,0 +1,285 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/external"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/routers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/networks"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/models"
+)
+
+// StackNetworkParams selects the network a stack boots on.
+// Without any of them the stack keeps booting on the region's shared network.
+type StackNetworkParams struct {
+	NetworkID      string `json:"networkId"`
+	FloatingIP     bool   `json:"floatingIp"`
+	FloatingIPPool string `json:"floatingIpPool"`
+}
+
+// UsesTenantNetwork reports whether the stack boots on a private project network
+func (p StackNetworkParams) UsesTenantNetwork() bool {
+	return len(p.NetworkID) > 0 || p.FloatingIP
+}
+
+type networkWithExternal struct {
+	networks.Network
+	external.NetworkExternalExt
+}
+
+// findNetwork looks a network up by id or by name
+func findNetwork(client *gophercloud.ServiceClient, idOrName string) (*networkWithExternal, error) {
+	var network networkWithExternal
+	if err := networks.Get(client, idOrName).ExtractInto(&network); err == nil {
+		return &network, nil
+	}
+
+	allPages, err := networks.List(client, networks.ListOpts{Name: idOrName}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	var found []networkWithExternal
+	if err := networks.ExtractNetworksInto(allPages, &found); err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("network %q not found", idOrName)
+	}
+	return &found[0], nil
+}
+
+// floatingPool returns the external network floating IPs are allocated from
+func floatingPool(client *gophercloud.ServiceClient, region shared.CloudRegion, pool string) (string, error) {
+	if len(pool) == 0 {
+		pool = region.PublicNetworkID
+	}
+	if len(pool) == 0 {
+		return "", fmt.Errorf("region %s has no public network", region.Tag)
+	}
+	network, err := findNetwork(client, pool)
+	if err != nil {
+		return "", err
+	}
+	if !network.External {
+		return "", fmt.Errorf("network %q is not a floating IP pool", pool)
+	}
+	return network.ID, nil
+}
+
+// validate rejects a floating IP pool given without asking for a floating IP
+func (p StackNetworkParams) validate() error {
+	if len(p.FloatingIPPool) > 0 && !p.FloatingIP {
+		return fmt.Errorf("floatingIpPool is only used with floatingIp")
+	}
+	return nil
+}
+
+// routedSubnets returns the subnets attached to a router of the project whose gateway is on the pool
+func routedSubnets(client *gophercloud.ServiceClient, poolID string) (map[string]bool, error) {
+	allPages, err := routers.List(client, routers.ListOpts{}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	list, err := routers.ExtractRouters(allPages)
+	if err != nil {
+		return nil, err
+	}
+	routed := map[string]bool{}
+	for _, router := range list {
+		if router.GatewayInfo.NetworkID != poolID {
+			continue
+		}
+		portPages, err := ports.List(client, ports.ListOpts{DeviceID: router.ID}).AllPages()
+		if err != nil {
+			return nil, err
+		}
+		routerPorts, err := ports.ExtractPorts(portPages)
+		if err != nil {
+			return nil, err
+		}
+		for _, port := range routerPorts {
+			for _, ip := range port.FixedIPs {
+				routed[ip.SubnetID] = true
+			}
+		}
+	}
+	return routed, nil
+}
+
+// tenantDNSServers are the name servers of created subnets, tenant_network_dns in the config table
+func tenantDNSServers() []string {
+	servers := []string{}
+	for _, server := range strings.Split(models.GetConfig("tenant_network_dns"), ",") {
+		if server = strings.TrimSpace(server); len(server) > 0 {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// ensureTenantNetwork returns the first private network of the project routed to the pool.
+// When the project has none, a network, a subnet and a router to the pool are created,
+// and whatever was created is removed again when a later step fails.
+func ensureTenantNetwork(client *gophercloud.ServiceClient, poolID, name string) (networkID string, err error) {
+	allPages, err := networks.List(client, networks.ListOpts{}).AllPages()
+	if err != nil {
+		return "", err
+	}
+	var existing []networkWithExternal
+	if err := networks.ExtractNetworksInto(allPages, &existing); err != nil {
+		return "", err
+	}
+	routed, err := routedSubnets(client, poolID)
+	if err != nil {
+		return "", err
+	}
+	for _, network := range existing {
+		if network.External || network.Shared {
+			continue
+		}
+		for _, subnetID := range network.Subnets {
+			if routed[subnetID] {
+				return network.ID, nil
+			}
+		}
+	}
+
+	var rollback []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(rollback) - 1; i >= 0; i-- {
+			if errRollback := rollback[i](); errRollback != nil {
+				fmt.Println("Failed rolling back tenant network", name, errRollback)
+			}
+		}
+	}()
+
+	adminStateUp := true
+	network, err := networks.Create(client, networks.CreateOpts{
+		Name:         fmt.Sprintf("%s-network", name),
+		AdminStateUp: &adminStateUp,
+	}).Extract()
+	if err != nil {
+		return "", err
+	}
+	rollback = append(rollback, func() error { return networks.Delete(client, network.ID).ExtractErr() })
+
+	cidr := models.GetConfig("tenant_network_cidr")
+	if len(cidr) == 0 {
+		cidr = "192.168.100.0/24"
+	}
+	enableDHCP := true
+	subnet, err := subnets.Create(client, subnets.CreateOpts{
+		NetworkID:      network.ID,
+		Name:           fmt.Sprintf("%s-subnet", name),
+		CIDR:           cidr,
+		IPVersion:      gophercloud.IPv4,
+		EnableDHCP:     &enableDHCP,
+		DNSNameservers: tenantDNSServers(),
+	}).Extract()
+	if err != nil {
+		return "", err
+	}
+	rollback = append(rollback, func() error { return subnets.Delete(client, subnet.ID).ExtractErr() })
+
+	router, err := routers.Create(client, routers.CreateOpts{
+		Name:         fmt.Sprintf("%s-router", name),
+		AdminStateUp: &adminStateUp,
+		GatewayInfo:  &routers.GatewayInfo{NetworkID: poolID},
+	}).Extract()
+	if err != nil {
+		return "", err
+	}
+	rollback = append(rollback, func() error { return routers.Delete(client, router.ID).ExtractErr() })
+
+	if _, err := routers.AddInterface(client, router.ID, routers.AddInterfaceOpts{SubnetID: subnet.ID}).Extract(); err != nil {
+		return "", err
+	}
+	return network.ID, nil
+}
+
+// resolveStackNetwork returns the network the stack should boot on, or "" for the legacy shared network
+func resolveStackNetwork(provider *gophercloud.ProviderClient, region shared.CloudRegion, params StackNetworkParams, name string) (string, error) {
+	if err := params.validate(); err != nil {
+		return "", err
+	}
+	if !params.UsesTenantNetwork() {
+		return "", nil
+	}
+	client, err := region.NetworkClient(provider)
+	if err != nil {
+		return "", err
+	}
+
+	if len(params.NetworkID) > 0 {
+		network, err := findNetwork(client, params.NetworkID)
+		if err != nil {
+			return "", err
+		}
+		return network.ID, nil
+	}
+
+	poolID, err := floatingPool(client, region, params.FloatingIPPool)
+	if err != nil {
+		return "", err
+	}
+	return ensureTenantNetwork(client, poolID, name)
+}
+
+// allocateStackAddresses returns the private address of the server on the network and,
+// when requested, associates a floating IP from the chosen pool with it
+func allocateStackAddresses(provider *gophercloud.ProviderClient, region shared.CloudRegion, serverID, networkID string, params StackNetworkParams) (privateIP, publicIP string, err error) {
+	client, err := region.NetworkClient(provider)
+	if err != nil {
+		return "", "", err
+	}
+
+	var port *ports.Port
+	// the port can show up a moment after the server turns ACTIVE
+	for i := 0; i < 10 && port == nil; i++ {
+		allPages, err := ports.List(client, ports.ListOpts{DeviceID: serverID, NetworkID: networkID}).AllPages()
+		if err != nil {
+			return "", "", err
+		}
+		serverPorts, err := ports.ExtractPorts(allPages)
+		if err != nil {
+			return "", "", err
+		}
+		if len(serverPorts) > 0 && len(serverPorts[0].FixedIPs) > 0 {
+			port = &serverPorts[0]
+			break
+		}
+		time.Sleep(3 * time.Second)
+	}
+	if port == nil {
+		return "", "", fmt.Errorf("server %s has no port on network %s", serverID, networkID)
+	}
+	privateIP = port.FixedIPs[0].IPAddress
+
+	if !params.FloatingIP {
+		return privateIP, "", nil
+	}
+	poolID, err := floatingPool(client, region, params.FloatingIPPool)
+	if err != nil {
+		return privateIP, "", err
+	}
+	fip, err := floatingips.Create(client, floatingips.CreateOpts{
+		FloatingNetworkID: poolID,
+		PortID:            port.ID,
+		FixedIP:           privateIP,
+		Description:       fmt.Sprintf("server %s", serverID),
+	}).Extract()
+	if err != nil {
+		return privateIP, "", err
+	}
+	return privateIP, fip.FloatingIP, nil
+}
@@ -357,11 +357,14 @@ func EmailForgotPassword(firstname, lastname, email, token string) bool {
 	req, _ := http.NewRequest("POST", url, payload)
 	req.Header.Add("Content-Type", "application/json")
 	res, err := http.DefaultClient.Do(req)
-	fmt.Println(err)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
 	defer res.Body.Close()
 	body, _ := ioutil.ReadAll(res.Body)
 	fmt.Println(body)
-	return true
+	return res.StatusCode < 300
 }
 
 // InviteUserToProject ...
@@ -378,11 +381,14 @@ func InviteUserToProject(invited_by, invited_project, email, token string) bool
 	req, _ := http.NewRequest("POST", url, payload)
 	req.Header.Add("Content-Type", "application/json")
 	res, err := http.DefaultClient.Do(req)
-	fmt.Println(err)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
 	defer res.Body.Close()
 	body, _ := ioutil.ReadAll(res.Body)
 	fmt.Println(body)
-	return true
+	return res.StatusCode < 300
 }
 
 func ProjectNotifcations(path, method string, payloadObject interface{}) bool {
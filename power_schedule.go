@@ -0,0 +1,553 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/orm"
+	"github.com/astaxie/beego/toolbox"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// Outcomes of a power schedule run
+const (
+	PowerRunSucceeded = "SUCCEEDED"
+	PowerRunSkipped   = "SKIPPED"
+	PowerRunFailed    = "FAILED"
+)
+
+// PowerSchedule stops and starts a stack at fixed times of the chosen week days
+type PowerSchedule struct {
+	ID          uint32    `orm:"column(id);auto;pk" json:"id"`
+	Name        string    `orm:"column(name);size(255)" json:"name"`
+	SysUserID   uint32    `orm:"column(sys_user_id)" json:"-"`
+	OsUserID    string    `orm:"column(os_user_id);size(64);index" json:"osUserId"`
+	Username    string    `orm:"column(username);size(255)" json:"-"`
+	ServerID    string    `orm:"column(server_id);size(64);index" json:"serverId"`
+	StopAt      string    `orm:"column(stop_at);size(5);null" json:"stopAt"`
+	StartAt     string    `orm:"column(start_at);size(5);null" json:"startAt"`
+	Weekdays    string    `orm:"column(weekdays);size(32)" json:"weekdays"`
+	TimeZone    string    `orm:"column(time_zone);size(64);null" json:"timeZone"`
+	Enabled     bool      `orm:"column(enabled)" json:"enabled"`
+	PausedUntil time.Time `orm:"column(paused_until);type(datetime);null" json:"pausedUntil"`
+	CheckedAt   time.Time `orm:"column(checked_at);type(datetime);null" json:"-"`
+	CreatedAt   time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+	UpdatedAt   time.Time `orm:"column(updated_at);auto_now;type(datetime)" json:"updatedAt"`
+}
+
+// TableName ...
+func (t *PowerSchedule) TableName() string {
+	return "power_schedules"
+}
+
+// PowerScheduleRun records what a schedule did, or why it did nothing, at one of its times
+type PowerScheduleRun struct {
+	ID         uint32    `orm:"column(id);auto;pk" json:"id"`
+	ScheduleID uint32    `orm:"column(schedule_id);index" json:"scheduleId"`
+	ServerID   string    `orm:"column(server_id);size(64)" json:"serverId"`
+	Action     string    `orm:"column(action);size(16)" json:"action"`
+	Status     string    `orm:"column(status);size(16)" json:"status"`
+	Message    string    `orm:"column(message);size(1024);null" json:"message"`
+	RunAt      time.Time `orm:"column(run_at);type(datetime);index" json:"runAt"`
+}
+
+// TableName ...
+func (t *PowerScheduleRun) TableName() string {
+	return "power_schedule_runs"
+}
+
+func init() {
+	orm.RegisterModel(new(PowerSchedule), new(PowerScheduleRun))
+	beego.AddAPPStartHook(startPowerScheduler)
+}
+
+// startPowerScheduler checks the schedules every minute once the application has started
+func startPowerScheduler() error {
+	task, err := newScheduledTask("power-schedules", "0 * * * * *", func() error {
+		runPowerSchedules(time.Now())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	toolbox.AddTask("power-schedules", task)
+	toolbox.StartTask()
+	return nil
+}
+
+// location is the schedule's time zone, or the configured gmt.time.gap when it has none
+func (t *PowerSchedule) location() *time.Location {
+	if len(t.TimeZone) > 0 {
+		if loc, err := time.LoadLocation(t.TimeZone); err == nil {
+			return loc
+		}
+	}
+	gap := beego.AppConfig.DefaultFloat("gmt.time.gap", 0)
+	return time.FixedZone(fmt.Sprintf("GMT%+g", gap), int(gap*3600))
+}
+
+// runsOn tells whether the schedule is active on the week day, 0 being Sunday
+func (t *PowerSchedule) runsOn(day time.Weekday) bool {
+	for _, value := range strings.Split(t.Weekdays, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && time.Weekday(n) == day {
+			return true
+		}
+	}
+	return false
+}
+
+// powerCatchUp is how late a missed action still runs, power.catchup.minutes in app.conf
+func powerCatchUp() time.Duration {
+	return time.Duration(beego.AppConfig.DefaultInt("power.catchup.minutes", 60)) * time.Minute
+}
+
+// dueActions returns the action of the schedule that fell due after since and up to now.
+// Runs missed while the scheduler was down are caught up, when a stop and a start were both
+// missed only the later one is returned as it is the state the stack should be in.
+func (t *PowerSchedule) dueActions(since, now time.Time) []string {
+	loc := t.location()
+	local := now.In(loc)
+	var due string
+	var dueAt time.Time
+	start := since.In(loc)
+	for day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc); !day.After(local); day = day.AddDate(0, 0, 1) {
+		if !t.runsOn(day.Weekday()) {
+			continue
+		}
+		for _, planned := range []struct{ action, clock string }{{"stop", t.StopAt}, {"start", t.StartAt}} {
+			clock, err := time.Parse("15:04", planned.clock)
+			if err != nil {
+				continue
+			}
+			at := time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, loc)
+			if at.After(since) && !at.After(now) && !at.Before(dueAt) {
+				due, dueAt = planned.action, at
+			}
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	return []string{due}
+}
+
+// runPowerSchedules carries out every schedule that fell due since it was last checked and prunes old runs
+func runPowerSchedules(now time.Time) {
+	o := orm.NewOrm()
+	var schedules []PowerSchedule
+	if _, err := o.QueryTable(new(PowerSchedule)).Filter("enabled", true).All(&schedules); err != nil {
+		fmt.Println("Failed listing power schedules", err)
+		return
+	}
+	oldest := now.Add(-powerCatchUp())
+	for i := range schedules {
+		schedule := &schedules[i]
+		since := schedule.CheckedAt
+		if since.Before(oldest) {
+			since = oldest
+		}
+		for _, action := range schedule.dueActions(since, now) {
+			go runPowerSchedule(schedule, action, now)
+		}
+		schedule.CheckedAt = now
+		if _, err := o.Update(schedule, "checked_at"); err != nil {
+			fmt.Println("Failed recording power schedule check", schedule.ID, err)
+		}
+	}
+
+	days := beego.AppConfig.DefaultInt("power.history.days", 30)
+	o.QueryTable(new(PowerScheduleRun)).Filter("run_at__lt", now.AddDate(0, 0, -days)).Delete()
+}
+
+// runPowerSchedule runs the action through the lifecycle actions, which keep usg_history in step
+func runPowerSchedule(schedule *PowerSchedule, action string, now time.Time) {
+	run := PowerScheduleRun{
+		ScheduleID: schedule.ID,
+		ServerID:   schedule.ServerID,
+		Action:     action,
+		RunAt:      now,
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			run.Status = PowerRunFailed
+			run.Message = fmt.Sprint(r)
+		}
+		o := orm.NewOrm()
+		if _, err := o.Insert(&run); err != nil {
+			fmt.Println("Failed recording power schedule run", schedule.ID, err)
+		}
+	}()
+
+	if now.Before(schedule.PausedUntil) {
+		run.Status = PowerRunSkipped
+		run.Message = "schedule paused until " + schedule.PausedUntil.Format(time.RFC3339)
+		return
+	}
+	stack, err := GetProjectStack(shared.Claims{SysUserID: schedule.SysUserID, OsUserID: schedule.OsUserID, Username: schedule.Username}, schedule.ServerID, RoleAdmin)
+	if err != nil {
+		run.Status = PowerRunFailed
+		run.Message = err.Error()
+		return
+	}
+	region, provider, err := stackServiceProvider(stack)
+	if err != nil {
+		run.Status = PowerRunFailed
+		run.Message = err.Error()
+		return
+	}
+
+	actor := StackActor{SysUserID: schedule.SysUserID, OsUserID: schedule.OsUserID, Username: schedule.Username, Provider: provider}
+	_, err = RunStackAction(actor, region, stack.ServerID, action)
+	if _, wrongState := err.(*StackStateError); wrongState {
+		// already stopped or started, e.g. by hand
+		run.Status = PowerRunSkipped
+		run.Message = err.Error()
+		return
+	}
+	if err != nil {
+		run.Status = PowerRunFailed
+		run.Message = err.Error()
+		notif := fmt.Sprintf("Scheduled %s of %s failed: %s", action, stack.Name, err.Error())
+		shared.SendPushNotificationToUser(stack.OsUserID, "Power schedule failed", notif, stack.ProjectID, "", nil)
+		return
+	}
+	run.Status = PowerRunSucceeded
+}
+
+// PowerScheduleController struct
+type PowerScheduleController struct {
+	shared.BaseController
+}
+
+// URLMapping URL mapping
+func (m *PowerScheduleController) URLMapping() {
+	m.Mapping("Create", m.Create)
+	m.Mapping("List", m.List)
+	m.Mapping("Update", m.Update)
+	m.Mapping("Delete", m.Delete)
+	m.Mapping("Override", m.Override)
+	m.Mapping("Runs", m.Runs)
+}
+
+// PowerScheduleParams ...
+type PowerScheduleParams struct {
+	Name     string `json:"name" bind:"required"`
+	ServerID string `json:"serverId" bind:"required"`
+	StopAt   string `json:"stopAt"`
+	StartAt  string `json:"startAt"`
+	Weekdays []int  `json:"weekdays" bind:"required"`
+	TimeZone string `json:"timeZone"`
+	Enabled  *bool  `json:"enabled"`
+}
+
+// apply validates the params and copies them onto the schedule
+func (p PowerScheduleParams) apply(schedule *PowerSchedule, claims shared.Claims) error {
+	if len(p.StopAt) == 0 && len(p.StartAt) == 0 {
+		return fmt.Errorf("stopAt or startAt is required")
+	}
+	for _, clock := range []string{p.StopAt, p.StartAt} {
+		if _, err := time.Parse("15:04", clock); len(clock) > 0 && err != nil {
+			return fmt.Errorf("invalid time %q, expected HH:MM", clock)
+		}
+	}
+	if p.StopAt == p.StartAt {
+		return fmt.Errorf("stopAt and startAt can not be the same")
+	}
+	if len(p.TimeZone) > 0 {
+		if _, err := time.LoadLocation(p.TimeZone); err != nil {
+			return fmt.Errorf("unknown time zone %q", p.TimeZone)
+		}
+	}
+	if len(p.Weekdays) == 0 {
+		return fmt.Errorf("at least one week day is required")
+	}
+	days := []int{}
+	seen := map[int]bool{}
+	for _, day := range p.Weekdays {
+		if day < 0 || day > 6 {
+			return fmt.Errorf("invalid week day %d, expected 0 (Sunday) to 6", day)
+		}
+		if !seen[day] {
+			seen[day] = true
+			days = append(days, day)
+		}
+	}
+	sort.Ints(days)
+	weekdays := make([]string, len(days))
+	for i, day := range days {
+		weekdays[i] = strconv.Itoa(day)
+	}
+
+	stack, err := GetProjectStack(claims, p.ServerID, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	schedule.Name = p.Name
+	schedule.ServerID = stack.ServerID
+	schedule.StopAt = p.StopAt
+	schedule.StartAt = p.StartAt
+	schedule.Weekdays = strings.Join(weekdays, ",")
+	schedule.TimeZone = p.TimeZone
+	if p.Enabled != nil {
+		schedule.Enabled = *p.Enabled
+	}
+	schedule.SysUserID = claims.SysUserID
+	schedule.OsUserID = claims.OsUserID
+	schedule.Username = claims.Username
+	// times already past when the schedule is saved are not caught up
+	schedule.CheckedAt = time.Now()
+	return nil
+}
+
+// GetOwnedPowerSchedule returns the power schedule when it belongs to the user
+func GetOwnedPowerSchedule(id uint32, osUserID string) (*PowerSchedule, error) {
+	o := orm.NewOrm()
+	schedule := PowerSchedule{}
+	err := o.QueryTable(new(PowerSchedule)).Filter("id", id).Filter("os_user_id", osUserID).One(&schedule)
+	if err != nil {
+		return nil, fmt.Errorf("power schedule %d not found", id)
+	}
+	return &schedule, nil
+}
+
+// Create ...
+// @Title Create
+// @Description create a power schedule that stops and starts a stack
+// @Param	body	body	thirtdparty.PowerScheduleParams	true	"body for schedule"
+// @Failure 403
+// @router /create [post]
+func (m *PowerScheduleController) Create() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params PowerScheduleParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+
+	schedule := PowerSchedule{Enabled: true}
+	if err := params.apply(&schedule, claims); err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	o := orm.NewOrm()
+	if _, err := o.Insert(&schedule); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(schedule)
+}
+
+// List ...
+// @Title List
+// @Description power schedules of the user
+// @Param	id	query	string	false	"server id"
+// @Failure 403
+// @router /list [get]
+func (m *PowerScheduleController) List() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	o := orm.NewOrm()
+	query := o.QueryTable(new(PowerSchedule)).Filter("os_user_id", claims.OsUserID)
+	if serverID := m.GetString("id"); len(serverID) > 0 {
+		query = query.Filter("server_id", serverID)
+	}
+	var schedules []PowerSchedule
+	if _, err := query.OrderBy("-id").All(&schedules); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(schedules)
+}
+
+// PowerScheduleUpdateParams ...
+type PowerScheduleUpdateParams struct {
+	ID uint32 `json:"id" bind:"required"`
+	PowerScheduleParams
+}
+
+// Update ...
+// @Title Update
+// @Description change the times, week days or time zone of a power schedule
+// @Param	body	body	thirtdparty.PowerScheduleUpdateParams	true	"body for schedule"
+// @Failure 403
+// @router /update [post]
+func (m *PowerScheduleController) Update() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params PowerScheduleUpdateParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	schedule, err := GetOwnedPowerSchedule(params.ID, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if err := params.apply(schedule, claims); err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	o := orm.NewOrm()
+	if _, err := o.Update(schedule); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(schedule)
+}
+
+// PowerScheduleIDParams ...
+type PowerScheduleIDParams struct {
+	ID uint32 `json:"id" bind:"required"`
+}
+
+// Delete ...
+// @Title Delete
+// @Description delete a power schedule and its run history
+// @Param	body	body	thirtdparty.PowerScheduleIDParams	true	"body for schedule"
+// @Failure 403
+// @router /delete [post]
+func (m *PowerScheduleController) Delete() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params PowerScheduleIDParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	schedule, err := GetOwnedPowerSchedule(params.ID, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	o := orm.NewOrm()
+	if _, err := o.Delete(schedule); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	o.QueryTable(new(PowerScheduleRun)).Filter("schedule_id", schedule.ID).Delete()
+	m.SetBody(schedule)
+}
+
+// PowerOverrideParams pauses the schedule for the number of hours, 0 resumes it
+type PowerOverrideParams struct {
+	ID    uint32 `json:"id" bind:"required"`
+	Hours int    `json:"hours"`
+}
+
+// Override ...
+// @Title Override
+// @Description pause a power schedule for a number of hours, or resume it with 0
+// @Param	body	body	thirtdparty.PowerOverrideParams	true	"body for override"
+// @Failure 403
+// @router /override [post]
+func (m *PowerScheduleController) Override() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params PowerOverrideParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	maxHours := beego.AppConfig.DefaultInt("power.override.max.hours", 720)
+	if params.Hours < 0 || params.Hours > maxHours {
+		err := fmt.Errorf("hours must be between 0 and %d", maxHours)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	schedule, err := GetOwnedPowerSchedule(params.ID, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	schedule.PausedUntil = time.Time{}
+	if params.Hours > 0 {
+		schedule.PausedUntil = time.Now().Add(time.Duration(params.Hours) * time.Hour)
+	}
+	o := orm.NewOrm()
+	if _, err := o.Update(schedule, "paused_until", "updated_at"); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(schedule)
+}
+
+// Runs ...
+// @Title Runs
+// @Description run history of a power schedule
+// @Param	id	query	int	true	"schedule id"
+// @Param	limit	query	int	false	"number of runs"
+// @Failure 403
+// @router /runs [get]
+func (m *PowerScheduleController) Runs() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	id, err := m.GetUint32("id")
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	schedule, err := GetOwnedPowerSchedule(id, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	limit, err := m.GetInt("limit", 50)
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+
+	o := orm.NewOrm()
+	runs := []PowerScheduleRun{}
+	if _, err := o.QueryTable(new(PowerScheduleRun)).Filter("schedule_id", schedule.ID).OrderBy("-id").Limit(limit).All(&runs); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(runs)
+}
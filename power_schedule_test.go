@@ -0,0 +1,49 @@
+package thirtdparty
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPowerScheduleDueActions(t *testing.T) {
+	// 2024-03-04 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+	weekdays := &PowerSchedule{StopAt: "19:00", StartAt: "07:30", Weekdays: "1,2,3,4,5", TimeZone: "UTC"}
+	cases := []struct {
+		name     string
+		schedule *PowerSchedule
+		since    time.Time
+		now      time.Time
+		want     []string
+	}{
+		{"stop falls due", weekdays, at(4, 18, 59), at(4, 19, 0), []string{"stop"}},
+		{"start falls due", weekdays, at(5, 7, 29), at(5, 7, 30), []string{"start"}},
+		{"nothing due", weekdays, at(4, 12, 0), at(4, 12, 1), nil},
+		{"due time already handled", weekdays, at(4, 19, 0), at(4, 19, 1), nil},
+		{"day off", weekdays, at(9, 18, 59), at(9, 19, 0), nil},
+		{"missed stop is caught up", weekdays, at(4, 18, 0), at(4, 19, 40), []string{"stop"}},
+		{"only the later of two missed actions", weekdays, at(4, 18, 0), at(5, 8, 0), []string{"start"}},
+		{"missed over midnight", &PowerSchedule{StopAt: "23:30", StartAt: "06:00", Weekdays: "0,1,2,3,4,5,6", TimeZone: "UTC"}, at(4, 23, 0), at(5, 0, 10), []string{"stop"}},
+		{"invalid clock is ignored", &PowerSchedule{StopAt: "25:00", StartAt: "07:30", Weekdays: "1", TimeZone: "UTC"}, at(4, 0, 0), at(4, 23, 59), []string{"start"}},
+	}
+	for _, c := range cases {
+		if got := c.schedule.dueActions(c.since, c.now); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPowerScheduleTimeZone(t *testing.T) {
+	schedule := &PowerSchedule{StopAt: "19:00", Weekdays: "1", TimeZone: "Asia/Ulaanbaatar"}
+	if schedule.location().String() != "Asia/Ulaanbaatar" {
+		t.Skip("time zone database not available")
+	}
+	// 19:00 in Ulaanbaatar is 11:00 UTC
+	since := time.Date(2024, 3, 4, 10, 59, 0, 0, time.UTC)
+	if got := schedule.dueActions(since, since.Add(time.Minute)); !reflect.DeepEqual(got, []string{"stop"}) {
+		t.Errorf("got %v, want [stop]", got)
+	}
+}
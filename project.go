@@ -2,12 +2,205 @@ package thirtdparty
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud"
+	blockquotas "github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/quotasets"
+	computequotas "github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/quotasets"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/roles"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/quotas"
 	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
 	"gitlab.com/ics-project/back-thirdparty/helper"
 	"gitlab.com/ics-project/back-thirdparty/integration/project"
 )
 
+// defaultProjectPurpose is the purpose projects are created with
+const defaultProjectPurpose = 14
+
+// ProjectSetting holds the owner of a project and the defaults its stacks are created with
+type ProjectSetting struct {
+	ID               uint32    `orm:"column(id);auto;pk" json:"id"`
+	ProjectID        string    `orm:"column(project_id);size(64);unique" json:"projectId"`
+	OwnerOsUserID    string    `orm:"column(owner_os_user_id);size(64);index" json:"ownerOsUserId"`
+	OwnerEmail       string    `orm:"column(owner_email);size(255)" json:"ownerEmail"`
+	Purpose          int       `orm:"column(purpose)" json:"purpose"`
+	DefaultRegion    string    `orm:"column(default_region);size(64);null" json:"defaultRegion"`
+	DefaultFlavorID  string    `orm:"column(default_flavor_id);size(64);null" json:"defaultFlavorId"`
+	DefaultImageID   string    `orm:"column(default_image_id);size(64);null" json:"defaultImageId"`
+	DefaultNetworkID string    `orm:"column(default_network_id);size(64);null" json:"defaultNetworkId"`
+	CreatedAt        time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+	UpdatedAt        time.Time `orm:"column(updated_at);auto_now;type(datetime)" json:"updatedAt"`
+}
+
+// TableName ...
+func (t *ProjectSetting) TableName() string {
+	return "project_settings"
+}
+
+func init() {
+	orm.RegisterModel(new(ProjectSetting))
+}
+
+// identityAdmin returns a keystone client with the admin credentials of the default region
+func identityAdmin() (*gophercloud.ServiceClient, error) {
+	region, err := shared.DefaultRegion()
+	if err != nil {
+		return nil, err
+	}
+	provider, err := region.AdminProvider()
+	if err != nil {
+		return nil, err
+	}
+	return region.IdentityClient(provider)
+}
+
+// defaultProjectID returns the project openstack created together with the user
+func defaultProjectID(osUserID string) (string, error) {
+	var projectID string
+	o := orm.NewOrm()
+	err := o.Raw("select su.os_tenant_id from sys_user su where su.os_user_id in (?)", osUserID).QueryRow(&projectID)
+	return projectID, err
+}
+
+// ownedProject returns the settings of the project when the user owns it.
+// The settings row is the owner record. Projects created before settings were kept are adopted
+// when they are the user's default project, or when they are legacy projects of the user.
+func ownedProject(claims shared.Claims, projectID string) (*ProjectSetting, error) {
+	if len(projectID) == 0 {
+		return nil, fmt.Errorf("project id is required")
+	}
+	o := orm.NewOrm()
+	setting := ProjectSetting{}
+	err := o.QueryTable(new(ProjectSetting)).Filter("project_id", projectID).One(&setting)
+	if err == nil {
+		if setting.OwnerOsUserID != claims.OsUserID {
+			return nil, fmt.Errorf("project %s not found", projectID)
+		}
+		return &setting, nil
+	}
+
+	if defaultID, err := defaultProjectID(claims.OsUserID); (err != nil || defaultID != projectID) && !legacyProject(claims, projectID) {
+		return nil, fmt.Errorf("project %s not found", projectID)
+	}
+	setting = ProjectSetting{ProjectID: projectID, OwnerOsUserID: claims.OsUserID, OwnerEmail: claims.Email, Purpose: defaultProjectPurpose}
+	if _, err := o.Insert(&setting); err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+// legacyProject tells whether the project was made by Create before settings were kept: Create set the
+// owner's email as its description, and keystone must still assign the user a role on it.
+func legacyProject(claims shared.Claims, projectID string) bool {
+	client, err := identityAdmin()
+	if err != nil {
+		return false
+	}
+	keystoneProject, err := projects.Get(client, projectID).Extract()
+	if err != nil || !strings.EqualFold(keystoneProject.Description, claims.Email) {
+		return false
+	}
+	allPages, err := roles.ListAssignments(client, roles.ListAssignmentsOpts{UserID: claims.OsUserID, ScopeProjectID: projectID}).AllPages()
+	if err != nil {
+		return false
+	}
+	assignments, err := roles.ExtractRoleAssignments(allPages)
+	return err == nil && len(assignments) > 0
+}
+
+// projectDeletable checks the rules a project must pass before it is deleted
+func projectDeletable(osUserID, projectID string) error {
+	/* rules
+	   You can't delete default project of the user of openstack
+	   You can't delete project with bill invoice
+	*/
+	defaultID, err := defaultProjectID(osUserID)
+	if err != nil {
+		return fmt.Errorf("Cannot find project user")
+	}
+	if defaultID == projectID {
+		return fmt.Errorf("Cannot delete default project")
+	}
+
+	var count int
+	o := orm.NewOrm()
+	err = o.Raw("select count(bi.id) as count from bill_invoice bi where bi.project_id in (?)", projectID).QueryRow(&count)
+	if err != nil {
+		return fmt.Errorf("Error querying bill invoice")
+	}
+	if count > 0 {
+		return fmt.Errorf("Project has bill invoices %v", count)
+	}
+	return nil
+}
+
+// ProjectQuota is one quota of the project with its usage
+type ProjectQuota struct {
+	Service  string `json:"service"`
+	Resource string `json:"resource"`
+	Limit    int    `json:"limit"`
+	InUse    int    `json:"inUse"`
+	Reserved int    `json:"reserved"`
+}
+
+// projectQuotas reads the compute, volume and network quotas of the project in the region.
+// A service that can not be read is reported in the second result.
+func projectQuotas(region shared.CloudRegion, projectID string) ([]ProjectQuota, []string, error) {
+	provider, err := region.AdminProvider()
+	if err != nil {
+		return nil, nil, err
+	}
+	result := []ProjectQuota{}
+	skipped := []string{}
+
+	if client, err := region.ComputeClient(provider); err == nil {
+		if detail, err := computequotas.GetDetail(client, projectID).Extract(); err == nil {
+			add := func(name string, quota computequotas.QuotaDetail) {
+				result = append(result, ProjectQuota{Service: "compute", Resource: name, Limit: quota.Limit, InUse: quota.InUse, Reserved: quota.Reserved})
+			}
+			add("instances", detail.Instances)
+			add("cores", detail.Cores)
+			add("ram", detail.RAM)
+			add("key pairs", detail.KeyPairs)
+		} else {
+			skipped = append(skipped, "compute: "+err.Error())
+		}
+	}
+
+	if client, err := region.BlockStorageClient(provider); err == nil {
+		if usage, err := blockquotas.GetUsage(client, projectID).Extract(); err == nil {
+			add := func(name string, quota blockquotas.QuotaUsage) {
+				result = append(result, ProjectQuota{Service: "volume", Resource: name, Limit: quota.Limit, InUse: quota.InUse, Reserved: quota.Reserved})
+			}
+			add("volumes", usage.Volumes)
+			add("gigabytes", usage.Gigabytes)
+			add("snapshots", usage.Snapshots)
+			add("backups", usage.Backups)
+		} else {
+			skipped = append(skipped, "volume: "+err.Error())
+		}
+	}
+
+	if client, err := region.NetworkClient(provider); err == nil {
+		if detail, err := quotas.GetDetail(client, projectID).Extract(); err == nil {
+			add := func(name string, quota quotas.QuotaDetail) {
+				result = append(result, ProjectQuota{Service: "network", Resource: name, Limit: quota.Limit, InUse: quota.Used, Reserved: quota.Reserved})
+			}
+			add("floating ips", detail.FloatingIP)
+			add("networks", detail.Network)
+			add("ports", detail.Port)
+			add("routers", detail.Router)
+			add("security groups", detail.SecurityGroup)
+		} else {
+			skipped = append(skipped, "network: "+err.Error())
+		}
+	}
+	return result, skipped, nil
+}
+
 // ProjectController struct
 type ProjectController struct {
 	shared.BaseController
@@ -17,12 +210,30 @@ type ProjectController struct {
 func (m *ProjectController) URLMapping() {
 	m.Mapping("Create", m.Create)
 	m.Mapping("List", m.List)
+	m.Mapping("Detail", m.Detail)
+	m.Mapping("Update", m.Update)
+	m.Mapping("Delete", m.Delete)
+	m.Mapping("Quotas", m.Quotas)
+	m.Mapping("Settings", m.Settings)
+	m.Mapping("UpdateSettings", m.UpdateSettings)
+	m.Mapping("Invite", m.Invite)
+	m.Mapping("Invitations", m.Invitations)
+	m.Mapping("RevokeInvitation", m.RevokeInvitation)
+	m.Mapping("AcceptInvitation", m.AcceptInvitation)
+	m.Mapping("DeclineInvitation", m.DeclineInvitation)
+	m.Mapping("Members", m.Members)
+	m.Mapping("ChangeRole", m.ChangeRole)
+	m.Mapping("RemoveMember", m.RemoveMember)
+	m.Mapping("Inventory", m.Inventory)
+	m.Mapping("RetryDelete", m.RetryDelete)
 }
 
 // Create project ...
 // @Title Create
 // @Description hint Create
 // @Param	projectName	string true "projectName"
+// @Param	description	string false "description"
+// @Param	purpose	int false "purpose"
 // @Failure 403
 // @router /create [post]
 func (m *ProjectController) Create() {
@@ -39,18 +250,23 @@ func (m *ProjectController) Create() {
 	// RequestedParams ...
 	type RequestedParams struct {
 		ProjectName string `json:"projectName" bind:"required"`
+		Description string `json:"description"`
+		Purpose     int    `json:"purpose"`
 	}
 	params := RequestedParams{}
 	if m.BindJSON(&params) != nil {
 		return
 	}
+	if params.Purpose == 0 {
+		params.Purpose = defaultProjectPurpose
+	}
 
 	// create new project ...
 	createdProject, err := project.CreateProject(project.CreateProjectStruct{
 		Email:       claims.Email,
 		OsUserID:    claims.OsUserID,
 		Name:        params.ProjectName,
-		Purpose:     14,
+		Purpose:     params.Purpose,
 		Register:    "",
 		Description: claims.Email,
 	})
@@ -61,6 +277,22 @@ func (m *ProjectController) Create() {
 		return
 	}
 
+	o := orm.NewOrm()
+	setting := ProjectSetting{ProjectID: createdProject.ID, OwnerOsUserID: claims.OsUserID, OwnerEmail: claims.Email, Purpose: params.Purpose}
+	// the settings are the owner record, without them the project is not reachable
+	if _, err := o.Insert(&setting); err != nil {
+		m.SetError(helper.StatusError, "Failed saving project owner", err.Error(), claims.UserID)
+		return
+	}
+	if len(params.Description) > 0 {
+		if client, err := identityAdmin(); err == nil {
+			description := params.Description
+			if _, err := projects.Update(client, createdProject.ID, projects.UpdateOpts{Description: &description}).Extract(); err != nil {
+				fmt.Println("Failed setting project description", createdProject.ID, err)
+			}
+		}
+	}
+
 	fmt.Println("✅✅✅ Successfully created new project: ", createdProject.Name)
 
 	m.SetBody(createdProject)
@@ -82,7 +314,7 @@ func (m *ProjectController) List() {
 		}
 	}()
 
-	projects, err := project.GetUserProjectList(claims.OsUserID)
+	projectList, err := project.GetUserProjectList(claims.OsUserID)
 
 	if err != nil {
 		m.SetError(helper.StatusError, "Failed listing projects "+err.Error(), "Failed listing projects "+err.Error(), claims.UserID)
@@ -90,5 +322,227 @@ func (m *ProjectController) List() {
 		return
 	}
 
-	m.SetBody(projects)
+	m.SetBody(projectList)
+}
+
+// ProjectDetail is a keystone project with its settings
+type ProjectDetail struct {
+	Project  *projects.Project `json:"project"`
+	Settings *ProjectSetting   `json:"settings"`
+}
+
+// Detail ...
+// @Title Detail
+// @Description project with its owner and default settings
+// @Param	id	query	string	true	"project id"
+// @Failure 403
+// @router /detail [get]
+func (m *ProjectController) Detail() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	setting, _, err := projectAccess(claims, m.GetString("id"), RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	client, err := identityAdmin()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	keystoneProject, err := projects.Get(client, setting.ProjectID).Extract()
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(ProjectDetail{Project: keystoneProject, Settings: setting})
+}
+
+// ProjectUpdateParams ...
+type ProjectUpdateParams struct {
+	ProjectID   string  `json:"projectId" bind:"required"`
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Purpose     int     `json:"purpose"`
+}
+
+// Update ...
+// @Title Update
+// @Description rename a project or change its description and purpose
+// @Param	body	body	thirtdparty.ProjectUpdateParams	true	"body for update"
+// @Failure 403
+// @router /update [post]
+func (m *ProjectController) Update() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params ProjectUpdateParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	if params.Name != nil && len(*params.Name) == 0 {
+		m.SetError(helper.StatusMissingParams, "name can not be empty", "name can not be empty", claims.UserID)
+		return
+	}
+	setting, _, err := projectAccess(claims, params.ProjectID, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	client, err := identityAdmin()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	opts := projects.UpdateOpts{Description: params.Description}
+	if params.Name != nil {
+		opts.Name = *params.Name
+	}
+	updated, err := projects.Update(client, setting.ProjectID, opts).Extract()
+	if err != nil {
+		m.SetError(helper.StatusError, "Failed updating project", err.Error(), claims.UserID)
+		return
+	}
+	if params.Purpose > 0 && params.Purpose != setting.Purpose {
+		setting.Purpose = params.Purpose
+		o := orm.NewOrm()
+		if _, err := o.Update(setting, "purpose", "updated_at"); err != nil {
+			m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+	}
+	m.SetBody(ProjectDetail{Project: updated, Settings: setting})
+}
+
+// Quotas ...
+// @Title Quotas
+// @Description compute, volume and network quotas of the project with their usage
+// @Param	id	query	string	true	"project id"
+// @Param	region	query	string	false	"region tag"
+// @Failure 403
+// @router /quotas [get]
+func (m *ProjectController) Quotas() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	setting, _, err := projectAccess(claims, m.GetString("id"), RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	region, err := resolveRegion(setting.ProjectID, m.GetString("region"))
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	list, skipped, err := projectQuotas(region, setting.ProjectID)
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(map[string]interface{}{
+		"projectId": setting.ProjectID,
+		"region":    region.Tag,
+		"quotas":    list,
+		"skipped":   skipped,
+	})
+}
+
+// Settings ...
+// @Title Settings
+// @Description default settings stacks of the project are created with
+// @Param	id	query	string	true	"project id"
+// @Failure 403
+// @router /settings [get]
+func (m *ProjectController) Settings() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	setting, _, err := projectAccess(claims, m.GetString("id"), RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(setting)
+}
+
+// ProjectSettingsParams ...
+type ProjectSettingsParams struct {
+	ProjectID        string `json:"projectId" bind:"required"`
+	DefaultRegion    string `json:"defaultRegion"`
+	DefaultFlavorID  string `json:"defaultFlavorId"`
+	DefaultImageID   string `json:"defaultImageId"`
+	DefaultNetworkID string `json:"defaultNetworkId"`
+}
+
+// UpdateSettings ...
+// @Title UpdateSettings
+// @Description change the default region, flavor, image and network of the project
+// @Param	body	body	thirtdparty.ProjectSettingsParams	true	"body for settings"
+// @Failure 403
+// @router /settings [post]
+func (m *ProjectController) UpdateSettings() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params ProjectSettingsParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	setting, _, err := projectAccess(claims, params.ProjectID, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if len(params.DefaultRegion) > 0 {
+		region, err := shared.GetRegion(params.DefaultRegion)
+		if err != nil {
+			m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		params.DefaultRegion = region.Tag
+	}
+
+	setting.DefaultRegion = params.DefaultRegion
+	setting.DefaultFlavorID = params.DefaultFlavorID
+	setting.DefaultImageID = params.DefaultImageID
+	setting.DefaultNetworkID = params.DefaultNetworkID
+	o := orm.NewOrm()
+	if _, err := o.Update(setting, "default_region", "default_flavor_id", "default_image_id", "default_network_id", "updated_at"); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(setting)
 }
@@ -0,0 +1,692 @@
+package thirtdparty
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/astaxie/beego/toolbox"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/backups"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/routers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/networks"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+	"gitlab.com/ics-project/back-thirdparty/integration/project"
+	"gitlab.com/ics-project/back-thirdparty/service"
+)
+
+// JobProjectDelete is the kind of jobs deleting a project with everything in it
+const JobProjectDelete = "project-delete"
+
+// Steps of a project deletion, a step starts once every item of the steps before it succeeded
+const (
+	deleteStepSchedules = iota + 1
+	deleteStepServers
+	deleteStepDomains
+	deleteStepFloatingIPs
+	deleteStepSnapshots
+	deleteStepVolumes
+	deleteStepBackups
+	deleteStepImages
+	deleteStepRouters
+	deleteStepSubnets
+	deleteStepNetworks
+	deleteStepSecurityGroups
+	deleteStepFlavors
+	deleteStepProject
+)
+
+// Kinds of the project deletion items that are not inventory groups
+const (
+	deleteKindProject        = "project"
+	deleteKindBackupPolicies = "backupPolicies"
+	deleteKindPowerSchedules = "powerSchedules"
+	deleteKindVolumeBackups  = "volumeBackups"
+	deleteKindImages         = "images"
+	deleteKindRouters        = "routers"
+	deleteKindSubnets        = "subnets"
+	deleteKindNetworks       = "networks"
+)
+
+// projectDeleteMu makes checking for a running deletion and queueing a new one one step
+var projectDeleteMu sync.Mutex
+
+// deleteWait bounds how long a deleted resource may take to disappear
+const deleteWait = 10 * time.Minute
+
+// ProjectDeleteParams ...
+type ProjectDeleteParams struct {
+	ProjectID string `json:"projectId" bind:"required"`
+	DryRun    bool   `json:"dryRun"`
+}
+
+// projectDeleteJobParams is what a deletion job needs again when it is retried
+type projectDeleteJobParams struct {
+	ProjectID string `json:"projectId"`
+	Email     string `json:"email"`
+}
+
+// ProjectDeletePlan is what a deletion would remove, in the order it removes it
+type ProjectDeletePlan struct {
+	ProjectID string         `json:"projectId"`
+	Blocker   string         `json:"blocker,omitempty"`
+	Counts    map[string]int `json:"counts"`
+	Items     []JobItem      `json:"items"`
+	Skipped   []string       `json:"skipped,omitempty"`
+}
+
+// deleteResource is a resource of the project outside the inventory groups
+type deleteResource struct {
+	ID   string
+	Name string
+}
+
+// projectExtras are the resources of a region the deletion removes besides the inventory
+type projectExtras struct {
+	VolumeBackups []deleteResource
+	Images        []deleteResource
+	Routers       []deleteResource
+	Subnets       []deleteResource
+	Networks      []deleteResource
+}
+
+// projectDeleteExtras lists the backups, images and networks of the project in the region.
+// A service that can not be read is reported as skipped.
+func projectDeleteExtras(region shared.CloudRegion, projectID string) (projectExtras, []string) {
+	extras := projectExtras{}
+	skipped := []string{}
+	clients, err := newInventoryClients(region)
+	if err != nil {
+		return extras, []string{err.Error()}
+	}
+	skip := func(kind string, err error) {
+		skipped = append(skipped, fmt.Sprintf("%s: %v", kind, err))
+	}
+
+	o := orm.NewOrm()
+	var stackBackups []StackBackup
+	if _, err := o.QueryTable(new(StackBackup)).Filter("project_id", projectID).Filter("region", region.Tag).Filter("kind", BackupVolume).All(&stackBackups); err != nil {
+		skip(deleteKindVolumeBackups, err)
+	}
+	for _, backup := range stackBackups {
+		if len(backup.ResourceID) > 0 {
+			extras.VolumeBackups = append(extras.VolumeBackups, deleteResource{ID: backup.ResourceID, Name: backup.Name})
+		}
+	}
+
+	// image backups and uploads are both owned by the project
+	if allPages, err := images.List(clients.image, images.ListOpts{Owner: projectID}).AllPages(); err != nil {
+		skip(deleteKindImages, err)
+	} else if list, err := images.ExtractImages(allPages); err != nil {
+		skip(deleteKindImages, err)
+	} else {
+		for _, image := range list {
+			extras.Images = append(extras.Images, deleteResource{ID: image.ID, Name: image.Name})
+		}
+	}
+
+	if allPages, err := routers.List(clients.network, routers.ListOpts{ProjectID: projectID}).AllPages(); err != nil {
+		skip(deleteKindRouters, err)
+	} else if list, err := routers.ExtractRouters(allPages); err != nil {
+		skip(deleteKindRouters, err)
+	} else {
+		for _, router := range list {
+			extras.Routers = append(extras.Routers, deleteResource{ID: router.ID, Name: router.Name})
+		}
+	}
+
+	if allPages, err := subnets.List(clients.network, subnets.ListOpts{ProjectID: projectID}).AllPages(); err != nil {
+		skip(deleteKindSubnets, err)
+	} else if list, err := subnets.ExtractSubnets(allPages); err != nil {
+		skip(deleteKindSubnets, err)
+	} else {
+		for _, subnet := range list {
+			extras.Subnets = append(extras.Subnets, deleteResource{ID: subnet.ID, Name: subnet.Name})
+		}
+	}
+
+	if allPages, err := networks.List(clients.network, networks.ListOpts{ProjectID: projectID}).AllPages(); err != nil {
+		skip(deleteKindNetworks, err)
+	} else if list, err := networks.ExtractNetworks(allPages); err != nil {
+		skip(deleteKindNetworks, err)
+	} else {
+		for _, network := range list {
+			extras.Networks = append(extras.Networks, deleteResource{ID: network.ID, Name: network.Name})
+		}
+	}
+	return extras, skipped
+}
+
+// projectSchedules returns the backup policies and power schedules that would act on the project
+func projectSchedules(projectID string) ([]BackupPolicy, []PowerSchedule, error) {
+	o := orm.NewOrm()
+	var policies []BackupPolicy
+	if _, err := o.QueryTable(new(BackupPolicy)).Filter("project_id", projectID).OrderBy("id").All(&policies); err != nil {
+		return nil, nil, err
+	}
+	var schedules []PowerSchedule
+	_, err := o.Raw("select ps.* from power_schedules ps join stacks s on s.server_id = ps.server_id where s.project_id = ? order by ps.id", projectID).QueryRows(&schedules)
+	return policies, schedules, err
+}
+
+// add appends a pending deletion item to the plan
+func (plan *ProjectDeletePlan) add(step int, kind, region, id, name string) {
+	plan.Items = append(plan.Items, JobItem{Step: step, Kind: kind, Region: region, ResourceID: id, Name: name, Status: JobItemPending})
+	plan.Counts[kind]++
+}
+
+// addSchedules plans the schedules first so that none of them acts on a resource being deleted
+func (plan *ProjectDeletePlan) addSchedules(policies []BackupPolicy, schedules []PowerSchedule) {
+	for _, policy := range policies {
+		plan.add(deleteStepSchedules, deleteKindBackupPolicies, "", fmt.Sprint(policy.ID), policy.Name)
+	}
+	for _, schedule := range schedules {
+		plan.add(deleteStepSchedules, deleteKindPowerSchedules, "", fmt.Sprint(schedule.ID), schedule.Name)
+	}
+}
+
+// addRegion plans the resources of one region
+func (plan *ProjectDeletePlan) addRegion(inventory *Inventory, extras projectExtras) {
+	region := inventory.Region
+	for _, server := range inventory.Servers {
+		plan.add(deleteStepServers, InventoryServers, region, server.ID, server.Name)
+	}
+	for _, stack := range inventory.Stacks {
+		if stack.DomainID > 0 {
+			plan.add(deleteStepDomains, InventoryDomains, region, fmt.Sprint(stack.DomainID), stack.Name)
+		}
+	}
+	for _, ip := range inventory.FloatingIPs {
+		plan.add(deleteStepFloatingIPs, InventoryFloatingIPs, region, ip.ID, ip.Address)
+	}
+	for _, snapshot := range inventory.Snapshots {
+		plan.add(deleteStepSnapshots, InventorySnapshots, region, snapshot.ID, snapshot.Name)
+	}
+	for _, volume := range inventory.Volumes {
+		plan.add(deleteStepVolumes, InventoryVolumes, region, volume.ID, volume.Name)
+	}
+	for _, backup := range extras.VolumeBackups {
+		plan.add(deleteStepBackups, deleteKindVolumeBackups, region, backup.ID, backup.Name)
+	}
+	for _, image := range extras.Images {
+		plan.add(deleteStepImages, deleteKindImages, region, image.ID, image.Name)
+	}
+	for _, router := range extras.Routers {
+		plan.add(deleteStepRouters, deleteKindRouters, region, router.ID, router.Name)
+	}
+	for _, subnet := range extras.Subnets {
+		plan.add(deleteStepSubnets, deleteKindSubnets, region, subnet.ID, subnet.Name)
+	}
+	for _, network := range extras.Networks {
+		plan.add(deleteStepNetworks, deleteKindNetworks, region, network.ID, network.Name)
+	}
+	for _, group := range inventory.SecurityGroups {
+		// the default group goes with the project
+		if group.Name != "default" {
+			plan.add(deleteStepSecurityGroups, InventorySecurityGroups, region, group.ID, group.Name)
+		}
+	}
+	for _, flavor := range inventory.Flavors {
+		plan.add(deleteStepFlavors, InventoryFlavors, region, flavor.FlavorID, flavor.Name)
+	}
+}
+
+// planProjectDelete lists the resources of the project over every region as deletion items
+func planProjectDelete(osUserID, projectID string) *ProjectDeletePlan {
+	plan := &ProjectDeletePlan{ProjectID: projectID, Counts: map[string]int{}, Items: []JobItem{}}
+	if err := projectDeletable(osUserID, projectID); err != nil {
+		plan.Blocker = err.Error()
+	}
+
+	policies, schedules, err := projectSchedules(projectID)
+	if err != nil {
+		plan.Skipped = append(plan.Skipped, fmt.Sprintf("schedules: %v", err))
+	}
+	plan.addSchedules(policies, schedules)
+	for _, region := range shared.DistinctRegions() {
+		inventory, err := projectInventory(region, projectID)
+		if err != nil {
+			plan.Skipped = append(plan.Skipped, fmt.Sprintf("%s: %v", region.Tag, err))
+			continue
+		}
+		for _, skipped := range inventory.Skipped {
+			plan.Skipped = append(plan.Skipped, fmt.Sprintf("%s %s", region.Tag, skipped))
+		}
+		extras, skipped := projectDeleteExtras(region, projectID)
+		for _, item := range skipped {
+			plan.Skipped = append(plan.Skipped, fmt.Sprintf("%s %s", region.Tag, item))
+		}
+		plan.addRegion(inventory, extras)
+	}
+	plan.add(deleteStepProject, deleteKindProject, "", projectID, projectID)
+	return plan
+}
+
+// waitGone polls get until the resource is not found
+func waitGone(get func() error) error {
+	deadline := time.Now().Add(deleteWait)
+	for time.Now().Before(deadline) {
+		if _, gone := get().(gophercloud.ErrDefault404); gone {
+			return nil
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return fmt.Errorf("resource was not deleted in %v", deleteWait)
+}
+
+// ignoreNotFound treats a resource that is already gone as deleted
+func ignoreNotFound(err error) error {
+	if _, gone := err.(gophercloud.ErrDefault404); gone {
+		return nil
+	}
+	return err
+}
+
+// waitVolumeFree waits for the volume of a deleted server to be detached, gone tells it no longer exists
+func waitVolumeFree(client *gophercloud.ServiceClient, volumeID string) (bool, error) {
+	deadline := time.Now().Add(deleteWait)
+	for {
+		volume, err := volumes.Get(client, volumeID).Extract()
+		if err != nil {
+			return ignoreNotFound(err) == nil, ignoreNotFound(err)
+		}
+		if len(volume.Attachments) == 0 && volume.Status != "detaching" && volume.Status != "deleting" {
+			return false, nil
+		}
+		if time.Now().After(deadline) {
+			return false, fmt.Errorf("volume %s is still %s", volumeID, volume.Status)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// deleteProjectItem removes the resource of one item
+func deleteProjectItem(actor StackActor, params projectDeleteJobParams, item *JobItem) error {
+	o := orm.NewOrm()
+	if item.Kind == deleteKindProject {
+		success, err := project.DeleteProject(project.DeleteProjectStruct{ProjectID: params.ProjectID, Email: params.Email})
+		if err != nil {
+			return err
+		}
+		if !success {
+			return fmt.Errorf("project %s was not deleted", params.ProjectID)
+		}
+		o.QueryTable(new(ProjectSetting)).Filter("project_id", params.ProjectID).Delete()
+		o.QueryTable(new(ProjectMember)).Filter("project_id", params.ProjectID).Delete()
+		o.QueryTable(new(ProjectInvitation)).Filter("project_id", params.ProjectID).Filter("status", InvitationPending).Update(orm.Params{"status": InvitationRevoked})
+		return nil
+	}
+	if item.Kind == deleteKindBackupPolicies {
+		if id, err := strconv.ParseUint(item.ResourceID, 10, 32); err == nil {
+			toolbox.DeleteTask(policyTaskName(uint32(id)))
+		}
+		_, err := o.QueryTable(new(BackupPolicy)).Filter("id", item.ResourceID).Delete()
+		return err
+	}
+	if item.Kind == deleteKindPowerSchedules {
+		if _, err := o.QueryTable(new(PowerSchedule)).Filter("id", item.ResourceID).Delete(); err != nil {
+			return err
+		}
+		_, err := o.QueryTable(new(PowerScheduleRun)).Filter("schedule_id", item.ResourceID).Delete()
+		return err
+	}
+
+	region, err := shared.GetRegion(item.Region)
+	if err != nil {
+		return err
+	}
+	clients, err := newInventoryClients(region)
+	if err != nil {
+		return err
+	}
+
+	switch item.Kind {
+	case InventoryServers:
+		if err := ignoreNotFound(servers.Delete(clients.compute, item.ResourceID).ExtractErr()); err != nil {
+			return err
+		}
+		if err := waitGone(func() error { _, err := servers.Get(clients.compute, item.ResourceID).Extract(); return err }); err != nil {
+			return err
+		}
+		logID := service.CreateLogAction(item.ResourceID, "Instance", item.Name, "Delete", actor.OsUserID, nil)
+		closeInstanceUsage(actor, item.ResourceID, "DELETED", logID)
+		o.QueryTable("usg_history").Filter("os_instance_id", item.ResourceID).Filter("type", "IP").Filter("end_date", "").Update(orm.Params{
+			"status":             "DELETED",
+			"end_date":           time.Now().Format(helper.TimeFormatYYYYMMDDHHMMSS),
+			"last_log_action_id": logID,
+		})
+		updateStackStatus(item.ResourceID, "DELETED")
+		o.QueryTable(new(StackVolume)).Filter("server_id", item.ResourceID).Exclude("status", VolumeDeleted).Update(orm.Params{"status": VolumeDetached, "detached_at": time.Now()})
+
+	case InventoryDomains:
+		var ip string
+		err := o.Raw("select coalesce(ip, '') from domains where id = ?", item.ResourceID).QueryRow(&ip)
+		if err == orm.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(ip) > 0 {
+			if response := DeleteDomainAWS(item.Name, ip); response.StatusCode != 0 {
+				return fmt.Errorf("failed deleting DNS record: %s", response.ErrorMsg)
+			}
+		}
+		if _, err := o.Raw("delete from domains where id = ?", item.ResourceID).Exec(); err != nil {
+			return err
+		}
+
+	case InventoryFloatingIPs:
+		if err := ignoreNotFound(floatingips.Delete(clients.network, item.ResourceID).ExtractErr()); err != nil {
+			return err
+		}
+
+	case InventorySnapshots:
+		if err := ignoreNotFound(snapshots.Delete(clients.volume, item.ResourceID).ExtractErr()); err != nil {
+			return err
+		}
+		return waitGone(func() error { _, err := snapshots.Get(clients.volume, item.ResourceID).Extract(); return err })
+
+	case InventoryVolumes:
+		gone, err := waitVolumeFree(clients.volume, item.ResourceID)
+		if err != nil {
+			return err
+		}
+		if !gone {
+			if err := ignoreNotFound(volumes.Delete(clients.volume, item.ResourceID, volumes.DeleteOpts{}).ExtractErr()); err != nil {
+				return err
+			}
+			if err := waitGone(func() error { _, err := volumes.Get(clients.volume, item.ResourceID).Extract(); return err }); err != nil {
+				return err
+			}
+		}
+		logID := service.CreateLogAction(item.ResourceID, "Volume", item.Name, "Delete", actor.OsUserID, nil)
+		closeUsage(actor, "Volume", item.ResourceID, "DELETED", logID)
+		o.QueryTable(new(StackVolume)).Filter("volume_id", item.ResourceID).Update(orm.Params{"status": VolumeDeleted, "deleted_at": time.Now()})
+
+	case deleteKindVolumeBackups:
+		if err := ignoreNotFound(backups.Delete(clients.volume, item.ResourceID).ExtractErr()); err != nil {
+			return err
+		}
+		if err := waitGone(func() error { _, err := backups.Get(clients.volume, item.ResourceID).Extract(); return err }); err != nil {
+			return err
+		}
+		o.QueryTable(new(StackBackup)).Filter("resource_id", item.ResourceID).Delete()
+
+	case deleteKindImages:
+		if err := ignoreNotFound(images.Delete(clients.image, item.ResourceID).ExtractErr()); err != nil {
+			return err
+		}
+		o.QueryTable(new(StackBackup)).Filter("resource_id", item.ResourceID).Delete()
+		o.QueryTable(new(StackImage)).Filter("image_id", item.ResourceID).Delete()
+
+	case deleteKindRouters:
+		// interfaces keep a router from being deleted, the gateway goes with it
+		allPages, err := ports.List(clients.network, ports.ListOpts{DeviceID: item.ResourceID}).AllPages()
+		if err != nil {
+			return ignoreNotFound(err)
+		}
+		list, err := ports.ExtractPorts(allPages)
+		if err != nil {
+			return err
+		}
+		for _, port := range list {
+			if port.DeviceOwner == "network:router_gateway" {
+				continue
+			}
+			if _, err := routers.RemoveInterface(clients.network, item.ResourceID, routers.RemoveInterfaceOpts{PortID: port.ID}).Extract(); ignoreNotFound(err) != nil {
+				return err
+			}
+		}
+		return ignoreNotFound(routers.Delete(clients.network, item.ResourceID).ExtractErr())
+
+	case deleteKindSubnets:
+		return ignoreNotFound(subnets.Delete(clients.network, item.ResourceID).ExtractErr())
+
+	case deleteKindNetworks:
+		return ignoreNotFound(networks.Delete(clients.network, item.ResourceID).ExtractErr())
+
+	case InventorySecurityGroups:
+		return ignoreNotFound(groups.Delete(clients.network, item.ResourceID).ExtractErr())
+
+	case InventoryFlavors:
+		// custom flavors are shared by size, only the project's access is removed
+		_, err := flavors.RemoveAccess(clients.compute, item.ResourceID, flavors.RemoveAccessOpts{Tenant: params.ProjectID}).Extract()
+		if err := ignoreNotFound(err); err != nil {
+			return err
+		}
+		o.QueryTable(new(CustomFlavorAccess)).Filter("flavor_id", item.ResourceID).Filter("project_id", params.ProjectID).Delete()
+
+	default:
+		return fmt.Errorf("unknown resource kind %q", item.Kind)
+	}
+	return nil
+}
+
+// orderDeleteItems sorts the items by step over every region, keeping the planned order within a step
+func orderDeleteItems(items []JobItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Step < items[j].Step
+	})
+}
+
+// newDeleteItems returns the planned items whose resource is not among the items of an earlier attempt
+func newDeleteItems(saved, planned []JobItem) []JobItem {
+	known := map[string]bool{}
+	for _, item := range saved {
+		known[item.Kind+"/"+item.Region+"/"+item.ResourceID] = true
+	}
+	added := []JobItem{}
+	for _, item := range planned {
+		if !known[item.Kind+"/"+item.Region+"/"+item.ResourceID] {
+			added = append(added, item)
+		}
+	}
+	return added
+}
+
+// runProjectDelete deletes the pending items step by step. When a step has failures
+// the items of the later steps are skipped so that a retry can continue from there.
+func runProjectDelete(job *Job, actor StackActor, params projectDeleteJobParams, items []JobItem) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("Project deletion panicked", job.ID, r)
+		}
+		finished := finishJob(job.ID)
+		if finished == nil {
+			return
+		}
+		topic := "Project deleted"
+		if finished.Status != JobSucceeded {
+			topic = "Project deletion failed"
+		}
+		shared.SendPushNotificationToUser(actor.OsUserID, topic, fmt.Sprintf("Project %s: %s", params.ProjectID, finished.Message), params.ProjectID, "", nil)
+	}()
+	setJobStatus(job.ID, JobRunning)
+
+	orderDeleteItems(items)
+	blockedAt := 0
+	for i := range items {
+		item := &items[i]
+		if item.Status == JobItemSucceeded {
+			continue
+		}
+		if blockedAt > 0 && item.Step > blockedAt {
+			setJobItem(item, JobItemSkipped, fmt.Errorf("waiting for step %d", blockedAt))
+			continue
+		}
+		if err := deleteProjectItem(actor, params, item); err != nil {
+			setJobItem(item, JobItemFailed, err)
+			if blockedAt == 0 {
+				blockedAt = item.Step
+			}
+			continue
+		}
+		setJobItem(item, JobItemSucceeded, nil)
+	}
+}
+
+// projectDeleteRunning tells whether a deletion of the project is queued or running
+func projectDeleteRunning(projectID string) bool {
+	o := orm.NewOrm()
+	return o.QueryTable(new(Job)).Filter("kind", JobProjectDelete).Filter("status__in", JobQueued, JobRunning).
+		Filter("params__contains", fmt.Sprintf("%q", projectID)).Exist()
+}
+
+// startProjectDelete queues the deletion of the project, or only plans it on a dry run
+func startProjectDelete(claims shared.Claims, clientIP string, params ProjectDeleteParams) (interface{}, error) {
+	if _, err := ownedProject(claims, params.ProjectID); err != nil {
+		return nil, err
+	}
+	plan := planProjectDelete(claims.OsUserID, params.ProjectID)
+	if params.DryRun {
+		return plan, nil
+	}
+	if len(plan.Blocker) > 0 {
+		return nil, fmt.Errorf("%s", plan.Blocker)
+	}
+
+	actor := ActorFromClaims(claims, clientIP)
+	jobParams := projectDeleteJobParams{ProjectID: params.ProjectID, Email: claims.Email}
+	projectDeleteMu.Lock()
+	if projectDeleteRunning(params.ProjectID) {
+		projectDeleteMu.Unlock()
+		return nil, fmt.Errorf("project %s is already being deleted", params.ProjectID)
+	}
+	job, err := newJob(JobProjectDelete, "delete", actor, jobParams, plan.Items)
+	projectDeleteMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	go runProjectDelete(job, actor, jobParams, plan.Items)
+	return job, nil
+}
+
+// Delete ...
+// @Title Delete
+// @Description delete a project that is not the default one and has no invoices. The resources are removed
+// in the background by the returned job, a dry run only lists them.
+// @Param	body	body	thirtdparty.ProjectDeleteParams	true	"body for delete"
+// @Failure 403
+// @router /delete [post]
+func (m *ProjectController) Delete() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params ProjectDeleteParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	result, err := startProjectDelete(claims, m.GetClientIP(), params)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(result)
+}
+
+// JobIDParams ...
+type JobIDParams struct {
+	JobID uint32 `json:"jobId" bind:"required"`
+}
+
+// RetryDelete ...
+// @Title RetryDelete
+// @Description retry the failed and skipped items of a project deletion, together with the resources
+// made in the project since
+// @Param	body	body	thirtdparty.JobIDParams	true	"body for retry"
+// @Failure 403
+// @router /delete/retry [post]
+func (m *ProjectController) RetryDelete() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params JobIDParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	job, err := GetOwnedJob(params.JobID, claims.OsUserID)
+	if err != nil || job.Kind != JobProjectDelete {
+		m.SetError(helper.StatusMissingParams, "job not found", "job not found", claims.UserID)
+		return
+	}
+	if job.Status == JobQueued || job.Status == JobRunning || job.Status == JobSucceeded {
+		m.SetError(helper.StatusMissingParams, "job is "+job.Status, "job is "+job.Status, claims.UserID)
+		return
+	}
+	var jobParams projectDeleteJobParams
+	if err := json.Unmarshal([]byte(job.Params), &jobParams); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if _, err := ownedProject(claims, jobParams.ProjectID); err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	// the project is planned again, it may have gained resources or blockers since the first attempt
+	plan := planProjectDelete(claims.OsUserID, jobParams.ProjectID)
+	if len(plan.Blocker) > 0 {
+		m.SetError(helper.StatusMissingParams, plan.Blocker, plan.Blocker, claims.UserID)
+		return
+	}
+
+	o := orm.NewOrm()
+	count, err := o.QueryTable(new(Job)).Filter("id", job.ID).Filter("status", job.Status).Update(orm.Params{"status": JobQueued})
+	if err != nil || count == 0 {
+		m.SetError(helper.StatusMissingParams, "job is already being retried", "job is already being retried", claims.UserID)
+		return
+	}
+	var items []JobItem
+	o.QueryTable(new(JobItem)).Filter("job_id", job.ID).OrderBy("step", "id").All(&items)
+	for i := range items {
+		if items[i].Status != JobItemSucceeded {
+			setJobItem(&items[i], JobItemPending, nil)
+		}
+	}
+	added := newDeleteItems(items, plan.Items)
+	for i := range added {
+		added[i].JobID = job.ID
+		id, err := o.Insert(&added[i])
+		if err != nil {
+			setJobStatus(job.ID, JobFailed)
+			m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		added[i].ID = uint32(id)
+	}
+	if len(added) > 0 {
+		job.Total += len(added)
+		o.Update(job, "total")
+		items = append(items, added...)
+	}
+	job.Status = JobQueued
+
+	go runProjectDelete(job, ActorFromClaims(claims, m.GetClientIP()), jobParams, items)
+	m.SetBody(job)
+}
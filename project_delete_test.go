@@ -0,0 +1,117 @@
+package thirtdparty
+
+import "testing"
+
+func TestProjectDeletePlanAddSchedules(t *testing.T) {
+	plan := &ProjectDeletePlan{Counts: map[string]int{}, Items: []JobItem{}}
+	plan.addSchedules(
+		[]BackupPolicy{{ID: 1, Name: "nightly"}},
+		[]PowerSchedule{{ID: 2, Name: "office hours"}, {ID: 3, Name: "weekend"}},
+	)
+	if len(plan.Items) != 3 {
+		t.Fatalf("got %d items, want 3", len(plan.Items))
+	}
+	for _, item := range plan.Items {
+		if item.Step != deleteStepSchedules || item.Region != "" || item.Status != JobItemPending {
+			t.Errorf("%s %s: step %d, region %q, status %s", item.Kind, item.Name, item.Step, item.Region, item.Status)
+		}
+	}
+	if plan.Items[0].Kind != deleteKindBackupPolicies || plan.Items[0].ResourceID != "1" {
+		t.Errorf("first item is %s %s", plan.Items[0].Kind, plan.Items[0].ResourceID)
+	}
+	if plan.Counts[deleteKindBackupPolicies] != 1 || plan.Counts[deleteKindPowerSchedules] != 2 {
+		t.Errorf("counts %v", plan.Counts)
+	}
+}
+
+func TestProjectDeletePlanAddRegion(t *testing.T) {
+	inventory := &Inventory{
+		Region:         "ub1",
+		Servers:        []InventoryServer{{ID: "srv", Name: "web"}},
+		Stacks:         []Stack{{Name: "web", DomainID: 7}, {Name: "plain"}},
+		FloatingIPs:    []InventoryFloatingIP{{ID: "fip", Address: "203.0.113.10"}},
+		Snapshots:      []InventorySnapshot{{ID: "snap", Name: "before upgrade"}},
+		Volumes:        []InventoryVolume{{ID: "vol", Name: "data"}},
+		SecurityGroups: []InventorySecurityGroup{{ID: "sg-default", Name: "default"}, {ID: "sg-web", Name: "web"}},
+		Flavors:        []CustomFlavor{{FlavorID: "flv", Name: "custom-2-4096-40"}},
+	}
+	extras := projectExtras{
+		VolumeBackups: []deleteResource{{ID: "bak", Name: "data backup"}},
+		Images:        []deleteResource{{ID: "img", Name: "web image"}},
+		Routers:       []deleteResource{{ID: "rtr", Name: "router"}},
+		Subnets:       []deleteResource{{ID: "sub", Name: "subnet"}},
+		Networks:      []deleteResource{{ID: "net", Name: "network"}},
+	}
+	plan := &ProjectDeletePlan{Counts: map[string]int{}, Items: []JobItem{}}
+	plan.addRegion(inventory, extras)
+
+	want := map[string]int{
+		"srv":    deleteStepServers,
+		"7":      deleteStepDomains,
+		"fip":    deleteStepFloatingIPs,
+		"snap":   deleteStepSnapshots,
+		"vol":    deleteStepVolumes,
+		"bak":    deleteStepBackups,
+		"img":    deleteStepImages,
+		"rtr":    deleteStepRouters,
+		"sub":    deleteStepSubnets,
+		"net":    deleteStepNetworks,
+		"sg-web": deleteStepSecurityGroups,
+		"flv":    deleteStepFlavors,
+	}
+	if len(plan.Items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(plan.Items), len(want))
+	}
+	for _, item := range plan.Items {
+		step, ok := want[item.ResourceID]
+		if !ok {
+			t.Errorf("unexpected item %s %s", item.Kind, item.ResourceID)
+			continue
+		}
+		if item.Step != step {
+			t.Errorf("%s: step %d, want %d", item.ResourceID, item.Step, step)
+		}
+		if item.Region != "ub1" {
+			t.Errorf("%s: region %q", item.ResourceID, item.Region)
+		}
+	}
+	if plan.Counts[InventorySecurityGroups] != 1 || plan.Counts[InventoryDomains] != 1 {
+		t.Errorf("counts %v", plan.Counts)
+	}
+}
+
+func TestOrderDeleteItems(t *testing.T) {
+	items := []JobItem{
+		{ResourceID: "srv-a", Region: "a", Step: deleteStepServers},
+		{ResourceID: "sg-a", Region: "a", Step: deleteStepSecurityGroups},
+		{ResourceID: "srv-b", Region: "b", Step: deleteStepServers},
+		{ResourceID: "vol-b", Region: "b", Step: deleteStepVolumes},
+		{ResourceID: "policy", Step: deleteStepSchedules},
+		{ResourceID: "project", Step: deleteStepProject},
+	}
+	orderDeleteItems(items)
+	want := []string{"policy", "srv-a", "srv-b", "vol-b", "sg-a", "project"}
+	for i, item := range items {
+		if item.ResourceID != want[i] {
+			t.Fatalf("position %d: got %s, want %s", i, item.ResourceID, want[i])
+		}
+	}
+}
+
+func TestNewDeleteItems(t *testing.T) {
+	saved := []JobItem{
+		{Kind: InventoryServers, Region: "a", ResourceID: "srv", Status: JobItemSucceeded},
+		{Kind: InventoryVolumes, Region: "a", ResourceID: "vol", Status: JobItemFailed},
+		{Kind: deleteKindProject, ResourceID: "project", Status: JobItemSkipped},
+	}
+	planned := []JobItem{
+		{Kind: InventoryVolumes, Region: "a", ResourceID: "vol"},
+		{Kind: InventoryVolumes, Region: "b", ResourceID: "vol"},
+		{Kind: InventoryServers, Region: "a", ResourceID: "srv-new"},
+		{Kind: deleteKindProject, ResourceID: "project"},
+	}
+	added := newDeleteItems(saved, planned)
+	if len(added) != 2 || added[0].Region != "b" || added[1].ResourceID != "srv-new" {
+		t.Errorf("got %+v, want the volume of region b and the new server", added)
+	}
+}
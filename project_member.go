@@ -0,0 +1,636 @@
+package thirtdparty
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/roles"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// Project roles, an owner may do everything, an admin manages stacks and members, a viewer only reads
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleViewer = "viewer"
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleAdmin: 2, RoleOwner: 3}
+
+// Invitation statuses
+const (
+	InvitationPending  = "PENDING"
+	InvitationAccepted = "ACCEPTED"
+	InvitationDeclined = "DECLINED"
+	InvitationRevoked  = "REVOKED"
+)
+
+// ProjectMember is a user other than the owner who was granted a role in the project
+type ProjectMember struct {
+	ID        uint32    `orm:"column(id);auto;pk" json:"id"`
+	ProjectID string    `orm:"column(project_id);size(64);index" json:"projectId"`
+	OsUserID  string    `orm:"column(os_user_id);size(64);index" json:"osUserId"`
+	Email     string    `orm:"column(email);size(255)" json:"email"`
+	Role      string    `orm:"column(role);size(16)" json:"role"`
+	InvitedBy string    `orm:"column(invited_by);size(64)" json:"invitedBy"`
+	CreatedAt time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+	UpdatedAt time.Time `orm:"column(updated_at);auto_now;type(datetime)" json:"updatedAt"`
+}
+
+// TableName ...
+func (t *ProjectMember) TableName() string {
+	return "project_members"
+}
+
+// TableUnique ...
+func (t *ProjectMember) TableUnique() [][]string {
+	return [][]string{{"ProjectID", "OsUserID"}}
+}
+
+// ProjectInvitation is a single-use invitation, only the hash of its token is kept
+type ProjectInvitation struct {
+	ID          uint32    `orm:"column(id);auto;pk" json:"id"`
+	ProjectID   string    `orm:"column(project_id);size(64);index" json:"projectId"`
+	Email       string    `orm:"column(email);size(255);index" json:"email"`
+	Role        string    `orm:"column(role);size(16)" json:"role"`
+	TokenHash   string    `orm:"column(token_hash);size(64);unique" json:"-"`
+	InvitedBy   string    `orm:"column(invited_by);size(64)" json:"invitedBy"`
+	Status      string    `orm:"column(status);size(16)" json:"status"`
+	ExpiresAt   time.Time `orm:"column(expires_at);type(datetime)" json:"expiresAt"`
+	RespondedAt time.Time `orm:"column(responded_at);type(datetime);null" json:"respondedAt"`
+	CreatedAt   time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+}
+
+// TableName ...
+func (t *ProjectInvitation) TableName() string {
+	return "project_invitations"
+}
+
+// SentInvitation is a new invitation and whether its email went out.
+// The token is only returned when it did not, for the inviter to pass on.
+type SentInvitation struct {
+	ProjectInvitation
+	EmailSent bool   `json:"emailSent"`
+	Token     string `json:"token,omitempty"`
+}
+
+func init() {
+	orm.RegisterModel(new(ProjectMember), new(ProjectInvitation))
+}
+
+// invitationTTL is how long an invitation can be accepted
+func invitationTTL() time.Duration {
+	return time.Duration(beego.AppConfig.DefaultInt("project.invitation.ttl.hours", 72)) * time.Hour
+}
+
+// keystoneRole is the keystone role a project role is granted as
+func keystoneRole(role string) string {
+	fallback := "member"
+	if role == RoleViewer {
+		fallback = "reader"
+	}
+	return beego.AppConfig.DefaultString("project.role."+role+".keystone", fallback)
+}
+
+func invitationHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newInvitationToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// projectAccess returns the settings of the project and the role of the user in it,
+// failing when the user has no role or a lower one than minimum
+func projectAccess(claims shared.Claims, projectID, minimum string) (*ProjectSetting, string, error) {
+	if setting, err := ownedProject(claims, projectID); err == nil {
+		return setting, RoleOwner, nil
+	}
+	o := orm.NewOrm()
+	member := ProjectMember{}
+	if err := o.QueryTable(new(ProjectMember)).Filter("project_id", projectID).Filter("os_user_id", claims.OsUserID).One(&member); err != nil {
+		return nil, "", fmt.Errorf("project %s not found", projectID)
+	}
+	if roleRank[member.Role] < roleRank[minimum] {
+		return nil, member.Role, fmt.Errorf("%s role is required", minimum)
+	}
+	setting := ProjectSetting{}
+	if err := o.QueryTable(new(ProjectSetting)).Filter("project_id", projectID).One(&setting); err != nil {
+		return nil, member.Role, fmt.Errorf("project %s not found", projectID)
+	}
+	return &setting, member.Role, nil
+}
+
+// keystoneRoleID looks the role up by name
+func keystoneRoleID(client *gophercloud.ServiceClient, name string) (string, error) {
+	allPages, err := roles.List(client, roles.ListOpts{Name: name}).AllPages()
+	if err != nil {
+		return "", err
+	}
+	list, err := roles.ExtractRoles(allPages)
+	if err != nil {
+		return "", err
+	}
+	if len(list) == 0 {
+		return "", fmt.Errorf("keystone role %q not found", name)
+	}
+	return list[0].ID, nil
+}
+
+// grantRole assigns the keystone role of the project role to the user
+func grantRole(projectID, osUserID, role string) error {
+	client, err := identityAdmin()
+	if err != nil {
+		return err
+	}
+	roleID, err := keystoneRoleID(client, keystoneRole(role))
+	if err != nil {
+		return err
+	}
+	return roles.Assign(client, roleID, roles.AssignOpts{UserID: osUserID, ProjectID: projectID}).ExtractErr()
+}
+
+// revokeRole removes the keystone role of the project role, a missing assignment is not an error
+func revokeRole(projectID, osUserID, role string) error {
+	client, err := identityAdmin()
+	if err != nil {
+		return err
+	}
+	roleID, err := keystoneRoleID(client, keystoneRole(role))
+	if err != nil {
+		return err
+	}
+	err = roles.Unassign(client, roleID, roles.UnassignOpts{UserID: osUserID, ProjectID: projectID}).ExtractErr()
+	if _, notFound := err.(gophercloud.ErrDefault404); notFound {
+		return nil
+	}
+	return err
+}
+
+// pendingInvitation finds the invitation of the token that the user may still answer
+func pendingInvitation(claims shared.Claims, token string) (*ProjectInvitation, error) {
+	o := orm.NewOrm()
+	invitation := ProjectInvitation{}
+	err := o.QueryTable(new(ProjectInvitation)).Filter("token_hash", invitationHash(token)).Filter("status", InvitationPending).One(&invitation)
+	if err != nil {
+		return nil, fmt.Errorf("invitation not found")
+	}
+	if err := invitation.answerableBy(claims.Email, time.Now()); err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// answerableBy fails unless the invitation is pending, addressed to the email and not expired at now
+func (t *ProjectInvitation) answerableBy(email string, now time.Time) error {
+	if t.Status != InvitationPending || !strings.EqualFold(t.Email, email) {
+		return fmt.Errorf("invitation not found")
+	}
+	if now.After(t.ExpiresAt) {
+		return fmt.Errorf("invitation expired")
+	}
+	return nil
+}
+
+// answerInvitation marks the invitation answered, it fails when another request answered it first
+func answerInvitation(invitation *ProjectInvitation, status string) error {
+	o := orm.NewOrm()
+	count, err := o.QueryTable(new(ProjectInvitation)).Filter("id", invitation.ID).Filter("status", InvitationPending).
+		Update(orm.Params{"status": status, "responded_at": time.Now()})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("invitation was already answered")
+	}
+	invitation.Status = status
+	return nil
+}
+
+// InviteParams ...
+type InviteParams struct {
+	ProjectID string `json:"projectId" bind:"required"`
+	Email     string `json:"email" bind:"required"`
+	Role      string `json:"role" bind:"required"`
+}
+
+// Invite ...
+// @Title Invite
+// @Description invite a user by email to the project as admin or viewer, only the owner invites admins
+// @Param	body	body	thirtdparty.InviteParams	true	"body for invite"
+// @Failure 403
+// @router /invite [post]
+func (m *ProjectController) Invite() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params InviteParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	params.Email = strings.ToLower(strings.TrimSpace(params.Email))
+	if params.Role != RoleAdmin && params.Role != RoleViewer {
+		m.SetError(helper.StatusMissingParams, "role must be admin or viewer", "role must be admin or viewer", claims.UserID)
+		return
+	}
+	setting, role, err := projectAccess(claims, params.ProjectID, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if err := grantable(role, params.Role); err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if strings.EqualFold(params.Email, setting.OwnerEmail) {
+		m.SetError(helper.StatusMissingParams, "the owner is already a member", "the owner is already a member", claims.UserID)
+		return
+	}
+
+	o := orm.NewOrm()
+	if o.QueryTable(new(ProjectMember)).Filter("project_id", setting.ProjectID).Filter("email", params.Email).Exist() {
+		m.SetError(helper.StatusMissingParams, "user is already a member", "user is already a member", claims.UserID)
+		return
+	}
+	// a new invitation replaces the pending one of the same email
+	o.QueryTable(new(ProjectInvitation)).Filter("project_id", setting.ProjectID).Filter("email", params.Email).
+		Filter("status", InvitationPending).Update(orm.Params{"status": InvitationRevoked})
+
+	token, err := newInvitationToken()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	invitation := ProjectInvitation{
+		ProjectID: setting.ProjectID,
+		Email:     params.Email,
+		Role:      params.Role,
+		TokenHash: invitationHash(token),
+		InvitedBy: claims.OsUserID,
+		Status:    InvitationPending,
+		ExpiresAt: time.Now().Add(invitationTTL()),
+	}
+	if _, err := o.Insert(&invitation); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	// when the email can not be sent the inviter gets the token to pass on instead
+	sent := shared.InviteUserToProject(claims.Email, setting.ProjectID, params.Email, token)
+	result := SentInvitation{ProjectInvitation: invitation, EmailSent: sent}
+	if !sent {
+		result.Token = token
+	}
+	m.SetBody(result)
+}
+
+// Invitations ...
+// @Title Invitations
+// @Description pending invitations of the project
+// @Param	id	query	string	true	"project id"
+// @Failure 403
+// @router /invitations [get]
+func (m *ProjectController) Invitations() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	setting, _, err := projectAccess(claims, m.GetString("id"), RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	o := orm.NewOrm()
+	list := []ProjectInvitation{}
+	o.QueryTable(new(ProjectInvitation)).Filter("project_id", setting.ProjectID).Filter("status", InvitationPending).
+		Filter("expires_at__gt", time.Now()).OrderBy("-id").All(&list)
+	m.SetBody(list)
+}
+
+// InvitationIDParams ...
+type InvitationIDParams struct {
+	ID uint32 `json:"id" bind:"required"`
+}
+
+// RevokeInvitation ...
+// @Title RevokeInvitation
+// @Description revoke a pending invitation
+// @Param	body	body	thirtdparty.InvitationIDParams	true	"body for revoke"
+// @Failure 403
+// @router /invitation/revoke [post]
+func (m *ProjectController) RevokeInvitation() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params InvitationIDParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	o := orm.NewOrm()
+	invitation := ProjectInvitation{}
+	if err := o.QueryTable(new(ProjectInvitation)).Filter("id", params.ID).One(&invitation); err != nil {
+		m.SetError(helper.StatusMissingParams, "invitation not found", err.Error(), claims.UserID)
+		return
+	}
+	if _, _, err := projectAccess(claims, invitation.ProjectID, RoleAdmin); err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if err := answerInvitation(&invitation, InvitationRevoked); err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(invitation)
+}
+
+// InvitationTokenParams ...
+type InvitationTokenParams struct {
+	Token string `json:"token" bind:"required"`
+}
+
+// AcceptInvitation ...
+// @Title AcceptInvitation
+// @Description accept an invitation sent to the user's email and get access to the project
+// @Param	body	body	thirtdparty.InvitationTokenParams	true	"body for accept"
+// @Failure 403
+// @router /invitation/accept [post]
+func (m *ProjectController) AcceptInvitation() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params InvitationTokenParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	invitation, err := pendingInvitation(claims, params.Token)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if err := answerInvitation(invitation, InvitationAccepted); err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	member, err := joinProject(invitation, claims.OsUserID, claims.Email)
+	if err != nil {
+		o := orm.NewOrm()
+		o.QueryTable(new(ProjectInvitation)).Filter("id", invitation.ID).Update(orm.Params{"status": InvitationPending})
+		m.SetError(helper.StatusError, "Failed granting project access", err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(member)
+}
+
+// joinProject records the member of the accepted invitation and grants its keystone role.
+// The member row comes first, and is removed again when the role can not be granted.
+func joinProject(invitation *ProjectInvitation, osUserID, email string) (*ProjectMember, error) {
+	member := &ProjectMember{
+		ProjectID: invitation.ProjectID,
+		OsUserID:  osUserID,
+		Email:     strings.ToLower(email),
+		Role:      invitation.Role,
+		InvitedBy: invitation.InvitedBy,
+	}
+	o := orm.NewOrm()
+	if _, err := o.Insert(member); err != nil {
+		return nil, err
+	}
+	if err := grantRole(invitation.ProjectID, osUserID, invitation.Role); err != nil {
+		o.Delete(member)
+		return nil, err
+	}
+	return member, nil
+}
+
+// DeclineInvitation ...
+// @Title DeclineInvitation
+// @Description decline an invitation sent to the user's email
+// @Param	body	body	thirtdparty.InvitationTokenParams	true	"body for decline"
+// @Failure 403
+// @router /invitation/decline [post]
+func (m *ProjectController) DeclineInvitation() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params InvitationTokenParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	invitation, err := pendingInvitation(claims, params.Token)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if err := answerInvitation(invitation, InvitationDeclined); err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(invitation)
+}
+
+// Members ...
+// @Title Members
+// @Description the owner and members of the project with their roles
+// @Param	id	query	string	true	"project id"
+// @Failure 403
+// @router /members [get]
+func (m *ProjectController) Members() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	setting, _, err := projectAccess(claims, m.GetString("id"), RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	o := orm.NewOrm()
+	list := []ProjectMember{}
+	o.QueryTable(new(ProjectMember)).Filter("project_id", setting.ProjectID).OrderBy("id").All(&list)
+	owner := ProjectMember{ProjectID: setting.ProjectID, OsUserID: setting.OwnerOsUserID, Email: setting.OwnerEmail, Role: RoleOwner, CreatedAt: setting.CreatedAt}
+	m.SetBody(append([]ProjectMember{owner}, list...))
+}
+
+// MemberParams ...
+type MemberParams struct {
+	ProjectID string `json:"projectId" bind:"required"`
+	OsUserID  string `json:"osUserId" bind:"required"`
+	Role      string `json:"role"`
+}
+
+// grantable fails unless a user with the role in the project may give the role to others.
+// Only the owner makes admins, an admin gives out the viewer role.
+func grantable(actorRole, role string) error {
+	if role == RoleAdmin && actorRole != RoleOwner {
+		return fmt.Errorf("only the owner can grant the admin role")
+	}
+	return nil
+}
+
+// projectMember finds the member the acting user may manage and the role of the acting user.
+// An admin only manages viewers.
+func projectMember(claims shared.Claims, params MemberParams) (*ProjectMember, string, error) {
+	_, role, err := projectAccess(claims, params.ProjectID, RoleAdmin)
+	if err != nil {
+		return nil, role, err
+	}
+	o := orm.NewOrm()
+	member := ProjectMember{}
+	if err := o.QueryTable(new(ProjectMember)).Filter("project_id", params.ProjectID).Filter("os_user_id", params.OsUserID).One(&member); err != nil {
+		return nil, role, fmt.Errorf("member not found")
+	}
+	if role != RoleOwner && member.Role != RoleViewer {
+		return nil, role, fmt.Errorf("only the owner can manage admins")
+	}
+	return &member, role, nil
+}
+
+// ChangeRole ...
+// @Title ChangeRole
+// @Description change the role of a member to admin or viewer, only the owner grants admin
+// @Param	body	body	thirtdparty.MemberParams	true	"body for role change"
+// @Failure 403
+// @router /member/role [post]
+func (m *ProjectController) ChangeRole() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params MemberParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	if params.Role != RoleAdmin && params.Role != RoleViewer {
+		m.SetError(helper.StatusMissingParams, "role must be admin or viewer", "role must be admin or viewer", claims.UserID)
+		return
+	}
+	member, role, err := projectMember(claims, params)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if err := grantable(role, params.Role); err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if member.Role == params.Role {
+		m.SetBody(member)
+		return
+	}
+
+	if keystoneRole(params.Role) != keystoneRole(member.Role) {
+		if err := grantRole(member.ProjectID, member.OsUserID, params.Role); err != nil {
+			m.SetError(helper.StatusError, "Failed granting project access", err.Error(), claims.UserID)
+			return
+		}
+		if err := revokeRole(member.ProjectID, member.OsUserID, member.Role); err != nil {
+			m.SetError(helper.StatusError, "Failed revoking project access", err.Error(), claims.UserID)
+			return
+		}
+	}
+	member.Role = params.Role
+	o := orm.NewOrm()
+	if _, err := o.Update(member, "role", "updated_at"); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(member)
+}
+
+// RemoveMember ...
+// @Title RemoveMember
+// @Description remove a member and revoke their access, members may remove themselves
+// @Param	body	body	thirtdparty.MemberParams	true	"body for remove"
+// @Failure 403
+// @router /member/remove [post]
+func (m *ProjectController) RemoveMember() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params MemberParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	o := orm.NewOrm()
+	var member *ProjectMember
+	if params.OsUserID == claims.OsUserID {
+		member = &ProjectMember{}
+		if err := o.QueryTable(new(ProjectMember)).Filter("project_id", params.ProjectID).Filter("os_user_id", claims.OsUserID).One(member); err != nil {
+			m.SetError(helper.StatusMissingParams, "member not found", err.Error(), claims.UserID)
+			return
+		}
+	} else {
+		var err error
+		if member, _, err = projectMember(claims, params); err != nil {
+			m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+	}
+
+	if err := revokeRole(member.ProjectID, member.OsUserID, member.Role); err != nil {
+		m.SetError(helper.StatusError, "Failed revoking project access", err.Error(), claims.UserID)
+		return
+	}
+	if _, err := o.Delete(member); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(member)
+}
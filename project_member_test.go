@@ -0,0 +1,54 @@
+package thirtdparty
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvitationAnswerableBy(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	invitation := func(status string, expiresAt time.Time) *ProjectInvitation {
+		return &ProjectInvitation{Email: "user@example.com", Status: status, ExpiresAt: expiresAt}
+	}
+	cases := []struct {
+		name       string
+		invitation *ProjectInvitation
+		email      string
+		want       string
+	}{
+		{"pending", invitation(InvitationPending, now.Add(time.Hour)), "user@example.com", ""},
+		{"email case does not matter", invitation(InvitationPending, now.Add(time.Hour)), "User@Example.com", ""},
+		{"other user", invitation(InvitationPending, now.Add(time.Hour)), "other@example.com", "invitation not found"},
+		{"already accepted", invitation(InvitationAccepted, now.Add(time.Hour)), "user@example.com", "invitation not found"},
+		{"revoked", invitation(InvitationRevoked, now.Add(time.Hour)), "user@example.com", "invitation not found"},
+		{"expired", invitation(InvitationPending, now.Add(-time.Second)), "user@example.com", "invitation expired"},
+	}
+	for _, c := range cases {
+		err := c.invitation.answerableBy(c.email, now)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestGrantable(t *testing.T) {
+	cases := []struct {
+		actor, role string
+		allow       bool
+	}{
+		{RoleOwner, RoleAdmin, true},
+		{RoleOwner, RoleViewer, true},
+		{RoleAdmin, RoleViewer, true},
+		{RoleAdmin, RoleAdmin, false},
+		{RoleViewer, RoleAdmin, false},
+	}
+	for _, c := range cases {
+		if err := grantable(c.actor, c.role); (err == nil) != c.allow {
+			t.Errorf("%s granting %s: got %v", c.actor, c.role, err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/quotasets"
+	computequotas "github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/quotasets"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/quotas"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// QuotaRequest is what a new stack will consume.
+// VCPUs and RAM (MB) are read from the flavor when FlavorID is set, Disk is in GB.
+type QuotaRequest struct {
+	FlavorID    string
+	VCPUs       int
+	RAM         int
+	Disk        int
+	Volumes     int
+	FloatingIPs int
+}
+
+// QuotaCheck compares one limit with its usage, a negative limit is unlimited
+type QuotaCheck struct {
+	Scope     string `json:"scope"`
+	Resource  string `json:"resource"`
+	Limit     int    `json:"limit"`
+	Used      int    `json:"used"`
+	Requested int    `json:"requested"`
+	Exceeded  bool   `json:"exceeded"`
+}
+
+// QuotaReport is the outcome of the pre-flight check
+type QuotaReport struct {
+	ProjectID string       `json:"projectId"`
+	Plan      string       `json:"plan"`
+	Checks    []QuotaCheck `json:"checks"`
+}
+
+func (r *QuotaReport) add(scope, resource string, limit, used, requested int) {
+	r.Checks = append(r.Checks, QuotaCheck{
+		Scope:     scope,
+		Resource:  resource,
+		Limit:     limit,
+		Used:      used,
+		Requested: requested,
+		Exceeded:  requested > 0 && limit >= 0 && used+requested > limit,
+	})
+}
+
+// Exceeded returns the checks the request would go over
+func (r *QuotaReport) Exceeded() []QuotaCheck {
+	exceeded := []QuotaCheck{}
+	for _, check := range r.Checks {
+		if check.Exceeded {
+			exceeded = append(exceeded, check)
+		}
+	}
+	return exceeded
+}
+
+// Summary describes every exceeded limit in one line
+func (r *QuotaReport) Summary() string {
+	lines := []string{}
+	for _, check := range r.Exceeded() {
+		lines = append(lines, fmt.Sprintf("%s %s: %d used + %d requested exceeds the limit of %d",
+			check.Scope, check.Resource, check.Used, check.Requested, check.Limit))
+	}
+	return strings.Join(lines, "; ")
+}
+
+// planLimit is the limit of the quota plan for the resource, -1 when the plan sets none
+func planLimit(plan, resource string) int {
+	if len(plan) == 0 {
+		return -1
+	}
+	return beego.AppConfig.DefaultInt(fmt.Sprintf("quota.plan.%s.%s", strings.ToLower(plan), resource), -1)
+}
+
+// planUsage sums what the user is billed for right now across every project
+func planUsage(osUserID string) (instances, vcpus, ram, volumes, disk, floatingIPs int, err error) {
+	var rows []orm.Params
+	o := orm.NewOrm()
+	_, err = o.Raw("SELECT type, COUNT(*) AS count, COALESCE(SUM(cpu), 0) AS cpu, COALESCE(SUM(ram), 0) AS ram, COALESCE(SUM(disk_size), 0) AS disk "+
+		"FROM usg_history WHERE os_user_id = ? AND end_date = '' GROUP BY type", osUserID).Values(&rows)
+	if err != nil {
+		return
+	}
+	value := func(row orm.Params, key string) int {
+		var n int
+		fmt.Sscan(fmt.Sprint(row[key]), &n)
+		return n
+	}
+	for _, row := range rows {
+		switch fmt.Sprint(row["type"]) {
+		case "Instance":
+			instances = value(row, "count")
+			vcpus = value(row, "cpu")
+			ram = value(row, "ram")
+		case "Volume":
+			volumes = value(row, "count")
+			disk = value(row, "disk")
+		case "IP":
+			floatingIPs = value(row, "count")
+		}
+	}
+	return
+}
+
+// preflightQuota reads the project's compute, volume and network quotas and the user's quota plan
+// and reports which of them the request would exceed. Every quota is read for the project, and a
+// quota that can not be read fails the check rather than letting the request through.
+func preflightQuota(provider *gophercloud.ProviderClient, claims shared.Claims, region shared.CloudRegion, projectID string, req QuotaRequest) (*QuotaReport, error) {
+	if len(projectID) == 0 {
+		return nil, fmt.Errorf("projectId is required")
+	}
+	computeClient, err := region.ComputeClient(provider)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.FlavorID) > 0 {
+		flavor, err := flavors.Get(computeClient, req.FlavorID).Extract()
+		if err != nil {
+			return nil, fmt.Errorf("flavor %s not found", req.FlavorID)
+		}
+		req.VCPUs = flavor.VCPUs
+		req.RAM = flavor.RAM
+	}
+
+	report := &QuotaReport{ProjectID: projectID, Plan: claims.QuotaPlan, Checks: []QuotaCheck{}}
+
+	detail, err := computequotas.GetDetail(computeClient, projectID).Extract()
+	if err != nil {
+		return nil, fmt.Errorf("compute quota can not be read: %v", err)
+	}
+	report.add("project", "instances", detail.Instances.Limit, detail.Instances.InUse+detail.Instances.Reserved, 1)
+	report.add("project", "vcpus", detail.Cores.Limit, detail.Cores.InUse+detail.Cores.Reserved, req.VCPUs)
+	report.add("project", "ram", detail.RAM.Limit, detail.RAM.InUse+detail.RAM.Reserved, req.RAM)
+
+	volumeClient, err := region.BlockStorageClient(provider)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := quotasets.GetUsage(volumeClient, projectID).Extract()
+	if err != nil {
+		return nil, fmt.Errorf("volume quota can not be read: %v", err)
+	}
+	report.add("project", "volumes", usage.Volumes.Limit, usage.Volumes.InUse+usage.Volumes.Reserved, req.Volumes)
+	report.add("project", "gigabytes", usage.Gigabytes.Limit, usage.Gigabytes.InUse+usage.Gigabytes.Reserved, req.Disk)
+
+	if req.FloatingIPs > 0 {
+		networkClient, err := region.NetworkClient(provider)
+		if err != nil {
+			return nil, err
+		}
+		detail, err := quotas.GetDetail(networkClient, projectID).Extract()
+		if err != nil {
+			return nil, fmt.Errorf("network quota can not be read: %v", err)
+		}
+		report.add("project", "floating ips", detail.FloatingIP.Limit, detail.FloatingIP.Used+detail.FloatingIP.Reserved, req.FloatingIPs)
+	}
+
+	if len(claims.QuotaPlan) > 0 {
+		instances, vcpus, ram, volumes, disk, floatingIPs, err := planUsage(claims.OsUserID)
+		if err != nil {
+			return nil, fmt.Errorf("plan usage can not be read: %v", err)
+		}
+		scope := "plan " + claims.QuotaPlan
+		report.add(scope, "instances", planLimit(claims.QuotaPlan, "instances"), instances, 1)
+		report.add(scope, "vcpus", planLimit(claims.QuotaPlan, "vcpus"), vcpus, req.VCPUs)
+		report.add(scope, "ram", planLimit(claims.QuotaPlan, "ram"), ram, req.RAM)
+		report.add(scope, "volumes", planLimit(claims.QuotaPlan, "volumes"), volumes, req.Volumes)
+		report.add(scope, "gigabytes", planLimit(claims.QuotaPlan, "gigabytes"), disk, req.Disk)
+		report.add(scope, "floating ips", planLimit(claims.QuotaPlan, "floatingips"), floatingIPs, req.FloatingIPs)
+	}
+	return report, nil
+}
+
+// providerQuotaRejected runs the pre-flight check with the clients of the provider and sets the
+// error response when the request does not fit
+func providerQuotaRejected(c *shared.BaseController, provider *gophercloud.ProviderClient, claims shared.Claims, region shared.CloudRegion, projectID string, req QuotaRequest) bool {
+	report, err := preflightQuota(provider, claims, region, projectID, req)
+	if err != nil {
+		c.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return true
+	}
+	if len(report.Exceeded()) > 0 {
+		summary := report.Summary()
+		c.SetErrorWithBody(helper.StatusBadRequest, report, "Quota exceeded: "+summary, summary, claims.UserID)
+		return true
+	}
+	return false
+}
+
+// floatingIPCount is the number of floating IPs the network params allocate
+func floatingIPCount(params StackNetworkParams) int {
+	if params.FloatingIP {
+		return 1
+	}
+	return 0
+}
+
+// QuotaController struct
+type QuotaController struct {
+	shared.BaseController
+}
+
+// URLMapping URL mapping
+func (m *QuotaController) URLMapping() {
+	m.Mapping("Check", m.Check)
+}
+
+// QuotaCheckParams ...
+type QuotaCheckParams struct {
+	ProjectID   string `json:"projectId"`
+	Region      string `json:"region"`
+	FlavorID    string `json:"flavorId"`
+	CPU         int    `json:"cpu"`
+	RAM         int    `json:"ram"`
+	Disk        int    `json:"disk" bind:"required"`
+	FloatingIPs int    `json:"floatingIps"`
+}
+
+// Check ...
+// @Title Check
+// @Description report whether a stack of the size fits the project's quotas and the user's plan
+// @Param	body	body	thirtdparty.QuotaCheckParams	true	"body for check"
+// @Failure 403
+// @router /check [post]
+func (m *QuotaController) Check() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params QuotaCheckParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	session, err := openSession(claims, m.GetClientIP(), params.ProjectID, params.Region, RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	report, err := preflightQuota(session.Provider(), claims, session.Region, session.ProjectID, QuotaRequest{
+		FlavorID:    params.FlavorID,
+		VCPUs:       params.CPU,
+		RAM:         params.RAM * 1024,
+		Disk:        params.Disk,
+		Volumes:     1,
+		FloatingIPs: params.FloatingIPs,
+	})
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(report)
+}
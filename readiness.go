@@ -0,0 +1,326 @@
+package thirtdparty
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/context"
+	"github.com/astaxie/beego/orm"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/service"
+)
+
+// Readiness statuses reported by the instance at the end of cloud-init
+const (
+	StackReady  = "READY"
+	StackFailed = "FAILED"
+)
+
+// maxReadyLog bounds the log excerpt stored with the stack
+const maxReadyLog = 8192
+
+// phoneHomeScript runs after every other user script, hence the zz prefix,
+// and reports whether cloud-init logged a failure together with the tail of its output
+const phoneHomeScript = `#!/bin/sh
+STATUS=success
+if grep -qE "Failed running|Traceback|Running module .* failed" /var/log/cloud-init.log 2>/dev/null; then
+  STATUS=failure
+fi
+LOG=$(tail -n 40 /var/log/cloud-init-output.log 2>/dev/null | base64 | tr -d '\n')
+for i in 1 2 3 4 5; do
+  curl -fsS -m 20 -X POST -H "Content-Type: application/json" \
+    -d "{\"token\":\"%s\",\"status\":\"$STATUS\",\"log\":\"$LOG\"}" "%s" && break
+  sleep 10
+done
+`
+
+// readinessMu keeps the phone home and the ACTIVE watcher from both sending the callback
+var readinessMu sync.Mutex
+
+// phoneHomeTimeout is the readiness log of a stack failed for not reporting before the deadline
+const phoneHomeTimeout = "instance did not phone home before the deadline"
+
+// maxPhoneHomeBody bounds the report read from an instance
+const maxPhoneHomeBody = 64 << 10
+
+func init() {
+	beego.AddAPPStartHook(resumePhoneHomeDeadlines)
+	// instances have no user token, so the report is served before the auth filters run
+	if path := phoneHomePath(); len(path) > 0 {
+		beego.InsertFilter(path, beego.BeforeStatic, servePhoneHome)
+	}
+}
+
+// phoneHomeURL is the public address instances report readiness to, phone home is off without it
+func phoneHomeURL() string {
+	return beego.AppConfig.String("phonehome.url")
+}
+
+// phoneHomePath is the path of phonehome.url on this API
+func phoneHomePath() string {
+	parsed, err := url.Parse(phoneHomeURL())
+	if err != nil {
+		return ""
+	}
+	return parsed.Path
+}
+
+func phoneHomeDeadline() time.Duration {
+	return time.Duration(beego.AppConfig.DefaultInt("phonehome.deadline", 30)) * time.Minute
+}
+
+// newPhoneHomeToken returns a random token for a new server, or "" when phone home is off
+func newPhoneHomeToken() string {
+	if len(phoneHomeURL()) == 0 {
+		return ""
+	}
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// phoneHomeHash is what the stack stores instead of the token itself
+func phoneHomeHash(token string) string {
+	if len(token) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// withPhoneHome turns the user-data into a multipart message with the phone home script as last part
+func withPhoneHome(userData []byte, token string) []byte {
+	if len(token) == 0 {
+		return userData
+	}
+
+	contentType := "text/cloud-config"
+	if bytes.HasPrefix(userData, []byte("#!")) {
+		contentType = "text/x-shellscript"
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	parts := []struct {
+		contentType string
+		filename    string
+		content     []byte
+	}{
+		{contentType, "base.yml", userData},
+		{"text/x-shellscript", "zz-phone-home", []byte(fmt.Sprintf(phoneHomeScript, token, phoneHomeURL()))},
+	}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", fmt.Sprintf("%s; charset=\"us-ascii\"", part.contentType))
+		header.Set("MIME-Version", "1.0")
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", part.filename))
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return userData
+		}
+		w.Write(part.content)
+	}
+	writer.Close()
+
+	message := fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n", writer.Boundary())
+	return append([]byte(message), body.Bytes()...)
+}
+
+// watchPhoneHome fails the stack when the instance has not phoned home before the deadline
+func watchPhoneHome(serverID string, deadline time.Duration) {
+	time.AfterFunc(deadline, func() {
+		stack, err := GetStackByServer(serverID)
+		if err != nil || stack.Status == StackReady || stack.Status == StackFailed {
+			return
+		}
+		markStackReadiness(stack, false, phoneHomeTimeout)
+	})
+}
+
+// resumePhoneHomeDeadlines re-arms the deadlines of stacks still waiting when the application restarts
+func resumePhoneHomeDeadlines() error {
+	o := orm.NewOrm()
+	var stacks []Stack
+	_, err := o.QueryTable(new(Stack)).Filter("phone_home_token__isnull", false).Exclude("phone_home_token", "").
+		Exclude("status__in", StackReady, StackFailed, "ERROR").All(&stacks)
+	if err != nil {
+		return err
+	}
+	for _, stack := range stacks {
+		remaining := time.Until(stack.CreatedAt.Add(phoneHomeDeadline()))
+		if remaining < 0 {
+			remaining = 0
+		}
+		watchPhoneHome(stack.ServerID, remaining)
+	}
+	return nil
+}
+
+// deliverWhenReady sends the partner callback now when the stack does not phone home,
+// otherwise stores it until the instance reports readiness
+func deliverWhenReady(serverID, callbackURL string, payload interface{}) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+
+	stack, err := GetStackByServer(serverID)
+	if err != nil || len(stack.PhoneHomeToken) == 0 {
+		shared.CallbackFunction(callbackURL, payload)
+		return
+	}
+	data, _ := json.Marshal(payload)
+	if stack.Status == StackReady || stack.Status == StackFailed {
+		shared.CallbackFunction(callbackURL, readinessCallback(string(data), stack.Status, stack.ReadyLog))
+		return
+	}
+
+	o := orm.NewOrm()
+	_, err = o.QueryTable(new(Stack)).Filter("server_id", serverID).Update(orm.Params{
+		"callback_url":     callbackURL,
+		"callback_payload": string(data),
+	})
+	if err != nil {
+		fmt.Println("Failed storing callback of", serverID, err)
+	}
+}
+
+// markStackReadiness stores the reported readiness and fires the stored callback once the stack is READY
+func markStackReadiness(reported *Stack, ok bool, log string) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+
+	// reload inside the lock so a callback stored meanwhile is not missed
+	stack, err := GetStackByServer(reported.ServerID)
+	if err != nil {
+		fmt.Println("Failed loading stack", reported.ServerID, err)
+		return
+	}
+
+	status := StackReady
+	var reportErr error
+	if !ok {
+		status = StackFailed
+		reportErr = fmt.Errorf("cloud-init failed")
+	}
+	if len(log) > maxReadyLog {
+		log = log[len(log)-maxReadyLog:]
+	}
+
+	o := orm.NewOrm()
+	_, err = o.QueryTable(new(Stack)).Filter("server_id", stack.ServerID).Update(orm.Params{
+		"status":     status,
+		"ready_log":  log,
+		"ready_at":   time.Now(),
+		"updated_at": time.Now(),
+	})
+	if err != nil {
+		fmt.Println("Failed updating readiness of", stack.ServerID, err)
+		return
+	}
+	service.CreateLogAction(stack.ServerID, "Instance", stack.Name, "PhoneHome", stack.OsUserID, reportErr)
+
+	if !ok {
+		notif := fmt.Sprintf("%s %s failed to provision", stack.Type, stack.Name)
+		shared.SendPushNotificationToUser(stack.OsUserID, "Stack failed", notif, stack.ProjectID, "", nil)
+	}
+	// the partner hears of a failure as well, and again when a late report turns out ready
+	if len(stack.CallbackURL) > 0 && len(stack.CallbackPayload) > 0 {
+		message := ""
+		if !ok {
+			message = log
+		}
+		shared.CallbackFunction(stack.CallbackURL, readinessCallback(stack.CallbackPayload, status, message))
+	}
+}
+
+// readinessCallback is the stored partner callback with the readiness of the stack added
+func readinessCallback(payload, status, message string) interface{} {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return json.RawMessage(payload)
+	}
+	fields["status"] = status
+	if status == StackFailed && len(message) > 0 {
+		fields["message"] = message
+	}
+	return fields
+}
+
+// acceptsReport tells whether the stack still takes a readiness report. A stack failed only for
+// not reporting before the deadline takes a late one, so a slow instance is not lost.
+func acceptsReport(status, readyLog string) bool {
+	switch status {
+	case StackReady:
+		return false
+	case StackFailed:
+		return readyLog == phoneHomeTimeout
+	}
+	return true
+}
+
+// reportPhoneHome records the report of an instance and returns the http status it is answered with
+func reportPhoneHome(params PhoneHomeParams) (int, error) {
+	hash := phoneHomeHash(params.Token)
+	stack := Stack{}
+	o := orm.NewOrm()
+	err := o.QueryTable(new(Stack)).Filter("phone_home_token", hash).One(&stack)
+	if err != nil || subtle.ConstantTimeCompare([]byte(stack.PhoneHomeToken), []byte(hash)) != 1 {
+		return http.StatusNotFound, fmt.Errorf("unknown phone home token")
+	}
+	if !acceptsReport(stack.Status, stack.ReadyLog) {
+		return http.StatusConflict, fmt.Errorf("stack already reported %s", stack.Status)
+	}
+
+	log := params.Log
+	if decoded, err := base64.StdEncoding.DecodeString(params.Log); err == nil {
+		log = string(decoded)
+	}
+	markStackReadiness(&stack, strings.EqualFold(params.Status, "success"), log)
+	return http.StatusOK, nil
+}
+
+// servePhoneHome answers the report of an instance from a filter, which ends the request
+// before the auth filters ask for a user token
+func servePhoneHome(ctx *context.Context) {
+	if ctx.Request.Method != http.MethodPost {
+		return
+	}
+	var params PhoneHomeParams
+	err := json.NewDecoder(io.LimitReader(ctx.Request.Body, maxPhoneHomeBody)).Decode(&params)
+	if err == nil && (len(params.Token) == 0 || len(params.Status) == 0) {
+		err = fmt.Errorf("token and status are required")
+	}
+	code := http.StatusBadRequest
+	if err == nil {
+		code, err = reportPhoneHome(params)
+	}
+	ctx.Output.SetStatus(code)
+	if err != nil {
+		ctx.Output.JSON(map[string]string{"error": err.Error()}, false, false)
+		return
+	}
+	ctx.Output.JSON(map[string]string{"status": "ok"}, false, false)
+}
+
+// PhoneHomeParams is the readiness report an instance posts to phonehome.url
+type PhoneHomeParams struct {
+	Token  string `json:"token" bind:"required"`
+	Status string `json:"status" bind:"required"`
+	Log    string `json:"log"`
+}
@@ -0,0 +1,44 @@
+package thirtdparty
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAcceptsReport(t *testing.T) {
+	cases := []struct {
+		status   string
+		readyLog string
+		want     bool
+	}{
+		{"ACTIVE", "", true},
+		{"BUILD", "", true},
+		{StackReady, "", false},
+		{StackFailed, "cloud-init failed", false},
+		{StackFailed, phoneHomeTimeout, true},
+	}
+	for _, c := range cases {
+		if got := acceptsReport(c.status, c.readyLog); got != c.want {
+			t.Errorf("%s %q: got %v, want %v", c.status, c.readyLog, got, c.want)
+		}
+	}
+}
+
+func TestReadinessCallback(t *testing.T) {
+	got := readinessCallback(`{"orderId":"42"}`, StackFailed, "boom")
+	want := map[string]interface{}{"orderId": "42", "status": StackFailed, "message": "boom"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("failed: got %v, want %v", got, want)
+	}
+
+	got = readinessCallback(`{"orderId":"42"}`, StackReady, "ignored")
+	want = map[string]interface{}{"orderId": "42", "status": StackReady}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ready: got %v, want %v", got, want)
+	}
+
+	if raw, ok := readinessCallback(`not json`, StackReady, "").(json.RawMessage); !ok || string(raw) != "not json" {
+		t.Errorf("a payload that is not an object must be passed as is, got %v", raw)
+	}
+}
@@ -0,0 +1,205 @@
+package shared
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/astaxie/beego"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+)
+
+// CloudRegion is one OpenStack region stacks can be provisioned in.
+// Regions are keyed by the same tag projects carry (CLOUD.MN, ICS ...).
+type CloudRegion struct {
+	Tag              string            `json:"tag"`
+	Cloud            string            `json:"cloud"`
+	Region           string            `json:"region"`
+	PublicNetworkID  string            `json:"publicNetworkId"`
+	Images           map[string]string `json:"images"`
+	Default          bool              `json:"default"`
+	IdentityEndpoint string            `json:"-"`
+	Username         string            `json:"-"`
+	Password         string            `json:"-"`
+	TenantID         string            `json:"-"`
+	DomainID         string            `json:"-"`
+}
+
+var (
+	regionsOnce sync.Once
+	regionList  []CloudRegion
+)
+
+// regionValue reads region.<tag>.<key> from app.conf and falls back to the given environment variable
+func regionValue(tag, key, env string) string {
+	if value := beego.AppConfig.String(fmt.Sprintf("region.%s.%s", tag, key)); len(value) > 0 {
+		return value
+	}
+	if len(env) > 0 {
+		return os.Getenv(env)
+	}
+	return ""
+}
+
+// loadRegions builds the registry from the cloud.regions list in app.conf.
+// The first region is the default one. Credentials of the two legacy clouds keep
+// their environment variables as fallback.
+func loadRegions() {
+	tags := strings.Split(beego.AppConfig.DefaultString("cloud.regions", "CLOUD.MN,ICS"), ",")
+	for i, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if len(tag) == 0 {
+			continue
+		}
+		envPrefix := ""
+		if tag == "ICS" {
+			envPrefix = "ics."
+		}
+		region := CloudRegion{
+			Tag:              tag,
+			Cloud:            regionValue(tag, "cloud", ""),
+			Region:           regionValue(tag, "region", ""),
+			PublicNetworkID:  regionValue(tag, "publicNetworkId", envPrefix+"public.network.id"),
+			IdentityEndpoint: regionValue(tag, "identityEndpoint", envPrefix+"identityEndpoint"),
+			Username:         regionValue(tag, "username", envPrefix+"username"),
+			Password:         regionValue(tag, "password", envPrefix+"password"),
+			TenantID:         regionValue(tag, "tenantID", envPrefix+"tenantID"),
+			DomainID:         regionValue(tag, "domainID", ""),
+			Images:           map[string]string{},
+			Default:          i == 0,
+		}
+		if len(region.Cloud) == 0 {
+			region.Cloud = tag
+		}
+		if len(region.Region) == 0 {
+			region.Region = "RegionOne"
+		}
+		if len(region.DomainID) == 0 {
+			region.DomainID = "default"
+		}
+		for _, name := range strings.Split(regionValue(tag, "images", ""), ",") {
+			name = strings.TrimSpace(name)
+			if len(name) > 0 {
+				region.Images[name] = regionValue(tag, "image."+name, "")
+			}
+		}
+		regionList = append(regionList, region)
+	}
+}
+
+// Regions returns every configured region
+func Regions() []CloudRegion {
+	regionsOnce.Do(loadRegions)
+	return regionList
+}
+
+// DistinctRegions returns the configured regions with the tags that point at the same
+// region of the same cloud folded into the first of them
+func DistinctRegions() []CloudRegion {
+	seen := map[string]bool{}
+	result := []CloudRegion{}
+	for _, region := range Regions() {
+		key := strings.ToLower(strings.TrimRight(region.IdentityEndpoint, "/")) + "|" + region.Region
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, region)
+	}
+	return result
+}
+
+// GetRegion returns the region registered under the tag
+func GetRegion(tag string) (CloudRegion, error) {
+	for _, region := range Regions() {
+		if strings.EqualFold(region.Tag, tag) {
+			return region, nil
+		}
+	}
+	return CloudRegion{}, fmt.Errorf("region %q is not configured", tag)
+}
+
+// DefaultRegion returns the first configured region
+func DefaultRegion() (CloudRegion, error) {
+	regions := Regions()
+	if len(regions) == 0 {
+		return CloudRegion{}, fmt.Errorf("no region is configured")
+	}
+	return regions[0], nil
+}
+
+// ResolveRegion picks the requested region, otherwise the region of the project's tag, otherwise the default
+func ResolveRegion(requested, projectTag string) (CloudRegion, error) {
+	if len(requested) > 0 {
+		return GetRegion(requested)
+	}
+	if len(projectTag) > 0 {
+		if region, err := GetRegion(projectTag); err == nil {
+			return region, nil
+		}
+	}
+	return DefaultRegion()
+}
+
+// Image returns the configured image id for the name or the fallback
+func (r CloudRegion) Image(name, fallback string) string {
+	if id := r.Images[name]; len(id) > 0 {
+		return id
+	}
+	return fallback
+}
+
+// AdminProvider authenticates with the admin credentials of the region's cloud
+func (r CloudRegion) AdminProvider() (*gophercloud.ProviderClient, error) {
+	opts := gophercloud.AuthOptions{
+		IdentityEndpoint: r.IdentityEndpoint,
+		Username:         r.Username,
+		Password:         r.Password,
+		TenantID:         r.TenantID,
+		DomainID:         r.DomainID,
+	}
+	return openstack.AuthenticatedClient(opts)
+}
+
+// ProjectProvider authenticates the region's service account scoped to the project
+func (r CloudRegion) ProjectProvider(projectID string) (*gophercloud.ProviderClient, error) {
+	opts := gophercloud.AuthOptions{
+		IdentityEndpoint: r.IdentityEndpoint,
+		Username:         r.Username,
+		Password:         r.Password,
+		DomainID:         r.DomainID,
+		Scope:            &gophercloud.AuthScope{ProjectID: projectID},
+	}
+	return openstack.AuthenticatedClient(opts)
+}
+
+func (r CloudRegion) endpoint() gophercloud.EndpointOpts {
+	return gophercloud.EndpointOpts{Region: r.Region}
+}
+
+// ComputeClient returns a nova client of the region
+func (r CloudRegion) ComputeClient(provider *gophercloud.ProviderClient) (*gophercloud.ServiceClient, error) {
+	return openstack.NewComputeV2(provider, r.endpoint())
+}
+
+// NetworkClient returns a neutron client of the region
+func (r CloudRegion) NetworkClient(provider *gophercloud.ProviderClient) (*gophercloud.ServiceClient, error) {
+	return openstack.NewNetworkV2(provider, r.endpoint())
+}
+
+// BlockStorageClient returns a cinder client of the region
+func (r CloudRegion) BlockStorageClient(provider *gophercloud.ProviderClient) (*gophercloud.ServiceClient, error) {
+	return openstack.NewBlockStorageV3(provider, r.endpoint())
+}
+
+// ImageClient returns a glance client of the region
+func (r CloudRegion) ImageClient(provider *gophercloud.ProviderClient) (*gophercloud.ServiceClient, error) {
+	return openstack.NewImageServiceV2(provider, r.endpoint())
+}
+
+// IdentityClient returns a keystone client of the region's cloud
+func (r CloudRegion) IdentityClient(provider *gophercloud.ProviderClient) (*gophercloud.ServiceClient, error) {
+	return openstack.NewIdentityV3(provider, r.endpoint())
+}
@@ -0,0 +1,235 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+	"gitlab.com/ics-project/back-thirdparty/service"
+)
+
+// resizeTimeout bounds how long a resize may take before it is rolled back
+const resizeTimeout = 20 * time.Minute
+
+// ResizeParams ...
+type ResizeParams struct {
+	ID       string `json:"id" bind:"required"`
+	FlavorID string `json:"flavorId" bind:"required"`
+}
+
+// Resize ...
+// @Title Resize
+// @Description resize the stack's server to another allowed flavor
+// @Param	body	body	thirtdparty.ResizeParams	true	"body for resize"
+// @Failure 403
+// @router /resize [post]
+func (m *StackController) Resize() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params ResizeParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+
+	stack, err := GetProjectStack(claims, params.ID, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	session, err := stackSession(claims, m.GetClientIP(), stack, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	computeClient, err := session.Compute()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	server, err := servers.Get(computeClient, stack.ServerID).Extract()
+	if err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if server.Status != "ACTIVE" && server.Status != "SHUTOFF" {
+		err := fmt.Errorf("server is %s, only ACTIVE or SHUTOFF servers can be resized", server.Status)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	match, err := stackFlavorMatch(computeClient, session.Region.Tag, stack.Type)
+	if err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	flavor, err := flavors.Get(computeClient, params.FlavorID).Extract()
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if !match(*flavor) {
+		err := fmt.Errorf("flavor %s is not available for %s stacks", flavor.Name, stack.Type)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if currentID, _ := server.Flavor["id"].(string); currentID == flavor.ID {
+		err := fmt.Errorf("server already uses flavor %s", flavor.Name)
+		m.SetError(helper.StatusAlready, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	err = servers.Resize(computeClient, server.ID, servers.ResizeOpts{FlavorRef: flavor.ID}).ExtractErr()
+	logID := service.CreateLogAction(server.ID, "Instance", server.Name, "Resize", claims.UserID, err)
+	if err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	updateStackStatus(server.ID, "RESIZE")
+
+	go watchResize(computeClient, *stack, flavor, m.GetClientIP(), logID)
+
+	m.SetBody(map[string]string{
+		"id":       server.ID,
+		"flavorId": flavor.ID,
+		"status":   "RESIZE",
+	})
+}
+
+// resizeStartGrace is how long a server may stay on its old flavor before nova is taken to have
+// given up on the resize without ever starting the migration
+const resizeStartGrace = 2 * time.Minute
+
+// Steps of a resize watch
+const (
+	resizeWait    = "wait"
+	resizeConfirm = "confirm"
+	resizeDone    = "done"
+	resizeAborted = "aborted"
+	resizeFailed  = "failed"
+)
+
+// resizeStep decides what the watch does with the server's status. A server back on its old flavor
+// after the migration started, or that never left it within the grace period, was rolled back by nova.
+func resizeStep(status, flavorID, target string, migrating bool, waited time.Duration) string {
+	switch status {
+	case "VERIFY_RESIZE":
+		return resizeConfirm
+	case "ERROR":
+		return resizeFailed
+	case "ACTIVE", "SHUTOFF":
+		if flavorID == target {
+			return resizeDone
+		}
+		if migrating || waited > resizeStartGrace {
+			return resizeAborted
+		}
+	}
+	return resizeWait
+}
+
+// watchResize confirms the resize once nova reaches VERIFY_RESIZE and reverts it when the confirm fails.
+// A resize nova rolled back itself, or that left the server in ERROR, is recorded and reported to the owner.
+func watchResize(client *gophercloud.ServiceClient, stack Stack, flavor *flavors.Flavor, clientIP string, logID int64) {
+	started := time.Now()
+	deadline := started.Add(resizeTimeout)
+	migrating := false
+	for time.Now().Before(deadline) {
+		time.Sleep(5 * time.Second)
+		server, err := servers.Get(client, stack.ServerID).Extract()
+		if err != nil {
+			continue
+		}
+		if server.Status == "RESIZE" {
+			migrating = true
+		}
+
+		currentID, _ := server.Flavor["id"].(string)
+		switch resizeStep(server.Status, currentID, flavor.ID, migrating, time.Since(started)) {
+		case resizeConfirm:
+			err := servers.ConfirmResize(client, server.ID).ExtractErr()
+			service.CreateLogAction(server.ID, "Instance", server.Name, "ConfirmResize", stack.OsUserID, err)
+			if err != nil {
+				revertResize(client, stack, server.Name)
+				return
+			}
+		case resizeDone:
+			o := orm.NewOrm()
+			o.QueryTable(new(Stack)).Filter("server_id", server.ID).Update(orm.Params{
+				"flavor_id":  flavor.ID,
+				"status":     server.Status,
+				"updated_at": time.Now(),
+			})
+			switchUsageFlavor(stack, server, flavor, clientIP, logID)
+			return
+		case resizeAborted:
+			reportResizeFailure(stack, server.Status, fmt.Errorf("nova rolled the resize to %s back", flavor.Name))
+			return
+		case resizeFailed:
+			reportResizeFailure(stack, server.Status, fmt.Errorf("resize to %s left the server in ERROR", flavor.Name))
+			return
+		}
+	}
+
+	server, err := servers.Get(client, stack.ServerID).Extract()
+	if err == nil && server.Status == "VERIFY_RESIZE" {
+		service.CreateLogAction(stack.ServerID, "Instance", stack.Name, "Resize", stack.OsUserID, fmt.Errorf("resize timed out"))
+		revertResize(client, stack, stack.Name)
+		return
+	}
+	status := "ERROR"
+	if err == nil {
+		status = server.Status
+	}
+	reportResizeFailure(stack, status, fmt.Errorf("resize timed out"))
+}
+
+// reportResizeFailure records the failed resize with the server's real status and tells the owner
+func reportResizeFailure(stack Stack, status string, err error) {
+	service.CreateLogAction(stack.ServerID, "Instance", stack.Name, "Resize", stack.OsUserID, err)
+	updateStackStatus(stack.ServerID, status)
+	notif := fmt.Sprintf("Resize of %s failed: %s", stack.Name, err.Error())
+	if errNotify := shared.SendPushNotificationToUser(stack.OsUserID, "Resize failed", notif, stack.ProjectID, "", nil); errNotify != nil {
+		fmt.Println("Failed notifying resize of", stack.ServerID, errNotify)
+	}
+}
+
+// revertResize rolls the server back to its previous flavor
+func revertResize(client *gophercloud.ServiceClient, stack Stack, name string) {
+	err := servers.RevertResize(client, stack.ServerID).ExtractErr()
+	service.CreateLogAction(stack.ServerID, "Instance", name, "RevertResize", stack.OsUserID, err)
+	if err != nil {
+		updateStackStatus(stack.ServerID, "ERROR")
+		return
+	}
+	updateStackStatus(stack.ServerID, "ACTIVE")
+}
+
+// switchUsageFlavor closes the running usage row of the server and opens one with the new flavor
+func switchUsageFlavor(stack Stack, server *servers.Server, flavor *flavors.Flavor, clientIP string, logID int64) {
+	actor := StackActor{SysUserID: stack.SysUserID, OsUserID: stack.OsUserID, ClientIP: clientIP}
+	closed, err := closeInstanceUsage(actor, server.ID, server.Status, logID)
+	if err != nil {
+		fmt.Println("Failed closing usage of", server.ID, err)
+		return
+	}
+	// a stopped server has no running usage to carry over
+	if closed == 0 {
+		return
+	}
+	if err := openInstanceUsage(actor, server, flavor, server.Status, logID); err != nil {
+		fmt.Println("Failed opening usage of", server.ID, err)
+	}
+}
@@ -0,0 +1,32 @@
+package thirtdparty
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResizeStep(t *testing.T) {
+	cases := []struct {
+		name      string
+		status    string
+		flavorID  string
+		migrating bool
+		waited    time.Duration
+		want      string
+	}{
+		{"migrating", "RESIZE", "old", true, time.Minute, resizeWait},
+		{"not started yet", "ACTIVE", "old", false, time.Minute, resizeWait},
+		{"verify", "VERIFY_RESIZE", "new", true, time.Minute, resizeConfirm},
+		{"confirmed", "ACTIVE", "new", true, time.Minute, resizeDone},
+		{"confirmed while stopped", "SHUTOFF", "new", true, time.Minute, resizeDone},
+		{"rolled back", "ACTIVE", "old", true, time.Minute, resizeAborted},
+		{"never started", "SHUTOFF", "old", false, resizeStartGrace + time.Second, resizeAborted},
+		{"error", "ERROR", "old", true, time.Minute, resizeFailed},
+		{"other status", "REBOOT", "old", false, time.Hour, resizeWait},
+	}
+	for _, c := range cases {
+		if got := resizeStep(c.status, c.flavorID, "new", c.migrating, c.waited); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
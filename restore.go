@@ -0,0 +1,495 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/backups"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+	"gitlab.com/ics-project/back-thirdparty/models"
+	"gitlab.com/ics-project/back-thirdparty/service"
+)
+
+// JobRestore is the kind of jobs restoring a backup as a new stack
+const JobRestore = "restore"
+
+// Restore modes
+const (
+	RestoreInPlace = "inplace"
+	RestoreNew     = "new"
+)
+
+// domainStacks are the stack types that are served from a reserved domain
+var domainStacks = map[string]bool{
+	"moodle":  true,
+	"meeting": true,
+}
+
+// RestoreParams ...
+type RestoreParams struct {
+	BackupID  uint32 `json:"backupId" bind:"required"`
+	Mode      string `json:"mode"`
+	Name      string `json:"name"`
+	FlavorID  string `json:"flavorId"`
+	AllowedIP string `json:"allowedIp"`
+	StackNetworkParams
+}
+
+// Restore ...
+// @Title Restore
+// @Description rebuild the stack from an image backup in place, or restore any backup as a new stack through the returned job
+// @Param	body	body	thirtdparty.RestoreParams	true	"body for restore"
+// @Failure 403
+// @router /restore [post]
+func (m *BackupController) Restore() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params RestoreParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	backup, err := GetOwnedBackup(params.BackupID, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if backup.Status != BackupAvailable {
+		err := fmt.Errorf("backup %d is %s", backup.ID, backup.Status)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	stack, err := GetProjectStack(claims, backup.ServerID, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	session, err := stackSession(claims, m.GetClientIP(), stack, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	clients, err := session.backupClients()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	switch params.Mode {
+	case "", RestoreInPlace:
+		m.restoreInPlace(clients, stack, backup)
+	case RestoreNew:
+		m.restoreAsNew(session, clients, stack, backup, params)
+	default:
+		err := fmt.Errorf("unknown restore mode %q", params.Mode)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+	}
+}
+
+// restoreInPlace rebuilds the stack's server from an image backup, keeping its id and addresses
+func (m *BackupController) restoreInPlace(clients *backupClients, stack *Stack, backup *StackBackup) {
+	claims := m.Claim()
+	if backup.Kind != BackupImage {
+		err := fmt.Errorf("only image backups can be restored in place, restore %s backups as a new stack", backup.Kind)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	// volume backed servers can only be rebuilt from microversion 2.93
+	rebuildClient := *clients.compute
+	rebuildClient.Microversion = "2.93"
+	server, err := servers.Rebuild(&rebuildClient, stack.ServerID, servers.RebuildOpts{
+		ImageRef: backup.ResourceID,
+		Name:     stack.Name,
+	}).Extract()
+	service.CreateLogAction(stack.ServerID, "Instance", stack.Name, "Restore", claims.UserID, err)
+	if err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	updateStackStatus(stack.ServerID, "REBUILD")
+
+	go func(stack Stack) {
+		for i := 0; i < 200; i++ {
+			time.Sleep(5 * time.Second)
+			server, err := servers.Get(clients.compute, stack.ServerID).Extract()
+			if err != nil {
+				continue
+			}
+			if server.Status == "ACTIVE" {
+				addresses := DiscoverAddresses(server)
+				for _, address := range stack.StoredAddresses().All {
+					if !hasAddress(addresses, address.Addr) {
+						addresses = append(addresses, address)
+					}
+				}
+				updateStackAddresses(stack.ServerID, "ACTIVE", summarizeAddresses(addresses))
+				o := orm.NewOrm()
+				o.QueryTable(new(Stack)).Filter("server_id", stack.ServerID).Update(orm.Params{
+					"image_id":   backup.ResourceID,
+					"updated_at": time.Now(),
+				})
+				return
+			}
+			if server.Status == "ERROR" {
+				updateStackStatus(stack.ServerID, "ERROR")
+				return
+			}
+		}
+	}(*stack)
+
+	m.SetBody(server)
+}
+
+// restoreAsNew checks the request and starts a job that boots a new stack of the same type from the backup
+func (m *BackupController) restoreAsNew(session *StackSession, clients *backupClients, source *Stack, backup *StackBackup, params RestoreParams) {
+	claims := m.Claim()
+	region := session.Region
+	if len(params.Name) == 0 {
+		m.SetError(helper.StatusMissingParams, "name is required", "name is required", claims.UserID)
+		return
+	}
+
+	flavorID := source.FlavorID
+	if len(params.FlavorID) > 0 {
+		flavor, err := flavors.Get(clients.compute, params.FlavorID).Extract()
+		if err != nil {
+			m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		match, err := stackFlavorMatch(clients.compute, region.Tag, source.Type)
+		if err != nil {
+			m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		if !match(*flavor) {
+			err := fmt.Errorf("flavor %s is not available for %s stacks", flavor.Name, source.Type)
+			m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		flavorID = flavor.ID
+	}
+	flavorRes, err := flavors.Get(clients.compute, flavorID).Extract()
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	diskSize := source.DiskSize
+	if backup.Size > diskSize {
+		diskSize = backup.Size
+	}
+	if backup.Kind != BackupImage && backup.Kind != BackupVolume && backup.Kind != BackupSnapshot {
+		err := fmt.Errorf("unknown backup kind %q", backup.Kind)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	if session.quotaRejected(&m.BaseController, QuotaRequest{FlavorID: flavorID, Disk: diskSize, Volumes: 1, FloatingIPs: floatingIPCount(params.StackNetworkParams)}) {
+		return
+	}
+
+	plan := &restorePlan{
+		session:   session,
+		clients:   clients,
+		source:    source,
+		backup:    backup,
+		params:    params,
+		name:      params.Name,
+		flavor:    flavorRes,
+		diskSize:  diskSize,
+		allowedIP: source.AllowedIP,
+	}
+	if len(params.AllowedIP) > 0 {
+		plan.allowedIP = params.AllowedIP
+	}
+	if domainStacks[source.Type] {
+		plan.name = params.Name + ".ics.itools.mn"
+		id, err := reserveStackDomain(claims.UserID, plan.name)
+		if err != nil {
+			m.SetError(helper.StatusAlready, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		plan.domainID = id
+	}
+
+	// the domain is released again on every failure from here on
+	fail := func(code int, err error) {
+		releaseStackDomain(plan.domainID)
+		m.SetError(code, err.Error(), err.Error(), claims.UserID)
+	}
+	plan.secGroup, err = restoreSecurityGroups(session, clients.compute, source, plan.allowedIP)
+	if err != nil {
+		fail(helper.StatusError, err)
+		return
+	}
+	plan.networkID, err = resolveStackNetwork(session.Provider(), region, params.StackNetworkParams, params.Name)
+	if err != nil {
+		fail(helper.StatusMissingParams, err)
+		return
+	}
+	if plan.networkID == "" {
+		plan.networkID = source.NetworkID
+	}
+
+	item := JobItem{ResourceID: fmt.Sprint(backup.ID), Kind: backup.Kind, Region: region.Tag, Name: plan.name}
+	items := []JobItem{item}
+	job, err := newJob(JobRestore, backup.Kind, session.Actor, params, items)
+	if err != nil {
+		fail(helper.StatusError, err)
+		return
+	}
+	go runRestore(job, &items[0], plan, m.GetClientIP())
+	m.SetBody(job)
+}
+
+// restorePlan is a checked restore as a new stack
+type restorePlan struct {
+	session   *StackSession
+	clients   *backupClients
+	source    *Stack
+	backup    *StackBackup
+	params    RestoreParams
+	name      string
+	flavor    *flavors.Flavor
+	diskSize  int
+	allowedIP string
+	secGroup  []string
+	networkID string
+	domainID  int64
+}
+
+// runRestore boots the restored stack and waits until it is active. The reserved domain and
+// a restored boot volume no server was created from are released when it fails.
+func runRestore(job *Job, item *JobItem, plan *restorePlan, clientIP string) {
+	var stack *Stack
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("Restore panicked", job.ID, r)
+			if stack == nil {
+				releaseStackDomain(plan.domainID)
+			}
+			setJobItem(item, JobItemFailed, fmt.Errorf("restore failed"))
+		}
+		finishJob(job.ID)
+	}()
+	setJobStatus(job.ID, JobRunning)
+
+	stack, logID, err := plan.boot()
+	if err != nil {
+		releaseStackDomain(plan.domainID)
+		setJobItem(item, JobItemFailed, err)
+		return
+	}
+	item.ResourceID = stack.ServerID
+	item.Kind = "server"
+	if _, err := orm.NewOrm().Update(item, "resource_id", "kind"); err != nil {
+		fmt.Println("Failed updating job item", item.ID, err)
+	}
+
+	if err := plan.waitActive(stack, logID, clientIP); err != nil {
+		setJobItem(item, JobItemFailed, err)
+		return
+	}
+	setJobItem(item, JobItemSucceeded, nil)
+}
+
+// boot creates the server of the plan and records its stack
+func (p *restorePlan) boot() (*Stack, int64, error) {
+	opts := stackServerOpts{Name: p.name, FlavorID: p.flavor.ID, NetworkID: p.networkID, DiskSize: p.diskSize, SecurityGroups: p.secGroup}
+	if p.backup.Kind == BackupImage {
+		opts.ImageID = p.backup.ResourceID
+	} else {
+		volumeID, err := restoreBootVolume(p.clients.volume, p.backup, p.name, p.diskSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		opts.VolumeID = volumeID
+		defer func() {
+			if len(opts.VolumeID) > 0 {
+				volumes.Delete(p.clients.volume, opts.VolumeID, volumes.DeleteOpts{})
+			}
+		}()
+	}
+	claims := p.session.Claims
+	server, err := p.session.bootServer(opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the volume is deleted together with the server from now on
+	opts.VolumeID = ""
+
+	logID := service.CreateLogAction(server.ID, p.source.Type, p.name, "Restore", claims.UserID, nil)
+
+	stack := recordStack(&Stack{
+		Type:            p.source.Type,
+		Name:            p.name,
+		ServerID:        server.ID,
+		ProjectID:       p.session.ProjectID,
+		Region:          p.session.Region.Tag,
+		SysUserID:       claims.SysUserID,
+		OsUserID:        claims.OsUserID,
+		FlavorID:        p.flavor.ID,
+		ImageID:         p.backup.ResourceID,
+		NetworkID:       p.networkID,
+		AllowedIP:       p.allowedIP,
+		DomainID:        uint32(p.domainID),
+		DiskSize:        p.diskSize,
+		TemplateVersion: p.source.TemplateVersion,
+		Probes:          p.source.Probes,
+	})
+	return stack, logID, nil
+}
+
+// waitActive bills the restored stack and stores its addresses once the server is active
+func (p *restorePlan) waitActive(stack *Stack, logID int64, clientIP string) error {
+	for i := 0; i < 200; i++ {
+		time.Sleep(5 * time.Second)
+		server, err := servers.Get(p.clients.compute, stack.ServerID).Extract()
+		if err != nil {
+			continue
+		}
+		if server.Status == "ERROR" {
+			updateStackStatus(stack.ServerID, "ERROR")
+			return fmt.Errorf("server %s failed to boot", stack.ServerID)
+		}
+		if server.Status != "ACTIVE" {
+			continue
+		}
+		service.CreateUsageAction(stack.SysUserID, stack.OsUserID, "Instance", stack.Name, server.ID, server.ID, p.flavor.Name, "ACTIVE", clientIP, logID, time.Now(), time.Time{}, 0, p.flavor.VCPUs, p.flavor.RAM, true)
+
+		addresses, err := resolveStackAddresses(p.session.Provider(), p.session.Region, server, p.networkID, p.params.StackNetworkParams)
+		if err != nil {
+			addresses.Error = err.Error()
+		}
+		updateStackAddresses(stack.ServerID, "ACTIVE", addresses)
+		addr := addresses.PublicIP
+		if len(addr) == 0 {
+			addr = addresses.Primary
+		}
+		if len(addr) > 0 {
+			if stack.DomainID > 0 {
+				o := orm.NewOrm()
+				o.QueryTable("domains").Filter("id", stack.DomainID).Update(orm.Params{
+					"ip": addr,
+				})
+			}
+			service.CreateUsageAction(stack.SysUserID, stack.OsUserID, "IP", addr, "", server.ID, "", "ACTIVE", addr, logID, time.Now(), time.Time{}, 0, 0, 0, true)
+		}
+
+		for _, volume := range server.AttachedVolumes {
+			service.CreateUsageAction(stack.SysUserID, stack.OsUserID, "Volume", volume.ID, volume.ID, server.ID, "", "ACTIVE", clientIP, logID, time.Now(), time.Time{}, stack.DiskSize, 0, 0, true)
+		}
+		return nil
+	}
+	return fmt.Errorf("server %s did not become active", stack.ServerID)
+}
+
+// releaseStackDomain frees a domain reserved for a stack that was not created
+func releaseStackDomain(domainID int64) {
+	if domainID == 0 {
+		return
+	}
+	if _, err := orm.NewOrm().Raw("delete from domains where id = ?", domainID).Exec(); err != nil {
+		fmt.Println("Failed releasing domain", domainID, err)
+	}
+}
+
+// reserveStackDomain checks the domain is free in route53 and in our table and reserves it
+func reserveStackDomain(osUserID, domainName string) (int64, error) {
+	isExist, err := Check(domainName)
+	if err != nil {
+		return 0, err
+	}
+	if isExist {
+		return 0, fmt.Errorf("domain %s is already taken", domainName)
+	}
+	count, err := models.CheckDomainName(domainName)
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return 0, fmt.Errorf("domain %s is already taken", domainName)
+	}
+	domainID, err := models.CreateDomain(osUserID, domainName)
+	return int64(domainID), err
+}
+
+// restoreSecurityGroups opens the stack type's rules in the default group,
+// or reuses the groups of the source server for stacks without fixed rules
+func restoreSecurityGroups(session *StackSession, computeClient *gophercloud.ServiceClient, source *Stack, allowedIP string) ([]string, error) {
+	if _, ok := stackPorts[source.Type]; ok {
+		name, err := session.openStackFirewall(source.Type, allowedIP)
+		if err != nil {
+			return nil, err
+		}
+		return []string{name}, nil
+	}
+
+	secGroup := []string{}
+	server, err := servers.Get(computeClient, source.ServerID).Extract()
+	if err != nil {
+		// the source server may be gone, which is often why it is being restored
+		return []string{"default"}, nil
+	}
+	for _, group := range server.SecurityGroups {
+		if name, ok := group["name"].(string); ok {
+			secGroup = append(secGroup, name)
+		}
+	}
+	if len(secGroup) == 0 {
+		secGroup = append(secGroup, "default")
+	}
+	return secGroup, nil
+}
+
+// restoreBootVolume creates a bootable volume from a cinder backup or a volume snapshot
+func restoreBootVolume(client *gophercloud.ServiceClient, backup *StackBackup, name string, diskSize int) (string, error) {
+	var volumeID string
+	switch backup.Kind {
+	case BackupVolume:
+		restore, err := backups.RestoreFromBackup(client, backup.ResourceID, backups.RestoreOpts{Name: name}).Extract()
+		if err != nil {
+			return "", err
+		}
+		volumeID = restore.VolumeID
+	case BackupSnapshot:
+		volume, err := volumes.Create(client, volumes.CreateOpts{
+			Name:       name,
+			Size:       diskSize,
+			SnapshotID: backup.ResourceID,
+		}).Extract()
+		if err != nil {
+			return "", err
+		}
+		volumeID = volume.ID
+	}
+
+	for i := 0; i < 120; i++ {
+		volume, err := volumes.Get(client, volumeID).Extract()
+		if err == nil {
+			switch volume.Status {
+			case "available":
+				if volume.Bootable != "true" {
+					volumes.Delete(client, volumeID, volumes.DeleteOpts{})
+					return "", fmt.Errorf("%s %d is not of a bootable volume", backup.Kind, backup.ID)
+				}
+				return volumeID, nil
+			case "error", "error_restoring":
+				return "", fmt.Errorf("restoring %s %d failed", backup.Kind, backup.ID)
+			}
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return "", fmt.Errorf("restoring %s %d timed out", backup.Kind, backup.ID)
+}
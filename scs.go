@@ -9,12 +9,10 @@ import (
 	"strings"
 	"time"
 
-	"github.com/astaxie/beego/orm"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
 	"gitlab.com/ics-project/back-thirdparty/helper"
-	"gitlab.com/ics-project/back-thirdparty/integration/compute"
 	"gitlab.com/ics-project/back-thirdparty/integration/networking"
 	"gitlab.com/ics-project/back-thirdparty/models"
 	"gitlab.com/ics-project/back-thirdparty/service"
@@ -77,38 +75,40 @@ func (m *SCSController) Create() {
 		AllowedIP   string `json:"allowedIp" bind:"required"`
 		CallbackUrl string `json:"callbackUrl" bind:"required"`
 		FlavorID    string `json:"flavorId"  bind:"required"`
+		Region      string `json:"region"`
+		ProjectID   string `json:"projectId"`
+		StackNetworkParams
 	}
 
 	params := RequestedParams{}
 	if m.BindJSON(&params) != nil {
 		return
 	}
+	session, err := openSession(claims, m.GetClientIP(), params.ProjectID, params.Region, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	region := session.Region
 	id := params.ID
 	flavorID := params.FlavorID // ics4  - 8gb -ram 4 vcpu
-	allowedIp := fmt.Sprintf("%s/32", params.AllowedIP)
 	callbackUrl := params.CallbackUrl
 
 	diskSize := 30
 
-	/* find default security group */
-	securityGroupList, err := compute.GetCompute(claims.Username).ListSecGroups()
-	if err != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), fmt.Sprintf("ifinance-%v", claims.UserID))
+	imageID := region.Image("3thparty", models.GetConfig("3thparty_image"))
+	if session.quotaRejected(&m.BaseController, QuotaRequest{FlavorID: flavorID, Disk: diskSize, Volumes: 1, FloatingIPs: floatingIPCount(params.StackNetworkParams)}) {
+		return
+	}
+	if session.imageRejected(&m.BaseController, "scs", imageID, flavorID, 0, diskSize) {
+		return
 	}
 
-	var sgIDs []interface{}
-	for _, secGroup := range securityGroupList {
-		if secGroup.Name == "default" {
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "psql", 8080, 8080, "tcp", allowedIp)
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "psql", 9990, 9990, "tcp", allowedIp)
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "psql", 8282, 8282, "tcp", allowedIp)
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "psql", 7077, 7077, "tcp", allowedIp)
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "psql", 5432, 5432, "tcp", allowedIp)
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "psql", 6060, 6060, "tcp", allowedIp)
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "public", 80, 80, "tcp", "0.0.0.0/0")
-			networking.GetNetworking(claims.Username).CreateSecGroupRule("ingress", "", secGroup.ID, "public", 443, 443, "tcp", "0.0.0.0/0")
-			sgIDs = append(sgIDs, secGroup.Name)
-		}
+	/* find default security group */
+	secGroupName, err := session.openStackFirewall("scs", params.AllowedIP)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
 	}
 
 	requestBody := map[string]interface{}{
@@ -122,18 +122,18 @@ func (m *SCSController) Create() {
 	}
 	fmt.Print(response)
 
-	networkID := ""
-	imageID := models.GetConfig("3thparty_image")
+	networkID, err := resolveStackNetwork(session.Provider(), region, params.StackNetworkParams, params.Name)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
 
 	if networkID == "" {
-		adminProvider, _ := shared.AuthOSAdmin()
+		adminProvider, _ := region.AdminProvider()
 		networkID, _ = networking.GetNetworking("admin").GetAvailableNetworks(adminProvider)
 	}
 
-	secGroup := make([]string, len(sgIDs))
-	for i, v := range sgIDs {
-		secGroup[i] = fmt.Sprint(v)
-	}
+	secGroup := []string{secGroupName}
 
 	userData, err := ioutil.ReadFile("files/scs/base.yml")
 	if err != nil {
@@ -183,62 +183,95 @@ func (m *SCSController) Create() {
 	output := strings.Join(lines, "\n")
 	fmt.Println(output)
 
-	scripted := []byte(output)
+	phoneHomeToken := newPhoneHomeToken()
+	scripted := withPhoneHome([]byte(output), phoneHomeToken)
 
-	server, errServer := compute.GetCompute(claims.Username).CreateServerForVolume(imageID, params.Name, flavorID, "", int(diskSize), secGroup, scripted, "nova", true, networkID)
+	server, errServer := session.bootServer(stackServerOpts{Name: params.Name, ImageID: imageID, FlavorID: flavorID, NetworkID: networkID, DiskSize: diskSize, SecurityGroups: secGroup, UserData: scripted})
 	if errServer != nil {
 		fmt.Print(errServer)
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), fmt.Sprintf("ifinance-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("ifinance-%v", claims.UserID))
 		return
 	}
 
 	service.CreateLogAction(server.ID, "scs", id, "Create", claims.UserID, err)
-	_, errGetFlavor := compute.GetCompute(claims.Username).GetFlavor(flavorID, "CLOUD.MN")
+	recordStack(&Stack{
+		Type:            "scs",
+		RequestID:       id,
+		Name:            params.Name,
+		ServerID:        server.ID,
+		ProjectID:       session.ProjectID,
+		Region:          region.Tag,
+		SysUserID:       claims.SysUserID,
+		OsUserID:        claims.OsUserID,
+		FlavorID:        flavorID,
+		ImageID:         imageID,
+		NetworkID:       networkID,
+		AllowedIP:       params.AllowedIP,
+		DiskSize:        diskSize,
+		TemplateVersion: templateVersion(userData),
+		PhoneHomeToken:  phoneHomeHash(phoneHomeToken),
+		HealthProbes: []HealthProbe{
+			{Name: "app", Kind: "tcp", Port: 8080},
+			{Name: "postgres", Kind: "tcp", Port: 5432},
+		},
+	})
+	if len(phoneHomeToken) > 0 {
+		watchPhoneHome(server.ID, phoneHomeDeadline())
+	}
+	computeClient, err := session.Compute()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), fmt.Sprintf("ifinance-%v", claims.UserID))
+		return
+	}
+	_, errGetFlavor := flavors.Get(computeClient, flavorID).Extract()
 	if errGetFlavor != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errServer.Error(), fmt.Sprintf("ifinance-%v", claims.UserID))
+		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), errGetFlavor.Error(), fmt.Sprintf("ifinance-%v", claims.UserID))
+		return
 	}
 
-	go func(serverid string, username string) {
-		provider := service.GetProvider(username)
-		for {
-			server, _ := servers.Get(service.GetClientCompute(provider), serverid).Extract()
+	go func(serverid string) {
+		deadline := time.Now().Add(provisionDeadline())
+		for time.Now().Before(deadline) {
+			server, err := servers.Get(computeClient, serverid).Extract()
+			if err != nil {
+				time.Sleep(3 * time.Second)
+				continue
+			}
 			if server.Status == "ACTIVE" {
-				var ip string
-				if server.Addresses["public1"] != nil {
-					for _, l := range server.Addresses["public1"].([]interface{}) {
-						tmp := l.(map[string]interface{})
-						ip = tmp["addr"].(string)
-					}
-				}
-				if server.Addresses["public2"] != nil {
-					for _, l := range server.Addresses["public2"].([]interface{}) {
-						tmp := l.(map[string]interface{})
-						ip = tmp["addr"].(string)
-
-					}
+				addresses, err := resolveStackAddresses(session.Provider(), region, server, networkID, params.StackNetworkParams)
+				if err != nil {
+					addresses.Error = err.Error()
 				}
+				ip := addresses.Primary
+				updateStackAddresses(serverid, "ACTIVE", addresses)
 
 				type ReturnParams struct {
-					ID          string `json:"requestId"`
-					DBName      string `json:"databaseName"`
-					DBUsername  string `json:"databaseUser"`
-					DBPassword  string `json:"databasePwd"`
-					SSHName     string `json:"sshName"`
-					SSHPassword string `json:"sshPassword"`
-					Ip          string `json:"databaseUrl"`
+					ID           string          `json:"requestId"`
+					DBName       string          `json:"databaseName"`
+					DBUsername   string          `json:"databaseUser"`
+					DBPassword   string          `json:"databasePwd"`
+					SSHName      string          `json:"sshName"`
+					SSHPassword  string          `json:"sshPassword"`
+					Ip           string          `json:"databaseUrl"`
+					PrivateIP    string          `json:"privateIp"`
+					PublicIP     string          `json:"publicIp"`
+					Addresses    []ServerAddress `json:"addresses"`
+					AddressError string          `json:"addressError,omitempty"`
 				}
 
-				returnParams := ReturnParams{ID: id, DBName: "primeifinance", SSHName: "fibo", SSHPassword: generatedSshPassword, Ip: ip}
+				returnParams := ReturnParams{ID: id, DBName: "primeifinance", SSHName: "fibo", SSHPassword: generatedSshPassword, Ip: ip, PrivateIP: addresses.PrivateIP, PublicIP: addresses.PublicIP, Addresses: addresses.All, AddressError: addresses.Error}
 				fmt.Println("sending callback request")
-				shared.CallbackFunction(callbackUrl, returnParams)
+				deliverWhenReady(serverid, callbackUrl, returnParams)
 				return
 			}
 			if server.Status == "ERROR" {
+				updateStackStatus(serverid, "ERROR")
 				return
 			}
 			time.Sleep(3 * time.Second)
 		}
-	}(server.ID, claims.Username)
+		failProvisioning(serverid)
+	}(server.ID)
 
 	m.SetBody(server)
 }
@@ -246,11 +279,17 @@ func (m *SCSController) Create() {
 // Flavors ...
 // @Title Flavors
 // @Description hint Flavors
+// @Param	region	query	string	false	"region tag"
+// @Param	min_cpu	query	int	false	"minimum vcpus"
+// @Param	max_cpu	query	int	false	"maximum vcpus"
+// @Param	min_ram	query	int	false	"minimum ram in MB"
+// @Param	max_ram	query	int	false	"maximum ram in MB"
+// @Param	sort	query	string	false	"name, cpu, ram, price or available"
+// @Param	order	query	string	false	"asc or desc"
 // @Failure 403
 // @router /list [get]
 func (m *SCSController) Flavors() {
 	claims := m.Claim()
-	var mainRes []flavors.Flavor
 	defer func() {
 		if r := recover(); r != nil {
 			m.RespondPanic(r)
@@ -259,20 +298,7 @@ func (m *SCSController) Flavors() {
 		}
 	}()
 
-	pAccess := flavors.AllAccess
-	listFlavors, err := compute.GetCompute(claims.Username).ListFlavors(pAccess)
-	if err != nil {
-		m.SetError(helper.StatusMissingParams, helper.StatusText(helper.StatusError), err.Error(), claims.UserID)
-		return
-	}
-	for _, c := range listFlavors {
-		if strings.Contains(c.Name, "IFinance") {
-			mainRes = append(mainRes, c)
-		}
-
-	}
-
-	m.SetBody(mainRes)
+	respondCatalogFlavors(&m.BaseController, claims, "scs")
 }
 
 // Action's ifinance stack ...
@@ -285,6 +311,8 @@ func (m *SCSController) Flavors() {
 // @Failure 403
 // @router /action [post]
 func (m *SCSController) Action() {
+	claims := m.Claim()
+
 	defer func() {
 		if r := recover(); r != nil {
 			m.RespondPanic(r)
@@ -303,109 +331,23 @@ func (m *SCSController) Action() {
 	if m.BindJSON(&params) != nil {
 		return
 	}
-	if params.Action == "start" {
-		m.Start(params.InstanceID)
-	} else if params.Action == "stop" {
-		m.Stop(params.InstanceID)
-	} else if params.Action == "restart" {
-		m.Reboot(params.InstanceID)
-	}
-	m.SetBody(params)
-}
-
-func (m *SCSController) Start(instanceID string) {
-	claims := m.Claim()
-	clientIP := m.GetClientIP()
-	errStart := compute.GetCompute(claims.Username).StartServer(instanceID, "CLOUD.MN")
-
-	server, errServer := compute.GetCompute(claims.Username).GetServer(instanceID, "CLOUD.MN")
-	flavor, err := compute.GetCompute(claims.Username).GetFlavor(server.Flavor["id"].(string), "CLOUD.MN")
-	logID := service.CreateLogAction(instanceID, "Instance", server.Name, "Start", claims.UserID, errStart)
-	myCache := utils.GetUCache()
-	if errStart != nil {
-		m.SetError(helper.StatusBadRequest, errStart.Error(), errStart.Error(), claims.UserID)
-		return
-	}
-	o := orm.NewOrm()
-	if errServer == nil {
-		usageObj := models.UsgHistory{
-			SysUserID:       uint32(claims.SysUserID),
-			OsUserID:        claims.OsUserID,
-			Type:            "Instance",
-			Hostname:        server.Name,
-			OsResourceID:    server.ID,
-			OsInstanceID:    server.ID,
-			Flavor:          flavor.Name,
-			DiskSize:        0,
-			CPU:             flavor.VCPUs,
-			RAM:             flavor.RAM,
-			Status:          "ACTIVE",
-			StartDate:       time.Now().Format(helper.TimeFormatYYYYMMDDHHMMSS),
-			EndDate:         "",
-			IP:              clientIP,
-			LastLogActionID: uint32(logID),
-		}
-		_, errTable := o.Insert(&usageObj)
-		if errTable != nil {
-			m.SetError(helper.StatusBadRequest, errTable.Error(), errTable.Error(), claims.UserID)
-			return
-		}
-		myCache.Set(server.ID, helper.Starting)
-	}
-
-	service.CreateLogAction(instanceID, "Instance", server.Name, "Start", claims.UserID, err)
+	stack, err := GetProjectStack(claims, params.InstanceID, RoleAdmin)
 	if err != nil {
-		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
-	}
-}
-
-func (m *SCSController) Stop(instanceID string) {
-	claims := m.Claim()
-	myCache := utils.GetUCache()
-	clientIP := m.GetClientIP()
-	err := compute.GetCompute(claims.Username).StopServer(instanceID, "CLOUD.MN")
-	if err != nil {
-		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
 		return
 	}
-	server, _ := compute.GetCompute(claims.Username).GetServer(instanceID, "CLOUD.MN")
-	logID := service.CreateLogAction(instanceID, "Instance", server.Name, "Stop", claims.UserID, err)
-	o := orm.NewOrm()
-	_, errTable := o.QueryTable("usg_history").Filter("os_resource_id", instanceID).Filter("end_date", "").Update(orm.Params{
-		"sys_user_id":        claims.SysUserID,
-		"os_user_id":         claims.OsUserID,
-		"status":             "SHUTOFF",
-		"end_date":           time.Now().Format(helper.TimeFormatYYYYMMDDHHMMSS),
-		"ip":                 clientIP,
-		"last_log_action_id": logID,
-	})
-
-	if errTable != nil {
-		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+	session, err := stackSession(claims, m.GetClientIP(), stack, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
 		return
 	}
-
-	myCache.Set(server.ID, helper.STOPPING)
-	service.CreateLogAction(instanceID, "Instance", server.Name, "Start", claims.UserID, err)
+	_, err = RunStackAction(session.Actor, session.Region, params.InstanceID, params.Action)
 	if err != nil {
 		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
-	}
-}
-
-func (m *SCSController) Reboot(instanceID string) {
-	claims := m.Claim()
-
-	server, errServer := compute.GetCompute(claims.Username).GetServer(instanceID, "CLOUD.MN")
-	if errServer != nil {
-		m.SetError(helper.StatusBadRequest, errServer.Error(), errServer.Error(), claims.UserID)
-	}
-	errStart := compute.GetCompute(claims.Username).RebootServer(instanceID, "hard", "CLOUD.MN")
-	service.CreateLogAction(instanceID, "Instance", server.Name, "Reboot", claims.UserID, errStart)
-	if errStart != nil {
-		m.SetError(helper.StatusBadRequest, errStart.Error(), errStart.Error(), claims.UserID)
 		return
 	}
-	m.SetBody(nil)
+	// partners read the echoed params, the server is available from the stack detail
+	m.SetBody(params)
 }
 
 // CreateRealm ...
@@ -0,0 +1,382 @@
+package thirtdparty
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/bootfromvolume"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/service"
+)
+
+// sessionRefreshMargin is how long before it expires a cached project token is replaced
+const sessionRefreshMargin = 5 * time.Minute
+
+// sessionKey identifies a project token in a region, of the user or of the service account when username is empty
+type sessionKey struct {
+	username  string
+	projectID string
+	region    string
+}
+
+// sessionToken is a cached project scoped provider. mu is held while it is refreshed so that
+// concurrent requests of the same key authenticate once. provider and expiresAt are written
+// holding both mu and sessionsMu, so either lock is enough to read them.
+type sessionToken struct {
+	mu        sync.Mutex
+	provider  *gophercloud.ProviderClient
+	expiresAt time.Time
+}
+
+var (
+	sessionsMu    sync.Mutex
+	sessionTokens = map[sessionKey]*sessionToken{}
+)
+
+// sessionTokenTTL is used when keystone does not tell when a token expires
+func sessionTokenTTL() time.Duration {
+	return time.Duration(beego.AppConfig.DefaultInt("session.token.ttl.minutes", 50)) * time.Minute
+}
+
+// sessionEntry returns the cache entry of the key, dropping expired entries when a new one is added
+func sessionEntry(key sessionKey) *sessionToken {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if token, ok := sessionTokens[key]; ok {
+		return token
+	}
+	now := time.Now()
+	for k, token := range sessionTokens {
+		if token.provider != nil && now.After(token.expiresAt) {
+			delete(sessionTokens, k)
+		}
+	}
+	token := &sessionToken{}
+	sessionTokens[key] = token
+	return token
+}
+
+// cachedProvider returns the cached provider of the key, logging in again when it is about to expire.
+// A provider handed out stays usable for the requests holding it after it is replaced.
+func cachedProvider(key sessionKey, login func() (*gophercloud.ProviderClient, error)) (*gophercloud.ProviderClient, error) {
+	token := sessionEntry(key)
+	token.mu.Lock()
+	defer token.mu.Unlock()
+
+	if token.provider != nil && time.Now().Add(sessionRefreshMargin).Before(token.expiresAt) {
+		return token.provider, nil
+	}
+	provider, err := login()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := tokenExpiry(provider)
+	sessionsMu.Lock()
+	token.provider = provider
+	token.expiresAt = expiresAt
+	sessionsMu.Unlock()
+	return provider, nil
+}
+
+// tokenExpiry reads when the token of the provider expires
+func tokenExpiry(provider *gophercloud.ProviderClient) time.Time {
+	if result, ok := provider.GetAuthResult().(tokens.CreateResult); ok {
+		if token, err := result.ExtractToken(); err == nil {
+			return token.ExpiresAt
+		}
+	}
+	return time.Now().Add(sessionTokenTTL())
+}
+
+// identityBase strips the version off a keystone endpoint so that the endpoints of one keystone compare equal
+func identityBase(endpoint string) string {
+	base := strings.TrimRight(strings.ToLower(endpoint), "/")
+	for _, version := range []string{"/v3", "/v2.0"} {
+		base = strings.TrimSuffix(base, version)
+	}
+	return base
+}
+
+// issuedBy tells whether the token of the provider was issued by the region's keystone
+func issuedBy(provider *gophercloud.ProviderClient, region shared.CloudRegion) bool {
+	endpoint := provider.IdentityBase
+	if len(endpoint) == 0 {
+		endpoint = provider.IdentityEndpoint
+	}
+	return len(endpoint) > 0 && identityBase(endpoint) == identityBase(region.IdentityEndpoint)
+}
+
+// serviceProvider returns the region's service account scoped to the project, for jobs that run after the
+// user's session is gone. The operators give the account its role on the project.
+// Callers check the user's access to the project first.
+func serviceProvider(region shared.CloudRegion, projectID string) (*gophercloud.ProviderClient, error) {
+	return cachedProvider(sessionKey{projectID: projectID, region: region.Tag}, func() (*gophercloud.ProviderClient, error) {
+		provider, err := region.ProjectProvider(projectID)
+		if _, unauthorized := err.(gophercloud.ErrDefault401); unauthorized {
+			// roles of the service account are assigned by the operators, never by the service itself
+			return nil, fmt.Errorf("the service account has no role on project %s in %s", projectID, region.Tag)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed login to project %s in %s: %v", projectID, region.Tag, err)
+		}
+		return provider, nil
+	})
+}
+
+// ErrLoginRequired is returned when the request carries no token of the user the region's keystone accepts
+var ErrLoginRequired = errors.New("your login is not valid for this region, please log in again")
+
+// scopedProvider returns a provider of the user's project in the region. The user's token is rescoped
+// by the keystone that issued it, a token of another keystone is not valid in the region.
+func scopedProvider(username, projectID string, region shared.CloudRegion) (*gophercloud.ProviderClient, error) {
+	user := service.GetProvider(username)
+	if user == nil || len(user.Token()) == 0 || !issuedBy(user, region) {
+		return nil, ErrLoginRequired
+	}
+	return cachedProvider(sessionKey{username: username, projectID: projectID, region: region.Tag}, func() (*gophercloud.ProviderClient, error) {
+		provider, err := openstack.AuthenticatedClient(gophercloud.AuthOptions{
+			IdentityEndpoint: region.IdentityEndpoint,
+			TokenID:          user.Token(),
+			Scope:            &gophercloud.AuthScope{ProjectID: projectID},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed login to project %s: %v", projectID, err)
+		}
+		return provider, nil
+	})
+}
+
+// StackSession is the project and region a request works in, with clients scoped to them.
+// Unlike the user's current stack it is not shared with the other requests of the user.
+type StackSession struct {
+	Claims    shared.Claims
+	Actor     StackActor
+	ProjectID string
+	Region    shared.CloudRegion
+	provider  *gophercloud.ProviderClient
+}
+
+// newStackSession logs the user into the project in the region for one request.
+// The user needs at least the minimum role in the project.
+func newStackSession(claims shared.Claims, clientIP, projectID string, region shared.CloudRegion, minimum string) (*StackSession, error) {
+	if len(projectID) == 0 {
+		return nil, fmt.Errorf("projectId is required")
+	}
+	if _, _, err := projectAccess(claims, projectID, minimum); err != nil {
+		return nil, err
+	}
+	provider, err := scopedProvider(claims.Username, projectID, region)
+	if err != nil {
+		return nil, err
+	}
+	actor := ActorFromClaims(claims, clientIP)
+	actor.Provider = provider
+	return &StackSession{Claims: claims, Actor: actor, ProjectID: projectID, Region: region, provider: provider}, nil
+}
+
+// openSession opens the session of the project and region a request names. The project defaults
+// to the user's default project and the region to the default region of the project.
+func openSession(claims shared.Claims, clientIP, projectID, requested, minimum string) (*StackSession, error) {
+	if len(projectID) == 0 {
+		defaultID, err := defaultProjectID(claims.OsUserID)
+		if err != nil || len(defaultID) == 0 {
+			return nil, fmt.Errorf("projectId is required")
+		}
+		projectID = defaultID
+	}
+	region, err := resolveRegion(projectID, requested)
+	if err != nil {
+		return nil, err
+	}
+	return newStackSession(claims, clientIP, projectID, region, minimum)
+}
+
+// stackSession opens the session of the project and region the stack lives in
+func stackSession(claims shared.Claims, clientIP string, stack *Stack, minimum string) (*StackSession, error) {
+	region, err := shared.GetRegion(stack.Region)
+	if err != nil {
+		return nil, err
+	}
+	projectID, err := stackProject(stack)
+	if err != nil {
+		return nil, err
+	}
+	return newStackSession(claims, clientIP, projectID, region, minimum)
+}
+
+// serverSession is stackSession for records that outlive their stack, the project is read
+// from the stack of the server when the record does not carry it
+func serverSession(claims shared.Claims, clientIP string, record *Stack, minimum string) (*StackSession, error) {
+	if len(record.ProjectID) == 0 {
+		if stack, err := GetStackByServer(record.ServerID); err == nil {
+			record.ProjectID = stack.ProjectID
+		}
+	}
+	return stackSession(claims, clientIP, record, minimum)
+}
+
+// stackServiceProvider is the region and service provider of the stack's project, for jobs that run
+// without a request. Callers check the user the job runs for still has access to the stack's project.
+func stackServiceProvider(stack *Stack) (shared.CloudRegion, *gophercloud.ProviderClient, error) {
+	region, err := shared.GetRegion(stack.Region)
+	if err != nil {
+		return region, nil, err
+	}
+	projectID, err := stackProject(stack)
+	if err != nil {
+		return region, nil, err
+	}
+	provider, err := serviceProvider(region, projectID)
+	return region, provider, err
+}
+
+// Provider returns the project scoped provider
+func (s *StackSession) Provider() *gophercloud.ProviderClient {
+	return s.provider
+}
+
+// Compute returns a nova client of the project
+func (s *StackSession) Compute() (*gophercloud.ServiceClient, error) {
+	return s.Region.ComputeClient(s.provider)
+}
+
+// Network returns a neutron client of the project
+func (s *StackSession) Network() (*gophercloud.ServiceClient, error) {
+	return s.Region.NetworkClient(s.provider)
+}
+
+// BlockStorage returns a cinder client of the project
+func (s *StackSession) BlockStorage() (*gophercloud.ServiceClient, error) {
+	return s.Region.BlockStorageClient(s.provider)
+}
+
+// Image returns a glance client of the project
+func (s *StackSession) Image() (*gophercloud.ServiceClient, error) {
+	return s.Region.ImageClient(s.provider)
+}
+
+// backupClients returns the compute, volume and image clients of the project
+func (s *StackSession) backupClients() (*backupClients, error) {
+	return newBackupClients(s.provider, s.Region)
+}
+
+// quotaRejected runs the pre-flight quota check against the project
+func (s *StackSession) quotaRejected(c *shared.BaseController, req QuotaRequest) bool {
+	return providerQuotaRejected(c, s.provider, s.Claims, s.Region, s.ProjectID, req)
+}
+
+// imageRejected validates the image with the images the project can see
+func (s *StackSession) imageRejected(c *shared.BaseController, stackType, imageID, flavorID string, ram, disk int) bool {
+	return providerImageRejected(c, s.provider, s.Claims, s.Region, stackType, imageID, flavorID, ram, disk)
+}
+
+// defaultSecurityGroup returns the default security group of the project
+func (s *StackSession) defaultSecurityGroup() (*groups.SecGroup, error) {
+	client, err := s.Network()
+	if err != nil {
+		return nil, err
+	}
+	allPages, err := groups.List(client, groups.ListOpts{Name: "default", ProjectID: s.ProjectID}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	secGroups, err := groups.ExtractGroups(allPages)
+	if err != nil {
+		return nil, err
+	}
+	if len(secGroups) == 0 {
+		return nil, fmt.Errorf("Default security group not found")
+	}
+	return &secGroups[0], nil
+}
+
+// openStackFirewall opens the ports of the stack type in the default security group and returns the group's name
+func (s *StackSession) openStackFirewall(stackType, allowedIP string) (string, error) {
+	secGroup, err := s.defaultSecurityGroup()
+	if err != nil {
+		return "", err
+	}
+	client, err := s.Network()
+	if err != nil {
+		return "", err
+	}
+	if err := applyStackFirewall(client, secGroup.ID, stackType, allowedIP); err != nil {
+		return "", err
+	}
+	return secGroup.Name, nil
+}
+
+// stackServerOpts describes a server booted from a volume. The volume is created from ImageID
+// unless VolumeID is set, and is deleted together with the server.
+type stackServerOpts struct {
+	Name           string
+	ImageID        string
+	VolumeID       string
+	FlavorID       string
+	NetworkID      string
+	DiskSize       int
+	SecurityGroups []string
+	UserData       []byte
+}
+
+// createVolumeFromImage creates a bootable volume of the type and waits until it is available
+func (s *StackSession) createVolumeFromImage(name, volumeType, imageID string, size int) (*volumes.Volume, error) {
+	client, err := s.BlockStorage()
+	if err != nil {
+		return nil, err
+	}
+	volume, err := volumes.Create(client, volumes.CreateOpts{
+		Name:        fmt.Sprintf("%s-volume", name),
+		Description: fmt.Sprintf("%s is volume", name),
+		Size:        size,
+		VolumeType:  volumeType,
+		ImageID:     imageID,
+	}).Extract()
+	if err != nil {
+		return nil, err
+	}
+	return waitVolume(client, volume.ID, "available")
+}
+
+// bootServer creates the server in the project
+func (s *StackSession) bootServer(opts stackServerOpts) (*servers.Server, error) {
+	client, err := s.Compute()
+	if err != nil {
+		return nil, err
+	}
+	device := bootfromvolume.BlockDevice{
+		UUID:                opts.ImageID,
+		SourceType:          bootfromvolume.SourceImage,
+		DestinationType:     bootfromvolume.DestinationVolume,
+		VolumeSize:          opts.DiskSize,
+		DeleteOnTermination: true,
+	}
+	if len(opts.VolumeID) > 0 {
+		device.UUID = opts.VolumeID
+		device.SourceType = bootfromvolume.SourceVolume
+	}
+	createOpts := servers.CreateOpts{
+		Name:             opts.Name,
+		FlavorRef:        opts.FlavorID,
+		SecurityGroups:   opts.SecurityGroups,
+		UserData:         opts.UserData,
+		AvailabilityZone: "nova",
+	}
+	if len(opts.NetworkID) > 0 {
+		createOpts.Networks = []servers.Network{{UUID: opts.NetworkID}}
+	}
+	return bootfromvolume.Create(client, bootfromvolume.CreateOptsExt{
+		CreateOptsBuilder: createOpts,
+		BlockDevice:       []bootfromvolume.BlockDevice{device},
+	}).Extract()
+}
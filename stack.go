@@ -0,0 +1,353 @@
+package thirtdparty
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+)
+
+// Stack is a provisioned stack (bbx, lambda, scs, ifinance, moodle, meeting)
+type Stack struct {
+	ID              uint32    `orm:"column(id);auto;pk" json:"id"`
+	RequestID       string    `orm:"column(request_id);size(128);null" json:"requestId"`
+	Type            string    `orm:"column(type);size(32)" json:"type"`
+	Name            string    `orm:"column(name);size(255)" json:"name"`
+	ServerID        string    `orm:"column(server_id);size(64);index" json:"serverId"`
+	ProjectID       string    `orm:"column(project_id);size(64);null" json:"projectId"`
+	Region          string    `orm:"column(region);size(64)" json:"region"`
+	SysUserID       uint32    `orm:"column(sys_user_id)" json:"-"`
+	OsUserID        string    `orm:"column(os_user_id);size(64);index" json:"osUserId"`
+	FlavorID        string    `orm:"column(flavor_id);size(64);null" json:"flavorId"`
+	ImageID         string    `orm:"column(image_id);size(64);null" json:"imageId"`
+	NetworkID       string    `orm:"column(network_id);size(64);null" json:"networkId"`
+	AllowedIP       string    `orm:"column(allowed_ip);size(64);null" json:"allowedIp"`
+	DomainID        uint32    `orm:"column(domain_id);null" json:"domainId"`
+	DiskSize        int       `orm:"column(disk_size)" json:"diskSize"`
+	TemplateVersion string    `orm:"column(template_version);size(64);null" json:"templateVersion"`
+	Status          string    `orm:"column(status);size(32)" json:"status"`
+	Addresses       string    `orm:"column(addresses);type(text);null" json:"-"`
+	PhoneHomeToken  string    `orm:"column(phone_home_token);size(64);null;index" json:"-"`
+	CallbackURL     string    `orm:"column(callback_url);size(1024);null" json:"-"`
+	CallbackPayload string    `orm:"column(callback_payload);type(text);null" json:"-"`
+	ReadyLog        string    `orm:"column(ready_log);type(text);null" json:"readyLog"`
+	ReadyAt         time.Time `orm:"column(ready_at);type(datetime);null" json:"readyAt"`
+	HealthStatus    string    `orm:"column(health_status);size(16);null" json:"healthStatus"`
+	HealthCheckedAt time.Time `orm:"column(health_checked_at);type(datetime);null" json:"healthCheckedAt"`
+	Probes          string    `orm:"column(probes);type(text);null" json:"-"`
+	CreatedAt       time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+	UpdatedAt       time.Time `orm:"column(updated_at);auto_now;type(datetime)" json:"updatedAt"`
+	// HealthProbes are the probes the stack declares when it is recorded, only the ones the
+	// API host can reach are stored in Probes
+	HealthProbes []HealthProbe `orm:"-" json:"-"`
+}
+
+// TableName ...
+func (t *Stack) TableName() string {
+	return "stacks"
+}
+
+// StackLegacy is the type of a stack backfilled from a server provisioned before stacks were recorded
+const StackLegacy = "legacy"
+
+func init() {
+	orm.RegisterModel(new(Stack))
+	beego.AddAPPStartHook(backfillStacks)
+}
+
+// templateVersion identifies the cloud-init template a stack was built from
+func templateVersion(template []byte) string {
+	sum := sha256.Sum256(template)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// recordStack stores the provisioned stack so later actions can find its type, owner and region
+func recordStack(stack *Stack) *Stack {
+	if len(stack.Status) == 0 {
+		stack.Status = "BUILD"
+	}
+	if len(stack.HealthProbes) > 0 {
+		stack.Probes = declareProbes(stack)
+	}
+	o := orm.NewOrm()
+	if _, err := o.Insert(stack); err != nil {
+		fmt.Println("Failed recording stack", stack.ServerID, err)
+	}
+	return stack
+}
+
+// backfillStacks records the servers provisioned before stacks were recorded, so that the handlers
+// finding stacks by their record can act on them. Servers already recorded are skipped, so it runs
+// on every start unless stack.backfill is turned off.
+func backfillStacks() error {
+	if !beego.AppConfig.DefaultBool("stack.backfill", true) {
+		return nil
+	}
+	o := orm.NewOrm()
+	var recorded []Stack
+	if _, err := o.QueryTable(new(Stack)).All(&recorded, "ServerID"); err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, stack := range recorded {
+		known[stack.ServerID] = true
+	}
+
+	for _, region := range shared.DistinctRegions() {
+		provider, err := region.AdminProvider()
+		if err != nil {
+			fmt.Println("Failed backfilling stacks of", region.Tag, err)
+			continue
+		}
+		client, err := region.ComputeClient(provider)
+		if err != nil {
+			fmt.Println("Failed backfilling stacks of", region.Tag, err)
+			continue
+		}
+		allPages, err := servers.List(client, servers.ListOpts{AllTenants: true}).AllPages()
+		if err != nil {
+			fmt.Println("Failed backfilling stacks of", region.Tag, err)
+			continue
+		}
+		list, err := servers.ExtractServers(allPages)
+		if err != nil {
+			fmt.Println("Failed backfilling stacks of", region.Tag, err)
+			continue
+		}
+		for i := range list {
+			server := &list[i]
+			if known[server.ID] {
+				continue
+			}
+			flavorID, _ := server.Flavor["id"].(string)
+			data, _ := json.Marshal(summarizeAddresses(DiscoverAddresses(server)))
+			recordStack(&Stack{
+				Type:      StackLegacy,
+				Name:      server.Name,
+				ServerID:  server.ID,
+				ProjectID: server.TenantID,
+				Region:    region.Tag,
+				OsUserID:  server.UserID,
+				FlavorID:  flavorID,
+				Status:    server.Status,
+				Addresses: string(data),
+			})
+			known[server.ID] = true
+		}
+	}
+	return nil
+}
+
+// GetStackByServer returns the stack record of the server
+func GetStackByServer(serverID string) (*Stack, error) {
+	o := orm.NewOrm()
+	stack := Stack{}
+	err := o.QueryTable(new(Stack)).Filter("server_id", serverID).One(&stack)
+	if err != nil {
+		return nil, err
+	}
+	return &stack, nil
+}
+
+// stackProject returns the project of the stack, the default project of its creator when it was recorded without one
+func stackProject(stack *Stack) (string, error) {
+	if len(stack.ProjectID) > 0 {
+		return stack.ProjectID, nil
+	}
+	projectID, err := defaultProjectID(stack.OsUserID)
+	if err != nil || len(projectID) == 0 {
+		return "", fmt.Errorf("project of stack %s is unknown", stack.ServerID)
+	}
+	return projectID, nil
+}
+
+// GetProjectStack returns the stack of the server when the user has at least the minimum role in its project
+func GetProjectStack(claims shared.Claims, serverID, minimum string) (*Stack, error) {
+	stack, err := GetStackByServer(serverID)
+	if err != nil {
+		return nil, fmt.Errorf("stack of server %s not found", serverID)
+	}
+	projectID, err := stackProject(stack)
+	if err != nil {
+		return nil, fmt.Errorf("stack of server %s not found", serverID)
+	}
+	if _, role, err := projectAccess(claims, projectID, minimum); err != nil {
+		if len(role) == 0 {
+			return nil, fmt.Errorf("stack of server %s not found", serverID)
+		}
+		return nil, err
+	}
+	return stack, nil
+}
+
+// updateStackStatus changes the status of the stack of the server
+func updateStackStatus(serverID, status string) {
+	o := orm.NewOrm()
+	_, err := o.QueryTable(new(Stack)).Filter("server_id", serverID).Update(orm.Params{
+		"status":     status,
+		"updated_at": time.Now(),
+	})
+	if err != nil {
+		fmt.Println("Failed updating stack status", serverID, err)
+	}
+}
+
+// provisionDeadline bounds how long a new server is watched until it turns ACTIVE
+func provisionDeadline() time.Duration {
+	return time.Duration(beego.AppConfig.DefaultInt("stack.provision.deadline", 30)) * time.Minute
+}
+
+// failProvisioning marks a server that never turned ACTIVE as failed
+func failProvisioning(serverID string) {
+	fmt.Println("Server did not become ACTIVE before the deadline", serverID)
+	updateStackStatus(serverID, "ERROR")
+}
+
+// updateStackAddresses stores the discovered addresses of the stack.
+// A readiness already reported by the instance is kept.
+func updateStackAddresses(serverID, status string, addresses StackAddresses) {
+	data, _ := json.Marshal(addresses)
+	o := orm.NewOrm()
+	_, err := o.QueryTable(new(Stack)).Filter("server_id", serverID).Update(orm.Params{
+		"addresses":  string(data),
+		"updated_at": time.Now(),
+	})
+	if err != nil {
+		fmt.Println("Failed updating stack addresses", serverID, err)
+		return
+	}
+	_, err = o.QueryTable(new(Stack)).Filter("server_id", serverID).Exclude("status__in", StackReady, StackFailed).Update(orm.Params{
+		"status": status,
+	})
+	if err != nil {
+		fmt.Println("Failed updating stack status", serverID, err)
+	}
+}
+
+// StoredAddresses returns the addresses saved with the stack
+func (t *Stack) StoredAddresses() StackAddresses {
+	addresses := StackAddresses{All: []ServerAddress{}}
+	if len(t.Addresses) > 0 {
+		json.Unmarshal([]byte(t.Addresses), &addresses)
+	}
+	return addresses
+}
+
+// StackController struct
+type StackController struct {
+	shared.BaseController
+}
+
+// URLMapping URL mapping
+func (m *StackController) URLMapping() {
+	m.Mapping("Detail", m.Detail)
+	m.Mapping("List", m.List)
+	m.Mapping("Resize", m.Resize)
+	m.Mapping("ConsoleLog", m.ConsoleLog)
+	m.Mapping("Console", m.Console)
+	m.Mapping("Health", m.Health)
+	m.Mapping("Action", m.Action)
+	m.Mapping("BulkAction", m.BulkAction)
+}
+
+// StackDetail is a stack with the live state of its server
+type StackDetail struct {
+	Stack
+	ServerStatus string         `json:"serverStatus"`
+	Addresses    StackAddresses `json:"addresses"`
+	Volumes      []StackVolume  `json:"volumes"`
+}
+
+// Detail ...
+// @Title Detail
+// @Description stack details with every address of its server
+// @Param	id	query	string	true	"server id"
+// @Failure 403
+// @router /detail [get]
+func (m *StackController) Detail() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	stack, err := GetProjectStack(claims, m.GetString("id"), RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	detail := StackDetail{Stack: *stack, Addresses: stack.StoredAddresses(), Volumes: stackVolumeList(stack.ServerID)}
+	session, err := stackSession(claims, m.GetClientIP(), stack, RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	computeClient, err := session.Compute()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	server, err := servers.Get(computeClient, stack.ServerID).Extract()
+	if err != nil {
+		detail.ServerStatus = "UNKNOWN"
+	} else {
+		detail.ServerStatus = server.Status
+		addresses := DiscoverAddresses(server)
+		for _, address := range detail.Addresses.All {
+			if !hasAddress(addresses, address.Addr) {
+				addresses = append(addresses, address)
+			}
+		}
+		detail.Addresses = summarizeAddresses(addresses)
+	}
+
+	m.SetBody(detail)
+}
+
+// List ...
+// @Title List
+// @Description stacks of the user, or every stack of a project the user is a member of
+// @Param	type	query	string	false	"stack type"
+// @Param	projectId	query	string	false	"project id"
+// @Failure 403
+// @router /list [get]
+func (m *StackController) List() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	o := orm.NewOrm()
+	query := o.QueryTable(new(Stack)).Filter("os_user_id", claims.OsUserID)
+	if projectID := m.GetString("projectId"); len(projectID) > 0 {
+		if _, _, err := projectAccess(claims, projectID, RoleViewer); err != nil {
+			m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		query = o.QueryTable(new(Stack)).Filter("project_id", projectID)
+	}
+	if stackType := m.GetString("type"); len(stackType) > 0 {
+		query = query.Filter("type", stackType)
+	}
+	var stacks []Stack
+	if _, err := query.OrderBy("-id").All(&stacks); err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(stacks)
+}
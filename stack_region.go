@@ -0,0 +1,36 @@
+package thirtdparty
+
+import (
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+)
+
+// RegionFlavor is a flavor listed from one of the regions
+type RegionFlavor struct {
+	flavors.Flavor
+	Region string `json:"region"`
+}
+
+// projectDefaults returns the settings whose default flavor, image and network apply to a stack of the
+// project created in the region. They belong to the project's default region, another region gets none.
+func projectDefaults(projectID string, region shared.CloudRegion) ProjectSetting {
+	setting := ProjectSetting{}
+	if len(projectID) == 0 || orm.NewOrm().QueryTable(new(ProjectSetting)).Filter("project_id", projectID).One(&setting) != nil {
+		return ProjectSetting{}
+	}
+	if defaultRegion, err := shared.ResolveRegion("", setting.DefaultRegion); err != nil || defaultRegion.Tag != region.Tag {
+		return ProjectSetting{}
+	}
+	return setting
+}
+
+// resolveRegion picks the requested region, otherwise the default region of the project, otherwise the default one
+func resolveRegion(projectID, requested string) (shared.CloudRegion, error) {
+	setting := ProjectSetting{}
+	if len(requested) == 0 && len(projectID) > 0 &&
+		orm.NewOrm().QueryTable(new(ProjectSetting)).Filter("project_id", projectID).One(&setting) == nil {
+		return shared.ResolveRegion("", setting.DefaultRegion)
+	}
+	return shared.ResolveRegion(requested, "")
+}
@@ -0,0 +1,678 @@
+package thirtdparty
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/orm"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/volumeactions"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumetypes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
+	"gitlab.com/ics-project/back-thirdparty/controllers/shared"
+	"gitlab.com/ics-project/back-thirdparty/helper"
+	"gitlab.com/ics-project/back-thirdparty/service"
+)
+
+// Data volume statuses
+const (
+	VolumeCreating  = "CREATING"
+	VolumeAttaching = "ATTACHING"
+	VolumeInUse     = "IN_USE"
+	VolumeExtending = "EXTENDING"
+	VolumeDetaching = "DETACHING"
+	VolumeDetached  = "DETACHED"
+	VolumeDeleting  = "DELETING"
+	VolumeDeleted   = "DELETED"
+	VolumeError     = "ERROR"
+)
+
+// volumeWait bounds how long a volume may take to reach a status
+const volumeWait = 10 * time.Minute
+
+// extending holds the cinder volumes being extended. The boot volume is extended through a
+// transient record without a status, so the guard is kept by cinder id.
+var (
+	extendingMu sync.Mutex
+	extending   = map[string]bool{}
+)
+
+// reserveExtend claims the volume for one extend, false when another one is running
+func reserveExtend(volumeID string) bool {
+	extendingMu.Lock()
+	defer extendingMu.Unlock()
+	if extending[volumeID] {
+		return false
+	}
+	extending[volumeID] = true
+	return true
+}
+
+func releaseExtend(volumeID string) {
+	extendingMu.Lock()
+	defer extendingMu.Unlock()
+	delete(extending, volumeID)
+}
+
+// settledStatus maps the status cinder reports for the volume to the status of its record,
+// fallback when cinder can not be read or the volume is still changing
+func settledStatus(client *gophercloud.ServiceClient, volumeID, fallback string) string {
+	current, err := volumes.Get(client, volumeID).Extract()
+	if err != nil {
+		return fallback
+	}
+	switch current.Status {
+	case "in-use":
+		return VolumeInUse
+	case "available":
+		return VolumeDetached
+	case "error", "error_deleting", "error_extending":
+		return VolumeError
+	}
+	return fallback
+}
+
+// StackVolume is a data volume added to a stack after it was provisioned
+type StackVolume struct {
+	ID         uint32    `orm:"column(id);auto;pk" json:"id"`
+	StackID    uint32    `orm:"column(stack_id);index" json:"stackId"`
+	ServerID   string    `orm:"column(server_id);size(64);index" json:"serverId"`
+	Region     string    `orm:"column(region);size(64)" json:"region"`
+	SysUserID  uint32    `orm:"column(sys_user_id)" json:"-"`
+	OsUserID   string    `orm:"column(os_user_id);size(64);index" json:"osUserId"`
+	VolumeID   string    `orm:"column(volume_id);size(64);null;index" json:"volumeId"`
+	Name       string    `orm:"column(name);size(255)" json:"name"`
+	VolumeType string    `orm:"column(volume_type);size(64);null" json:"volumeType"`
+	Size       int       `orm:"column(size)" json:"size"`
+	Device     string    `orm:"column(device);size(64);null" json:"device"`
+	Status     string    `orm:"column(status);size(16)" json:"status"`
+	Message    string    `orm:"column(message);size(1024);null" json:"message"`
+	AttachedAt time.Time `orm:"column(attached_at);type(datetime);null" json:"attachedAt"`
+	DetachedAt time.Time `orm:"column(detached_at);type(datetime);null" json:"detachedAt"`
+	DeletedAt  time.Time `orm:"column(deleted_at);type(datetime);null" json:"deletedAt"`
+	CreatedAt  time.Time `orm:"column(created_at);auto_now_add;type(datetime)" json:"createdAt"`
+	UpdatedAt  time.Time `orm:"column(updated_at);auto_now;type(datetime)" json:"updatedAt"`
+}
+
+// TableName ...
+func (t *StackVolume) TableName() string {
+	return "stack_volumes"
+}
+
+func init() {
+	orm.RegisterModel(new(StackVolume))
+}
+
+// setVolumeStatus stores the status of the volume and the reason of a failure
+func setVolumeStatus(volume *StackVolume, status, message string, fields ...string) {
+	volume.Status = status
+	volume.Message = message
+	if volume.ID == 0 {
+		return
+	}
+	o := orm.NewOrm()
+	if _, err := o.Update(volume, append([]string{"status", "message", "updated_at"}, fields...)...); err != nil {
+		fmt.Println("Failed updating volume", volume.ID, err)
+	}
+}
+
+// stackVolumeList returns the data volumes of the stack, deleted ones included
+func stackVolumeList(serverID string) []StackVolume {
+	o := orm.NewOrm()
+	list := []StackVolume{}
+	o.QueryTable(new(StackVolume)).Filter("server_id", serverID).OrderBy("id").All(&list)
+	return list
+}
+
+// GetOwnedVolume returns the data volume when it belongs to the user
+func GetOwnedVolume(id uint32, osUserID string) (*StackVolume, error) {
+	o := orm.NewOrm()
+	volume := StackVolume{}
+	err := o.QueryTable(new(StackVolume)).Filter("id", id).Filter("os_user_id", osUserID).Exclude("status", VolumeDeleted).One(&volume)
+	if err != nil {
+		return nil, fmt.Errorf("volume %d not found", id)
+	}
+	return &volume, nil
+}
+
+// waitVolume polls the volume until it reaches the cinder status
+func waitVolume(client *gophercloud.ServiceClient, volumeID, status string) (*volumes.Volume, error) {
+	deadline := time.Now().Add(volumeWait)
+	for time.Now().Before(deadline) {
+		volume, err := volumes.Get(client, volumeID).Extract()
+		if err == nil {
+			if volume.Status == status {
+				return volume, nil
+			}
+			if volume.Status == "error" || volume.Status == "error_extending" {
+				return volume, fmt.Errorf("volume %s is %s", volumeID, volume.Status)
+			}
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return nil, fmt.Errorf("volume %s did not become %s in time", volumeID, status)
+}
+
+// validVolumeType checks the type against the volume types of the region, an empty type is the default one
+func validVolumeType(client *gophercloud.ServiceClient, name string) error {
+	if len(name) == 0 {
+		return nil
+	}
+	allPages, err := volumetypes.List(client, volumetypes.ListOpts{}).AllPages()
+	if err != nil {
+		return err
+	}
+	types, err := volumetypes.ExtractVolumeTypes(allPages)
+	if err != nil {
+		return err
+	}
+	for _, volumeType := range types {
+		if volumeType.Name == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown volume type %q", name)
+}
+
+// attachVolume attaches the volume to the server and opens its usage, a reattached volume keeps its usage
+func attachVolume(clients *backupClients, actor StackActor, volume *StackVolume, reattach bool) {
+	setVolumeStatus(volume, VolumeAttaching, "")
+	attachment, err := volumeattach.Create(clients.compute, volume.ServerID, volumeattach.CreateOpts{VolumeID: volume.VolumeID}).Extract()
+	if err == nil {
+		_, err = waitVolume(clients.volume, volume.VolumeID, "in-use")
+	}
+	logID := service.CreateLogAction(volume.VolumeID, "Volume", volume.Name, "Attach", actor.OsUserID, err)
+	if err != nil {
+		setVolumeStatus(volume, VolumeError, err.Error())
+		return
+	}
+
+	volume.Device = attachment.Device
+	volume.AttachedAt = time.Now()
+	setVolumeStatus(volume, VolumeInUse, "", "device", "attached_at")
+
+	if reattach {
+		o := orm.NewOrm()
+		o.QueryTable("usg_history").Filter("os_resource_id", volume.VolumeID).Filter("type", "Volume").Filter("end_date", "").Update(orm.Params{
+			"status":             "ACTIVE",
+			"os_instance_id":     volume.ServerID,
+			"last_log_action_id": logID,
+		})
+		return
+	}
+	service.CreateUsageAction(actor.SysUserID, actor.OsUserID, "Volume", volume.VolumeID, volume.VolumeID, volume.ServerID, "", "ACTIVE", actor.ClientIP, logID, time.Now(), time.Time{}, volume.Size, 0, 0, true)
+}
+
+// createVolume creates the cinder volume of a new data volume and attaches it
+func createVolume(clients *backupClients, actor StackActor, volume *StackVolume) {
+	defer func() {
+		if r := recover(); r != nil {
+			setVolumeStatus(volume, VolumeError, fmt.Sprint(r))
+		}
+	}()
+
+	created, err := volumes.Create(clients.volume, volumes.CreateOpts{
+		Name:        volume.Name,
+		Size:        volume.Size,
+		VolumeType:  volume.VolumeType,
+		Description: fmt.Sprintf("data volume of %s", volume.ServerID),
+	}).Extract()
+	if err == nil {
+		volume.VolumeID = created.ID
+		_, err = waitVolume(clients.volume, created.ID, "available")
+	}
+	service.CreateLogAction(volume.VolumeID, "Volume", volume.Name, "Create", actor.OsUserID, err)
+	if err != nil {
+		setVolumeStatus(volume, VolumeError, err.Error(), "volume_id")
+		return
+	}
+	setVolumeStatus(volume, VolumeAttaching, "", "volume_id")
+	attachVolume(clients, actor, volume, false)
+}
+
+// extendVolume grows the volume, online while it is attached, and moves its usage to the new size
+func extendVolume(clients *backupClients, actor StackActor, volume *StackVolume, previous string, newSize int, onExtended func()) {
+	defer releaseExtend(volume.VolumeID)
+	defer func() {
+		if r := recover(); r != nil {
+			setVolumeStatus(volume, VolumeError, fmt.Sprint(r))
+		}
+	}()
+
+	current, err := volumes.Get(clients.volume, volume.VolumeID).Extract()
+	if err != nil {
+		setVolumeStatus(volume, previous, err.Error())
+		return
+	}
+	client := clients.volume
+	if current.Status == "in-use" {
+		// extending an attached volume needs microversion 3.42
+		online := *clients.volume
+		online.Microversion = "3.42"
+		client = &online
+	}
+	settled := current.Status
+
+	err = volumeactions.ExtendSize(client, volume.VolumeID, volumeactions.ExtendSizeOpts{NewSize: newSize}).ExtractErr()
+	if err == nil {
+		var extended *volumes.Volume
+		extended, err = waitVolume(clients.volume, volume.VolumeID, settled)
+		if err == nil && extended.Size != newSize {
+			err = fmt.Errorf("volume %s is %d GB instead of %d GB", volume.VolumeID, extended.Size, newSize)
+		}
+	}
+	logID := service.CreateLogAction(volume.VolumeID, "Volume", volume.Name, "Extend", actor.OsUserID, err)
+	if err != nil {
+		setVolumeStatus(volume, previous, err.Error())
+		return
+	}
+
+	volume.Size = newSize
+	setVolumeStatus(volume, previous, "", "size")
+	if onExtended != nil {
+		onExtended()
+	}
+	if closed, _ := closeUsage(actor, "Volume", volume.VolumeID, "ACTIVE", logID); closed > 0 {
+		service.CreateUsageAction(actor.SysUserID, actor.OsUserID, "Volume", volume.VolumeID, volume.VolumeID, volume.ServerID, "", "ACTIVE", actor.ClientIP, logID, time.Now(), time.Time{}, newSize, 0, 0, true)
+	}
+}
+
+// detachVolume detaches the volume from its server, it stays billed until deleted
+func detachVolume(clients *backupClients, actor StackActor, volume *StackVolume) {
+	defer func() {
+		if r := recover(); r != nil {
+			setVolumeStatus(volume, VolumeError, fmt.Sprint(r))
+		}
+	}()
+
+	err := volumeattach.Delete(clients.compute, volume.ServerID, volume.VolumeID).ExtractErr()
+	if err == nil {
+		_, err = waitVolume(clients.volume, volume.VolumeID, "available")
+	}
+	service.CreateLogAction(volume.VolumeID, "Volume", volume.Name, "Detach", actor.OsUserID, err)
+	if err != nil {
+		// a detach nova accepted may still finish, or fail the volume
+		setVolumeStatus(volume, settledStatus(clients.volume, volume.VolumeID, VolumeError), err.Error())
+		return
+	}
+	volume.Device = ""
+	volume.DetachedAt = time.Now()
+	setVolumeStatus(volume, VolumeDetached, "", "device", "detached_at")
+
+	o := orm.NewOrm()
+	o.QueryTable("usg_history").Filter("os_resource_id", volume.VolumeID).Filter("type", "Volume").Filter("end_date", "").Update(orm.Params{
+		"status": "AVAILABLE",
+	})
+}
+
+// deleteVolume deletes the detached or failed volume and closes its usage.
+// A volume cinder refuses to delete keeps the status it had.
+func deleteVolume(clients *backupClients, actor StackActor, volume *StackVolume, previous string) {
+	err := volumes.Delete(clients.volume, volume.VolumeID, volumes.DeleteOpts{}).ExtractErr()
+	if _, notFound := err.(gophercloud.ErrDefault404); notFound {
+		err = nil
+	}
+	logID := service.CreateLogAction(volume.VolumeID, "Volume", volume.Name, "Delete", actor.OsUserID, err)
+	if err != nil {
+		setVolumeStatus(volume, previous, err.Error())
+		return
+	}
+	volume.DeletedAt = time.Now()
+	setVolumeStatus(volume, VolumeDeleted, "", "deleted_at")
+	if _, err := closeUsage(actor, "Volume", volume.VolumeID, "DELETED", logID); err != nil {
+		fmt.Println("Failed closing usage of volume", volume.VolumeID, err)
+	}
+}
+
+// VolumeController manages the data volumes of stacks
+type VolumeController struct {
+	shared.BaseController
+}
+
+// URLMapping URL mapping
+func (m *VolumeController) URLMapping() {
+	m.Mapping("Types", m.Types)
+	m.Mapping("Attach", m.Attach)
+	m.Mapping("Extend", m.Extend)
+	m.Mapping("Detach", m.Detach)
+	m.Mapping("Delete", m.Delete)
+}
+
+// stackClients returns the owned stack of the server with clients of its project and the actor acting in it
+func (m *VolumeController) stackClients(serverID string, claims shared.Claims) (*Stack, *backupClients, StackActor, error) {
+	stack, err := GetProjectStack(claims, serverID, RoleAdmin)
+	if err != nil {
+		return nil, nil, StackActor{}, err
+	}
+	session, err := stackSession(claims, m.GetClientIP(), stack, RoleAdmin)
+	if err != nil {
+		return nil, nil, StackActor{}, err
+	}
+	clients, err := session.backupClients()
+	if err != nil {
+		return nil, nil, StackActor{}, err
+	}
+	return stack, clients, session.Actor, nil
+}
+
+// Types ...
+// @Title Types
+// @Description volume types data volumes can be created with
+// @Param	projectId	query	string	false	"project id, the default project when empty"
+// @Param	region	query	string	false	"region tag"
+// @Failure 403
+// @router /types [get]
+func (m *VolumeController) Types() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	session, err := openSession(claims, m.GetClientIP(), m.GetString("projectId"), m.GetString("region"), RoleViewer)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	client, err := session.BlockStorage()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	allPages, err := volumetypes.List(client, volumetypes.ListOpts{}).AllPages()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	types, err := volumetypes.ExtractVolumeTypes(allPages)
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	m.SetBody(types)
+}
+
+// VolumeAttachParams creates a new data volume, or reattaches a detached one when VolumeID is set
+type VolumeAttachParams struct {
+	ID         string `json:"id" bind:"required"`
+	VolumeID   uint32 `json:"volumeId"`
+	Name       string `json:"name"`
+	Size       int    `json:"size"`
+	VolumeType string `json:"volumeType"`
+}
+
+// Attach ...
+// @Title Attach
+// @Description create a data volume and attach it to the stack, or reattach a detached one
+// @Param	body	body	thirtdparty.VolumeAttachParams	true	"body for attach"
+// @Failure 403
+// @router /attach [post]
+func (m *VolumeController) Attach() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params VolumeAttachParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	stack, clients, actor, err := m.stackClients(params.ID, claims)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	if params.VolumeID > 0 {
+		volume, err := GetOwnedVolume(params.VolumeID, claims.OsUserID)
+		if err != nil {
+			m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		if volume.Status != VolumeDetached || volume.Region != stack.Region {
+			err := fmt.Errorf("volume %d is %s and can not be attached to %s", volume.ID, volume.Status, stack.Name)
+			m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		volume.StackID = stack.ID
+		volume.ServerID = stack.ServerID
+		setVolumeStatus(volume, VolumeAttaching, "", "stack_id", "server_id")
+		go attachVolume(clients, actor, volume, true)
+		m.SetBody(volume)
+		return
+	}
+
+	maxSize := beego.AppConfig.DefaultInt("volume.max.size", 1000)
+	if params.Size <= 0 || params.Size > maxSize {
+		err := fmt.Errorf("size must be between 1 and %d GB", maxSize)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if err := validVolumeType(clients.volume, params.VolumeType); err != nil {
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if len(params.Name) == 0 {
+		params.Name = fmt.Sprintf("%s-data-%s", stack.Name, time.Now().Format("20060102150405"))
+	}
+
+	volume := StackVolume{
+		StackID:    stack.ID,
+		ServerID:   stack.ServerID,
+		Region:     stack.Region,
+		SysUserID:  claims.SysUserID,
+		OsUserID:   claims.OsUserID,
+		Name:       params.Name,
+		VolumeType: params.VolumeType,
+		Size:       params.Size,
+		Status:     VolumeCreating,
+	}
+	o := orm.NewOrm()
+	id, err := o.Insert(&volume)
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	volume.ID = uint32(id)
+	created := volume
+	go createVolume(clients, actor, &created)
+	m.SetBody(volume)
+}
+
+// VolumeExtendParams extends a data volume by its id, or the boot volume of the stack when VolumeID is 0
+type VolumeExtendParams struct {
+	ID       string `json:"id" bind:"required"`
+	VolumeID uint32 `json:"volumeId"`
+	Size     int    `json:"size" bind:"required"`
+}
+
+// Extend ...
+// @Title Extend
+// @Description grow a data volume or the boot volume of the stack, online when attached
+// @Param	body	body	thirtdparty.VolumeExtendParams	true	"body for extend"
+// @Failure 403
+// @router /extend [post]
+func (m *VolumeController) Extend() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params VolumeExtendParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	stack, clients, actor, err := m.stackClients(params.ID, claims)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	var volume *StackVolume
+	var onExtended func()
+	if params.VolumeID > 0 {
+		volume, err = GetOwnedVolume(params.VolumeID, claims.OsUserID)
+		if err != nil || volume.ServerID != stack.ServerID {
+			err = fmt.Errorf("volume %d not found on %s", params.VolumeID, stack.Name)
+			m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		if volume.Status != VolumeInUse && volume.Status != VolumeDetached {
+			err := fmt.Errorf("volume %d is %s", volume.ID, volume.Status)
+			m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+	} else {
+		bootVolume, _, err := stackVolumes(clients, stack.ServerID)
+		if err != nil || len(bootVolume) == 0 {
+			err = fmt.Errorf("%s has no boot volume", stack.Name)
+			m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+			return
+		}
+		// the boot volume is not a data volume, it is extended through a transient record
+		volume = &StackVolume{ServerID: stack.ServerID, VolumeID: bootVolume, Name: stack.Name, Size: stack.DiskSize, Status: VolumeInUse}
+		serverID := stack.ServerID
+		onExtended = func() {
+			o := orm.NewOrm()
+			o.QueryTable(new(Stack)).Filter("server_id", serverID).Update(orm.Params{"disk_size": params.Size, "updated_at": time.Now()})
+		}
+	}
+
+	maxSize := beego.AppConfig.DefaultInt("volume.max.size", 1000)
+	if params.Size <= volume.Size || params.Size > maxSize {
+		err := fmt.Errorf("size must be above %d and at most %d GB", volume.Size, maxSize)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	if !reserveExtend(volume.VolumeID) {
+		err := fmt.Errorf("volume %s is already being extended", volume.VolumeID)
+		m.SetError(helper.StatusAlready, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	previous := volume.Status
+	setVolumeStatus(volume, VolumeExtending, "")
+	extended := *volume
+	go extendVolume(clients, actor, &extended, previous, params.Size, onExtended)
+	m.SetBody(volume)
+}
+
+// VolumeIDParams ...
+type VolumeIDParams struct {
+	VolumeID uint32 `json:"volumeId" bind:"required"`
+}
+
+// Detach ...
+// @Title Detach
+// @Description detach a data volume from its stack, it is kept until deleted
+// @Param	body	body	thirtdparty.VolumeIDParams	true	"body for detach"
+// @Failure 403
+// @router /detach [post]
+func (m *VolumeController) Detach() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params VolumeIDParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	volume, err := GetOwnedVolume(params.VolumeID, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if volume.Status != VolumeInUse {
+		err := fmt.Errorf("volume %d is %s and can not be detached", volume.ID, volume.Status)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	_, clients, actor, err := m.stackClients(volume.ServerID, claims)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	setVolumeStatus(volume, VolumeDetaching, "")
+	detached := *volume
+	go detachVolume(clients, actor, &detached)
+	m.SetBody(volume)
+}
+
+// Delete ...
+// @Title Delete
+// @Description delete a detached data volume
+// @Param	body	body	thirtdparty.VolumeIDParams	true	"body for delete"
+// @Failure 403
+// @router /delete [post]
+func (m *VolumeController) Delete() {
+	claims := m.Claim()
+	defer func() {
+		if r := recover(); r != nil {
+			m.RespondPanic(r)
+		} else {
+			m.Respond()
+		}
+	}()
+
+	var params VolumeIDParams
+	if m.BindJSON(&params) != nil {
+		return
+	}
+	volume, err := GetOwnedVolume(params.VolumeID, claims.OsUserID)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	if volume.Status != VolumeDetached && volume.Status != VolumeError {
+		err := fmt.Errorf("volume %d is %s, detach it first", volume.ID, volume.Status)
+		m.SetError(helper.StatusBadRequest, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	session, err := serverSession(claims, m.GetClientIP(), &Stack{ServerID: volume.ServerID, Region: volume.Region, OsUserID: volume.OsUserID}, RoleAdmin)
+	if err != nil {
+		m.SetError(helper.StatusMissingParams, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+	clients, err := session.backupClients()
+	if err != nil {
+		m.SetError(helper.StatusError, err.Error(), err.Error(), claims.UserID)
+		return
+	}
+
+	actor := session.Actor
+	if len(volume.VolumeID) == 0 {
+		// creation failed before cinder returned a volume
+		volume.DeletedAt = time.Now()
+		setVolumeStatus(volume, VolumeDeleted, "", "deleted_at")
+		m.SetBody(volume)
+		return
+	}
+	previous := volume.Status
+	setVolumeStatus(volume, VolumeDeleting, "")
+	deleteVolume(clients, actor, volume, previous)
+	if volume.Status != VolumeDeleted {
+		m.SetError(helper.StatusError, volume.Message, volume.Message, claims.UserID)
+		return
+	}
+	m.SetBody(volume)
+}